@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"httpfromtcp/internal/response"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+type result struct {
+	completed    int
+	elapsed      time.Duration
+	bytesRead    int64
+	bytesWritten int64
+	dials        int
+	latencies    []time.Duration
+	statuses     map[int]int
+	// errors counts failed requests by what went wrong
+	errors map[string]int
+}
+
+func newResult() result {
+	return result{statuses: map[int]int{}, errors: map[string]int{}}
+}
+
+func (r *result) merge(other *result) {
+	r.completed += other.completed
+	r.bytesRead += other.bytesRead
+	r.bytesWritten += other.bytesWritten
+	r.dials += other.dials
+	r.latencies = append(r.latencies, other.latencies...)
+	for code, n := range other.statuses {
+		r.statuses[code] += n
+	}
+	for kind, n := range other.errors {
+		r.errors[kind] += n
+	}
+}
+
+// budget hands out requests to the workers when -n is set
+type budget struct {
+	limited   bool
+	remaining atomic.Int64
+}
+
+// take claims up to n requests and returns how many it got
+func (b *budget) take(n int) int {
+	if !b.limited {
+		return n
+	}
+	for {
+		remaining := b.remaining.Load()
+		if remaining <= 0 {
+			return 0
+		}
+		granted := min(int64(n), remaining)
+		if b.remaining.CompareAndSwap(remaining, remaining-granted) {
+			return int(granted)
+		}
+	}
+}
+
+func run(ctx context.Context, cfg *config) *result {
+	b := &budget{limited: cfg.requests > 0}
+	b.remaining.Store(int64(cfg.requests))
+	// every batch is written in one go, pipelined requests back to back
+	batch := make([]byte, 0, len(cfg.wire)*cfg.pipeline)
+	for range cfg.pipeline {
+		batch = append(batch, cfg.wire...)
+	}
+
+	total := newResult()
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	start := time.Now()
+	for range cfg.connections {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := &worker{cfg: cfg, budget: b, batch: batch, res: newResult()}
+			w.loop(ctx)
+			mu.Lock()
+			total.merge(&w.res)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	total.elapsed = time.Since(start)
+	return &total
+}
+
+type worker struct {
+	cfg    *config
+	budget *budget
+	batch  []byte
+	res    result
+
+	// mu guards conn against interrupt, which closes it from another goroutine
+	mu          sync.Mutex
+	interrupted bool
+	conn        net.Conn
+	parser      *response.Parser
+}
+
+const dialBackoff = 10 * time.Millisecond
+
+func (w *worker) loop(ctx context.Context) {
+	// a read waiting on a slow server would outlast -d, closing the
+	// connection ends it
+	stop := context.AfterFunc(ctx, w.interrupt)
+	defer stop()
+	defer w.close()
+	for ctx.Err() == nil {
+		n := w.budget.take(w.cfg.pipeline)
+		if n == 0 {
+			return
+		}
+		if w.conn == nil {
+			if err := w.dial(ctx); err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				w.res.errors[classify(err, "dial")] += n
+				// a server that is down would otherwise be dialed in a tight loop
+				time.Sleep(dialBackoff)
+				continue
+			}
+		}
+		w.send(ctx, n)
+	}
+}
+
+func (w *worker) dial(ctx context.Context) error {
+	dialer := &net.Dialer{Timeout: w.cfg.timeout}
+	var conn net.Conn
+	var err error
+	if w.cfg.tls != nil {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: w.cfg.tls}).DialContext(ctx, "tcp", w.cfg.addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", w.cfg.addr)
+	}
+	if err != nil {
+		return err
+	}
+	w.res.dials++
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.interrupted {
+		conn.Close()
+	}
+	w.conn = conn
+	w.parser = response.NewParser(&countingReader{reader: conn, count: &w.res.bytesRead})
+	return nil
+}
+
+func (w *worker) close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.conn != nil {
+		w.conn.Close()
+		w.conn, w.parser = nil, nil
+	}
+}
+
+// interrupt ends the run for this worker, whatever it is waiting on
+func (w *worker) interrupt() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.interrupted = true
+	if w.conn != nil {
+		w.conn.Close()
+	}
+}
+
+// send writes n requests and reads their responses, latency is counted
+// from the write so pipelined responses include their wait in line.
+// Requests cut off by the end of the run aren't counted as errors.
+func (w *worker) send(ctx context.Context, n int) {
+	w.conn.SetWriteDeadline(time.Now().Add(w.cfg.timeout))
+	start := time.Now()
+	written, err := w.conn.Write(w.batch[:n*len(w.cfg.wire)])
+	w.res.bytesWritten += int64(written)
+	if err != nil {
+		if ctx.Err() == nil {
+			w.res.errors[classify(err, "write")] += n
+		}
+		w.close()
+		return
+	}
+
+	for i := range n {
+		w.conn.SetReadDeadline(time.Now().Add(w.cfg.timeout))
+		resp, err := w.readResponse()
+		if err != nil {
+			if ctx.Err() == nil {
+				w.res.errors[classify(err, "read")] += n - i
+			}
+			w.close()
+			return
+		}
+		w.res.latencies = append(w.res.latencies, time.Since(start))
+		w.res.statuses[int(resp.StatusLine.StatusCode)]++
+		w.res.completed++
+
+		if !w.cfg.keepAlive || !resp.KeepAlive() {
+			w.close()
+			if lost := n - 1 - i; lost > 0 {
+				w.res.errors["closed"] += lost
+			}
+			return
+		}
+	}
+}
+
+// readResponse skips interim responses
+func (w *worker) readResponse() (*response.Response, error) {
+	for {
+		resp, err := w.parser.ReadResponse(w.cfg.method)
+		if err != nil {
+			return nil, err
+		}
+		if !resp.IsInformational() || resp.StatusLine.StatusCode == response.StatusCodeSwitchingProtocols {
+			return resp, nil
+		}
+	}
+}
+
+// classify names an error for the breakdown, op is where it happened
+func classify(err error, op string) string {
+	var netErr net.Error
+	switch {
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE):
+		return "reset"
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "closed"
+	case op == "read":
+		// the connection worked, so the response itself was bad
+		return "parse"
+	default:
+		return op
+	}
+}
+
+type countingReader struct {
+	reader io.Reader
+	count  *int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.reader.Read(p)
+	*cr.count += int64(n)
+	return n, err
+}
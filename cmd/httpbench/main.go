@@ -0,0 +1,234 @@
+// httpbench sends requests to a server over N connections and reports
+// throughput, latency percentiles and errors:
+//
+//	httpbench -c 50 -d 10s -k -pipeline 4 http://localhost:42069/
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"httpfromtcp/internal/request"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"time"
+)
+
+// headerFlags collects repeated -H "Key: Value" flags
+type headerFlags []string
+
+func (h *headerFlags) String() string {
+	return strings.Join(*h, ", ")
+}
+
+func (h *headerFlags) Set(value string) error {
+	if !strings.Contains(value, ":") {
+		return fmt.Errorf("header %q is not Key: Value", value)
+	}
+	*h = append(*h, value)
+	return nil
+}
+
+type config struct {
+	addr        string
+	tls         *tls.Config
+	connections int
+	requests    int
+	duration    time.Duration
+	timeout     time.Duration
+	keepAlive   bool
+	pipeline    int
+	method      string
+	// wire is the request serialized once, every send writes it as is
+	wire []byte
+}
+
+func main() {
+	var (
+		headerValues headerFlags
+		cfg          config
+		body         string
+		bodyFile     string
+		insecure     bool
+	)
+	flag.IntVar(&cfg.connections, "c", 10, "concurrent connections")
+	flag.IntVar(&cfg.requests, "n", 0, "total requests, 0 runs for -d instead")
+	flag.DurationVar(&cfg.duration, "d", 10*time.Second, "how long to run when -n is 0")
+	flag.DurationVar(&cfg.timeout, "timeout", 5*time.Second, "timeout for each read and write")
+	flag.BoolVar(&cfg.keepAlive, "k", false, "keep connections alive between requests")
+	flag.IntVar(&cfg.pipeline, "pipeline", 1, "requests written before reading responses, needs -k above 1")
+	flag.StringVar(&cfg.method, "m", "GET", "request method")
+	flag.Var(&headerValues, "H", "request header as \"Key: Value\", repeatable")
+	flag.StringVar(&body, "body", "", "request body")
+	flag.StringVar(&bodyFile, "body-file", "", "read the request body from a file")
+	flag.BoolVar(&insecure, "insecure", false, "skip certificate verification for https")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: httpbench [flags] url\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if bodyFile != "" {
+		data, err := os.ReadFile(bodyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		body = string(data)
+	}
+	if err := cfg.setup(flag.Arg(0), headerValues, []byte(body), insecure); err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if cfg.requests == 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.duration)
+		defer cancel()
+	}
+
+	fmt.Printf("Running %s against %s\n", cfg.describe(), flag.Arg(0))
+	result := run(ctx, &cfg)
+	result.report(os.Stdout)
+}
+
+func (cfg *config) setup(rawURL string, headerValues []string, body []byte, insecure bool) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	port := u.Port()
+	switch u.Scheme {
+	case "http":
+		if port == "" {
+			port = "80"
+		}
+	case "https":
+		if port == "" {
+			port = "443"
+		}
+		cfg.tls = &tls.Config{ServerName: u.Hostname(), InsecureSkipVerify: insecure}
+	default:
+		return fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	cfg.addr = net.JoinHostPort(u.Hostname(), port)
+
+	if cfg.connections < 1 || cfg.pipeline < 1 {
+		return errors.New("-c and -pipeline must be at least 1")
+	}
+	if cfg.pipeline > 1 && !cfg.keepAlive {
+		return errors.New("-pipeline needs -k, a closed connection can't take more requests")
+	}
+
+	target := u.RequestURI()
+	builder := request.NewBuilder(strings.ToUpper(cfg.method), target).Host(u.Host)
+	for _, value := range headerValues {
+		key, value, _ := strings.Cut(value, ":")
+		builder.Header(strings.TrimSpace(key), strings.TrimSpace(value))
+	}
+	if !cfg.keepAlive {
+		builder.Header("Connection", "close")
+	}
+	if len(body) > 0 {
+		builder.Body(body)
+	}
+	req, err := builder.Build()
+	if err != nil {
+		return err
+	}
+	wire := &bytes.Buffer{}
+	if err := req.Write(wire); err != nil {
+		return err
+	}
+	cfg.wire = wire.Bytes()
+	cfg.method = req.RequestLine.Method
+	return nil
+}
+
+func (cfg *config) describe() string {
+	limit := cfg.duration.String()
+	if cfg.requests > 0 {
+		limit = fmt.Sprintf("%d requests", cfg.requests)
+	}
+	keepAlive := "off"
+	if cfg.keepAlive {
+		keepAlive = "on"
+	}
+	return fmt.Sprintf("%s, %d connections, keep-alive %s, pipeline %d", limit, cfg.connections, keepAlive, cfg.pipeline)
+}
+
+func (r *result) report(w io.Writer) {
+	seconds := r.elapsed.Seconds()
+	fmt.Fprintf(w, "\n%d requests in %s, %.1f req/s\n", r.completed, r.elapsed.Round(time.Millisecond), float64(r.completed)/seconds)
+	fmt.Fprintf(w, "%s read, %s written, %s/s read\n", formatBytes(r.bytesRead), formatBytes(r.bytesWritten), formatBytes(int64(float64(r.bytesRead)/seconds)))
+	fmt.Fprintf(w, "%d connections opened\n", r.dials)
+
+	if len(r.latencies) > 0 {
+		sort.Slice(r.latencies, func(i, j int) bool { return r.latencies[i] < r.latencies[j] })
+		var total time.Duration
+		for _, latency := range r.latencies {
+			total += latency
+		}
+		fmt.Fprintf(w, "\nLatency\n")
+		fmt.Fprintf(w, "  min    %v\n", r.latencies[0])
+		fmt.Fprintf(w, "  mean   %v\n", total/time.Duration(len(r.latencies)))
+		for _, p := range []float64{50, 90, 99, 99.9} {
+			fmt.Fprintf(w, "  p%-5g %v\n", p, percentile(r.latencies, p))
+		}
+		fmt.Fprintf(w, "  max    %v\n", r.latencies[len(r.latencies)-1])
+	}
+
+	if len(r.statuses) > 0 {
+		fmt.Fprintf(w, "\nStatus codes\n")
+		for _, code := range sortedKeys(r.statuses) {
+			fmt.Fprintf(w, "  %d  %d\n", code, r.statuses[code])
+		}
+	}
+	if len(r.errors) > 0 {
+		fmt.Fprintf(w, "\nErrors\n")
+		for _, kind := range sortedKeys(r.errors) {
+			fmt.Fprintf(w, "  %-8s %d\n", kind, r.errors[kind])
+		}
+	}
+}
+
+// percentile uses the nearest rank on sorted latencies
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	rank := int(float64(len(sorted))*p/100+0.5) - 1
+	return sorted[min(max(rank, 0), len(sorted)-1)]
+}
+
+func sortedKeys[K int | string](m map[K]int) []K {
+	keys := make([]K, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
+}
+
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.2f GiB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.2f MiB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.2f KiB", float64(n)/(1<<10))
+	default:
+		return fmt.Sprintf("%d B", n)
+	}
+}
@@ -1,21 +1,24 @@
 package main
 
 import (
+	"context"
 	"crypto/sha256"
 	"fmt"
+	"httpfromtcp/internal/client"
 	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/health"
 	"httpfromtcp/internal/request"
 	"httpfromtcp/internal/response"
 	"httpfromtcp/internal/server"
-	"io"
+	"httpfromtcp/internal/tracing"
 	"log"
 	"log/slog"
-	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"strings"
 	"syscall"
+	"time"
 )
 
 const port = 42069
@@ -61,7 +64,6 @@ func proxyHandler(w *response.Writer, req *request.Request) {
 	header := headers.NewHeaders()
 
 	if !strings.HasPrefix(req.RequestLine.RequestTarget, prefix) {
-		header["Connection"] = "close"
 		header["Content-Type"] = "text/html"
 		w.WriteStatusLine(response.StatusCodeBadRequest)
 		header["Content-Length"] = fmt.Sprint(len(badRequestBody))
@@ -70,41 +72,55 @@ func proxyHandler(w *response.Writer, req *request.Request) {
 		return
 	}
 
-	fullBuffer := []byte{}
 	trailers := headers.NewHeaders()
-	resp, err := http.Get(fmt.Sprint("https://developer.mozilla.org/en-US/docs/Web/API/Fetch_API/Using_Fetch"))
+	upstreamReq, err := client.NewRequest("GET", "https://developer.mozilla.org/en-US/docs/Web/API/Fetch_API/Using_Fetch", nil)
 	if err != nil {
 		return
 	}
+	tracing.Inject(req.Context(), func(key, value string) {
+		upstreamReq.Headers.Remove(key)
+		upstreamReq.Headers.Add(key, value)
+	})
+	resp, err := client.DefaultClient.Do(upstreamReq)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
 
 	header.Add("Transfer-Encoding", "chunked")
 
-	header.Add("Connection", "close")
 	header.Add("Content-Type", "text/html")
 
 	header.Add("Trailer", "X-Content-SHA256")
 	header.Add("Trailer", "X-Content-Length")
 	slog.Info("ResponseHeaders", "Headers", header)
+	w.WriteStatusLine(response.StatusCodeOk)
+	if err := w.WriteHeaders(header); err != nil {
+		slog.Error("Trailers", "error", err)
+		return
+	}
+	// one buffer for the whole copy, the checksum is computed as the body
+	// streams instead of keeping all of it
+	buffer := make([]byte, 32*1024)
+	hash := sha256.New()
+	total := 0
 	for {
-		buffer := make([]byte, 32)
 		bytesRead, err := resp.Body.Read(buffer)
-		if err != nil {
-			if err == io.EOF {
-				w.WriteChunkedBodyDone()
+		if bytesRead > 0 {
+			if _, err := w.WriteChunkedBody(buffer[:bytesRead]); err != nil {
+				slog.Error("Chunced", "error", err)
+				return
 			}
-			break
+			hash.Write(buffer[:bytesRead])
+			total += bytesRead
 		}
-		len, err := w.WriteChunkedBody(buffer[:bytesRead])
 		if err != nil {
-			slog.Error("Chunced", "error", err)
-			return
+			break
 		}
-		fullBuffer = append(fullBuffer, buffer[:bytesRead]...)
-		slog.Info("Chunced", "length", len)
 	}
-	trailers.Add("X-Content-Length", fmt.Sprint(len(fullBuffer)))
-	trailers.Add("X-Content-SHA256", fmt.Sprintf("%x", sha256.Sum256(fullBuffer)))
-	w.WriteHeaders(trailers)
+	trailers.Add("X-Content-Length", fmt.Sprint(total))
+	trailers.Add("X-Content-SHA256", fmt.Sprintf("%x", hash.Sum(nil)))
+	w.WriteTrailers(trailers)
 }
 
 func videoHandler(w *response.Writer, req *request.Request) {
@@ -112,7 +128,6 @@ func videoHandler(w *response.Writer, req *request.Request) {
 	header := headers.NewHeaders()
 
 	if !strings.HasPrefix(req.RequestLine.RequestTarget, prefix) || req.RequestLine.Method != "GET" {
-		header["Connection"] = "close"
 		header["Content-Type"] = "text/html"
 		w.WriteStatusLine(response.StatusCodeBadRequest)
 		header["Content-Length"] = fmt.Sprint(len(badRequestBody))
@@ -135,7 +150,6 @@ func videoHandler(w *response.Writer, req *request.Request) {
 
 func handler(w *response.Writer, req *request.Request) {
 	headers := headers.NewHeaders()
-	headers["Connection"] = "close"
 	headers["Content-Type"] = "text/html"
 
 	switch req.RequestLine.RequestTarget {
@@ -157,17 +171,25 @@ func handler(w *response.Writer, req *request.Request) {
 	}
 }
 
+const shutdownTimeout = 10 * time.Second
+
 func main() {
-	server, err := server.Serve(42069, videoHandler)
+	checks := health.New()
+	server, err := server.Serve(42069, checks.Middleware(videoHandler), server.WithDrainDelay(2*time.Second))
 	if err != nil {
 		log.Fatalf("Error starting server: %v", err)
 	}
-	defer server.Close()
+	checks.WatchServer(server)
 	log.Println("Server started on port", port)
 
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 	<-sigChan
-	server.State.Store(false)
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Println("Server stopped with requests in flight:", err)
+		return
+	}
 	log.Println("Server gracefully stopped")
 }
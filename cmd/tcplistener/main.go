@@ -22,7 +22,9 @@ func main() {
 
 		request, err := request.RequestFromReader(conn)
 		if err != nil {
-			log.Fatal(err)
+			log.Print(err)
+			conn.Close()
+			continue
 		}
 
 		requestLine := fmt.Sprintf("Request line:\n- Method: %s\n- Target: %s\n- Version: %s\n Headers:", request.RequestLine.Method, request.RequestLine.HTTPVersion, request.RequestLine.RequestTarget)
@@ -0,0 +1,179 @@
+package accesslog
+
+import (
+	"encoding/json"
+	"fmt"
+	"httpfromtcp/internal/auth"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Entry is one served request
+type Entry struct {
+	Time      time.Time
+	RemoteIP  string
+	User      string
+	Method    string
+	Target    string
+	Proto     string
+	Status    int
+	Bytes     int64
+	Duration  time.Duration
+	Referer   string
+	UserAgent string
+}
+
+// Formatter turns an entry into one log line, newline included
+type Formatter func(e *Entry) []byte
+
+const clfTime = "02/Jan/2006:15:04:05 -0700"
+
+// Common is the Apache Common Log Format
+func Common(e *Entry) []byte {
+	return []byte(common(e) + "\n")
+}
+
+// Combined is Common followed by the referer and user agent
+func Combined(e *Entry) []byte {
+	return []byte(fmt.Sprintf("%s \"%s\" \"%s\"\n", common(e), dash(escape(e.Referer)), dash(escape(e.UserAgent))))
+}
+
+func common(e *Entry) string {
+	size := "-"
+	if e.Bytes > 0 {
+		size = strconv.FormatInt(e.Bytes, 10)
+	}
+	requestLine := escape(e.Method + " " + e.Target + " " + e.Proto)
+	return fmt.Sprintf("%s - %s [%s] \"%s\" %d %s",
+		dash(e.RemoteIP), dash(escape(e.User)), e.Time.Format(clfTime), requestLine, e.Status, size)
+}
+
+type jsonEntry struct {
+	Time       string  `json:"time"`
+	RemoteIP   string  `json:"remote_ip"`
+	User       string  `json:"user,omitempty"`
+	Method     string  `json:"method"`
+	Target     string  `json:"target"`
+	Proto      string  `json:"proto"`
+	Status     int     `json:"status"`
+	Bytes      int64   `json:"bytes"`
+	DurationMs float64 `json:"duration_ms"`
+	Referer    string  `json:"referer,omitempty"`
+	UserAgent  string  `json:"user_agent,omitempty"`
+}
+
+// JSON writes one object per line
+func JSON(e *Entry) []byte {
+	line, _ := json.Marshal(jsonEntry{
+		Time:       e.Time.Format(time.RFC3339Nano),
+		RemoteIP:   e.RemoteIP,
+		User:       e.User,
+		Method:     e.Method,
+		Target:     e.Target,
+		Proto:      e.Proto,
+		Status:     e.Status,
+		Bytes:      e.Bytes,
+		DurationMs: float64(e.Duration) / float64(time.Millisecond),
+		Referer:    e.Referer,
+		UserAgent:  e.UserAgent,
+	})
+	return append(line, '\n')
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// escape keeps client supplied values from breaking or forging log lines
+func escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c >= 0x7f:
+			fmt.Fprintf(&b, "\\x%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+type Logger struct {
+	Out    io.Writer
+	Format Formatter
+
+	mu  sync.Mutex
+	now func() time.Time
+}
+
+func New(out io.Writer, format Formatter) *Logger {
+	return &Logger{Out: out, Format: format, now: time.Now}
+}
+
+// Middleware logs every request once the handler returns, put it first in
+// the chain so the time spent in other middleware is included
+func (l *Logger) Middleware(next server.Handler) server.Handler {
+	return func(w *response.Writer, req *request.Request) {
+		start := l.clock()
+		next(w, req)
+		l.Log(newEntry(req, w, start, l.clock().Sub(start)))
+	}
+}
+
+func (l *Logger) clock() time.Time {
+	if l.now == nil {
+		return time.Now()
+	}
+	return l.now()
+}
+
+func (l *Logger) Log(e *Entry) error {
+	line := l.Format(e)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err := l.Out.Write(line)
+	return err
+}
+
+func newEntry(req *request.Request, w *response.Writer, start time.Time, duration time.Duration) *Entry {
+	e := &Entry{
+		Time:     start,
+		RemoteIP: remoteIP(req),
+		Method:   req.RequestLine.Method,
+		Target:   req.RequestLine.RequestTarget,
+		Proto:    "HTTP/" + req.RequestLine.HTTPVersion,
+		Status:   int(w.StatusCode()),
+		Bytes:    w.BytesWritten(),
+		Duration: duration,
+	}
+	if principal := auth.FromRequest(req); principal != nil {
+		e.User = principal.Name
+	}
+	e.Referer, _ = req.Headers.Get("referer")
+	e.UserAgent, _ = req.Headers.Get("user-agent")
+	return e
+}
+
+func remoteIP(req *request.Request) string {
+	if req.ClientIP != "" {
+		return req.ClientIP
+	}
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		return host
+	}
+	return req.RemoteAddr
+}
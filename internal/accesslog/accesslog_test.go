@@ -0,0 +1,107 @@
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var start = time.Date(2030, 10, 10, 13, 55, 36, 0, time.FixedZone("", -7*60*60))
+
+func serve(t *testing.T, format Formatter, raw string) string {
+	t.Helper()
+	req, err := request.RequestFromReader(strings.NewReader(raw))
+	require.NoError(t, err)
+	req.RemoteAddr = "127.0.0.1:5000"
+
+	out := &bytes.Buffer{}
+	l := New(out, format)
+	now := start
+	l.now = func() time.Time {
+		current := now
+		now = now.Add(1500 * time.Microsecond)
+		return current
+	}
+	l.Middleware(func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.StatusCodeOk)
+		w.WriteHeaders(response.GetDefaultHeaders(2326))
+		w.WriteBody(make([]byte, 2326))
+	})(&response.Writer{Writer: &bytes.Buffer{}}, req)
+	return out.String()
+}
+
+const getRequest = "GET /apache_pb.gif HTTP/1.1\r\nHost: localhost\r\nReferer: http://www.example.com/start.html\r\nUser-Agent: Mozilla/4.08\r\n\r\n"
+
+func TestFormats(t *testing.T) {
+	// TEST: Common
+	assert.Equal(t, "127.0.0.1 - - [10/Oct/2030:13:55:36 -0700] \"GET /apache_pb.gif HTTP/1.1\" 200 2326\n", serve(t, Common, getRequest))
+
+	// TEST: Combined
+	assert.Equal(t, "127.0.0.1 - - [10/Oct/2030:13:55:36 -0700] \"GET /apache_pb.gif HTTP/1.1\" 200 2326 \"http://www.example.com/start.html\" \"Mozilla/4.08\"\n", serve(t, Combined, getRequest))
+
+	// TEST: Quotes in the user agent are escaped
+	line := serve(t, Combined, "GET / HTTP/1.1\r\nHost: localhost\r\nUser-Agent: evil\" 500 \"x\r\n\r\n")
+	assert.True(t, strings.HasSuffix(line, ` "-" "evil\" 500 \"x"`+"\n"), line)
+
+	// TEST: JSON
+	var entry map[string]any
+	require.NoError(t, json.Unmarshal([]byte(serve(t, JSON, getRequest)), &entry))
+	assert.Equal(t, "GET", entry["method"])
+	assert.Equal(t, float64(200), entry["status"])
+	assert.Equal(t, float64(2326), entry["bytes"])
+	assert.Equal(t, 1.5, entry["duration_ms"])
+	assert.Equal(t, "Mozilla/4.08", entry["user_agent"])
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logs", "access.log")
+	now := start
+	rf := &RotatingFile{Path: path, MaxSize: 12, MaxAge: time.Hour, MaxBackups: 2, now: func() time.Time { return now }}
+	require.NoError(t, rf.open())
+	defer rf.Close()
+
+	write := func(s string) {
+		now = now.Add(time.Second)
+		_, err := rf.Write([]byte(s))
+		require.NoError(t, err)
+	}
+
+	// TEST: Size based rotation
+	write("12345\n")
+	write("6789\n")
+	write("abc\n")
+	backups, err := rf.Backups()
+	require.NoError(t, err)
+	require.Len(t, backups, 1)
+	data, err := os.ReadFile(backups[0])
+	require.NoError(t, err)
+	assert.Equal(t, "12345\n6789\n", string(data))
+
+	// TEST: Age based rotation
+	now = now.Add(2 * time.Hour)
+	write("d\n")
+	backups, err = rf.Backups()
+	require.NoError(t, err)
+	assert.Len(t, backups, 2)
+	data, err = os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "d\n", string(data))
+
+	// TEST: Old backups are pruned
+	require.NoError(t, rf.Rotate())
+	backups, err = rf.Backups()
+	require.NoError(t, err)
+	assert.Len(t, backups, 2)
+	data, err = os.ReadFile(backups[0])
+	require.NoError(t, err)
+	assert.Equal(t, "abc\n", string(data))
+}
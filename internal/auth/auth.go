@@ -0,0 +1,63 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"strings"
+)
+
+var (
+	ErrNoCredentials      = errors.New("no credentials")
+	ErrInvalidCredentials = errors.New("invalid credentials")
+)
+
+// Principal is who a request was authenticated as
+type Principal struct {
+	Name   string
+	Scheme string
+	// Claims holds the token claims for bearer tokens, nil otherwise
+	Claims map[string]any
+}
+
+type contextKey struct{}
+
+func withPrincipal(req *request.Request, p *Principal) *request.Request {
+	return req.WithContext(context.WithValue(req.Context(), contextKey{}, p))
+}
+
+// FromRequest returns the principal the middleware attached, nil without one
+func FromRequest(req *request.Request) *Principal {
+	p, _ := req.Context().Value(contextKey{}).(*Principal)
+	return p
+}
+
+// credentials splits an Authorization header into its scheme and the rest
+func credentials(req *request.Request, scheme string) (string, bool) {
+	value, ok := req.Headers.Get("authorization")
+	if !ok {
+		return "", false
+	}
+	gotScheme, rest, _ := strings.Cut(strings.TrimSpace(value), " ")
+	if !strings.EqualFold(gotScheme, scheme) {
+		return "", false
+	}
+	return strings.TrimSpace(rest), true
+}
+
+// quote makes s an auth-param quoted-string
+func quote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	return `"` + strings.ReplaceAll(s, `"`, `\"`) + `"`
+}
+
+// challenge answers 401 with the WWW-Authenticate value
+func challenge(w *response.Writer, wwwAuthenticate string) {
+	body := []byte(response.ReasonStatusLineMap[response.StatusCodeUnauthorized] + "\n")
+	h := response.GetDefaultHeaders(len(body))
+	h["WWW-Authenticate"] = wwwAuthenticate
+	w.WriteStatusLine(response.StatusCodeUnauthorized)
+	w.WriteHeaders(h)
+	w.WriteBody(body)
+}
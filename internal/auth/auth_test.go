@@ -0,0 +1,229 @@
+package auth
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// serve runs req through middleware and returns the response and the principal
+func serve(t *testing.T, middleware server.Middleware, req *request.Request) (*response.Response, *Principal) {
+	t.Helper()
+	var principal *Principal
+	out := &bytes.Buffer{}
+	w := &response.Writer{Writer: out}
+	middleware(func(w *response.Writer, req *request.Request) {
+		principal = FromRequest(req)
+		w.WriteStatusLine(response.StatusCodeOk)
+		w.WriteHeaders(response.GetDefaultHeaders(0))
+	})(w, req)
+
+	resp, err := response.ResponseFromReader(out)
+	require.NoError(t, err)
+	return resp, principal
+}
+
+func get(t *testing.T, authorization string) *request.Request {
+	t.Helper()
+	raw := "GET /private HTTP/1.1\r\nHost: localhost\r\n"
+	if authorization != "" {
+		raw += "Authorization: " + authorization + "\r\n"
+	}
+	req, err := request.RequestFromReader(strings.NewReader(raw + "\r\n"))
+	require.NoError(t, err)
+	return req
+}
+
+func basicAuth(user, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password))
+}
+
+func TestBasic(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("s3cret"), bcrypt.MinCost)
+	require.NoError(t, err)
+	htpasswd, err := ParseHtpasswd(strings.NewReader("# users\nalice:" + string(hash) + "\n"))
+	require.NoError(t, err)
+
+	for name, verifier := range map[string]PasswordVerifier{
+		"users":    Users{"alice": "s3cret"},
+		"htpasswd": htpasswd,
+	} {
+		basic := &Basic{Realm: "admin", Verifier: verifier}
+
+		// TEST: Valid credentials
+		resp, principal := serve(t, basic.Middleware, get(t, basicAuth("alice", "s3cret")))
+		assert.Equal(t, response.StatusCodeOk, resp.StatusLine.StatusCode, name)
+		require.NotNil(t, principal, name)
+		assert.Equal(t, "alice", principal.Name)
+
+		// TEST: Wrong password and unknown user
+		for _, authorization := range []string{basicAuth("alice", "nope"), basicAuth("bob", "s3cret"), "Basic !!!", ""} {
+			resp, principal = serve(t, basic.Middleware, get(t, authorization))
+			assert.Equal(t, response.StatusCodeUnauthorized, resp.StatusLine.StatusCode, name)
+			assert.Nil(t, principal)
+			challenge, _ := resp.Headers.Get("www-authenticate")
+			assert.Equal(t, `Basic realm="admin", charset="UTF-8"`, challenge)
+		}
+	}
+
+	// TEST: Non bcrypt htpasswd entries are refused
+	_, err = ParseHtpasswd(strings.NewReader("alice:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n"))
+	assert.Error(t, err)
+}
+
+func makeJWT(t *testing.T, alg string, claims map[string]any, signFn func([]byte) []byte) string {
+	t.Helper()
+	header, err := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	require.NoError(t, err)
+	payload, err := json.Marshal(claims)
+	require.NoError(t, err)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signFn([]byte(signed)))
+}
+
+func TestBearerJWT(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	now := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	verifier := &JWTVerifier{HMACKey: key, Issuer: "issuer", Audience: "api", now: func() time.Time { return now }}
+	bearer := &Bearer{Realm: "api", Verifier: verifier}
+	hs256 := func(data []byte) []byte {
+		mac := hmac.New(sha256.New, key)
+		mac.Write(data)
+		return mac.Sum(nil)
+	}
+	claims := func(exp time.Time) map[string]any {
+		return map[string]any{"sub": "alice", "iss": "issuer", "aud": []string{"api"}, "exp": exp.Unix()}
+	}
+
+	// TEST: Valid HS256 token
+	token := makeJWT(t, "HS256", claims(now.Add(time.Hour)), hs256)
+	resp, principal := serve(t, bearer.Middleware, get(t, "Bearer "+token))
+	assert.Equal(t, response.StatusCodeOk, resp.StatusLine.StatusCode)
+	require.NotNil(t, principal)
+	assert.Equal(t, "alice", principal.Name)
+	assert.Equal(t, "Bearer", principal.Scheme)
+
+	// TEST: Missing token has no error code
+	resp, _ = serve(t, bearer.Middleware, get(t, ""))
+	assert.Equal(t, response.StatusCodeUnauthorized, resp.StatusLine.StatusCode)
+	challenge, _ := resp.Headers.Get("www-authenticate")
+	assert.Equal(t, `Bearer realm="api"`, challenge)
+
+	// TEST: Expired token
+	token = makeJWT(t, "HS256", claims(now.Add(-time.Minute)), hs256)
+	resp, _ = serve(t, bearer.Middleware, get(t, "Bearer "+token))
+	challenge, _ = resp.Headers.Get("www-authenticate")
+	assert.Equal(t, `Bearer realm="api", error="invalid_token", error_description="the token expired"`, challenge)
+
+	// TEST: Verifier that returns no principal and no error
+	nobody := &Bearer{Realm: "api", Verifier: TokenVerifierFunc(func(string) (*Principal, error) { return nil, nil })}
+	resp, principal = serve(t, nobody.Middleware, get(t, "Bearer "+token))
+	assert.Equal(t, response.StatusCodeUnauthorized, resp.StatusLine.StatusCode)
+	assert.Nil(t, principal)
+	challenge, _ = resp.Headers.Get("www-authenticate")
+	assert.Equal(t, `Bearer realm="api", error="invalid_token", error_description="the token is invalid"`, challenge)
+
+	// TEST: Tampered payload, wrong audience and alg none
+	valid := makeJWT(t, "HS256", claims(now.Add(time.Hour)), hs256)
+	parts := strings.Split(valid, ".")
+	tampered := parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"mallory"}`)) + "." + parts[2]
+	_, err := verifier.Verify(tampered)
+	assert.ErrorIs(t, err, ErrInvalidSignature)
+
+	wrongAud := claims(now.Add(time.Hour))
+	wrongAud["aud"] = "other"
+	_, err = verifier.Verify(makeJWT(t, "HS256", wrongAud, hs256))
+	assert.ErrorIs(t, err, ErrInvalidClaims)
+
+	_, err = verifier.Verify(makeJWT(t, "none", claims(now.Add(time.Hour)), func([]byte) []byte { return nil }))
+	assert.ErrorIs(t, err, ErrUnsupportedAlg)
+
+	// TEST: RS256
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	rsaVerifier := &JWTVerifier{PublicKey: &rsaKey.PublicKey, now: func() time.Time { return now }}
+	rs256 := func(data []byte) []byte {
+		digest := sha256.Sum256(data)
+		signature, err := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, digest[:])
+		require.NoError(t, err)
+		return signature
+	}
+	got, err := rsaVerifier.Verify(makeJWT(t, "RS256", claims(now.Add(time.Hour)), rs256))
+	require.NoError(t, err)
+	assert.Equal(t, "alice", got["sub"])
+
+	// TEST: HS256 token against an RSA only verifier
+	_, err = rsaVerifier.Verify(makeJWT(t, "HS256", claims(now.Add(time.Hour)), hs256))
+	assert.ErrorIs(t, err, ErrUnsupportedAlg)
+}
+
+func TestHMAC(t *testing.T) {
+	secret := []byte("shared-secret")
+	now := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	mw := &HMAC{
+		Realm:           "api",
+		Keys:            func(keyID string) ([]byte, bool) { return secret, keyID == "client-1" },
+		RequiredHeaders: []string{"Host"},
+		MaxSkew:         5 * time.Minute,
+		now:             func() time.Time { return now },
+	}
+	post := func(body string) *request.Request {
+		raw := "POST /orders HTTP/1.1\r\nHost: localhost\r\nDate: " + now.Format(http.TimeFormat) +
+			"\r\nContent-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n" + body
+		req, err := request.RequestFromReader(strings.NewReader(raw))
+		require.NoError(t, err)
+		return req
+	}
+
+	// TEST: Signed request
+	req := post("hello")
+	require.NoError(t, SignRequest(req, "client-1", secret, "host", "date"))
+	resp, principal := serve(t, mw.Middleware, req)
+	assert.Equal(t, response.StatusCodeOk, resp.StatusLine.StatusCode)
+	require.NotNil(t, principal)
+	assert.Equal(t, "client-1", principal.Name)
+
+	// TEST: Body changed after signing
+	req = post("hello")
+	require.NoError(t, SignRequest(req, "client-1", secret, "host", "date"))
+	req.Body = []byte("jello")
+	resp, _ = serve(t, mw.Middleware, req)
+	assert.Equal(t, response.StatusCodeUnauthorized, resp.StatusLine.StatusCode)
+	challenge, _ := resp.Headers.Get("www-authenticate")
+	assert.Equal(t, `HMAC-SHA256 realm="api", headers="host date", error="invalid_signature"`, challenge)
+
+	// TEST: Date left out of the signature
+	req = post("hello")
+	require.NoError(t, SignRequest(req, "client-1", secret, "host"))
+	resp, _ = serve(t, mw.Middleware, req)
+	assert.Equal(t, response.StatusCodeUnauthorized, resp.StatusLine.StatusCode)
+
+	// TEST: Unknown key and stale date
+	req = post("hello")
+	require.NoError(t, SignRequest(req, "client-2", secret, "host", "date"))
+	resp, _ = serve(t, mw.Middleware, req)
+	assert.Equal(t, response.StatusCodeUnauthorized, resp.StatusLine.StatusCode)
+
+	mw.now = func() time.Time { return now.Add(time.Hour) }
+	req = post("hello")
+	require.NoError(t, SignRequest(req, "client-1", secret, "host", "date"))
+	resp, _ = serve(t, mw.Middleware, req)
+	assert.Equal(t, response.StatusCodeUnauthorized, resp.StatusLine.StatusCode)
+}
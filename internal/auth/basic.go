@@ -0,0 +1,119 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// PasswordVerifier checks a user name and password
+type PasswordVerifier interface {
+	VerifyPassword(user, password string) bool
+}
+
+// Users is a plain user to password map, checked in constant time
+type Users map[string]string
+
+func (u Users) VerifyPassword(user, password string) bool {
+	expected, ok := u[user]
+	if !ok {
+		// compare anyway so unknown users take as long as known ones
+		expected = "\x00"
+	}
+	// hashing first makes the comparison independent of the lengths
+	expectedSum := sha256.Sum256([]byte(expected))
+	gotSum := sha256.Sum256([]byte(password))
+	return subtle.ConstantTimeCompare(expectedSum[:], gotSum[:]) == 1 && ok
+}
+
+// Htpasswd holds users from an htpasswd file, only bcrypt entries are
+// supported since the other formats are not safe to keep using
+type Htpasswd map[string][]byte
+
+func LoadHtpasswd(path string) (Htpasswd, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseHtpasswd(f)
+}
+
+func ParseHtpasswd(r io.Reader) (Htpasswd, error) {
+	users := Htpasswd{}
+	scanner := bufio.NewScanner(r)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("htpasswd line %d: missing colon", lineNumber)
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("htpasswd line %d: %w", lineNumber, err)
+		}
+		users[user] = []byte(hash)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// dummyHash is compared against for unknown users to keep timing even
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy"), bcrypt.DefaultCost)
+
+func (h Htpasswd) VerifyPassword(user, password string) bool {
+	hash, ok := h[user]
+	if !ok {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return false
+	}
+	return bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil
+}
+
+type Basic struct {
+	Realm    string
+	Verifier PasswordVerifier
+}
+
+func (b *Basic) Middleware(next server.Handler) server.Handler {
+	return func(w *response.Writer, req *request.Request) {
+		user, err := b.authenticate(req)
+		if err != nil {
+			challenge(w, "Basic realm="+quote(b.Realm)+`, charset="UTF-8"`)
+			return
+		}
+		next(w, withPrincipal(req, &Principal{Name: user, Scheme: "Basic"}))
+	}
+}
+
+func (b *Basic) authenticate(req *request.Request) (string, error) {
+	encoded, ok := credentials(req, "Basic")
+	if !ok {
+		return "", ErrNoCredentials
+	}
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", ErrInvalidCredentials
+	}
+	user, password, ok := strings.Cut(string(decoded), ":")
+	if !ok || !b.Verifier.VerifyPassword(user, password) {
+		return "", ErrInvalidCredentials
+	}
+	return user, nil
+}
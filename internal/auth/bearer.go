@@ -0,0 +1,60 @@
+package auth
+
+import (
+	"errors"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+)
+
+// TokenVerifier turns a bearer token into the principal it belongs to
+type TokenVerifier interface {
+	VerifyToken(token string) (*Principal, error)
+}
+
+// TokenVerifierFunc lets a plain function act as a TokenVerifier
+type TokenVerifierFunc func(token string) (*Principal, error)
+
+func (f TokenVerifierFunc) VerifyToken(token string) (*Principal, error) {
+	return f(token)
+}
+
+type Bearer struct {
+	Realm    string
+	Verifier TokenVerifier
+}
+
+func (b *Bearer) Middleware(next server.Handler) server.Handler {
+	return func(w *response.Writer, req *request.Request) {
+		token, ok := credentials(req, "Bearer")
+		if !ok || token == "" {
+			// RFC 6750 section 3.1, no error code when credentials are missing
+			challenge(w, "Bearer realm="+quote(b.Realm))
+			return
+		}
+		principal, err := b.Verifier.VerifyToken(token)
+		if err == nil && principal == nil {
+			// a verifier that finds nobody behind the token rejects it
+			err = ErrInvalidCredentials
+		}
+		if err != nil {
+			challenge(w, "Bearer realm="+quote(b.Realm)+`, error="invalid_token", error_description=`+quote(description(err)))
+			return
+		}
+		principal.Scheme = "Bearer"
+		next(w, withPrincipal(req, principal))
+	}
+}
+
+// description keeps token details out of the challenge, only the reason
+// a client can act on is reported
+func description(err error) string {
+	switch {
+	case errors.Is(err, ErrTokenExpired):
+		return "the token expired"
+	case errors.Is(err, ErrTokenNotYetValid):
+		return "the token is not valid yet"
+	default:
+		return "the token is invalid"
+	}
+}
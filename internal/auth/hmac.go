@@ -0,0 +1,212 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+const HMACScheme = "HMAC-SHA256"
+
+var (
+	ErrUnknownKey        = errors.New("unknown signing key")
+	ErrMissingHeader     = errors.New("required header is not signed")
+	ErrClockSkew         = errors.New("request date outside the allowed skew")
+	ErrMalformedAuthData = errors.New("malformed authorization parameters")
+)
+
+// stringToSign covers the method, the target, the signed headers in the
+// order given and the sha256 of the body
+func stringToSign(req *request.Request, body []byte, signedHeaders []string) (string, error) {
+	var b strings.Builder
+	b.WriteString(req.RequestLine.Method + "\n")
+	b.WriteString(req.RequestLine.RequestTarget + "\n")
+	for _, name := range signedHeaders {
+		value, ok := req.Headers.Get(name)
+		if !ok {
+			return "", fmt.Errorf("%w: %s", ErrMissingHeader, name)
+		}
+		b.WriteString(strings.ToLower(name) + ":" + strings.TrimSpace(value) + "\n")
+	}
+	digest := sha256.Sum256(body)
+	b.WriteString(hex.EncodeToString(digest[:]))
+	return b.String(), nil
+}
+
+func sign(secret []byte, data string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// SignRequest adds an Authorization header signing req with secret, it is
+// meant for clients talking to a server behind the HMAC middleware
+func SignRequest(req *request.Request, keyID string, secret []byte, signedHeaders ...string) error {
+	toSign, err := stringToSign(req, req.Body, signedHeaders)
+	if err != nil {
+		return err
+	}
+	signature := base64.StdEncoding.EncodeToString(sign(secret, toSign))
+	req.Headers.Remove("authorization")
+	req.Headers.Add("authorization", fmt.Sprintf(`%s keyId=%s, headers=%s, signature=%s`,
+		HMACScheme, quote(keyID), quote(strings.ToLower(strings.Join(signedHeaders, " "))), quote(signature)))
+	return nil
+}
+
+type HMAC struct {
+	Realm string
+	// Keys looks up the secret for a key id
+	Keys func(keyID string) ([]byte, bool)
+	// RequiredHeaders have to be among the signed headers
+	RequiredHeaders []string
+	// MaxSkew rejects requests whose Date header is further off than this,
+	// zero skips the check. Date has to be signed for it to mean anything.
+	MaxSkew time.Duration
+
+	now func() time.Time
+}
+
+func (h *HMAC) Middleware(next server.Handler) server.Handler {
+	return func(w *response.Writer, req *request.Request) {
+		keyID, err := h.authenticate(req)
+		if err != nil {
+			wwwAuthenticate := HMACScheme + " realm=" + quote(h.Realm)
+			if required := h.required(); len(required) > 0 {
+				wwwAuthenticate += ", headers=" + quote(strings.Join(required, " "))
+			}
+			if !errors.Is(err, ErrNoCredentials) {
+				wwwAuthenticate += `, error="invalid_signature"`
+			}
+			challenge(w, wwwAuthenticate)
+			return
+		}
+		next(w, withPrincipal(req, &Principal{Name: keyID, Scheme: HMACScheme}))
+	}
+}
+
+func (h *HMAC) required() []string {
+	required := make([]string, 0, len(h.RequiredHeaders)+1)
+	for _, name := range h.RequiredHeaders {
+		required = append(required, strings.ToLower(name))
+	}
+	if h.MaxSkew > 0 && !slices.Contains(required, "date") {
+		required = append(required, "date")
+	}
+	return required
+}
+
+func (h *HMAC) authenticate(req *request.Request) (string, error) {
+	value, ok := credentials(req, HMACScheme)
+	if !ok {
+		return "", ErrNoCredentials
+	}
+	params, err := parseParams(value)
+	if err != nil {
+		return "", err
+	}
+	keyID, signatureParam := params["keyid"], params["signature"]
+	if keyID == "" || signatureParam == "" {
+		return "", ErrMalformedAuthData
+	}
+	signature, err := base64.StdEncoding.DecodeString(signatureParam)
+	if err != nil {
+		return "", ErrMalformedAuthData
+	}
+
+	signedHeaders := strings.Fields(strings.ToLower(params["headers"]))
+	for _, name := range h.required() {
+		if !slices.Contains(signedHeaders, name) {
+			return "", fmt.Errorf("%w: %s", ErrMissingHeader, name)
+		}
+	}
+
+	secret, ok := h.Keys(keyID)
+	if !ok {
+		return "", ErrUnknownKey
+	}
+	body, err := req.ReadBody()
+	if err != nil {
+		return "", err
+	}
+	toSign, err := stringToSign(req, body, signedHeaders)
+	if err != nil {
+		return "", err
+	}
+	if !hmac.Equal(sign(secret, toSign), signature) {
+		return "", ErrInvalidSignature
+	}
+
+	if h.MaxSkew > 0 {
+		if err := h.checkDate(req); err != nil {
+			return "", err
+		}
+	}
+	return keyID, nil
+}
+
+func (h *HMAC) checkDate(req *request.Request) error {
+	value, _ := req.Headers.Get("date")
+	date, err := http.ParseTime(value)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrClockSkew, err)
+	}
+	now := time.Now()
+	if h.now != nil {
+		now = h.now()
+	}
+	if skew := now.Sub(date); skew > h.MaxSkew || skew < -h.MaxSkew {
+		return ErrClockSkew
+	}
+	return nil
+}
+
+// parseParams reads comma separated auth-params, names are lowercased
+func parseParams(s string) (map[string]string, error) {
+	params := map[string]string{}
+	for s = strings.TrimSpace(s); s != ""; {
+		name, rest, ok := strings.Cut(s, "=")
+		if !ok {
+			return nil, ErrMalformedAuthData
+		}
+		name = strings.ToLower(strings.TrimSpace(name))
+		rest = strings.TrimSpace(rest)
+
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			var b strings.Builder
+			i := 1
+			for ; i < len(rest) && rest[i] != '"'; i++ {
+				if rest[i] == '\\' && i+1 < len(rest) {
+					i++
+				}
+				b.WriteByte(rest[i])
+			}
+			if i >= len(rest) {
+				return nil, ErrMalformedAuthData
+			}
+			value, rest = b.String(), rest[i+1:]
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+			value = strings.TrimSpace(value)
+			rest = "," + rest
+		}
+		params[name] = value
+
+		rest = strings.TrimSpace(rest)
+		if rest != "" && rest[0] != ',' {
+			return nil, ErrMalformedAuthData
+		}
+		s = strings.TrimSpace(strings.TrimPrefix(rest, ","))
+	}
+	return params, nil
+}
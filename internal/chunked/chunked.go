@@ -0,0 +1,228 @@
+package chunked
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"httpfromtcp/internal/headers"
+	"io"
+	"strconv"
+)
+
+type decoderState int
+
+const (
+	decoderStateSize decoderState = iota
+	decoderStateData
+	decoderStateDataEnd
+	decoderStateTrailers
+	decoderStateDone
+)
+
+var (
+	CRLF              = []byte("\r\n")
+	ErrMalformedChunk = errors.New("malformed chunk")
+	// ErrTrailersTooLarge is a trailer section over MaxTrailerBytes
+	ErrTrailersTooLarge = errors.New("chunked trailers too large")
+)
+
+// Decoder is an incremental chunked transfer coding decoder, it is fed
+// whatever bytes are available and remembers where it stopped
+type Decoder struct {
+	Trailers headers.Headers
+	// MaxTrailerBytes bounds the trailer section, 0 for no limit
+	MaxTrailerBytes int
+
+	state     decoderState
+	remaining int
+	// trailerRead is how much of the trailer section was consumed
+	trailerRead int
+}
+
+func NewDecoder(trailers headers.Headers) *Decoder {
+	if trailers == nil {
+		trailers = headers.NewHeaders()
+	}
+	return &Decoder{Trailers: trailers}
+}
+
+// Reset readies the decoder for another body, keeping trailers in trailers
+func (d *Decoder) Reset(trailers headers.Headers) {
+	*d = Decoder{Trailers: trailers}
+}
+
+func (d *Decoder) Done() bool {
+	return d.state == decoderStateDone
+}
+
+// Decode consumes as much of data as possible and appends the decoded
+// payload to body, it returns the number of consumed bytes
+func (d *Decoder) Decode(data []byte, body []byte) (int, []byte, error) {
+	read := 0
+
+	for {
+		switch d.state {
+		case decoderStateDone:
+			return read, body, nil
+		case decoderStateSize:
+			idx := bytes.Index(data[read:], CRLF)
+			if idx == -1 {
+				if len(data[read:]) > MaxSizeLineLength {
+					return read, body, fmt.Errorf("%w: chunk size line too long", ErrMalformedChunk)
+				}
+				return read, body, nil
+			}
+			if idx > MaxSizeLineLength {
+				return read, body, fmt.Errorf("%w: chunk size line too long", ErrMalformedChunk)
+			}
+			size, err := ParseSize(data[read : read+idx])
+			if err != nil {
+				return read, body, err
+			}
+			read += idx + len(CRLF)
+			d.remaining = size
+			if size == 0 {
+				d.state = decoderStateTrailers
+			} else {
+				d.state = decoderStateData
+			}
+		case decoderStateData:
+			available := data[read:]
+			taken := min(d.remaining, len(available))
+			body = append(body, available[:taken]...)
+			d.remaining -= taken
+			read += taken
+			if d.remaining > 0 {
+				return read, body, nil
+			}
+			d.state = decoderStateDataEnd
+		case decoderStateDataEnd:
+			if len(data[read:]) < len(CRLF) {
+				return read, body, nil
+			}
+			if !bytes.HasPrefix(data[read:], CRLF) {
+				return read, body, fmt.Errorf("%w: missing crlf after chunk data", ErrMalformedChunk)
+			}
+			read += len(CRLF)
+			d.state = decoderStateSize
+		case decoderStateTrailers:
+			bytesRead, done, err := d.Trailers.Parse(data[read:])
+			if err != nil {
+				return read, body, err
+			}
+			read += bytesRead
+			d.trailerRead += bytesRead
+			if d.MaxTrailerBytes > 0 && !done && d.trailerRead+len(data[read:]) > d.MaxTrailerBytes {
+				return read, body, ErrTrailersTooLarge
+			}
+			if done {
+				d.state = decoderStateDone
+				return read + len(CRLF), body, nil
+			}
+			if bytesRead == 0 {
+				return read, body, nil
+			}
+		}
+	}
+}
+
+// MaxSizeLineLength bounds a chunk-size line with its extensions, so a
+// client can't make the decoder buffer an endless line
+const MaxSizeLineLength = 4096
+
+// ParseSize parses a chunk-size line without its CRLF, chunk extensions are
+// checked against the grammar and otherwise ignored
+func ParseSize(line []byte) (int, error) {
+	size, extensions, hasExtensions := bytes.Cut(line, []byte(";"))
+	size = bytes.TrimRight(size, " \t")
+	if len(size) == 0 || len(size) > 8 {
+		return 0, fmt.Errorf("%w: size %q", ErrMalformedChunk, size)
+	}
+	if hasExtensions && !validExtensions(extensions) {
+		return 0, fmt.Errorf("%w: extension %q", ErrMalformedChunk, extensions)
+	}
+	chunkSize, err := strconv.ParseUint(string(size), 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("%w: size %q", ErrMalformedChunk, size)
+	}
+	return int(chunkSize), nil
+}
+
+// validExtensions checks what follows the first ';' of a size line:
+// name[=value] pairs separated by ';', with optional whitespace around the
+// separators and values that are tokens or quoted strings (RFC 9112 section 7.1.1)
+func validExtensions(ext []byte) bool {
+	for {
+		ext = bytes.TrimLeft(ext, " \t")
+		name := tokenPrefix(ext)
+		if name == 0 {
+			return false
+		}
+		ext = bytes.TrimLeft(ext[name:], " \t")
+		if len(ext) > 0 && ext[0] == '=' {
+			ext = bytes.TrimLeft(ext[1:], " \t")
+			n := tokenPrefix(ext)
+			if n == 0 {
+				n = quotedPrefix(ext)
+			}
+			if n == 0 {
+				return false
+			}
+			ext = bytes.TrimLeft(ext[n:], " \t")
+		}
+		if len(ext) == 0 {
+			return true
+		}
+		if ext[0] != ';' {
+			return false
+		}
+		ext = ext[1:]
+	}
+}
+
+// tokenPrefix is the length of the token ext starts with
+func tokenPrefix(ext []byte) int {
+	n := 0
+	for n < len(ext) && headers.IsToken(ext[n:n+1]) {
+		n++
+	}
+	return n
+}
+
+// quotedPrefix is the length of the quoted string ext starts with, 0 if
+// there is none or it isn't closed
+func quotedPrefix(ext []byte) int {
+	if len(ext) == 0 || ext[0] != '"' {
+		return 0
+	}
+	for i := 1; i < len(ext); i++ {
+		switch c := ext[i]; {
+		case c == '"':
+			return i + 1
+		case c == '\\':
+			i++
+		case c < ' ' && c != '\t', c == 0x7f:
+			return 0
+		}
+	}
+	return 0
+}
+
+func WriteChunk(w io.Writer, p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	chunk := fmt.Sprintf("%X\r\n%s\r\n", len(p), string(p))
+	return w.Write([]byte(chunk))
+}
+
+// WriteLastChunk terminates the body, trailers go between the zero
+// sized chunk and the final CRLF
+func WriteLastChunk(w io.Writer, trailers headers.Headers) (int, error) {
+	lastChunk := "0\r\n"
+	for _, key := range trailers.Keys() {
+		lastChunk += fmt.Sprintf("%s: %s\r\n", headers.CanonicalKey(key), trailers[key])
+	}
+	lastChunk += "\r\n"
+	return w.Write([]byte(lastChunk))
+}
@@ -0,0 +1,98 @@
+package chunked
+
+import (
+	"bytes"
+	"httpfromtcp/internal/headers"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSize(t *testing.T) {
+	for line, size := range map[string]int{
+		"0":                   0,
+		"1a":                  26,
+		"FFFFFFFF":            0xFFFFFFFF,
+		"5 ":                  5,
+		"5;a":                 5,
+		"5;a=b;c":             5,
+		"5 ; a = b ; c=\"x\"": 5,
+		"5;a=\"q\\\"uote\"":   5,
+	} {
+		got, err := ParseSize([]byte(line))
+		require.NoError(t, err, line)
+		assert.Equal(t, size, got, line)
+	}
+
+	for _, line := range []string{"", " 5", "g", "-1", "+1", "0x5", "123456789", "5;", "5;=b", "5;a=", "5;a=\"b", "5;a b", "5;a=b c", "5;a=\"\x01\""} {
+		_, err := ParseSize([]byte(line))
+		assert.ErrorIs(t, err, ErrMalformedChunk, line)
+	}
+}
+
+// decode feeds data to a fresh decoder step bytes at a time, the way a
+// parser would with reads of that size
+func decode(data []byte, step int) ([]byte, headers.Headers, bool, error) {
+	d := NewDecoder(nil)
+	var body, pending []byte
+	for len(data) > 0 && !d.Done() {
+		n := min(step, len(data))
+		pending = append(pending, data[:n]...)
+		data = data[n:]
+		read, decoded, err := d.Decode(pending, body)
+		body = decoded
+		if err != nil {
+			return body, d.Trailers, false, err
+		}
+		pending = pending[read:]
+	}
+	return body, d.Trailers, d.Done(), nil
+}
+
+func FuzzDecoder(f *testing.F) {
+	f.Add([]byte("5\r\nhello\r\n0\r\n\r\n"))
+	f.Add([]byte("3;ext=1\r\nhel\r\n2\r\nlo\r\n0\r\nX-Sum: 1\r\n\r\n"))
+	f.Add([]byte("5;q=\"a;b\"\r\nhello\r\n0\r\n\r\n"))
+	f.Add([]byte("zz\r\n"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		body, trailers, done, err := decode(data, len(data)+1)
+		splitBody, splitTrailers, splitDone, splitErr := decode(data, 1)
+
+		// the outcome can't depend on how the bytes arrive
+		require.Equal(t, err == nil, splitErr == nil, "whole: %v, split: %v", err, splitErr)
+		if err != nil {
+			return
+		}
+		assert.Equal(t, done, splitDone)
+		assert.Equal(t, string(body), string(splitBody))
+		assert.Equal(t, trailers, splitTrailers)
+	})
+}
+
+func FuzzRoundTrip(f *testing.F) {
+	f.Add([]byte("hello"), 2)
+	f.Add([]byte{}, 1)
+
+	f.Fuzz(func(t *testing.T, payload []byte, chunkSize int) {
+		if chunkSize < 1 {
+			chunkSize = 1
+		}
+		encoded := &bytes.Buffer{}
+		for rest := payload; len(rest) > 0; {
+			n := min(chunkSize, len(rest))
+			_, err := WriteChunk(encoded, rest[:n])
+			require.NoError(t, err)
+			rest = rest[n:]
+		}
+		_, err := WriteLastChunk(encoded, headers.Headers{"x-count": "1"})
+		require.NoError(t, err)
+
+		body, trailers, done, err := decode(encoded.Bytes(), 7)
+		require.NoError(t, err)
+		assert.True(t, done)
+		assert.Equal(t, string(payload), string(body))
+		assert.Equal(t, "1", trailers["x-count"])
+	})
+}
@@ -0,0 +1,332 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errNoHost            = errors.New("request has no host")
+	errUnsupportedScheme = errors.New("unsupported scheme")
+)
+
+type Client struct {
+	// MaxIdlePerHost is how many keep-alive connections are kept per host
+	MaxIdlePerHost int
+	IdleTimeout    time.Duration
+	DialTimeout    time.Duration
+	TLSConfig      *tls.Config
+
+	mu   sync.Mutex
+	idle map[string][]*conn
+}
+
+type conn struct {
+	netConn  net.Conn
+	parser   *response.Parser
+	key      string
+	idleFrom time.Time
+}
+
+var DefaultClient = &Client{}
+
+const (
+	defaultMaxIdlePerHost = 2
+	defaultIdleTimeout    = 90 * time.Second
+	defaultDialTimeout    = 30 * time.Second
+)
+
+func NewRequest(method, rawURL string, body []byte) (*request.Request, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, errNoHost
+	}
+
+	req := &request.Request{
+		RequestLine: request.RequestLine{
+			HTTPVersion:   "1.1",
+			RequestTarget: u.String(),
+			Method:        method,
+		},
+		Headers: headers.NewHeaders(),
+		Body:    body,
+	}
+	req.Headers["host"] = u.Host
+	return req, nil
+}
+
+func Get(rawURL string) (*Response, error) {
+	return DefaultClient.Get(rawURL)
+}
+
+func (c *Client) Get(rawURL string) (*Response, error) {
+	req, err := NewRequest("GET", rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.Do(req)
+}
+
+// Do sends the request and returns as soon as the response headers are read,
+// the body is streamed from the connection and has to be closed by the caller.
+// RequestTarget may be in absolute form (https://host/path) to pick the scheme,
+// otherwise the Host header is dialed over plain tcp. Ending the request's
+// context closes the connection, also while the body is read.
+func (c *Client) Do(req *request.Request) (*Response, error) {
+	scheme, addr, host, target, err := resolveTarget(req)
+	if err != nil {
+		return nil, err
+	}
+	ctx := req.Context()
+
+	// a pooled connection may have been closed by the server while idle,
+	// so a failure on a reused one is retried once on a fresh connection.
+	// Once the request reached the wire that is only safe when the server
+	// may run it twice, and a BodyStream can't be sent twice at all.
+	for attempt := 0; attempt < 2; attempt++ {
+		cn, reused, err := c.getConn(ctx, scheme, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, written, err := c.roundTrip(ctx, cn, req, host, target)
+		if err != nil {
+			cn.netConn.Close()
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			resendable := !written || isIdempotent(req.RequestLine.Method)
+			if reused && req.BodyStream == nil && resendable {
+				continue
+			}
+			return nil, err
+		}
+		return resp, nil
+	}
+	return nil, fmt.Errorf("client: connection to %s lost", addr)
+}
+
+var idempotentMethods = map[string]struct{}{
+	"GET":     {},
+	"HEAD":    {},
+	"PUT":     {},
+	"DELETE":  {},
+	"OPTIONS": {},
+	"TRACE":   {},
+}
+
+func isIdempotent(method string) bool {
+	_, ok := idempotentMethods[method]
+	return ok
+}
+
+// countingWriter tells whether anything was written to the connection
+type countingWriter struct {
+	w       net.Conn
+	written int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.written += int64(n)
+	return n, err
+}
+
+// roundTrip reports whether any of the request was written, even when it fails
+func (c *Client) roundTrip(ctx context.Context, cn *conn, req *request.Request, host, target string) (*Response, bool, error) {
+	stop := context.AfterFunc(ctx, func() { cn.netConn.Close() })
+	resp, written, err := c.exchange(cn, req, host, target, stop)
+	if err != nil {
+		stop()
+	}
+	return resp, written, err
+}
+
+// exchange writes the request and reads the response head, stop ends the
+// watch on the context once the body is done with
+func (c *Client) exchange(cn *conn, req *request.Request, host, target string, stop func() bool) (*Response, bool, error) {
+	// the wire always carries origin form and a Host header
+	wireReq := *req
+	wireReq.RequestLine.RequestTarget = target
+	wireReq.Headers = req.Headers.Clone()
+	wireReq.Headers["host"] = host
+	out := &countingWriter{w: cn.netConn}
+	if err := wireReq.Write(out); err != nil {
+		return nil, out.written > 0, err
+	}
+
+	var head *response.Response
+	for {
+		var err error
+		head, err = cn.parser.ReadResponseHead(req.RequestLine.Method)
+		if err != nil {
+			return nil, true, err
+		}
+		// interim responses are skipped, the final one follows them
+		if !head.IsInformational() || head.StatusLine.StatusCode == 101 {
+			break
+		}
+	}
+
+	resp := &Response{
+		HTTPVersion: head.StatusLine.HTTPVersion,
+		StatusCode:  head.StatusLine.StatusCode,
+		Reason:      head.StatusLine.Reason,
+		Headers:     head.Headers,
+		Trailers:    head.Trailers,
+		SetCookies:  head.SetCookies,
+		keepAlive:   head.KeepAlive(),
+	}
+
+	reusable := resp.keepAlive && !wantsClose(req.Headers)
+	resp.Body = &body{
+		reader: cn.parser.BodyReader(head),
+		onEOF: func() {
+			// false when the context already closed the connection
+			if stop() && reusable {
+				c.putConn(cn)
+			} else {
+				cn.netConn.Close()
+			}
+		},
+		onClose: func() {
+			stop()
+			cn.netConn.Close()
+		},
+	}
+	return resp, true, nil
+}
+
+func resolveTarget(req *request.Request) (scheme, addr, host, target string, err error) {
+	scheme = "http"
+	target = req.RequestLine.RequestTarget
+	host, _ = req.Headers.Get("host")
+
+	if strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") {
+		u, err := url.Parse(target)
+		if err != nil {
+			return "", "", "", "", err
+		}
+		scheme = u.Scheme
+		host = u.Host
+		target = u.RequestURI()
+	}
+	if host == "" {
+		return "", "", "", "", errNoHost
+	}
+
+	addr = host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		switch scheme {
+		case "http":
+			addr = net.JoinHostPort(host, "80")
+		case "https":
+			addr = net.JoinHostPort(host, "443")
+		default:
+			return "", "", "", "", fmt.Errorf("%w: %s", errUnsupportedScheme, scheme)
+		}
+	}
+	return scheme, addr, host, target, nil
+}
+
+func (c *Client) getConn(ctx context.Context, scheme, addr string) (*conn, bool, error) {
+	key := scheme + "://" + addr
+	idleTimeout := c.IdleTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = defaultIdleTimeout
+	}
+
+	c.mu.Lock()
+	for len(c.idle[key]) > 0 {
+		conns := c.idle[key]
+		cn := conns[len(conns)-1]
+		c.idle[key] = conns[:len(conns)-1]
+		if time.Since(cn.idleFrom) > idleTimeout {
+			cn.netConn.Close()
+			continue
+		}
+		c.mu.Unlock()
+		return cn, true, nil
+	}
+	c.mu.Unlock()
+
+	dialTimeout := c.DialTimeout
+	if dialTimeout <= 0 {
+		dialTimeout = defaultDialTimeout
+	}
+	dialer := &net.Dialer{Timeout: dialTimeout}
+
+	var netConn net.Conn
+	var err error
+	if scheme == "https" {
+		config := c.TLSConfig
+		if config == nil {
+			config = &tls.Config{}
+		}
+		config = config.Clone()
+		if config.ServerName == "" {
+			config.ServerName, _, _ = net.SplitHostPort(addr)
+		}
+		netConn, err = (&tls.Dialer{NetDialer: dialer, Config: config}).DialContext(ctx, "tcp", addr)
+	} else {
+		netConn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	return &conn{
+		netConn: netConn,
+		parser:  response.NewParser(netConn),
+		key:     key,
+	}, false, nil
+}
+
+func (c *Client) putConn(cn *conn) {
+	maxIdle := c.MaxIdlePerHost
+	if maxIdle <= 0 {
+		maxIdle = defaultMaxIdlePerHost
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.idle == nil {
+		c.idle = map[string][]*conn{}
+	}
+	if len(c.idle[cn.key]) >= maxIdle {
+		cn.netConn.Close()
+		return
+	}
+	cn.idleFrom = time.Now()
+	c.idle[cn.key] = append(c.idle[cn.key], cn)
+}
+
+// CloseIdleConnections closes every pooled connection
+func (c *Client) CloseIdleConnections() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, conns := range c.idle {
+		for _, cn := range conns {
+			cn.netConn.Close()
+		}
+		delete(c.idle, key)
+	}
+}
+
+func wantsClose(h headers.Headers) bool {
+	connection, _ := h.Get("connection")
+	return strings.EqualFold(strings.TrimSpace(connection), "close")
+}
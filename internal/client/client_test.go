@@ -0,0 +1,225 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestServer(t *testing.T) (*httptest.Server, *atomic.Int32) {
+	var conns atomic.Int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/length":
+			w.Header().Set("Content-Length", "5")
+			io.WriteString(w, "hello")
+		case "/chunked":
+			w.Header().Set("Trailer", "X-Checksum")
+			flusher := w.(http.Flusher)
+			io.WriteString(w, "chunk one,")
+			flusher.Flush()
+			io.WriteString(w, "chunk two")
+			w.Header().Set("X-Checksum", "abc")
+		case "/echo":
+			body, _ := io.ReadAll(r.Body)
+			fmt.Fprintf(w, "%s %s %s", r.Method, r.Header.Get("X-Test"), body)
+		case "/nocontent":
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	server.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	server.Start()
+	t.Cleanup(server.Close)
+	return server, &conns
+}
+
+func TestClient(t *testing.T) {
+	server, conns := newTestServer(t)
+	c := &Client{}
+	defer c.CloseIdleConnections()
+
+	// TEST: Content-Length body
+	resp, err := c.Get(server.URL + "/length")
+	require.NoError(t, err)
+	assert.Equal(t, 200, int(resp.StatusCode))
+	assert.Equal(t, "OK", resp.Reason)
+	body, err := resp.ReadAll()
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+
+	// TEST: Chunked body with trailers
+	resp, err = c.Get(server.URL + "/chunked")
+	require.NoError(t, err)
+	body, err = resp.ReadAll()
+	require.NoError(t, err)
+	assert.Equal(t, "chunk one,chunk two", string(body))
+	assert.Equal(t, "abc", resp.Trailers["x-checksum"])
+
+	// TEST: Request body and headers are sent
+	req, err := NewRequest("POST", server.URL+"/echo", []byte("payload"))
+	require.NoError(t, err)
+	req.Headers.Add("X-Test", "yes")
+	resp, err = c.Do(req)
+	require.NoError(t, err)
+	body, err = resp.ReadAll()
+	require.NoError(t, err)
+	assert.Equal(t, "POST yes payload", string(body))
+
+	// TEST: No content response has empty body
+	resp, err = c.Get(server.URL + "/nocontent")
+	require.NoError(t, err)
+	body, err = resp.ReadAll()
+	require.NoError(t, err)
+	assert.Equal(t, 204, int(resp.StatusCode))
+	assert.Empty(t, body)
+
+	// TEST: Keep-alive connection got reused for every request
+	assert.Equal(t, int32(1), conns.Load())
+
+	// TEST: Closing body early drops the connection
+	resp, err = c.Get(server.URL + "/length")
+	require.NoError(t, err)
+	resp.Body.Close()
+	resp, err = c.Get(server.URL + "/length")
+	require.NoError(t, err)
+	resp.ReadAll()
+	assert.Equal(t, int32(2), conns.Load())
+}
+
+func TestCloseDelimitedBody(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		buffer := make([]byte, 1024)
+		conn.Read(buffer)
+		io.WriteString(conn, "HTTP/1.1 200 OK\r\nConnection: close\r\n\r\nuntil the end")
+		conn.Close()
+	}()
+
+	// TEST: Body is read till the server closes the connection
+	resp, err := Get("http://" + listener.Addr().String() + "/")
+	require.NoError(t, err)
+	body, err := resp.ReadAll()
+	require.NoError(t, err)
+	assert.Equal(t, "until the end", string(body))
+	assert.False(t, resp.keepAlive)
+
+	// TEST: Missing host
+	_, err = NewRequest("GET", "/relative", nil)
+	require.Error(t, err)
+	assert.True(t, strings.Contains(err.Error(), "host"))
+}
+
+func TestRetryOnReusedConnection(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	// every connection answers its first request and drops the second one unanswered
+	var requests atomic.Int32
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buffer := make([]byte, 1024)
+				for i := 0; ; i++ {
+					if _, err := conn.Read(buffer); err != nil {
+						return
+					}
+					requests.Add(1)
+					if i > 0 {
+						return
+					}
+					io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+				}
+			}()
+		}
+	}()
+	url := "http://" + listener.Addr().String() + "/"
+
+	warmUp := func(c *Client) {
+		resp, err := c.Get(url)
+		require.NoError(t, err)
+		_, err = resp.ReadAll()
+		require.NoError(t, err)
+	}
+
+	// TEST: Idempotent request is resent on a fresh connection
+	c := &Client{}
+	defer c.CloseIdleConnections()
+	warmUp(c)
+	requests.Store(0)
+	resp, err := c.Get(url)
+	require.NoError(t, err)
+	resp.ReadAll()
+	assert.Equal(t, int32(2), requests.Load())
+
+	// TEST: Request that reached the server is not sent again when it isn't idempotent
+	c = &Client{}
+	defer c.CloseIdleConnections()
+	warmUp(c)
+	requests.Store(0)
+	req, err := NewRequest("POST", url, []byte("once"))
+	require.NoError(t, err)
+	_, err = c.Do(req)
+	require.Error(t, err)
+	assert.Equal(t, int32(1), requests.Load())
+}
+
+func TestContextCancel(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	// answers with the head and part of the body, then stalls
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buffer := make([]byte, 1024)
+		conn.Read(buffer)
+		io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\nhalf")
+		conn.Read(buffer)
+	}()
+	url := "http://" + listener.Addr().String() + "/"
+
+	// TEST: Ending the context stops a body read stuck on the connection
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := NewRequest("GET", url, nil)
+	require.NoError(t, err)
+	resp, err := (&Client{}).Do(req.WithContext(ctx))
+	require.NoError(t, err)
+	time.AfterFunc(10*time.Millisecond, cancel)
+	_, err = resp.ReadAll()
+	require.Error(t, err)
+
+	// TEST: Request with an ended context fails without retrying
+	_, err = (&Client{}).Do(req.WithContext(ctx))
+	require.ErrorIs(t, err, context.Canceled)
+}
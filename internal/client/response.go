@@ -0,0 +1,58 @@
+package client
+
+import (
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/response"
+	"io"
+	"sync"
+)
+
+type Response struct {
+	HTTPVersion string
+	StatusCode  response.StatusCode
+	Reason      string
+	Headers     headers.Headers
+	// Trailers are filled once a chunked Body is read to io.EOF
+	Trailers headers.Headers
+	// SetCookies has each Set-Cookie line, see response.Response
+	SetCookies []string
+	Body       io.ReadCloser
+
+	keepAlive bool
+}
+
+// body hands the connection back to the pool once the message is fully
+// read and drops it when the caller gives up early
+type body struct {
+	reader  io.Reader
+	onEOF   func()
+	onClose func()
+
+	once sync.Once
+	done bool
+}
+
+func (b *body) Read(p []byte) (int, error) {
+	if b.done {
+		return 0, io.EOF
+	}
+	n, err := b.reader.Read(p)
+	if err == io.EOF {
+		b.done = true
+		b.once.Do(b.onEOF)
+	} else if err != nil {
+		b.once.Do(b.onClose)
+	}
+	return n, err
+}
+
+func (b *body) Close() error {
+	b.once.Do(b.onClose)
+	return nil
+}
+
+// ReadAll reads the whole body and closes it
+func (r *Response) ReadAll() ([]byte, error) {
+	defer r.Body.Close()
+	return io.ReadAll(r.Body)
+}
@@ -0,0 +1,231 @@
+package cookie
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type SameSite int
+
+const (
+	SameSiteDefault SameSite = iota
+	SameSiteLax
+	SameSiteStrict
+	SameSiteNone
+)
+
+type Cookie struct {
+	Name  string
+	Value string
+
+	Path    string
+	Domain  string
+	Expires time.Time
+	// MaxAge 0 leaves the attribute out, negative deletes the cookie right away
+	MaxAge      int
+	Secure      bool
+	HttpOnly    bool
+	SameSite    SameSite
+	Partitioned bool
+}
+
+var (
+	errInvalidName   = errors.New("invalid cookie name")
+	errInvalidValue  = errors.New("invalid cookie value")
+	errInvalidPath   = errors.New("invalid cookie path")
+	errInvalidDomain = errors.New("invalid cookie domain")
+	errNeedsSecure   = errors.New("cookie attribute requires Secure")
+)
+
+const expiresFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range []byte(s) {
+		if c <= ' ' || c >= 0x7f || strings.IndexByte("()<>@,;:\\\"/[]?={}", c) >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// isCookieValue checks cookie-octets from RFC 6265, optionally in quotes
+func isCookieValue(s string) bool {
+	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+		s = s[1 : len(s)-1]
+	}
+	for _, c := range []byte(s) {
+		if c < 0x21 || c > 0x7e || c == '"' || c == ',' || c == ';' || c == '\\' {
+			return false
+		}
+	}
+	return true
+}
+
+func isAttributeValue(s string) bool {
+	for _, c := range []byte(s) {
+		if c < 0x20 || c == 0x7f || c == ';' {
+			return false
+		}
+	}
+	return true
+}
+
+func isDomain(s string) bool {
+	s = strings.TrimPrefix(s, ".")
+	if s == "" || len(s) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(s, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range []byte(label) {
+			isAlnum := (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+			if !isAlnum && c != '-' {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (c *Cookie) Validate() error {
+	if !isToken(c.Name) {
+		return fmt.Errorf("%w: %q", errInvalidName, c.Name)
+	}
+	if !isCookieValue(c.Value) {
+		return fmt.Errorf("%w: %q", errInvalidValue, c.Value)
+	}
+	if !isAttributeValue(c.Path) {
+		return fmt.Errorf("%w: %q", errInvalidPath, c.Path)
+	}
+	if c.Domain != "" && !isDomain(c.Domain) {
+		return fmt.Errorf("%w: %q", errInvalidDomain, c.Domain)
+	}
+	if c.SameSite == SameSiteNone && !c.Secure {
+		return fmt.Errorf("%w: SameSite=None", errNeedsSecure)
+	}
+	if c.Partitioned && !c.Secure {
+		return fmt.Errorf("%w: Partitioned", errNeedsSecure)
+	}
+	return nil
+}
+
+// String renders the Set-Cookie value, call Validate first
+func (c *Cookie) String() string {
+	var sb strings.Builder
+	sb.WriteString(c.Name)
+	sb.WriteString("=")
+	sb.WriteString(c.Value)
+
+	if c.Path != "" {
+		sb.WriteString("; Path=" + c.Path)
+	}
+	if c.Domain != "" {
+		sb.WriteString("; Domain=" + strings.TrimPrefix(c.Domain, "."))
+	}
+	if !c.Expires.IsZero() {
+		sb.WriteString("; Expires=" + c.Expires.UTC().Format(expiresFormat))
+	}
+	if c.MaxAge > 0 {
+		sb.WriteString("; Max-Age=" + strconv.Itoa(c.MaxAge))
+	} else if c.MaxAge < 0 {
+		sb.WriteString("; Max-Age=0")
+	}
+	if c.HttpOnly {
+		sb.WriteString("; HttpOnly")
+	}
+	if c.Secure {
+		sb.WriteString("; Secure")
+	}
+	switch c.SameSite {
+	case SameSiteLax:
+		sb.WriteString("; SameSite=Lax")
+	case SameSiteStrict:
+		sb.WriteString("; SameSite=Strict")
+	case SameSiteNone:
+		sb.WriteString("; SameSite=None")
+	}
+	if c.Partitioned {
+		sb.WriteString("; Partitioned")
+	}
+	return sb.String()
+}
+
+// ParseCookieHeader reads the name=value pairs of a Cookie request header,
+// malformed pairs are skipped
+func ParseCookieHeader(value string) []*Cookie {
+	var cookies []*Cookie
+	for _, pair := range strings.Split(value, ";") {
+		name, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok {
+			continue
+		}
+		name = strings.TrimSpace(name)
+		val = strings.TrimSpace(val)
+		if !isToken(name) || !isCookieValue(val) {
+			continue
+		}
+		cookies = append(cookies, &Cookie{Name: name, Value: strings.Trim(val, "\"")})
+	}
+	return cookies
+}
+
+// ParseSetCookie reads a Set-Cookie header value, unknown attributes are ignored
+func ParseSetCookie(line string) (*Cookie, error) {
+	parts := strings.Split(line, ";")
+	name, value, ok := strings.Cut(strings.TrimSpace(parts[0]), "=")
+	name = strings.TrimSpace(name)
+	value = strings.TrimSpace(value)
+	if !ok || !isToken(name) {
+		return nil, fmt.Errorf("%w: %q", errInvalidName, name)
+	}
+	if !isCookieValue(value) {
+		return nil, fmt.Errorf("%w: %q", errInvalidValue, value)
+	}
+
+	c := &Cookie{Name: name, Value: strings.Trim(value, "\"")}
+	for _, attr := range parts[1:] {
+		key, val, _ := strings.Cut(strings.TrimSpace(attr), "=")
+		val = strings.TrimSpace(val)
+		switch strings.ToLower(strings.TrimSpace(key)) {
+		case "path":
+			c.Path = val
+		case "domain":
+			c.Domain = strings.TrimPrefix(val, ".")
+		case "expires":
+			if expires, err := time.Parse(expiresFormat, val); err == nil {
+				c.Expires = expires
+			}
+		case "max-age":
+			if maxAge, err := strconv.Atoi(val); err == nil {
+				if maxAge <= 0 {
+					maxAge = -1
+				}
+				c.MaxAge = maxAge
+			}
+		case "secure":
+			c.Secure = true
+		case "httponly":
+			c.HttpOnly = true
+		case "samesite":
+			switch strings.ToLower(val) {
+			case "lax":
+				c.SameSite = SameSiteLax
+			case "strict":
+				c.SameSite = SameSiteStrict
+			case "none":
+				c.SameSite = SameSiteNone
+			}
+		case "partitioned":
+			c.Partitioned = true
+		}
+	}
+	return c, nil
+}
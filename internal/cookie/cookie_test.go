@@ -0,0 +1,110 @@
+package cookie
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCookie(t *testing.T) {
+	// TEST: All attributes
+	c := &Cookie{
+		Name:        "session",
+		Value:       "abc123",
+		Path:        "/",
+		Domain:      ".example.com",
+		Expires:     time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC),
+		MaxAge:      3600,
+		Secure:      true,
+		HttpOnly:    true,
+		SameSite:    SameSiteNone,
+		Partitioned: true,
+	}
+	require.NoError(t, c.Validate())
+	assert.Equal(t, "session=abc123; Path=/; Domain=example.com; Expires=Wed, 02 Jan 2030 03:04:05 GMT; Max-Age=3600; HttpOnly; Secure; SameSite=None; Partitioned", c.String())
+
+	// TEST: Round trip through ParseSetCookie
+	parsed, err := ParseSetCookie(c.String())
+	require.NoError(t, err)
+	assert.Equal(t, c.Name, parsed.Name)
+	assert.Equal(t, "example.com", parsed.Domain)
+	assert.True(t, c.Expires.Equal(parsed.Expires))
+	assert.Equal(t, 3600, parsed.MaxAge)
+	assert.Equal(t, SameSiteNone, parsed.SameSite)
+	assert.True(t, parsed.Partitioned && parsed.Secure && parsed.HttpOnly)
+
+	// TEST: Deleting cookie
+	c = &Cookie{Name: "gone", MaxAge: -1}
+	assert.Equal(t, "gone=; Max-Age=0", c.String())
+
+	// TEST: Validation failures
+	invalid := []*Cookie{
+		{Name: "bad name", Value: "x"},
+		{Name: "x", Value: "semi;colon"},
+		{Name: "x", Value: "with space"},
+		{Name: "x", Value: "y", Path: "/a;b"},
+		{Name: "x", Value: "y", Domain: "bad_domain.com"},
+		{Name: "x", Value: "y", SameSite: SameSiteNone},
+		{Name: "x", Value: "y", Partitioned: true},
+	}
+	for _, c := range invalid {
+		assert.Error(t, c.Validate(), c.Name+"="+c.Value)
+	}
+
+	// TEST: Cookie header parsing skips junk
+	cookies := ParseCookieHeader(`a=1; b="quoted"; junk; c=3;; bad name=4`)
+	require.Len(t, cookies, 3)
+	assert.Equal(t, "a", cookies[0].Name)
+	assert.Equal(t, "quoted", cookies[1].Value)
+	assert.Equal(t, "3", cookies[2].Value)
+}
+
+func TestSecureCookies(t *testing.T) {
+	secret := []byte(strings.Repeat("s", 32))
+
+	// TEST: Short secret is rejected
+	_, err := NewSigner([]byte("short"))
+	require.Error(t, err)
+
+	// TEST: Signed round trip
+	signer, err := NewSigner(secret)
+	require.NoError(t, err)
+	encoded, err := signer.Encode("session", "user=42")
+	require.NoError(t, err)
+	assert.NoError(t, (&Cookie{Name: "session", Value: encoded}).Validate())
+	value, err := signer.Decode("session", encoded)
+	require.NoError(t, err)
+	assert.Equal(t, "user=42", value)
+
+	// TEST: Tampered or renamed cookie fails
+	_, err = signer.Decode("session", "dXNlcj0x"+encoded[8:])
+	require.ErrorIs(t, err, ErrInvalidSignature)
+	_, err = signer.Decode("other", encoded)
+	require.ErrorIs(t, err, ErrInvalidSignature)
+
+	// TEST: Expired signature
+	signer.MaxAge = time.Minute
+	signer.now = func() time.Time { return time.Now().Add(time.Hour) }
+	_, err = signer.Decode("session", encoded)
+	require.ErrorIs(t, err, ErrExpired)
+
+	// TEST: Encrypted round trip hides the value
+	encrypter, err := NewEncrypter(secret)
+	require.NoError(t, err)
+	encoded, err = encrypter.Encode("session", "user=42")
+	require.NoError(t, err)
+	assert.NotContains(t, encoded, "user")
+	value, err = encrypter.Decode("session", encoded)
+	require.NoError(t, err)
+	assert.Equal(t, "user=42", value)
+	_, err = encrypter.Decode("other", encoded)
+	require.ErrorIs(t, err, ErrInvalidSignature)
+
+	// TEST: Different secret can't decode
+	other, _ := NewEncrypter([]byte(strings.Repeat("o", 32)))
+	_, err = other.Decode("session", encoded)
+	require.ErrorIs(t, err, ErrInvalidSignature)
+}
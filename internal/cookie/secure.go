@@ -0,0 +1,155 @@
+package cookie
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidSignature = errors.New("cookie signature is invalid")
+	ErrExpired          = errors.New("cookie has expired")
+	errShortSecret      = errors.New("cookie secret must be at least 32 bytes")
+	errMalformed        = errors.New("malformed secure cookie")
+)
+
+const minSecretLen = 32
+
+// Codec protects cookie values with a server secret, the cookie name is
+// bound into the value so it can't be replayed under another name
+type Codec interface {
+	Encode(name, value string) (string, error)
+	Decode(name, encoded string) (string, error)
+}
+
+// deriveKey gives every purpose its own key from the one server secret
+func deriveKey(secret []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+type Signer struct {
+	// MaxAge rejects values signed longer ago, 0 disables the check
+	MaxAge time.Duration
+
+	key []byte
+	now func() time.Time
+}
+
+func NewSigner(secret []byte) (*Signer, error) {
+	if len(secret) < minSecretLen {
+		return nil, errShortSecret
+	}
+	return &Signer{key: deriveKey(secret, "cookie-sign"), now: time.Now}, nil
+}
+
+func (s *Signer) mac(name, payload string) []byte {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(name + "|" + payload))
+	return mac.Sum(nil)
+}
+
+// Encode produces base64(value)|timestamp|signature, the value stays readable
+func (s *Signer) Encode(name, value string) (string, error) {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(value)) + "|" + strconv.FormatInt(s.now().Unix(), 10)
+	signature := base64.RawURLEncoding.EncodeToString(s.mac(name, payload))
+	return payload + "|" + signature, nil
+}
+
+func (s *Signer) Decode(name, encoded string) (string, error) {
+	idx := strings.LastIndex(encoded, "|")
+	if idx == -1 {
+		return "", errMalformed
+	}
+	payload, signature := encoded[:idx], encoded[idx+1:]
+	expected, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(expected, s.mac(name, payload)) {
+		return "", ErrInvalidSignature
+	}
+
+	value, timestamp, ok := strings.Cut(payload, "|")
+	if !ok {
+		return "", errMalformed
+	}
+	if err := checkAge(timestamp, s.MaxAge, s.now()); err != nil {
+		return "", err
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return "", errMalformed
+	}
+	return string(decoded), nil
+}
+
+func checkAge(timestamp string, maxAge time.Duration, now time.Time) error {
+	issued, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errMalformed
+	}
+	if maxAge > 0 && now.Sub(time.Unix(issued, 0)) > maxAge {
+		return ErrExpired
+	}
+	return nil
+}
+
+// Encrypter hides the value with AES-GCM, which also authenticates it
+type Encrypter struct {
+	MaxAge time.Duration
+
+	aead cipher.AEAD
+	now  func() time.Time
+}
+
+func NewEncrypter(secret []byte) (*Encrypter, error) {
+	if len(secret) < minSecretLen {
+		return nil, errShortSecret
+	}
+	block, err := aes.NewCipher(deriveKey(secret, "cookie-encrypt"))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Encrypter{aead: aead, now: time.Now}, nil
+}
+
+func (e *Encrypter) Encode(name, value string) (string, error) {
+	nonce := make([]byte, e.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	plaintext := strconv.FormatInt(e.now().Unix(), 10) + "|" + value
+	sealed := e.aead.Seal(nonce, nonce, []byte(plaintext), []byte(name))
+	return base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+func (e *Encrypter) Decode(name, encoded string) (string, error) {
+	sealed, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || len(sealed) < e.aead.NonceSize() {
+		return "", errMalformed
+	}
+	nonce, ciphertext := sealed[:e.aead.NonceSize()], sealed[e.aead.NonceSize():]
+	plaintext, err := e.aead.Open(nil, nonce, ciphertext, []byte(name))
+	if err != nil {
+		return "", ErrInvalidSignature
+	}
+
+	timestamp, value, ok := strings.Cut(string(plaintext), "|")
+	if !ok {
+		return "", errMalformed
+	}
+	if err := checkAge(timestamp, e.MaxAge, e.now()); err != nil {
+		return "", err
+	}
+	return value, nil
+}
@@ -0,0 +1,166 @@
+package cors
+
+import (
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORS answers preflight requests and adds the Access-Control headers
+// browsers need before they hand a cross origin response to a script
+type CORS struct {
+	// AllowedOrigins holds exact origins, "*" for any origin, or patterns
+	// with one wildcard such as "https://*.example.com"
+	AllowedOrigins []string
+	// AllowOriginFunc is asked when no entry in AllowedOrigins matches
+	AllowOriginFunc func(origin string) bool
+	// AllowedMethods defaults to GET, HEAD and POST
+	AllowedMethods []string
+	// AllowedHeaders empty allows whatever headers the preflight asks for
+	AllowedHeaders []string
+	ExposedHeaders []string
+	// AllowCredentials lets cookies and auth through, the origin is then
+	// echoed back instead of "*" since browsers refuse the wildcard
+	AllowCredentials bool
+	// MaxAge is how long a browser may cache a preflight, zero leaves it
+	// to the browser default
+	MaxAge time.Duration
+}
+
+var defaultMethods = []string{"GET", "HEAD", "POST"}
+
+func (c *CORS) Middleware(next server.Handler) server.Handler {
+	return func(w *response.Writer, req *request.Request) {
+		origin, hasOrigin := req.Headers.Get("origin")
+		requestMethod, hasRequestMethod := req.Headers.Get("access-control-request-method")
+
+		if req.RequestLine.Method == "OPTIONS" && hasOrigin && hasRequestMethod {
+			c.preflight(w, req, origin, requestMethod)
+			return
+		}
+
+		if hasOrigin {
+			c.addResponseHeaders(w, origin)
+		}
+		next(w, req)
+	}
+}
+
+func (c *CORS) preflight(w *response.Writer, req *request.Request, origin, requestMethod string) {
+	// the answer depends on all three, caches must not mix them up
+	w.AddHeader("Vary", "Origin, Access-Control-Request-Method, Access-Control-Request-Headers")
+
+	requestHeaders, _ := req.Headers.Get("access-control-request-headers")
+	allowedOrigin, ok := c.allowedOrigin(origin)
+	if ok && c.methodAllowed(requestMethod) && c.headersAllowed(requestHeaders) {
+		w.AddHeader("Access-Control-Allow-Origin", allowedOrigin)
+		if c.AllowCredentials {
+			w.AddHeader("Access-Control-Allow-Credentials", "true")
+		}
+		w.AddHeader("Access-Control-Allow-Methods", strings.ToUpper(strings.TrimSpace(requestMethod)))
+		if requestHeaders = strings.TrimSpace(requestHeaders); requestHeaders != "" {
+			w.AddHeader("Access-Control-Allow-Headers", requestHeaders)
+		}
+		if c.MaxAge > 0 {
+			w.AddHeader("Access-Control-Max-Age", strconv.Itoa(int(c.MaxAge/time.Second)))
+		}
+	}
+
+	// a refused preflight still gets 204, the missing headers are what
+	// tells the browser no
+	w.WriteStatusLine(response.StatusCodeNoContent)
+	h := response.GetDefaultHeaders(0)
+	delete(h, "Content-Length")
+	delete(h, "Content-Type")
+	w.WriteHeaders(h)
+}
+
+func (c *CORS) addResponseHeaders(w *response.Writer, origin string) {
+	allowedOrigin, ok := c.allowedOrigin(origin)
+	if allowedOrigin != "*" {
+		w.AddHeader("Vary", "Origin")
+	}
+	if !ok {
+		return
+	}
+	w.AddHeader("Access-Control-Allow-Origin", allowedOrigin)
+	if c.AllowCredentials {
+		w.AddHeader("Access-Control-Allow-Credentials", "true")
+	}
+	if len(c.ExposedHeaders) > 0 {
+		w.AddHeader("Access-Control-Expose-Headers", strings.Join(c.ExposedHeaders, ", "))
+	}
+}
+
+// allowedOrigin returns the Access-Control-Allow-Origin value for origin
+func (c *CORS) allowedOrigin(origin string) (string, bool) {
+	for _, allowed := range c.AllowedOrigins {
+		if allowed == "*" {
+			if c.AllowCredentials {
+				return origin, true
+			}
+			return "*", true
+		}
+		if matchOrigin(allowed, origin) {
+			return origin, true
+		}
+	}
+	if c.AllowOriginFunc != nil && c.AllowOriginFunc(origin) {
+		return origin, true
+	}
+	return "", false
+}
+
+func matchOrigin(pattern, origin string) bool {
+	prefix, suffix, wildcard := strings.Cut(strings.ToLower(pattern), "*")
+	origin = strings.ToLower(origin)
+	if !wildcard {
+		return prefix == origin
+	}
+	if len(origin) <= len(prefix)+len(suffix) || !strings.HasPrefix(origin, prefix) || !strings.HasSuffix(origin, suffix) {
+		return false
+	}
+	// the wildcard stands for subdomain labels, not a scheme or port
+	middle := origin[len(prefix) : len(origin)-len(suffix)]
+	return !strings.ContainsAny(middle, "/:")
+}
+
+func (c *CORS) methodAllowed(method string) bool {
+	methods := c.AllowedMethods
+	if len(methods) == 0 {
+		methods = defaultMethods
+	}
+	method = strings.TrimSpace(method)
+	for _, allowed := range methods {
+		if strings.EqualFold(allowed, method) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *CORS) headersAllowed(requestHeaders string) bool {
+	if len(c.AllowedHeaders) == 0 {
+		return true
+	}
+	for _, name := range strings.Split(requestHeaders, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		allowed := false
+		for _, allowedHeader := range c.AllowedHeaders {
+			if allowedHeader == "*" || strings.EqualFold(allowedHeader, name) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+	return true
+}
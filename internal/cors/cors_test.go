@@ -0,0 +1,116 @@
+package cors
+
+import (
+	"bytes"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// serve runs a request with the given extra header lines through c
+func serve(t *testing.T, c *CORS, method string, lines ...string) (*response.Response, bool) {
+	t.Helper()
+	raw := method + " /api HTTP/1.1\r\nHost: localhost\r\n"
+	for _, line := range lines {
+		raw += line + "\r\n"
+	}
+	req, err := request.RequestFromReader(strings.NewReader(raw + "\r\n"))
+	require.NoError(t, err)
+
+	called := false
+	out := &bytes.Buffer{}
+	c.Middleware(func(w *response.Writer, req *request.Request) {
+		called = true
+		w.WriteStatusLine(response.StatusCodeOk)
+		w.WriteHeaders(response.GetDefaultHeaders(0))
+	})(&response.Writer{Writer: out}, req)
+
+	resp, err := response.ResponseFromReader(out)
+	require.NoError(t, err)
+	return resp, called
+}
+
+func header(resp *response.Response, key string) string {
+	value, _ := resp.Headers.Get(key)
+	return value
+}
+
+func TestCORS(t *testing.T) {
+	c := &CORS{
+		AllowedOrigins:   []string{"https://app.example.com", "https://*.example.org"},
+		AllowedMethods:   []string{"GET", "POST", "PUT"},
+		AllowedHeaders:   []string{"Content-Type", "X-Request-Id"},
+		ExposedHeaders:   []string{"X-Request-Id"},
+		AllowCredentials: true,
+		MaxAge:           10 * time.Minute,
+	}
+
+	// TEST: Simple request from an allowed origin
+	resp, called := serve(t, c, "GET", "Origin: https://app.example.com")
+	assert.True(t, called)
+	assert.Equal(t, "https://app.example.com", header(resp, "access-control-allow-origin"))
+	assert.Equal(t, "true", header(resp, "access-control-allow-credentials"))
+	assert.Equal(t, "X-Request-Id", header(resp, "access-control-expose-headers"))
+	assert.Equal(t, "Origin", header(resp, "vary"))
+
+	// TEST: Wildcard pattern
+	resp, _ = serve(t, c, "GET", "Origin: https://eu.example.org")
+	assert.Equal(t, "https://eu.example.org", header(resp, "access-control-allow-origin"))
+	resp, _ = serve(t, c, "GET", "Origin: https://evil.com/x.example.org")
+	assert.Empty(t, header(resp, "access-control-allow-origin"))
+
+	// TEST: Disallowed origin still varies on Origin
+	resp, called = serve(t, c, "GET", "Origin: https://evil.com")
+	assert.True(t, called)
+	assert.Empty(t, header(resp, "access-control-allow-origin"))
+	assert.Equal(t, "Origin", header(resp, "vary"))
+
+	// TEST: Same origin requests get nothing
+	resp, _ = serve(t, c, "GET")
+	assert.Empty(t, header(resp, "vary"))
+
+	// TEST: Preflight
+	resp, called = serve(t, c, "OPTIONS",
+		"Origin: https://app.example.com",
+		"Access-Control-Request-Method: PUT",
+		"Access-Control-Request-Headers: content-type, x-request-id")
+	assert.False(t, called)
+	assert.Equal(t, response.StatusCodeNoContent, resp.StatusLine.StatusCode)
+	assert.Equal(t, "https://app.example.com", header(resp, "access-control-allow-origin"))
+	assert.Equal(t, "PUT", header(resp, "access-control-allow-methods"))
+	assert.Equal(t, "content-type, x-request-id", header(resp, "access-control-allow-headers"))
+	assert.Equal(t, "600", header(resp, "access-control-max-age"))
+	assert.Equal(t, "Origin, Access-Control-Request-Method, Access-Control-Request-Headers", header(resp, "vary"))
+
+	// TEST: Preflight with a method or header that isn't allowed
+	resp, _ = serve(t, c, "OPTIONS", "Origin: https://app.example.com", "Access-Control-Request-Method: DELETE")
+	assert.Empty(t, header(resp, "access-control-allow-origin"))
+	resp, _ = serve(t, c, "OPTIONS",
+		"Origin: https://app.example.com",
+		"Access-Control-Request-Method: GET",
+		"Access-Control-Request-Headers: authorization")
+	assert.Empty(t, header(resp, "access-control-allow-origin"))
+
+	// TEST: Plain OPTIONS goes to the handler
+	_, called = serve(t, c, "OPTIONS")
+	assert.True(t, called)
+}
+
+func TestAnyOrigin(t *testing.T) {
+	// TEST: Wildcard without credentials needs no Vary
+	c := &CORS{AllowedOrigins: []string{"*"}}
+	resp, _ := serve(t, c, "GET", "Origin: https://a.test")
+	assert.Equal(t, "*", header(resp, "access-control-allow-origin"))
+	assert.Empty(t, header(resp, "vary"))
+
+	// TEST: Credentials echo the origin
+	c.AllowCredentials = true
+	resp, _ = serve(t, c, "GET", "Origin: https://a.test")
+	assert.Equal(t, "https://a.test", header(resp, "access-control-allow-origin"))
+	assert.Equal(t, "Origin", header(resp, "vary"))
+}
@@ -3,7 +3,7 @@ package headers
 import (
 	"bytes"
 	"fmt"
-	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -23,14 +23,141 @@ func NewHeaders() Headers {
 
 type Key []byte
 
-var KeyRegexp = regexp.MustCompile("^[A-Za-z0-9!#$%&'*+-.^_`|~]+$")
+// tokenChars marks the bytes allowed in a token (RFC 9110 section 5.6.2),
+// a table lookup per byte instead of running a regexp on every field name
+var tokenChars = func() (table [256]bool) {
+	for c := '0'; c <= '9'; c++ {
+		table[c] = true
+	}
+	for c := 'a'; c <= 'z'; c++ {
+		table[c] = true
+		table[c-'a'+'A'] = true
+	}
+	for _, c := range []byte("!#$%&'*+-.^_`|~") {
+		table[c] = true
+	}
+	return table
+}()
 
-func (k *Key) isValid() bool {
-	if len(*k) < 1 {
+// IsToken reports whether b is a non-empty token
+func IsToken(b []byte) bool {
+	if len(b) == 0 {
 		return false
 	}
+	for _, c := range b {
+		if !tokenChars[c] {
+			return false
+		}
+	}
+	return true
+}
+
+func (k *Key) isValid() bool {
+	return IsToken(*k)
+}
+
+// isValidValue rejects control characters other than tab, a lone CR or
+// LF in a value could end the field early for another parser
+func isValidValue(value []byte) bool {
+	for _, c := range value {
+		if (c < ' ' && c != '\t') || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// commonKeys are field names frequent enough to be worth keeping one
+// string for, so parsing them allocates nothing
+var commonKeys = func() map[string]string {
+	keys := map[string]string{}
+	for _, key := range []string{
+		"accept", "accept-encoding", "accept-language", "authorization",
+		"cache-control", "connection", "content-encoding", "content-length",
+		"content-type", "cookie", "date", "expect", "forwarded", "host",
+		"if-modified-since", "if-none-match", "origin", "pragma", "range",
+		"referer", "te", "trailer", "transfer-encoding", "upgrade",
+		"user-agent", "x-forwarded-for", "x-forwarded-proto", "x-real-ip",
+		"x-request-id", "traceparent", "tracestate",
+		"sec-websocket-key", "sec-websocket-version", "sec-websocket-protocol",
+		"access-control-request-method", "access-control-request-headers",
+	} {
+		keys[key] = key
+	}
+	return keys
+}()
+
+// maxCommonKeyLen bounds the stack buffer the lookup lowercases into
+const maxCommonKeyLen = 32
+
+// CommonKey returns the shared lowercase string for a frequent field name
+func CommonKey(name []byte) (string, bool) {
+	if len(name) > maxCommonKeyLen {
+		return "", false
+	}
+	var lower [maxCommonKeyLen]byte
+	for i, c := range name {
+		if c >= 'A' && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		lower[i] = c
+	}
+	key, ok := commonKeys[string(lower[:len(name)])]
+	return key, ok
+}
+
+// CanonicalKey turns a stored lowercase key into its wire form, content-type becomes Content-Type
+func CanonicalKey(key string) string {
+	canonical := []byte(strings.ToLower(key))
+	upper := true
+	for i, c := range canonical {
+		if upper && c >= 'a' && c <= 'z' {
+			canonical[i] = c - 'a' + 'A'
+		}
+		upper = c == '-'
+	}
+	return string(canonical)
+}
+
+// Keys returns the header keys sorted, so headers are written in a stable order
+func (h Headers) Keys() []string {
+	keys := make([]string, 0, len(h))
+	for key := range h {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// forbiddenTrailers are fields a recipient needs before the body, so they
+// can't be sent after it (RFC 9110 section 6.5.1)
+var forbiddenTrailers = map[string]struct{}{
+	"authorization":       {},
+	"cache-control":       {},
+	"connection":          {},
+	"content-encoding":    {},
+	"content-length":      {},
+	"content-range":       {},
+	"content-type":        {},
+	"expect":              {},
+	"host":                {},
+	"keep-alive":          {},
+	"max-forwards":        {},
+	"pragma":              {},
+	"proxy-authenticate":  {},
+	"proxy-authorization": {},
+	"proxy-connection":    {},
+	"range":               {},
+	"set-cookie":          {},
+	"te":                  {},
+	"trailer":             {},
+	"transfer-encoding":   {},
+	"www-authenticate":    {},
+}
 
-	return KeyRegexp.MatchString(string(*k))
+func IsForbiddenTrailer(key string) bool {
+	_, ok := forbiddenTrailers[strings.ToLower(key)]
+	return ok
 }
 
 func (h *Headers) Get(key string) (string, bool) {
@@ -54,19 +181,73 @@ func (h *Headers) GetInt(key string) (int, bool) {
 	return intVal, true
 }
 
+// ParseContentLength accepts digits only, a list of the same value from
+// repeated headers is allowed
+func ParseContentLength(value string) (int, bool) {
+	length := -1
+	for part := range strings.SplitSeq(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" || strings.TrimLeft(part, "0123456789") != "" {
+			return 0, false
+		}
+		n, err := strconv.Atoi(part)
+		if err != nil || (length != -1 && n != length) {
+			return 0, false
+		}
+		length = n
+	}
+	return length, true
+}
+
 func (h *Headers) Add(key, value string) {
 	headers := *h
 	mapKey := strings.ToLower(string(key))
+	separator := ", "
+	if mapKey == "cookie" {
+		// cookie pairs can't be separated by commas
+		separator = "; "
+	}
 	if existingValue, ok := headers[mapKey]; !ok {
 		headers[mapKey] = string(value)
 	} else {
-		headers[mapKey] = existingValue + ", " + string(value)
+		headers[mapKey] = existingValue + separator + string(value)
 	}
 }
 
 func (h *Headers) Remove(key string) {
 	headers := *h
-	delete(headers, key)
+	delete(headers, strings.ToLower(key))
+}
+
+func (h Headers) Clone() Headers {
+	clone := make(Headers, len(h))
+	for key, value := range h {
+		clone[key] = value
+	}
+	return clone
+}
+
+// ParseField splits a field line without its CRLF into views of its name
+// and value, leading whitespace before the name is skipped
+func ParseField(line []byte) (name, value []byte, err error) {
+	collonIdx := bytes.IndexByte(line, ':')
+	if collonIdx == -1 {
+		return nil, nil, fmt.Errorf("headers parse err: %s", ErrNoColonInHeader)
+	}
+	// no whitespace is allowed between the name and the colon (RFC 9112 section 5.1)
+	if collonIdx == 0 || line[collonIdx-1] == ' ' || line[collonIdx-1] == '\t' {
+		return nil, nil, fmt.Errorf("headers parse err: %s", ErrMalformedHeader)
+	}
+	var key Key = bytes.TrimLeft(line[:collonIdx], " \t")
+	if !key.isValid() {
+		return nil, nil, fmt.Errorf("headers parse err: %s", ErrMalformedHeader)
+	}
+
+	value = bytes.Trim(line[collonIdx+1:], " \t")
+	if !isValidValue(value) {
+		return nil, nil, fmt.Errorf("headers parse err: %s", ErrMalformedHeader)
+	}
+	return key, value, nil
 }
 
 func (h Headers) Parse(data []byte) (n int, done bool, err error) {
@@ -79,21 +260,15 @@ func (h Headers) Parse(data []byte) (n int, done bool, err error) {
 	}
 	headerBytes := data[:crlfIdx]
 
-	collonIdx := bytes.Index(headerBytes, []byte(":"))
-	if collonIdx == -1 {
-		return 0, false, fmt.Errorf("headers parse err: %s", ErrNoColonInHeader)
-	}
-	if data[collonIdx-1] == ' ' {
-		return 0, false, fmt.Errorf("headers parse err: %s", ErrMalformedHeader)
+	key, value, err := ParseField(headerBytes)
+	if err != nil {
+		return 0, false, err
 	}
-	var key Key = bytes.TrimSpace(headerBytes[:collonIdx])
-	if !key.isValid() {
-		return 0, false, fmt.Errorf("headers parse err: %s", ErrMalformedHeader)
+	name, ok := CommonKey(key)
+	if !ok {
+		name = strings.ToLower(string(key))
 	}
-
-	value := bytes.TrimSpace(headerBytes[collonIdx+1:])
-
-	h.Add(string(key), string(value))
+	h.Add(name, string(value))
 
 	return len(headerBytes) + len(CRLF), false, nil
 }
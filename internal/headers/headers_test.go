@@ -1,6 +1,8 @@
 package headers
 
 import (
+	"bytes"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -80,3 +82,69 @@ func TestHeaders(t *testing.T) {
 	assert.Equal(t, 0, n)
 	assert.False(t, done)
 }
+
+func FuzzParse(f *testing.F) {
+	f.Add([]byte("Host: localhost:42069\r\n\r\n"))
+	f.Add([]byte("   Host:    localhost\r\n"))
+	f.Add([]byte(": empty\r\n"))
+	f.Add([]byte("X-A: b\rc\r\n"))
+	f.Add([]byte("\r\n"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		h := NewHeaders()
+		n, done, err := h.Parse(data)
+		if err != nil {
+			assert.Equal(t, 0, n)
+			assert.Empty(t, h)
+			return
+		}
+		if done {
+			assert.Equal(t, 0, n)
+			assert.True(t, bytes.HasPrefix(data, CRLF))
+			return
+		}
+		if n == 0 {
+			assert.NotContains(t, string(data), "\r\n")
+			return
+		}
+		// exactly one line was consumed and stored in canonical form
+		assert.True(t, bytes.HasSuffix(data[:n], CRLF))
+		assert.Equal(t, n-len(CRLF), bytes.Index(data, CRLF))
+		require.Len(t, h, 1)
+		for key, value := range h {
+			assert.True(t, IsToken([]byte(key)), key)
+			assert.Equal(t, strings.ToLower(key), key)
+			assert.NotContains(t, value, "\r")
+			assert.NotContains(t, value, "\n")
+			assert.Equal(t, strings.Trim(value, " \t"), value)
+		}
+	})
+}
+
+func BenchmarkParse(b *testing.B) {
+	for name, line := range map[string][]byte{
+		"common": []byte("Content-Type: application/json\r\n"),
+		"custom": []byte("X-Request-Id: 5f0c8a2e-6c1b-4d8e-9a57-0b5d3c2e1f40\r\n"),
+	} {
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			h := NewHeaders()
+			for b.Loop() {
+				clear(h)
+				if _, _, err := h.Parse(line); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkIsToken(b *testing.B) {
+	key := []byte("Access-Control-Request-Headers")
+	b.ReportAllocs()
+	for b.Loop() {
+		if !IsToken(key) {
+			b.Fatal("not a token")
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package health
+
+import (
+	"encoding/json"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"runtime"
+	"time"
+)
+
+type debugConn struct {
+	ID           uint64 `json:"id"`
+	RemoteAddr   string `json:"remote_addr"`
+	State        string `json:"state"`
+	Age          string `json:"age"`
+	InState      string `json:"in_state"`
+	RequestsSeen int    `json:"requests"`
+}
+
+type debugRuntime struct {
+	GoVersion    string `json:"go_version"`
+	Goroutines   int    `json:"goroutines"`
+	CPUs         int    `json:"cpus"`
+	HeapAlloc    uint64 `json:"heap_alloc_bytes"`
+	HeapObjects  uint64 `json:"heap_objects"`
+	Sys          uint64 `json:"sys_bytes"`
+	TotalAlloc   uint64 `json:"total_alloc_bytes"`
+	NumGC        uint32 `json:"gc_count"`
+	PauseTotalNs uint64 `json:"gc_pause_total_ns"`
+}
+
+type debugPage struct {
+	Uptime       string       `json:"uptime"`
+	ShuttingDown bool         `json:"shutting_down"`
+	Connections  []debugConn  `json:"connections"`
+	Runtime      debugRuntime `json:"runtime"`
+}
+
+// Debug shows the watched server's open connections with their state and
+// age, and runtime stats. ReadMemStats stops the world briefly, so this
+// is for people and not for scraping.
+func (c *Checker) Debug(w *response.Writer, req *request.Request) {
+	now := time.Now()
+	page := debugPage{
+		Uptime:      now.Sub(c.started).Round(time.Second).String(),
+		Connections: []debugConn{},
+	}
+
+	c.mu.Lock()
+	s := c.server
+	c.mu.Unlock()
+	if s != nil {
+		page.ShuttingDown = s.ShuttingDown()
+		for _, info := range s.Connections() {
+			page.Connections = append(page.Connections, debugConn{
+				ID:           info.ID,
+				RemoteAddr:   info.RemoteAddr,
+				State:        info.State.String(),
+				Age:          now.Sub(info.OpenedAt).Round(time.Millisecond).String(),
+				InState:      now.Sub(info.StateSince).Round(time.Millisecond).String(),
+				RequestsSeen: info.RequestsSeen,
+			})
+		}
+	}
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	page.Runtime = debugRuntime{
+		GoVersion:    runtime.Version(),
+		Goroutines:   runtime.NumGoroutine(),
+		CPUs:         runtime.NumCPU(),
+		HeapAlloc:    mem.HeapAlloc,
+		HeapObjects:  mem.HeapObjects,
+		Sys:          mem.Sys,
+		TotalAlloc:   mem.TotalAlloc,
+		NumGC:        mem.NumGC,
+		PauseTotalNs: mem.PauseTotalNs,
+	}
+
+	body, err := json.MarshalIndent(page, "", "  ")
+	if err != nil {
+		writeBody(w, response.StatusCodeInternalServerError, "text/plain", []byte(err.Error()))
+		return
+	}
+	writeBody(w, response.StatusCodeOk, "application/json", append(body, '\n'))
+}
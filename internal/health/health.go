@@ -0,0 +1,181 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Check reports a dependency as unhealthy by returning an error, it should
+// give up when ctx is done
+type Check func(ctx context.Context) error
+
+const DefaultTimeout = 5 * time.Second
+
+var ErrShuttingDown = errors.New("server is shutting down")
+
+type namedCheck struct {
+	name  string
+	check Check
+}
+
+// Checker serves /healthz (liveness) and /readyz (readiness), and with
+// DebugPath set a JSON page of the server's connections and runtime
+type Checker struct {
+	// Timeout bounds every run of the checks, 0 uses DefaultTimeout
+	Timeout time.Duration
+	// DebugPath serves the debug page when not empty, keep it off public
+	// listeners since it shows client addresses
+	DebugPath string
+
+	mu        sync.Mutex
+	liveness  []namedCheck
+	readiness []namedCheck
+	server    *server.Server
+	started   time.Time
+}
+
+func New() *Checker {
+	return &Checker{started: time.Now()}
+}
+
+// AddLiveness registers a check that fails /healthz, a failing liveness
+// check gets the process restarted so keep them to the process itself
+func (c *Checker) AddLiveness(name string, check Check) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.liveness = append(c.liveness, namedCheck{name, check})
+}
+
+// AddReadiness registers a check that fails /readyz, such as a database
+// the handlers can't work without
+func (c *Checker) AddReadiness(name string, check Check) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readiness = append(c.readiness, namedCheck{name, check})
+}
+
+// WatchServer fails readiness once s starts shutting down, so load
+// balancers stop sending traffic while it drains
+func (c *Checker) WatchServer(s *server.Server) {
+	c.mu.Lock()
+	c.server = s
+	c.mu.Unlock()
+	c.AddReadiness("shutdown", func(context.Context) error {
+		if s.ShuttingDown() {
+			return ErrShuttingDown
+		}
+		return nil
+	})
+}
+
+type result struct {
+	name string
+	err  error
+}
+
+// run runs the checks concurrently, results keep the registration order
+func (c *Checker) run(ctx context.Context, checks []namedCheck) []result {
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	results := make([]result, len(checks))
+	var wg sync.WaitGroup
+	for i, nc := range checks {
+		results[i].name = nc.name
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			done := make(chan error, 1)
+			go func() { done <- nc.check(ctx) }()
+			select {
+			case err := <-done:
+				results[i].err = err
+			case <-ctx.Done():
+				// a check that ignores ctx must not hold up the probe
+				results[i].err = ctx.Err()
+			}
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+func (c *Checker) Healthz(w *response.Writer, req *request.Request) {
+	c.mu.Lock()
+	checks := c.liveness
+	c.mu.Unlock()
+	c.serveChecks(w, req, checks)
+}
+
+func (c *Checker) Readyz(w *response.Writer, req *request.Request) {
+	c.mu.Lock()
+	checks := c.readiness
+	c.mu.Unlock()
+	c.serveChecks(w, req, checks)
+}
+
+// serveChecks answers "ok" or 503 with the failures, ?verbose lists every
+// check in the [+]name ok / [-]name failed style kubernetes uses
+func (c *Checker) serveChecks(w *response.Writer, req *request.Request, checks []namedCheck) {
+	results := c.run(req.Context(), checks)
+	query, _ := req.Query()
+	_, verbose := query["verbose"]
+
+	var sb strings.Builder
+	failed := false
+	for _, r := range results {
+		if r.err != nil {
+			failed = true
+			fmt.Fprintf(&sb, "[-]%s failed: %v\n", r.name, r.err)
+		} else if verbose {
+			fmt.Fprintf(&sb, "[+]%s ok\n", r.name)
+		}
+	}
+
+	status := response.StatusCodeOk
+	if failed {
+		status = response.StatusCodeServiceUnavailable
+		sb.WriteString("check failed\n")
+	} else if verbose {
+		sb.WriteString("ok\n")
+	} else {
+		sb.WriteString("ok")
+	}
+	writeBody(w, status, "text/plain; charset=utf-8", []byte(sb.String()))
+}
+
+func writeBody(w *response.Writer, status response.StatusCode, contentType string, body []byte) {
+	h := response.GetDefaultHeaders(len(body))
+	h["Content-Type"] = contentType
+	h["Cache-Control"] = "no-store"
+	w.WriteStatusLine(status)
+	w.WriteHeaders(h)
+	w.WriteBody(body)
+}
+
+// Middleware answers the health and debug paths and passes the rest on
+func (c *Checker) Middleware(next server.Handler) server.Handler {
+	return func(w *response.Writer, req *request.Request) {
+		switch path := req.Path(); {
+		case path == "/healthz":
+			c.Healthz(w, req)
+		case path == "/readyz":
+			c.Readyz(w, req)
+		case c.DebugPath != "" && path == c.DebugPath:
+			c.Debug(w, req)
+		default:
+			next(w, req)
+		}
+	}
+}
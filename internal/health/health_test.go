@@ -0,0 +1,119 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+	"httpfromtcp/internal/servertest"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func get(t *testing.T, h server.Handler, target string) *servertest.Recorded {
+	t.Helper()
+	rec, err := servertest.Record(h, servertest.NewRequest("GET", target, nil))
+	require.NoError(t, err)
+	return rec
+}
+
+func TestChecks(t *testing.T) {
+	c := New()
+	c.Timeout = 50 * time.Millisecond
+	var dbErr error
+	c.AddLiveness("goroutines", func(context.Context) error { return nil })
+	c.AddReadiness("db", func(context.Context) error { return dbErr })
+	h := c.Middleware(func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.StatusCodeNotFound)
+		w.WriteHeaders(response.GetDefaultHeaders(0))
+	})
+
+	// TEST: Passing checks answer ok
+	resp := get(t, h, "/healthz")
+	assert.Equal(t, response.StatusCodeOk, resp.StatusCode)
+	assert.Equal(t, "ok", string(resp.Body))
+	resp = get(t, h, "/readyz?verbose")
+	assert.Equal(t, response.StatusCodeOk, resp.StatusCode)
+	assert.Equal(t, "[+]db ok\nok\n", string(resp.Body))
+
+	// TEST: A failing readiness check gives 503 and doesn't touch liveness
+	dbErr = errors.New("connection refused")
+	resp = get(t, h, "/readyz")
+	assert.Equal(t, response.StatusCodeServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, "[-]db failed: connection refused\ncheck failed\n", string(resp.Body))
+	resp = get(t, h, "/healthz")
+	assert.Equal(t, response.StatusCodeOk, resp.StatusCode)
+
+	// TEST: A check that hangs times out
+	c.AddLiveness("stuck", func(context.Context) error { select {} })
+	start := time.Now()
+	resp = get(t, h, "/healthz")
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Equal(t, response.StatusCodeServiceUnavailable, resp.StatusCode)
+	assert.Contains(t, string(resp.Body), "[-]stuck failed: context deadline exceeded")
+
+	// TEST: Other paths and the debug page when disabled go to the handler
+	assert.Equal(t, response.StatusCodeNotFound, get(t, h, "/").StatusCode)
+	assert.Equal(t, response.StatusCodeNotFound, get(t, h, "/debug/server").StatusCode)
+}
+
+func TestWatchServer(t *testing.T) {
+	c := New()
+	c.DebugPath = "/debug/server"
+	release := make(chan struct{})
+	ts := servertest.NewServer(c.Middleware(func(w *response.Writer, req *request.Request) {
+		<-release
+		w.WriteStatusLine(response.StatusCodeOk)
+		w.WriteHeaders(response.GetDefaultHeaders(0))
+	}), server.WithLogger(slog.New(slog.DiscardHandler)), server.WithDrainDelay(time.Second))
+	s := ts.Server
+	c.WatchServer(s)
+	fetch := func(target string) (response.StatusCode, []byte) {
+		resp, err := ts.Get(target)
+		require.NoError(t, err)
+		body, err := resp.ReadAll()
+		require.NoError(t, err)
+		return resp.StatusCode, body
+	}
+
+	busy, err := ts.Dial()
+	require.NoError(t, err)
+	defer busy.Close()
+	io.WriteString(busy, "GET /slow HTTP/1.1\r\nHost: localhost\r\n\r\n")
+
+	// TEST: Ready while serving
+	status, _ := fetch("/readyz")
+	assert.Equal(t, response.StatusCodeOk, status)
+
+	// TEST: The debug page lists the busy connection and runtime stats
+	var page debugPage
+	require.Eventually(t, func() bool {
+		_, body := fetch("/debug/server")
+		require.NoError(t, json.Unmarshal(body, &page))
+		return len(page.Connections) == 2
+	}, time.Second, 5*time.Millisecond)
+	assert.Equal(t, "active", page.Connections[0].State)
+	assert.Equal(t, busy.LocalAddr().String(), page.Connections[0].RemoteAddr)
+	assert.Positive(t, page.Runtime.Goroutines)
+	assert.NotEmpty(t, page.Runtime.GoVersion)
+
+	// TEST: Readiness fails while draining, liveness doesn't
+	done := make(chan error, 1)
+	go func() { done <- s.Shutdown(context.Background()) }()
+	require.Eventually(t, s.ShuttingDown, time.Second, time.Millisecond)
+	status, body := fetch("/readyz")
+	assert.Equal(t, response.StatusCodeServiceUnavailable, status)
+	assert.Contains(t, string(body), "[-]shutdown failed: server is shutting down")
+	status, _ = fetch("/healthz")
+	assert.Equal(t, response.StatusCodeOk, status)
+
+	close(release)
+	assert.NoError(t, <-done)
+}
@@ -0,0 +1,142 @@
+package metrics
+
+import (
+	"errors"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HTTPMetrics are the server metrics, Middleware covers requests and
+// ServerOptions the connections and read errors the handler never sees
+type HTTPMetrics struct {
+	// Route names the route a request counts under, it should map to a
+	// small fixed set since every value is a new series. nil counts every
+	// request under defaultRoute.
+	Route func(req *request.Request) string
+
+	requests          *CounterVec
+	duration          *HistogramVec
+	bytesIn           *CounterVec
+	bytesOut          *CounterVec
+	activeConnections Gauge
+	connections       Counter
+	readErrors        *CounterVec
+	keepAliveReused   Counter
+
+	now func() time.Time
+}
+
+func NewHTTPMetrics(r *Registry) *HTTPMetrics {
+	return &HTTPMetrics{
+		requests: r.NewCounterVec("http_requests_total",
+			"Requests handled, by method, route and status.", "method", "route", "status"),
+		duration: r.NewHistogramVec("http_request_duration_seconds",
+			"Time spent in the handler.", nil, "method", "route"),
+		bytesIn: r.NewCounterVec("http_request_body_bytes_total",
+			"Request body bytes read.", "method", "route"),
+		bytesOut: r.NewCounterVec("http_response_body_bytes_total",
+			"Response body bytes written.", "method", "route"),
+		activeConnections: r.NewGauge("http_connections_active",
+			"Connections currently open."),
+		connections: r.NewCounter("http_connections_total",
+			"Connections accepted."),
+		readErrors: r.NewCounterVec("http_request_read_errors_total",
+			"Requests that could not be read, by type.", "type"),
+		keepAliveReused: r.NewCounter("http_keepalive_reused_total",
+			"Requests served on a connection that had served one before."),
+		now: time.Now,
+	}
+}
+
+// defaultRoute keeps the series bounded when no Route is set, labelling by
+// path would let clients create a series per URL
+const defaultRoute = "other"
+
+func (m *HTTPMetrics) route(req *request.Request) string {
+	if m.Route != nil {
+		return m.Route(req)
+	}
+	return defaultRoute
+}
+
+func (m *HTTPMetrics) Middleware(next server.Handler) server.Handler {
+	return func(w *response.Writer, req *request.Request) {
+		start := m.now()
+		next(w, req)
+		elapsed := m.now().Sub(start)
+
+		method, route := req.RequestLine.Method, m.route(req)
+		status := strconv.Itoa(int(w.StatusCode()))
+		m.requests.WithLabelValues(method, route, status).Inc()
+		m.duration.WithLabelValues(method, route).Observe(elapsed.Seconds())
+		m.bytesIn.WithLabelValues(method, route).Add(float64(req.BodyBytes()))
+		m.bytesOut.WithLabelValues(method, route).Add(float64(w.BytesWritten()))
+		if req.Sequence > 1 {
+			m.keepAliveReused.Inc()
+		}
+	}
+}
+
+// ServerOptions hooks the metrics into the server's connection handling
+func (m *HTTPMetrics) ServerOptions() []server.Option {
+	return []server.Option{
+		server.WithConnState(m.connState),
+		server.WithReadError(m.readError),
+	}
+}
+
+func (m *HTTPMetrics) connState(conn net.Conn, state server.ConnState) {
+	switch state {
+	case server.StateNew:
+		m.connections.Inc()
+		m.activeConnections.Inc()
+	case server.StateClosed, server.StateHijacked:
+		m.activeConnections.Dec()
+	}
+}
+
+// readErrorTypes label the parser errors that get their own status, they
+// wrap ErrMalformedRequest too and are checked first
+var readErrorTypes = []struct {
+	err   error
+	label string
+}{
+	{request.ErrRequestLineTooLong, "request_line_too_long"},
+	{request.ErrHeadersTooLarge, "headers_too_large"},
+	{request.ErrBodyTooLarge, "body_too_large"},
+	{request.ErrUnsupportedTransferEncoding, "unsupported_transfer_encoding"},
+	{request.ErrMethodNotImplemented, "method_not_implemented"},
+	{request.ErrVersionNotSupported, "version_not_supported"},
+}
+
+func (m *HTTPMetrics) readError(err error) {
+	if label := readErrorType(err); label != "" {
+		m.readErrors.WithLabelValues(label).Inc()
+	}
+}
+
+// readErrorType is the label an error is counted under, empty for a client
+// closing an idle connection, which is no error
+func readErrorType(err error) string {
+	var ioErr *request.IOError
+	if errors.As(err, &ioErr) {
+		if ioErr.Clean() {
+			return ""
+		}
+		return strings.ReplaceAll(ioErr.Kind.String(), " ", "_")
+	}
+	for _, t := range readErrorTypes {
+		if errors.Is(err, t.err) {
+			return t.label
+		}
+	}
+	if errors.Is(err, request.ErrMalformedRequest) {
+		return "malformed"
+	}
+	return "other"
+}
@@ -0,0 +1,230 @@
+package metrics
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type metricType string
+
+const (
+	typeCounter   metricType = "counter"
+	typeGauge     metricType = "gauge"
+	typeHistogram metricType = "histogram"
+)
+
+// DefaultBuckets are the Prometheus client defaults, in seconds
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// family is one metric name with all its labelled series
+type family struct {
+	name    string
+	help    string
+	kind    metricType
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	labelValues []string
+	value       float64
+	// histograms only
+	counts []uint64
+	count  uint64
+}
+
+func (f *family) get(labelValues []string) *series {
+	if len(labelValues) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s takes %d label values, got %d", f.name, len(f.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labelValues: make([]string, len(labelValues))}
+		for i, value := range labelValues {
+			s.labelValues[i] = strings.Clone(value)
+		}
+		if f.kind == typeHistogram {
+			s.counts = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+type Counter struct {
+	f *family
+	s *series
+}
+
+// Add panics on negative values, counters only go up
+func (c Counter) Add(v float64) {
+	if v < 0 {
+		panic("metrics: counter decreased")
+	}
+	c.f.mu.Lock()
+	c.s.value += v
+	c.f.mu.Unlock()
+}
+
+func (c Counter) Inc() {
+	c.Add(1)
+}
+
+func (c Counter) Value() float64 {
+	c.f.mu.Lock()
+	defer c.f.mu.Unlock()
+	return c.s.value
+}
+
+type Gauge struct {
+	f *family
+	s *series
+}
+
+func (g Gauge) Set(v float64) {
+	g.f.mu.Lock()
+	g.s.value = v
+	g.f.mu.Unlock()
+}
+
+func (g Gauge) Add(v float64) {
+	g.f.mu.Lock()
+	g.s.value += v
+	g.f.mu.Unlock()
+}
+
+func (g Gauge) Inc() { g.Add(1) }
+
+func (g Gauge) Dec() { g.Add(-1) }
+
+func (g Gauge) Value() float64 {
+	g.f.mu.Lock()
+	defer g.f.mu.Unlock()
+	return g.s.value
+}
+
+type Histogram struct {
+	f *family
+	s *series
+}
+
+func (h Histogram) Observe(v float64) {
+	h.f.mu.Lock()
+	defer h.f.mu.Unlock()
+	for i, upper := range h.f.buckets {
+		if v <= upper {
+			h.s.counts[i]++
+		}
+	}
+	h.s.count++
+	h.s.value += v
+}
+
+type CounterVec struct{ f *family }
+
+func (cv *CounterVec) WithLabelValues(values ...string) Counter {
+	return Counter{f: cv.f, s: cv.f.get(values)}
+}
+
+type GaugeVec struct{ f *family }
+
+func (gv *GaugeVec) WithLabelValues(values ...string) Gauge {
+	return Gauge{f: gv.f, s: gv.f.get(values)}
+}
+
+type HistogramVec struct{ f *family }
+
+func (hv *HistogramVec) WithLabelValues(values ...string) Histogram {
+	return Histogram{f: hv.f, s: hv.f.get(values)}
+}
+
+// Registry holds metric families and renders them in registration order
+type Registry struct {
+	mu       sync.Mutex
+	families []*family
+	names    map[string]struct{}
+}
+
+func NewRegistry() *Registry {
+	return &Registry{names: map[string]struct{}{}}
+}
+
+func (r *Registry) register(name, help string, kind metricType, buckets []float64, labels []string) *family {
+	if !validName(name) {
+		panic("metrics: invalid metric name " + name)
+	}
+	for _, label := range labels {
+		if !validName(label) || strings.HasPrefix(label, "__") || (kind == typeHistogram && label == "le") {
+			panic("metrics: invalid label name " + label)
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.names[name]; ok {
+		panic("metrics: duplicate metric " + name)
+	}
+	f := &family{name: name, help: help, kind: kind, labels: labels, buckets: buckets, series: map[string]*series{}}
+	r.names[name] = struct{}{}
+	r.families = append(r.families, f)
+	return f
+}
+
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{f: r.register(name, help, typeCounter, nil, labels)}
+}
+
+func (r *Registry) NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{f: r.register(name, help, typeGauge, nil, labels)}
+}
+
+// NewHistogramVec uses DefaultBuckets when buckets is nil
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	return &HistogramVec{f: r.register(name, help, typeHistogram, buckets, labels)}
+}
+
+func (r *Registry) NewCounter(name, help string) Counter {
+	return r.NewCounterVec(name, help).WithLabelValues()
+}
+
+func (r *Registry) NewGauge(name, help string) Gauge {
+	return r.NewGaugeVec(name, help).WithLabelValues()
+}
+
+func validName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, c := range name {
+		letter := c == '_' || c == ':' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+		if !letter && (i == 0 || c < '0' || c > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return fmt.Sprint(v)
+}
@@ -0,0 +1,193 @@
+package metrics
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func render(t *testing.T, r *Registry) string {
+	t.Helper()
+	var buf bytes.Buffer
+	_, err := r.WriteTo(&buf)
+	require.NoError(t, err)
+	return buf.String()
+}
+
+func TestExposition(t *testing.T) {
+	r := NewRegistry()
+	requests := r.NewCounterVec("requests_total", "Requests.\nAll of them.", "method", "path")
+	inFlight := r.NewGauge("in_flight", "In flight.")
+	latency := r.NewHistogramVec("latency_seconds", "Latency.", []float64{0.5, 0.1}, "method")
+
+	requests.WithLabelValues("POST", `/a"b`).Add(2)
+	requests.WithLabelValues("GET", "/").Inc()
+	inFlight.Inc()
+	inFlight.Inc()
+	inFlight.Dec()
+	latency.WithLabelValues("GET").Observe(0.05)
+	latency.WithLabelValues("GET").Observe(0.3)
+	latency.WithLabelValues("GET").Observe(2)
+
+	// TEST: Text format with escaping, sorted series and cumulative buckets
+	expected := `# HELP requests_total Requests.\nAll of them.
+# TYPE requests_total counter
+requests_total{method="GET",path="/"} 1
+requests_total{method="POST",path="/a\"b"} 2
+# HELP in_flight In flight.
+# TYPE in_flight gauge
+in_flight 1
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{method="GET",le="0.1"} 1
+latency_seconds_bucket{method="GET",le="0.5"} 2
+latency_seconds_bucket{method="GET",le="+Inf"} 3
+latency_seconds_sum{method="GET"} 2.35
+latency_seconds_count{method="GET"} 3
+`
+	assert.Equal(t, expected, render(t, r))
+
+	// TEST: Misuse panics
+	assert.Panics(t, func() { r.NewGauge("in_flight", "again") })
+	assert.Panics(t, func() { r.NewCounter("bad-name", "") })
+	assert.Panics(t, func() { requests.WithLabelValues("GET") })
+	assert.Panics(t, func() { requests.WithLabelValues("GET", "/").Add(-1) })
+}
+
+func TestHTTPMetrics(t *testing.T) {
+	r := NewRegistry()
+	m := NewHTTPMetrics(r)
+	h := server.Chain(func(w *response.Writer, req *request.Request) {
+		if req.Path() == "/metrics" {
+			r.Handler(w, req)
+			return
+		}
+		if req.Path() == "/upload" {
+			// streamed through a copy, the way middleware passes requests on
+			io.Copy(io.Discard, req.WithContext(req.Context()).BodyReader())
+		}
+		w.WriteStatusLine(response.StatusCodeOk)
+		w.WriteHeaders(response.GetDefaultHeaders(5))
+		w.WriteBody([]byte("hello"))
+	}, m.Middleware)
+	m.Route = func(req *request.Request) string {
+		if req.Path() == "/hello" || req.Path() == "/upload" {
+			return req.Path()
+		}
+		return "other"
+	}
+
+	s, err := server.Serve(0, h, m.ServerOptions()...)
+	require.NoError(t, err)
+	defer func() {
+		s.State.Store(false)
+		s.Close()
+	}()
+	addr := s.Listener.Addr().String()
+
+	send := func(raw string) *response.Response {
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer conn.Close()
+		io.WriteString(conn, raw)
+		resp, err := response.ResponseFromReader(conn)
+		require.NoError(t, err)
+		return resp
+	}
+
+	// TEST: Requests, bytes and read errors are counted
+	send("GET /hello?x=1 HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	send("POST /hello HTTP/1.1\r\nHost: localhost\r\nContent-Length: 3\r\n\r\nabc")
+	send("POST /upload HTTP/1.1\r\nHost: localhost\r\nExpect: 100-continue\r\nContent-Length: 4\r\n\r\nabcd")
+	send("garbage\r\n\r\n")
+
+	// TEST: A second request on a connection counts as reused
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	parser := response.NewParser(conn)
+	for range 2 {
+		io.WriteString(conn, "GET /hello HTTP/1.1\r\nHost: localhost\r\n\r\n")
+		_, err = parser.ReadResponse("GET")
+		require.NoError(t, err)
+	}
+	conn.Close()
+	send("GET /" + strings.Repeat("a", 10<<10) + " HTTP/1.1\r\nHost: localhost\r\n\r\n")
+
+	var body string
+	require.Eventually(t, func() bool {
+		resp := send("GET /metrics HTTP/1.1\r\nHost: localhost\r\n\r\n")
+		contentType, _ := resp.Headers.Get("content-type")
+		assert.Equal(t, ContentType, contentType)
+		body = string(resp.Body)
+		// the scrape itself is still open
+		return strings.Contains(body, "http_connections_active 1\n")
+	}, time.Second, 10*time.Millisecond)
+
+	assert.Contains(t, body, `http_requests_total{method="GET",route="/hello",status="200"} 3`)
+	assert.Contains(t, body, `http_request_body_bytes_total{method="POST",route="/upload"} 4`)
+	assert.Contains(t, body, "http_keepalive_reused_total 1\n")
+	assert.Contains(t, body, `http_requests_total{method="POST",route="/hello",status="200"} 1`)
+	assert.Contains(t, body, `http_request_body_bytes_total{method="POST",route="/hello"} 3`)
+	assert.Contains(t, body, `http_response_body_bytes_total{method="GET",route="/hello"} 15`)
+	assert.Contains(t, body, `http_request_duration_seconds_count{method="GET",route="/hello"} 3`)
+	assert.Contains(t, body, `http_request_read_errors_total{type="malformed"} 1`)
+	assert.Contains(t, body, `http_request_read_errors_total{type="request_line_too_long"} 1`)
+	assert.Contains(t, body, "http_connections_total ")
+}
+
+func TestPooledRequests(t *testing.T) {
+	r := NewRegistry()
+	m := NewHTTPMetrics(r)
+	m.Route = func(req *request.Request) string { return req.Path() }
+	h := m.Middleware(func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.StatusCodeOk)
+		w.WriteHeaders(response.GetDefaultHeaders(0))
+	})
+
+	// the paths are the same length, so a reused buffer lines up exactly
+	for _, path := range []string{"/first", "/other"} {
+		req := request.AcquireRequest()
+		raw := "GET " + path + " HTTP/1.1\r\nHost: localhost\r\n\r\n"
+		require.NoError(t, request.NewParser(strings.NewReader(raw)).ReadRequestHeadInto(req))
+		h(&response.Writer{Writer: io.Discard}, req)
+		request.ReleaseRequest(req)
+	}
+
+	// TEST: Label values survive the request going back to the pool
+	body := render(t, r)
+	assert.Contains(t, body, `route="/first"`)
+	assert.Contains(t, body, `route="/other"`)
+}
+
+func TestDefaultRoute(t *testing.T) {
+	m := NewHTTPMetrics(NewRegistry())
+	req, err := request.RequestFromReader(strings.NewReader("GET /users/42 HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+
+	// TEST: Paths are not labels unless Route says so
+	assert.Equal(t, "other", m.route(req))
+	m.Route = func(req *request.Request) string { return "/users/:id" }
+	assert.Equal(t, "/users/:id", m.route(req))
+}
+
+func TestReadErrorType(t *testing.T) {
+	// TEST: Parser errors are labelled by type
+	assert.Equal(t, "headers_too_large", readErrorType(fmt.Errorf("%w: %w", request.ErrMalformedRequest, request.ErrHeadersTooLarge)))
+	assert.Equal(t, "body_too_large", readErrorType(fmt.Errorf("%w: %w", request.ErrMalformedRequest, request.ErrBodyTooLarge)))
+	assert.Equal(t, "malformed", readErrorType(fmt.Errorf("%w: bad", request.ErrMalformedRequest)))
+	assert.Equal(t, "timeout", readErrorType(&request.IOError{Kind: request.IOErrorTimeout, Err: os.ErrDeadlineExceeded}))
+	assert.Equal(t, "", readErrorType(&request.IOError{Kind: request.IOErrorClientClosed, Err: io.EOF}))
+	assert.Equal(t, "other", readErrorType(errors.New("boom")))
+}
@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"net/url"
+	"sync/atomic"
+	"time"
+)
+
+type Backend struct {
+	URL *url.URL
+
+	healthy     atomic.Bool
+	active      atomic.Int64
+	failures    atomic.Int32
+	ejectedTill atomic.Int64
+}
+
+func NewBackend(rawURL string) (*Backend, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, errBadBackendURL
+	}
+
+	b := &Backend{URL: u}
+	b.healthy.Store(true)
+	return b, nil
+}
+
+func (b *Backend) Healthy() bool {
+	if b.healthy.Load() {
+		return true
+	}
+	// passive ejection is time limited when nobody probes the backend
+	till := b.ejectedTill.Load()
+	if till != 0 && time.Now().UnixNano() >= till {
+		b.markHealthy()
+		return true
+	}
+	return false
+}
+
+func (b *Backend) ActiveConnections() int64 {
+	return b.active.Load()
+}
+
+func (b *Backend) markHealthy() {
+	b.failures.Store(0)
+	b.ejectedTill.Store(0)
+	b.healthy.Store(true)
+}
+
+func (b *Backend) markUnhealthy(ejectFor time.Duration) {
+	if ejectFor > 0 {
+		b.ejectedTill.Store(time.Now().Add(ejectFor).UnixNano())
+	} else {
+		b.ejectedTill.Store(0)
+	}
+	b.healthy.Store(false)
+}
+
+// reportFailure counts consecutive failures and ejects the backend once
+// maxFailures is reached. It returns true when the backend got ejected.
+func (b *Backend) reportFailure(maxFailures int, ejectFor time.Duration) bool {
+	failures := b.failures.Add(1)
+	if maxFailures > 0 && int(failures) >= maxFailures && b.healthy.Load() {
+		b.markUnhealthy(ejectFor)
+		return true
+	}
+	return false
+}
+
+func (b *Backend) reportSuccess() {
+	b.failures.Store(0)
+}
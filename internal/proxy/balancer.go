@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"hash/crc32"
+	"httpfromtcp/internal/request"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+type Balancer interface {
+	// Next picks a backend out of the healthy ones, backends is never empty
+	Next(backends []*Backend, req *request.Request) *Backend
+}
+
+type RoundRobin struct {
+	counter atomic.Uint64
+}
+
+func (rr *RoundRobin) Next(backends []*Backend, _ *request.Request) *Backend {
+	idx := rr.counter.Add(1) - 1
+	return backends[idx%uint64(len(backends))]
+}
+
+type LeastConnections struct{}
+
+func (LeastConnections) Next(backends []*Backend, _ *request.Request) *Backend {
+	best := backends[0]
+	for _, b := range backends[1:] {
+		if b.ActiveConnections() < best.ActiveConnections() {
+			best = b
+		}
+	}
+	return best
+}
+
+// ConsistentHash routes requests with the same header value to the same
+// backend using a hash ring, so adding or ejecting a backend only moves
+// the keys that belonged to it.
+type ConsistentHash struct {
+	Header   string
+	Replicas int
+
+	mu sync.Mutex
+	// members is the backend set ring was built for
+	members []*Backend
+	ring    []ringPoint
+}
+
+type ringPoint struct {
+	hash    uint32
+	backend *Backend
+}
+
+const defaultReplicas = 100
+
+func (ch *ConsistentHash) Next(backends []*Backend, req *request.Request) *Backend {
+	key := ""
+	if req != nil {
+		key, _ = req.Headers.Get(ch.Header)
+	}
+
+	ring := ch.ringFor(backends)
+	hash := crc32.ChecksumIEEE([]byte(key))
+	idx := sort.Search(len(ring), func(i int) bool { return ring[i].hash >= hash })
+	if idx == len(ring) {
+		idx = 0
+	}
+	return ring[idx].backend
+}
+
+// ringFor returns the ring for backends, building it only when the set
+// changed since the last call. A built ring is never modified.
+func (ch *ConsistentHash) ringFor(backends []*Backend) []ringPoint {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	if ch.ring != nil && slices.Equal(ch.members, backends) {
+		return ch.ring
+	}
+
+	replicas := ch.Replicas
+	if replicas <= 0 {
+		replicas = defaultReplicas
+	}
+	ring := make([]ringPoint, 0, len(backends)*replicas)
+	for _, b := range backends {
+		for i := range replicas {
+			hash := crc32.ChecksumIEEE([]byte(strconv.Itoa(i) + b.URL.String()))
+			ring = append(ring, ringPoint{hash: hash, backend: b})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+	ch.members = slices.Clone(backends)
+	ch.ring = ring
+	return ring
+}
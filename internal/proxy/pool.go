@@ -0,0 +1,162 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"httpfromtcp/internal/client"
+	"httpfromtcp/internal/request"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+var (
+	errBadBackendURL     = errors.New("backend url must have scheme and host")
+	errNoHealthyBackends = errors.New("no healthy backends")
+)
+
+type HealthCheck struct {
+	Path     string
+	Interval time.Duration
+	Timeout  time.Duration
+}
+
+type Pool struct {
+	Backends []*Backend
+	Balancer Balancer
+
+	// HealthCheck enables active probing when Interval is set
+	HealthCheck HealthCheck
+	// MaxFailures consecutive failed requests eject a backend, 0 disables passive ejection
+	MaxFailures int
+	// EjectFor limits passive ejection when active checks are off
+	EjectFor time.Duration
+
+	client   *client.Client
+	stop     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+func NewPool(balancer Balancer, urls ...string) (*Pool, error) {
+	if balancer == nil {
+		balancer = &RoundRobin{}
+	}
+	pool := &Pool{
+		Balancer:    balancer,
+		MaxFailures: 3,
+		EjectFor:    30 * time.Second,
+		client:      &client.Client{},
+		stop:        make(chan struct{}),
+	}
+	for _, rawURL := range urls {
+		backend, err := NewBackend(rawURL)
+		if err != nil {
+			return nil, err
+		}
+		pool.Backends = append(pool.Backends, backend)
+	}
+	return pool, nil
+}
+
+func (p *Pool) healthy(exclude map[*Backend]bool) []*Backend {
+	res := make([]*Backend, 0, len(p.Backends))
+	for _, b := range p.Backends {
+		if b.Healthy() && !exclude[b] {
+			res = append(res, b)
+		}
+	}
+	return res
+}
+
+func (p *Pool) pick(req *request.Request, exclude map[*Backend]bool) (*Backend, error) {
+	candidates := p.healthy(exclude)
+	if len(candidates) == 0 {
+		return nil, errNoHealthyBackends
+	}
+	return p.Balancer.Next(candidates, req), nil
+}
+
+func (p *Pool) reportFailure(b *Backend) {
+	ejectFor := p.EjectFor
+	if p.HealthCheck.Interval > 0 {
+		// the prober brings it back
+		ejectFor = 0
+	}
+	if b.reportFailure(p.MaxFailures, ejectFor) {
+		slog.Warn("BackendEjected", "backend", b.URL.String())
+	}
+}
+
+func (p *Pool) StartHealthChecks() {
+	if p.HealthCheck.Interval <= 0 {
+		return
+	}
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		ticker := time.NewTicker(p.HealthCheck.Interval)
+		defer ticker.Stop()
+		for {
+			p.CheckNow()
+			select {
+			case <-p.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// CheckNow probes every backend once and waits for the results
+func (p *Pool) CheckNow() {
+	var wg sync.WaitGroup
+	for _, b := range p.Backends {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.probe(b)
+		}()
+	}
+	wg.Wait()
+}
+
+func (p *Pool) Stop() {
+	p.stopOnce.Do(func() { close(p.stop) })
+	p.wg.Wait()
+}
+
+func (p *Pool) probe(b *Backend) {
+	timeout := p.HealthCheck.Timeout
+	if timeout <= 0 {
+		timeout = 2 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	probeURL := *b.URL
+	probeURL.Path = p.HealthCheck.Path
+	req, err := client.NewRequest("GET", probeURL.String(), nil)
+	if err != nil {
+		return
+	}
+
+	resp, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		if b.healthy.Load() {
+			slog.Warn("HealthCheckFailed", "backend", b.URL.String(), "error", err)
+		}
+		b.markUnhealthy(0)
+		return
+	}
+	// reading it to the end keeps the connection for the next probe
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 400 {
+		b.markHealthy()
+	} else {
+		b.markUnhealthy(0)
+	}
+}
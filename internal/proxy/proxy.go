@@ -0,0 +1,300 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"httpfromtcp/internal/client"
+	"httpfromtcp/internal/cookie"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/tracing"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+type Route struct {
+	Prefix      string
+	Pool        *Pool
+	StripPrefix bool
+}
+
+type Proxy struct {
+	Routes []Route
+	// MaxRetries is how many other backends an idempotent request is retried on
+	MaxRetries int
+	// Client sends the upstream requests, nil uses client.DefaultClient
+	Client *client.Client
+	// Tracer adds a client span per upstream attempt, without one the
+	// incoming trace context is still passed upstream
+	Tracer *tracing.Tracer
+}
+
+var idempotentMethods = map[string]struct{}{
+	"GET":     {},
+	"HEAD":    {},
+	"PUT":     {},
+	"DELETE":  {},
+	"OPTIONS": {},
+	"TRACE":   {},
+}
+
+var hopByHopHeaders = []string{
+	"connection",
+	"keep-alive",
+	"proxy-connection",
+	"proxy-authenticate",
+	"proxy-authorization",
+	"te",
+	"trailer",
+	"transfer-encoding",
+	"upgrade",
+}
+
+func (p *Proxy) route(target string) (*Route, bool) {
+	var best *Route
+	for i := range p.Routes {
+		r := &p.Routes[i]
+		if strings.HasPrefix(target, r.Prefix) && (best == nil || len(r.Prefix) > len(best.Prefix)) {
+			best = r
+		}
+	}
+	return best, best != nil
+}
+
+func (p *Proxy) Handler(w *response.Writer, req *request.Request) {
+	route, ok := p.route(req.RequestLine.RequestTarget)
+	if !ok {
+		writeError(w, response.StatusCodeNotFound)
+		return
+	}
+
+	target := req.RequestLine.RequestTarget
+	if route.StripPrefix {
+		target = "/" + strings.TrimPrefix(strings.TrimPrefix(target, route.Prefix), "/")
+	}
+
+	attempts := 1
+	if _, ok := idempotentMethods[req.RequestLine.Method]; ok {
+		attempts += p.MaxRetries
+	}
+
+	// a body left on the connection can be read only once, it is streamed
+	// upstream unless a retry may have to send it again
+	body := req.Body
+	var bodyStream io.Reader
+	if req.BodyPending() {
+		if attempts == 1 {
+			bodyStream = req.BodyReader()
+		} else {
+			var err error
+			if body, err = io.ReadAll(req.BodyReader()); err != nil {
+				slog.Warn("ProxyRequestBody", "error", err)
+				writeError(w, response.StatusCodeBadRequest)
+				return
+			}
+		}
+	}
+
+	tried := map[*Backend]bool{}
+	for attempt := range attempts {
+		backend, err := route.Pool.pick(req, tried)
+		if err != nil {
+			break
+		}
+		tried[backend] = true
+
+		resp, span, err := p.forward(backend, req, target, body, bodyStream)
+		if err != nil {
+			slog.Warn("ProxyUpstream", "backend", backend.URL.String(), "error", err)
+			route.Pool.reportFailure(backend)
+			span.RecordError(err)
+			span.End()
+			continue
+		}
+		span.SetAttribute("http.response.status_code", int(resp.StatusCode))
+		if resp.StatusCode >= 400 {
+			span.SetStatus(tracing.StatusError, "")
+		}
+
+		if isUpstreamFailure(resp.StatusCode) {
+			route.Pool.reportFailure(backend)
+			// the last answer is passed on when no other backend is left to try
+			if attempt < attempts-1 && len(route.Pool.healthy(tried)) > 0 {
+				slog.Warn("ProxyUpstream", "backend", backend.URL.String(), "status", resp.StatusCode)
+				resp.Body.Close()
+				backend.active.Add(-1)
+				span.End()
+				continue
+			}
+		} else {
+			backend.reportSuccess()
+		}
+		err = copyResponse(w, resp)
+		resp.Body.Close()
+		backend.active.Add(-1)
+		span.End()
+		if err != nil {
+			slog.Error("ProxyCopy", "backend", backend.URL.String(), "error", err)
+		}
+		return
+	}
+
+	if len(tried) == 0 {
+		writeError(w, response.StatusCodeServiceUnavailable)
+		return
+	}
+	writeError(w, response.StatusCodeBadGateway)
+}
+
+func isUpstreamFailure(statusCode response.StatusCode) bool {
+	return statusCode == response.StatusCodeBadGateway ||
+		statusCode == response.StatusCodeServiceUnavailable ||
+		statusCode == response.StatusCodeGatewayTimeout
+}
+
+// forward sends the request with body, or bodyStream when it is set, to the
+// backend. On success the caller owns the active connection counter and has
+// to decrement it. The span is always returned and the caller ends it.
+func (p *Proxy) forward(b *Backend, req *request.Request, target string, body []byte, bodyStream io.Reader) (*client.Response, *tracing.Span, error) {
+	upstream := p.Client
+	if upstream == nil {
+		upstream = client.DefaultClient
+	}
+
+	ctx := req.Context()
+	var span *tracing.Span
+	if p.Tracer != nil {
+		ctx, span = p.Tracer.Start(ctx, "proxy "+req.RequestLine.Method, tracing.SpanKindClient)
+		span.SetAttribute("http.request.method", req.RequestLine.Method)
+		span.SetAttribute("server.address", b.URL.Host)
+		span.SetAttribute("url.path", strings.Clone(target))
+	}
+
+	upstreamURL := strings.TrimSuffix(b.URL.String(), "/") + target
+	upstreamReq, err := client.NewRequest(req.RequestLine.Method, upstreamURL, body)
+	if err != nil {
+		return nil, span, err
+	}
+	for key, value := range req.Headers {
+		// the proxy already answered Expect when it read the body
+		if isHopByHop(key) || key == "host" || key == request.CONTENT_LENGTH_HEADER || key == "expect" {
+			continue
+		}
+		upstreamReq.Headers[key] = value
+	}
+	if bodyStream != nil {
+		upstreamReq.BodyStream = bodyStream
+		// a chunked body has no length and is sent on chunked again
+		if length, ok := req.Headers.Get(request.CONTENT_LENGTH_HEADER); ok {
+			upstreamReq.Headers[request.CONTENT_LENGTH_HEADER] = length
+		}
+	}
+	if host, ok := req.Headers.Get("host"); ok {
+		upstreamReq.Headers["x-forwarded-host"] = host
+	}
+	tracing.Inject(ctx, func(key, value string) {
+		upstreamReq.Headers[strings.ToLower(key)] = value
+	})
+
+	b.active.Add(1)
+	resp, err := upstream.Do(upstreamReq.WithContext(ctx))
+	if err != nil {
+		b.active.Add(-1)
+		return nil, span, err
+	}
+	return resp, span, nil
+}
+
+func isHopByHop(key string) bool {
+	key = strings.ToLower(key)
+	for _, h := range hopByHopHeaders {
+		if h == key {
+			return true
+		}
+	}
+	return false
+}
+
+func copyResponse(w *response.Writer, resp *client.Response) error {
+	header := headers.NewHeaders()
+	for key, value := range resp.Headers {
+		if isHopByHop(key) || key == request.CONTENT_LENGTH_HEADER || key == "set-cookie" {
+			continue
+		}
+		header[key] = value
+	}
+	// Expires has a comma in it, so cookies come from the unfolded lines
+	for _, value := range resp.SetCookies {
+		c, err := cookie.ParseSetCookie(value)
+		if err == nil {
+			err = w.SetCookie(c)
+		}
+		if err != nil {
+			slog.Warn("ProxyCookieDropped", "error", err)
+		}
+	}
+
+	// a body without a length is passed on chunked, 204 and 304 have none
+	bodyless := resp.StatusCode == response.StatusCodeNoContent || resp.StatusCode == response.StatusCodeNotModified
+	contentLength, hasLength := resp.Headers.Get(request.CONTENT_LENGTH_HEADER)
+	chunked := !bodyless && !hasLength
+	if chunked {
+		header["transfer-encoding"] = "chunked"
+	} else if hasLength {
+		header[request.CONTENT_LENGTH_HEADER] = contentLength
+	}
+
+	if err := w.WriteStatusLine(resp.StatusCode); err != nil {
+		return err
+	}
+	if err := w.WriteHeaders(header); err != nil {
+		return err
+	}
+
+	if !chunked {
+		_, err := io.Copy(bodyWriter{w}, resp.Body)
+		return err
+	}
+
+	buffer := make([]byte, 32*1024)
+	for {
+		bytesRead, err := resp.Body.Read(buffer)
+		if bytesRead > 0 {
+			if _, werr := w.WriteChunkedBody(buffer[:bytesRead]); werr != nil {
+				return werr
+			}
+			// upstream may be streaming, pass each chunk on right away
+			if werr := w.Flush(); werr != nil {
+				return werr
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			_, err = w.WriteChunkedBodyDone()
+			return err
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// bodyWriter goes through WriteBody, so the copy lands behind the buffered headers
+type bodyWriter struct {
+	w *response.Writer
+}
+
+func (bw bodyWriter) Write(p []byte) (int, error) {
+	return bw.w.WriteBody(p)
+}
+
+func writeError(w *response.Writer, statusCode response.StatusCode) {
+	body := response.ReasonStatusLineMap[statusCode]
+	header := headers.NewHeaders()
+	header["content-type"] = "text/plain"
+	header[request.CONTENT_LENGTH_HEADER] = fmt.Sprint(len(body))
+	w.WriteStatusLine(statusCode)
+	w.WriteHeaders(header)
+	w.WriteBody([]byte(body))
+}
@@ -0,0 +1,346 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/servertest"
+	"httpfromtcp/internal/tracing"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestBackend(name string, hits *atomic.Int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		hits.Add(1)
+		fmt.Fprintf(w, "%s %s", name, r.URL.Path)
+	}))
+}
+
+func newTestRequest(method, target string) *request.Request {
+	return &request.Request{
+		RequestLine: request.RequestLine{
+			HTTPVersion:   "1.1",
+			RequestTarget: target,
+			Method:        method,
+		},
+		Headers: headers.NewHeaders(),
+	}
+}
+
+func TestBalancers(t *testing.T) {
+	a, _ := NewBackend("http://a.local")
+	b, _ := NewBackend("http://b.local")
+	c, _ := NewBackend("http://c.local")
+	backends := []*Backend{a, b, c}
+
+	// TEST: Round robin cycles through backends
+	rr := &RoundRobin{}
+	assert.Equal(t, a, rr.Next(backends, nil))
+	assert.Equal(t, b, rr.Next(backends, nil))
+	assert.Equal(t, c, rr.Next(backends, nil))
+	assert.Equal(t, a, rr.Next(backends, nil))
+
+	// TEST: Least connections picks the idlest backend
+	a.active.Store(5)
+	b.active.Store(1)
+	c.active.Store(3)
+	assert.Equal(t, b, LeastConnections{}.Next(backends, nil))
+
+	// TEST: Consistent hash is sticky per header value
+	ch := &ConsistentHash{Header: "X-User"}
+	req := newTestRequest("GET", "/")
+	req.Headers.Add("X-User", "alice")
+	first := ch.Next(backends, req)
+	for range 10 {
+		assert.Equal(t, first, ch.Next(backends, req))
+	}
+
+	// TEST: Consistent hash ring is only built when the backend set changes
+	ring := ch.ring
+	ch.Next(backends, req)
+	assert.Same(t, &ring[0], &ch.ring[0])
+	ch.Next(backends[:2], req)
+	assert.Len(t, ch.ring, 2*defaultReplicas)
+
+	// TEST: Consistent hash keeps keys of remaining backends in place
+	var others []*Backend
+	for _, backend := range backends {
+		if backend != first {
+			others = append(others, backend)
+		}
+	}
+	moved := 0
+	for i := range 100 {
+		req := newTestRequest("GET", "/")
+		req.Headers.Add("X-User", fmt.Sprint("user", i))
+		before := ch.Next(backends, req)
+		after := ch.Next(others, req)
+		if before != first && before != after {
+			moved++
+		}
+	}
+	assert.Equal(t, 0, moved)
+}
+
+func TestProxy(t *testing.T) {
+	var hitsA, hitsB atomic.Int32
+	serverA := newTestBackend("a", &hitsA)
+	defer serverA.Close()
+	serverB := newTestBackend("b", &hitsB)
+	defer serverB.Close()
+
+	// TEST: Requests are spread and prefix is stripped
+	pool, err := NewPool(&RoundRobin{}, serverA.URL, serverB.URL)
+	require.NoError(t, err)
+	p := &Proxy{Routes: []Route{{Prefix: "/api", Pool: pool, StripPrefix: true}}}
+	for range 4 {
+		buf := &bytes.Buffer{}
+		p.Handler(&response.Writer{Writer: buf}, newTestRequest("GET", "/api/users"))
+		assert.True(t, strings.HasPrefix(buf.String(), "HTTP/1.1 200 OK\r\n"))
+		assert.Contains(t, buf.String(), " /users")
+	}
+	assert.Equal(t, int32(2), hitsA.Load())
+	assert.Equal(t, int32(2), hitsB.Load())
+
+	// TEST: Unknown route
+	buf := &bytes.Buffer{}
+	p.Handler(&response.Writer{Writer: buf}, newTestRequest("GET", "/other"))
+	assert.True(t, strings.HasPrefix(buf.String(), "HTTP/1.1 404 Not Found\r\n"))
+
+	// TEST: Idempotent request is retried on another backend and dead one is ejected
+	deadServer := httptest.NewServer(http.NotFoundHandler())
+	deadURL := deadServer.URL
+	deadServer.Close()
+	pool, err = NewPool(&RoundRobin{}, deadURL, serverA.URL)
+	require.NoError(t, err)
+	pool.MaxFailures = 1
+	p = &Proxy{Routes: []Route{{Prefix: "/", Pool: pool}}, MaxRetries: 1}
+	buf = &bytes.Buffer{}
+	p.Handler(&response.Writer{Writer: buf}, newTestRequest("GET", "/retry"))
+	assert.True(t, strings.HasPrefix(buf.String(), "HTTP/1.1 200 OK\r\n"))
+	assert.Contains(t, buf.String(), "a /retry")
+	assert.False(t, pool.Backends[0].Healthy())
+
+	// TEST: Non idempotent request is not retried
+	pool, err = NewPool(&RoundRobin{}, deadURL, serverA.URL)
+	require.NoError(t, err)
+	p = &Proxy{Routes: []Route{{Prefix: "/", Pool: pool}}, MaxRetries: 1}
+	buf = &bytes.Buffer{}
+	p.Handler(&response.Writer{Writer: buf}, newTestRequest("POST", "/retry"))
+	assert.True(t, strings.HasPrefix(buf.String(), "HTTP/1.1 502 Bad Gateway\r\n"))
+
+	// TEST: Idempotent request is retried when the upstream answers 503
+	unavailable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer unavailable.Close()
+	pool, err = NewPool(&RoundRobin{}, unavailable.URL, serverA.URL)
+	require.NoError(t, err)
+	p = &Proxy{Routes: []Route{{Prefix: "/", Pool: pool}}, MaxRetries: 1}
+	buf = &bytes.Buffer{}
+	p.Handler(&response.Writer{Writer: buf}, newTestRequest("GET", "/unavailable"))
+	assert.True(t, strings.HasPrefix(buf.String(), "HTTP/1.1 200 OK\r\n"))
+
+	// TEST: Upstream 503 is passed on when there is nothing left to try
+	pool, err = NewPool(&RoundRobin{}, unavailable.URL)
+	require.NoError(t, err)
+	p = &Proxy{Routes: []Route{{Prefix: "/", Pool: pool}}, MaxRetries: 1}
+	buf = &bytes.Buffer{}
+	p.Handler(&response.Writer{Writer: buf}, newTestRequest("GET", "/unavailable"))
+	assert.True(t, strings.HasPrefix(buf.String(), "HTTP/1.1 503 Service Unavailable\r\n"))
+
+	// TEST: No healthy backends
+	pool, err = NewPool(&RoundRobin{}, deadURL)
+	require.NoError(t, err)
+	pool.Backends[0].markUnhealthy(time.Minute)
+	p = &Proxy{Routes: []Route{{Prefix: "/", Pool: pool}}}
+	buf = &bytes.Buffer{}
+	p.Handler(&response.Writer{Writer: buf}, newTestRequest("GET", "/"))
+	assert.True(t, strings.HasPrefix(buf.String(), "HTTP/1.1 503 Service Unavailable\r\n"))
+}
+
+func TestSetCookiePassthrough(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Set-Cookie", "a=1; Expires=Wed, 21 Oct 2026 07:28:00 GMT")
+		w.Header().Add("Set-Cookie", "b=2; Path=/; HttpOnly")
+		fmt.Fprint(w, "ok")
+	}))
+	defer backend.Close()
+
+	// TEST: Each upstream cookie keeps its own Set-Cookie line
+	pool, err := NewPool(nil, backend.URL)
+	require.NoError(t, err)
+	p := &Proxy{Routes: []Route{{Prefix: "/", Pool: pool}}}
+	buf := &bytes.Buffer{}
+	p.Handler(&response.Writer{Writer: buf}, newTestRequest("GET", "/"))
+	assert.Contains(t, buf.String(), "\r\nSet-Cookie: a=1; Expires=Wed, 21 Oct 2026 07:28:00 GMT\r\n")
+	assert.Contains(t, buf.String(), "\r\nSet-Cookie: b=2; Path=/; HttpOnly\r\n")
+}
+
+func TestDeferredBody(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "%d %q %s", r.ContentLength, r.Header.Get("Expect"), body)
+	}))
+	defer backend.Close()
+
+	pool, err := NewPool(nil, backend.URL)
+	require.NoError(t, err)
+	p := &Proxy{Routes: []Route{{Prefix: "/", Pool: pool}}}
+	ts := servertest.NewServer(p.Handler)
+	defer ts.Close()
+
+	send := func(head, body string) string {
+		conn, err := ts.Dial()
+		require.NoError(t, err)
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		_, err = io.WriteString(conn, head)
+		require.NoError(t, err)
+		line, err := reader.ReadString('\n')
+		require.NoError(t, err)
+		require.Equal(t, "HTTP/1.1 100 Continue\r\n", line)
+		_, err = reader.ReadString('\n')
+		require.NoError(t, err)
+		_, err = io.WriteString(conn, body)
+		require.NoError(t, err)
+		resp, err := response.NewParser(reader).ReadResponse("POST")
+		require.NoError(t, err)
+		return string(resp.Body)
+	}
+
+	// TEST: Body held back for 100-continue reaches the backend with its length
+	got := send("POST /upload HTTP/1.1\r\nHost: proxy\r\nExpect: 100-continue\r\nContent-Length: 5\r\n\r\n", "hello")
+	assert.Equal(t, `5 "" hello`, got)
+
+	// TEST: Chunked body held back for 100-continue is streamed on chunked
+	got = send("POST /upload HTTP/1.1\r\nHost: proxy\r\nExpect: 100-continue\r\nTransfer-Encoding: chunked\r\n\r\n",
+		"5\r\nhello\r\n6\r\n world\r\n0\r\n\r\n")
+	assert.Equal(t, `-1 "" hello world`, got)
+}
+
+func TestHealthChecks(t *testing.T) {
+	var healthy atomic.Bool
+	healthy.Store(true)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	pool, err := NewPool(nil, server.URL)
+	require.NoError(t, err)
+	pool.HealthCheck = HealthCheck{Path: "/health", Interval: time.Hour}
+
+	// TEST: Failing probe marks backend unhealthy
+	healthy.Store(false)
+	pool.CheckNow()
+	assert.False(t, pool.Backends[0].Healthy())
+
+	// TEST: Successful probe brings it back
+	healthy.Store(true)
+	pool.CheckNow()
+	assert.True(t, pool.Backends[0].Healthy())
+
+	// TEST: Passive ejection expires without active checks
+	pool.HealthCheck = HealthCheck{}
+	pool.MaxFailures = 2
+	pool.EjectFor = 10 * time.Millisecond
+	pool.reportFailure(pool.Backends[0])
+	assert.True(t, pool.Backends[0].Healthy())
+	pool.reportFailure(pool.Backends[0])
+	assert.False(t, pool.Backends[0].Healthy())
+	time.Sleep(20 * time.Millisecond)
+	assert.True(t, pool.Backends[0].Healthy())
+
+	// TEST: Background checker stops
+	pool.HealthCheck = HealthCheck{Path: "/health", Interval: 5 * time.Millisecond}
+	pool.StartHealthChecks()
+	pool.Stop()
+}
+
+type spanRecorder struct {
+	mu    sync.Mutex
+	spans []*tracing.SpanData
+}
+
+func (sr *spanRecorder) Export(spans []*tracing.SpanData) error {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	sr.spans = append(sr.spans, spans...)
+	return nil
+}
+
+func TestTracing(t *testing.T) {
+	traceparents := make(chan string, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparents <- r.Header.Get("Traceparent")
+		fmt.Fprint(w, "ok")
+	}))
+	defer backend.Close()
+
+	pool, err := NewPool(nil, backend.URL)
+	require.NoError(t, err)
+	recorder := &spanRecorder{}
+	tracer := tracing.NewTracer(recorder)
+	tracer.BatchSize = 1
+	p := &Proxy{Routes: []Route{{Prefix: "/", Pool: pool}}, Tracer: tracer}
+
+	// TEST: Upstream call gets a client span that is passed on
+	ctx, serverSpan := tracer.Start(context.Background(), "GET /", tracing.SpanKindServer)
+	buf := &bytes.Buffer{}
+	p.Handler(&response.Writer{Writer: buf}, newTestRequest("GET", "/items").WithContext(ctx))
+	serverSpan.End()
+	tracer.Flush()
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\nok"), buf.String())
+
+	require.Len(t, recorder.spans, 2)
+	clientSpan := recorder.spans[0]
+	assert.Equal(t, tracing.SpanKindClient, clientSpan.Kind)
+	assert.Equal(t, serverSpan.SpanContext().SpanID, clientSpan.Parent)
+	assert.Equal(t, 200, clientSpan.Attributes["http.response.status_code"])
+	assert.Equal(t, clientSpan.SpanContext.Traceparent(), <-traceparents)
+
+	// TEST: Without a tracer the incoming context is still propagated
+	p.Tracer = nil
+	p.Handler(&response.Writer{Writer: &bytes.Buffer{}}, newTestRequest("GET", "/items").WithContext(ctx))
+	assert.Equal(t, serverSpan.SpanContext().Traceparent(), <-traceparents)
+
+	// TEST: Path attribute survives the request going back to the pool
+	p.Tracer = tracer
+	recorder.mu.Lock()
+	recorder.spans = nil
+	recorder.mu.Unlock()
+	for _, path := range []string{"/aaaa", "/bbbb"} {
+		req := request.AcquireRequest()
+		raw := "GET " + path + " HTTP/1.1\r\nHost: localhost\r\n\r\n"
+		require.NoError(t, request.NewParser(strings.NewReader(raw)).ReadRequestHeadInto(req))
+		p.Handler(&response.Writer{Writer: &bytes.Buffer{}}, req)
+		request.ReleaseRequest(req)
+		<-traceparents
+	}
+	tracer.Flush()
+	require.Len(t, recorder.spans, 2)
+	assert.Equal(t, "/aaaa", recorder.spans[0].Attributes["url.path"])
+}
@@ -0,0 +1,97 @@
+package ratelimit
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultMaxKeys bounds how many clients a limiter tracks
+const DefaultMaxKeys = 10000
+
+type entry[T any] struct {
+	key   string
+	state T
+}
+
+// keyTable keeps per key state in LRU order, once it is full the client
+// seen least recently is forgotten, which at worst gives it a fresh limit
+type keyTable[T any] struct {
+	mu      sync.Mutex
+	maxKeys int
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+func newKeyTable[T any](maxKeys int) *keyTable[T] {
+	if maxKeys <= 0 {
+		maxKeys = DefaultMaxKeys
+	}
+	return &keyTable[T]{
+		maxKeys: maxKeys,
+		order:   list.New(),
+		entries: map[string]*list.Element{},
+	}
+}
+
+// update runs fn on the state for key with the table locked, init makes
+// the state for keys not seen before
+func (kt *keyTable[T]) update(key string, init func() T, fn func(state *T)) {
+	kt.mu.Lock()
+	defer kt.mu.Unlock()
+
+	element, ok := kt.entries[key]
+	if ok {
+		kt.order.MoveToFront(element)
+	} else {
+		key = strings.Clone(key)
+		element = kt.order.PushFront(&entry[T]{key: key, state: init()})
+		kt.entries[key] = element
+		for kt.order.Len() > kt.maxKeys {
+			oldest := kt.order.Back()
+			kt.order.Remove(oldest)
+			delete(kt.entries, oldest.Value.(*entry[T]).key)
+		}
+	}
+	fn(&element.Value.(*entry[T]).state)
+}
+
+// evictIdle drops keys whose state idle reports as unused since before now
+func (kt *keyTable[T]) evictIdle(idle func(state *T) bool) int {
+	kt.mu.Lock()
+	defer kt.mu.Unlock()
+	removed := 0
+	for element := kt.order.Back(); element != nil; {
+		previous := element.Prev()
+		e := element.Value.(*entry[T])
+		if idle(&e.state) {
+			kt.order.Remove(element)
+			delete(kt.entries, e.key)
+			removed++
+		}
+		element = previous
+	}
+	return removed
+}
+
+func (kt *keyTable[T]) len() int {
+	kt.mu.Lock()
+	defer kt.mu.Unlock()
+	return kt.order.Len()
+}
+
+func startEviction(interval time.Duration, stop <-chan struct{}, evict func()) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				evict()
+			}
+		}
+	}()
+}
@@ -0,0 +1,187 @@
+package ratelimit
+
+import (
+	"math"
+	"time"
+)
+
+// Decision is the outcome of one request against a limiter
+type Decision struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// Reset is how long until the client has its full quota again
+	Reset time.Duration
+	// RetryAfter is how long a refused client should wait
+	RetryAfter time.Duration
+}
+
+type Limiter interface {
+	Allow(key string) Decision
+}
+
+// denyAll refuses without counting, waiting a period changes nothing but
+// it keeps clients from retrying right away
+func denyAll(period time.Duration) Decision {
+	return Decision{Reset: period, RetryAfter: period}
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// TokenBucket allows Burst requests at once and refills at Limit per Period,
+// a Limit of 0 or less refuses every request
+type TokenBucket struct {
+	Limit  int
+	Period time.Duration
+	Burst  int
+
+	keys *keyTable[bucket]
+	now  func() time.Time
+}
+
+func NewTokenBucket(limit int, period time.Duration, burst int, maxKeys int) *TokenBucket {
+	if burst <= 0 {
+		burst = limit
+	}
+	return &TokenBucket{
+		Limit:  limit,
+		Period: period,
+		Burst:  burst,
+		keys:   newKeyTable[bucket](maxKeys),
+		now:    time.Now,
+	}
+}
+
+// perToken is the time it takes to refill one token
+func (tb *TokenBucket) perToken() time.Duration {
+	return tb.Period / time.Duration(tb.Limit)
+}
+
+func (tb *TokenBucket) Allow(key string) Decision {
+	if tb.Limit <= 0 {
+		return denyAll(tb.Period)
+	}
+	now := tb.now()
+	decision := Decision{Limit: tb.Burst}
+	tb.keys.update(key, func() bucket {
+		return bucket{tokens: float64(tb.Burst), last: now}
+	}, func(b *bucket) {
+		elapsed := now.Sub(b.last)
+		b.tokens = math.Min(float64(tb.Burst), b.tokens+float64(elapsed)/float64(tb.perToken()))
+		b.last = now
+
+		if b.tokens >= 1 {
+			b.tokens--
+			decision.Allowed = true
+		} else {
+			decision.RetryAfter = time.Duration((1 - b.tokens) * float64(tb.perToken()))
+		}
+		decision.Remaining = int(b.tokens)
+		decision.Reset = time.Duration((float64(tb.Burst) - b.tokens) * float64(tb.perToken()))
+	})
+	return decision
+}
+
+// StartEviction forgets buckets that have been full for a while, until stop is closed
+func (tb *TokenBucket) StartEviction(interval time.Duration, stop <-chan struct{}) {
+	startEviction(interval, stop, func() {
+		if tb.Limit <= 0 {
+			return
+		}
+		now := tb.now()
+		full := time.Duration(tb.Burst) * tb.perToken()
+		tb.keys.evictIdle(func(b *bucket) bool { return now.Sub(b.last) > full })
+	})
+}
+
+type window struct {
+	start    time.Time
+	current  int
+	previous int
+}
+
+// SlidingWindow allows Limit requests in any Window, it weights the count of
+// the previous fixed window by how much of it still overlaps. A Limit of 0
+// or less refuses every request.
+type SlidingWindow struct {
+	Limit  int
+	Window time.Duration
+
+	keys *keyTable[window]
+	now  func() time.Time
+}
+
+func NewSlidingWindow(limit int, w time.Duration, maxKeys int) *SlidingWindow {
+	return &SlidingWindow{
+		Limit:  limit,
+		Window: w,
+		keys:   newKeyTable[window](maxKeys),
+		now:    time.Now,
+	}
+}
+
+func (sw *SlidingWindow) Allow(key string) Decision {
+	if sw.Limit <= 0 {
+		return denyAll(sw.Window)
+	}
+	now := sw.now()
+	windowStart := now.Truncate(sw.Window)
+	decision := Decision{Limit: sw.Limit}
+	sw.keys.update(key, func() window {
+		return window{start: windowStart}
+	}, func(w *window) {
+		switch {
+		case windowStart.Equal(w.start):
+		case windowStart.Sub(w.start) == sw.Window:
+			w.previous, w.current = w.current, 0
+			w.start = windowStart
+		default:
+			w.previous, w.current = 0, 0
+			w.start = windowStart
+		}
+
+		elapsed := now.Sub(w.start)
+		overlap := 1 - float64(elapsed)/float64(sw.Window)
+		estimate := float64(w.previous)*overlap + float64(w.current)
+
+		if estimate+1 <= float64(sw.Limit) {
+			w.current++
+			estimate++
+			decision.Allowed = true
+		} else {
+			decision.RetryAfter = sw.retryAfter(w, elapsed)
+		}
+		decision.Remaining = max(0, sw.Limit-int(math.Ceil(estimate)))
+		decision.Reset = sw.Window - elapsed
+		if w.current > 0 {
+			// the current count only stops mattering a window later
+			decision.Reset += sw.Window
+		}
+	})
+	return decision
+}
+
+// retryAfter is when the estimate first leaves room for one more request
+func (sw *SlidingWindow) retryAfter(w *window, elapsed time.Duration) time.Duration {
+	remaining := sw.Window - elapsed
+	if w.current+1 > sw.Limit {
+		// wait for the next window, where current becomes the weighted part
+		room := float64(sw.Limit - 1)
+		overlapNeeded := room / float64(w.current)
+		return remaining + time.Duration((1-overlapNeeded)*float64(sw.Window))
+	}
+	room := float64(sw.Limit - w.current - 1)
+	overlapNeeded := room / float64(w.previous)
+	return time.Duration((1-overlapNeeded)*float64(sw.Window)) - elapsed
+}
+
+// StartEviction forgets clients with nothing left in either window, until stop is closed
+func (sw *SlidingWindow) StartEviction(interval time.Duration, stop <-chan struct{}) {
+	startEviction(interval, stop, func() {
+		now := sw.now()
+		sw.keys.evictIdle(func(w *window) bool { return now.Sub(w.start) >= 2*sw.Window })
+	})
+}
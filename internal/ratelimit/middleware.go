@@ -0,0 +1,93 @@
+package ratelimit
+
+import (
+	"httpfromtcp/internal/auth"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+	"math"
+	"net"
+	"strconv"
+	"time"
+)
+
+// KeyFunc picks the key a request is counted under, requests without one
+// are not limited
+type KeyFunc func(req *request.Request) (string, bool)
+
+func ByRemoteIP() KeyFunc {
+	return func(req *request.Request) (string, bool) {
+		host, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			return req.RemoteAddr, req.RemoteAddr != ""
+		}
+		return host, true
+	}
+}
+
+// ByClientIP keys on the address resolved through trusted proxies, use it
+// instead of ByRemoteIP when the server sits behind a load balancer
+func ByClientIP() KeyFunc {
+	byRemoteIP := ByRemoteIP()
+	return func(req *request.Request) (string, bool) {
+		if req.ClientIP != "" {
+			return req.ClientIP, true
+		}
+		return byRemoteIP(req)
+	}
+}
+
+func ByHeader(name string) KeyFunc {
+	return func(req *request.Request) (string, bool) {
+		value, ok := req.Headers.Get(name)
+		return value, ok && value != ""
+	}
+}
+
+// ByPrincipal keys on the identity set by the auth middleware, which has to
+// run before the limiter
+func ByPrincipal() KeyFunc {
+	return func(req *request.Request) (string, bool) {
+		principal := auth.FromRequest(req)
+		if principal == nil || principal.Name == "" {
+			return "", false
+		}
+		return principal.Scheme + ":" + principal.Name, true
+	}
+}
+
+type Middleware struct {
+	Limiter Limiter
+	Key     KeyFunc
+}
+
+func (m *Middleware) Middleware(next server.Handler) server.Handler {
+	return func(w *response.Writer, req *request.Request) {
+		key, ok := m.Key(req)
+		if !ok {
+			next(w, req)
+			return
+		}
+
+		decision := m.Limiter.Allow(key)
+		w.AddHeader("RateLimit-Limit", strconv.Itoa(decision.Limit))
+		w.AddHeader("RateLimit-Remaining", strconv.Itoa(decision.Remaining))
+		w.AddHeader("RateLimit-Reset", seconds(decision.Reset))
+		if decision.Allowed {
+			next(w, req)
+			return
+		}
+
+		body := []byte(response.ReasonStatusLineMap[response.StatusCodeTooManyRequests] + "\n")
+		h := response.GetDefaultHeaders(len(body))
+		h["Retry-After"] = seconds(decision.RetryAfter)
+		w.WriteStatusLine(response.StatusCodeTooManyRequests)
+		w.WriteHeaders(h)
+		w.WriteBody(body)
+	}
+}
+
+// seconds rounds up, telling a client to come back too early just gets it refused again
+func seconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
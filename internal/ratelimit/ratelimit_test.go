@@ -0,0 +1,194 @@
+package ratelimit
+
+import (
+	"bytes"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+	"httpfromtcp/internal/servertest"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeClock struct{ now time.Time }
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) Advance(d time.Duration) { c.now = c.now.Add(d) }
+
+func newClock() *fakeClock {
+	return &fakeClock{now: time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func TestTokenBucket(t *testing.T) {
+	clock := newClock()
+	tb := NewTokenBucket(1, time.Second, 3, 0)
+	tb.now = clock.Now
+
+	// TEST: Burst then refused
+	for i := range 3 {
+		decision := tb.Allow("a")
+		assert.True(t, decision.Allowed)
+		assert.Equal(t, 2-i, decision.Remaining)
+	}
+	decision := tb.Allow("a")
+	assert.False(t, decision.Allowed)
+	assert.Equal(t, time.Second, decision.RetryAfter)
+	assert.Equal(t, 3*time.Second, decision.Reset)
+
+	// TEST: Keys are independent
+	assert.True(t, tb.Allow("b").Allowed)
+
+	// TEST: Refill
+	clock.Advance(time.Second)
+	assert.True(t, tb.Allow("a").Allowed)
+	assert.False(t, tb.Allow("a").Allowed)
+}
+
+func TestSlidingWindow(t *testing.T) {
+	clock := newClock()
+	sw := NewSlidingWindow(4, time.Minute, 0)
+	sw.now = clock.Now
+
+	// TEST: Limit within a window
+	for range 4 {
+		assert.True(t, sw.Allow("a").Allowed)
+	}
+	decision := sw.Allow("a")
+	assert.False(t, decision.Allowed)
+	assert.Equal(t, 0, decision.Remaining)
+	// 4 in the previous window only allow a fifth once a quarter of them has slid out
+	assert.Equal(t, 75*time.Second, decision.RetryAfter)
+
+	// TEST: Previous window still counts while it overlaps
+	clock.Advance(75 * time.Second)
+	assert.True(t, sw.Allow("a").Allowed)
+	assert.False(t, sw.Allow("a").Allowed)
+
+	// TEST: A window without requests resets the count
+	clock.Advance(3 * time.Minute)
+	for range 4 {
+		assert.True(t, sw.Allow("a").Allowed)
+	}
+}
+
+func TestZeroLimit(t *testing.T) {
+	clock := newClock()
+
+	// TEST: A limit of 0 refuses everything without dividing by it
+	tb := NewTokenBucket(0, time.Second, 0, 0)
+	tb.now = clock.Now
+	decision := tb.Allow("a")
+	assert.False(t, decision.Allowed)
+	assert.Equal(t, time.Second, decision.RetryAfter)
+	assert.Equal(t, 0, tb.keys.len())
+
+	sw := NewSlidingWindow(0, time.Minute, 0)
+	sw.now = clock.Now
+	decision = sw.Allow("a")
+	assert.False(t, decision.Allowed)
+	assert.Equal(t, time.Minute, decision.RetryAfter)
+
+	// TEST: A limit of 1 gives a finite retry
+	sw = NewSlidingWindow(1, time.Minute, 0)
+	sw.now = clock.Now
+	assert.True(t, sw.Allow("a").Allowed)
+	decision = sw.Allow("a")
+	assert.False(t, decision.Allowed)
+	assert.Equal(t, 2*time.Minute, decision.RetryAfter)
+}
+
+func TestKeyEviction(t *testing.T) {
+	clock := newClock()
+	tb := NewTokenBucket(1, time.Minute, 1, 2)
+	tb.now = clock.Now
+
+	// TEST: Least recently used key is dropped when full
+	tb.Allow("a")
+	tb.Allow("b")
+	tb.Allow("a")
+	tb.Allow("c")
+	assert.Equal(t, 2, tb.keys.len())
+	assert.True(t, tb.Allow("b").Allowed, "b was forgotten and starts over")
+	assert.False(t, tb.Allow("c").Allowed)
+
+	// TEST: Idle keys are evicted
+	clock.Advance(2 * time.Minute)
+	removed := tb.keys.evictIdle(func(b *bucket) bool { return clock.Now().Sub(b.last) > time.Minute })
+	assert.Equal(t, 2, removed)
+}
+
+func TestMiddleware(t *testing.T) {
+	clock := newClock()
+	tb := NewTokenBucket(1, time.Second, 2, 0)
+	tb.now = clock.Now
+	m := &Middleware{Limiter: tb, Key: ByRemoteIP()}
+
+	serve := func(remoteAddr string) *response.Response {
+		req, err := request.RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+		require.NoError(t, err)
+		req.RemoteAddr = remoteAddr
+		out := &bytes.Buffer{}
+		m.Middleware(func(w *response.Writer, req *request.Request) {
+			w.WriteStatusLine(response.StatusCodeOk)
+			w.WriteHeaders(response.GetDefaultHeaders(0))
+		})(&response.Writer{Writer: out}, req)
+		resp, err := response.ResponseFromReader(out)
+		require.NoError(t, err)
+		return resp
+	}
+
+	// TEST: Allowed responses carry RateLimit headers
+	resp := serve("10.0.0.1:5000")
+	assert.Equal(t, response.StatusCodeOk, resp.StatusLine.StatusCode)
+	remaining, _ := resp.Headers.Get("ratelimit-remaining")
+	assert.Equal(t, "1", remaining)
+
+	// TEST: Same IP on another port shares the limit
+	serve("10.0.0.1:5001")
+	resp = serve("10.0.0.1:5002")
+	assert.Equal(t, response.StatusCodeTooManyRequests, resp.StatusLine.StatusCode)
+	retryAfter, _ := resp.Headers.Get("retry-after")
+	assert.Equal(t, "1", retryAfter)
+	limit, _ := resp.Headers.Get("ratelimit-limit")
+	assert.Equal(t, "2", limit)
+
+	// TEST: Other clients are unaffected
+	resp = serve("10.0.0.2:5000")
+	assert.Equal(t, response.StatusCodeOk, resp.StatusLine.StatusCode)
+}
+
+func TestPooledRequests(t *testing.T) {
+	tb := NewTokenBucket(100, time.Second, 0, 0)
+	limiter := &Middleware{Limiter: tb, Key: ByHeader("X-Client")}
+	h := limiter.Middleware(func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.StatusCodeOk)
+		w.WriteHeaders(response.GetDefaultHeaders(0))
+	})
+	srv := servertest.NewServer(h, server.WithRequestPooling())
+	defer srv.Close()
+
+	// the requests are the same length, so a reused buffer lines up exactly
+	send := func(key string) {
+		conn, err := srv.Dial()
+		require.NoError(t, err)
+		defer conn.Close()
+		io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\nX-Client: "+key+"\r\n\r\n")
+		_, err = response.ResponseFromReader(conn)
+		require.NoError(t, err)
+	}
+	send("aaaa")
+	send("bbbb")
+
+	// TEST: Keys survive the request going back to the pool
+	var keys []string
+	for element := tb.keys.order.Back(); element != nil; element = element.Prev() {
+		keys = append(keys, element.Value.(*entry[bucket]).key)
+	}
+	assert.Equal(t, []string{"aaaa", "bbbb"}, keys)
+}
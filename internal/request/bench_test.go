@@ -0,0 +1,69 @@
+package request
+
+import (
+	"bytes"
+	"testing"
+)
+
+var benchRequest = []byte("POST /api/v1/items?limit=10 HTTP/1.1\r\n" +
+	"Host: localhost:42069\r\n" +
+	"User-Agent: httpbench/1.0\r\n" +
+	"Accept: application/json\r\n" +
+	"Accept-Encoding: gzip, deflate\r\n" +
+	"Content-Type: application/json\r\n" +
+	"Content-Length: 27\r\n" +
+	"X-Request-Id: 5f0c8a2e-6c1b-4d8e-9a57-0b5d3c2e1f40\r\n" +
+	"\r\n" +
+	`{"name":"widget","qty":100}`)
+
+func BenchmarkRequestFromReader(b *testing.B) {
+	b.ReportAllocs()
+	b.SetBytes(int64(len(benchRequest)))
+	for b.Loop() {
+		if _, err := RequestFromReader(bytes.NewReader(benchRequest)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkParserPooled is the server's path: one parser per connection
+// reused, requests taken from and given back to the pool
+func BenchmarkParserPooled(b *testing.B) {
+	b.ReportAllocs()
+	b.SetBytes(int64(len(benchRequest)))
+	reader := bytes.NewReader(benchRequest)
+	parser := NewParser(reader)
+	for b.Loop() {
+		reader.Reset(benchRequest)
+		parser.Reset(reader)
+		req := AcquireRequest()
+		if err := parser.ReadRequestHeadInto(req); err != nil {
+			b.Fatal(err)
+		}
+		if err := parser.ReadBody(req); err != nil {
+			b.Fatal(err)
+		}
+		ReleaseRequest(req)
+	}
+}
+
+func BenchmarkParserPooledChunked(b *testing.B) {
+	chunkedRequest := []byte("POST /upload HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n" +
+		"10;part=1\r\n0123456789abcdef\r\n10\r\n0123456789abcdef\r\n0\r\nX-Checksum: 1234\r\n\r\n")
+	b.ReportAllocs()
+	b.SetBytes(int64(len(chunkedRequest)))
+	reader := bytes.NewReader(chunkedRequest)
+	parser := NewParser(reader)
+	for b.Loop() {
+		reader.Reset(chunkedRequest)
+		parser.Reset(reader)
+		req := AcquireRequest()
+		if err := parser.ReadRequestHeadInto(req); err != nil {
+			b.Fatal(err)
+		}
+		if err := parser.ReadBody(req); err != nil {
+			b.Fatal(err)
+		}
+		ReleaseRequest(req)
+	}
+}
@@ -0,0 +1,96 @@
+package request
+
+import (
+	"bytes"
+	"io"
+)
+
+// deferredBody is a body the server left on the connection, so a handler
+// can stream it instead of having it read into memory up front
+type deferredBody struct {
+	parser *Parser
+	// before runs ahead of the first read
+	before func() error
+	// reader is the copy of the request reading the body, the others look
+	// there to tell whether it was read
+	reader *Request
+}
+
+// DeferBody leaves the body of r on the connection until it is read with
+// ReadBody or BodyReader. before runs once ahead of the first read, the
+// server sends 100 Continue there.
+func (p *Parser) DeferBody(r *Request, before func() error) {
+	r.deferred = &deferredBody{parser: p, before: before}
+}
+
+func (d *deferredBody) begin() error {
+	before := d.before
+	d.before = nil
+	if before == nil {
+		return nil
+	}
+	return before()
+}
+
+// BodyBytes is how much of the body was read off the connection so far,
+// also when a copy made with WithContext is the one reading it
+func (r *Request) BodyBytes() int {
+	if d := r.deferred; d != nil && d.reader != nil {
+		r = d.reader
+	}
+	return r.bodyRead + len(r.Body)
+}
+
+// BodyReader streams the body. A body still on the connection is decoded as
+// it is read and only a read's worth of it is held at a time, ReadBody can't
+// be used after.
+func (r *Request) BodyReader() io.Reader {
+	d := r.deferred
+	if d == nil {
+		return bytes.NewReader(r.Body)
+	}
+	r.deferred = nil
+	d.reader = r
+	return &bodyReader{request: r, deferred: d}
+}
+
+type bodyReader struct {
+	request  *Request
+	deferred *deferredBody
+	// offset is how much of Body was handed out
+	offset int
+	err    error
+}
+
+func (br *bodyReader) Read(p []byte) (int, error) {
+	r := br.request
+	if br.offset == len(r.Body) {
+		if br.err != nil {
+			return 0, br.err
+		}
+		if err := br.deferred.begin(); err != nil {
+			br.err = err
+			return 0, err
+		}
+		// what was handed out is dropped, Body is refilled from the start
+		r.bodyRead += len(r.Body)
+		r.Body = r.Body[:0]
+		br.offset = 0
+		if r.bodyDone() {
+			return 0, io.EOF
+		}
+		err := br.deferred.parser.advance(r, func() bool {
+			return len(r.Body) > 0 || r.bodyDone()
+		})
+		if err != nil {
+			br.err = err
+			return 0, err
+		}
+		if len(r.Body) == 0 {
+			return 0, io.EOF
+		}
+	}
+	n := copy(p, r.Body[br.offset:])
+	br.offset += n
+	return n, nil
+}
@@ -0,0 +1,108 @@
+package request
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// TrustedProxies are the networks whose X-Forwarded-For and Forwarded
+// headers are believed, anybody else could put whatever they like there
+type TrustedProxies []netip.Prefix
+
+// ParseTrustedProxies takes CIDRs or single addresses
+func ParseTrustedProxies(networks ...string) (TrustedProxies, error) {
+	proxies := make(TrustedProxies, 0, len(networks))
+	for _, network := range networks {
+		if !strings.Contains(network, "/") {
+			addr, err := netip.ParseAddr(network)
+			if err != nil {
+				return nil, err
+			}
+			proxies = append(proxies, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(network)
+		if err != nil {
+			return nil, err
+		}
+		proxies = append(proxies, prefix.Masked())
+	}
+	return proxies, nil
+}
+
+func (tp TrustedProxies) Contains(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range tp {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP walks the forwarding chain from the nearest hop back while the
+// hops are trusted proxies, the first untrusted address is the client.
+// Forwarded is used over X-Forwarded-For when both are present.
+func (tp TrustedProxies) ClientIP(req *Request) string {
+	remote, ok := parseHop(req.RemoteAddr)
+	if !ok {
+		return req.RemoteAddr
+	}
+	if !tp.Contains(remote) {
+		return remote.String()
+	}
+
+	hops := forwardedFor(req)
+	client := remote
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, ok := parseHop(hops[i])
+		if !ok {
+			// unknown or obfuscated, nothing further back can be trusted
+			break
+		}
+		client = hop
+		if !tp.Contains(hop) {
+			break
+		}
+	}
+	return client.String()
+}
+
+func forwardedFor(req *Request) []string {
+	if forwarded, ok := req.Headers.Get("forwarded"); ok {
+		var hops []string
+		for _, element := range strings.Split(forwarded, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				name, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(name, "for") {
+					hops = append(hops, strings.Trim(value, `"`))
+				}
+			}
+		}
+		return hops
+	}
+
+	xff, ok := req.Headers.Get("x-forwarded-for")
+	if !ok {
+		return nil
+	}
+	hops := strings.Split(xff, ",")
+	for i := range hops {
+		hops[i] = strings.TrimSpace(hops[i])
+	}
+	return hops
+}
+
+// parseHop reads an address with or without a port, IPv6 may be bracketed
+func parseHop(hop string) (netip.Addr, bool) {
+	if host, _, err := net.SplitHostPort(hop); err == nil {
+		hop = host
+	}
+	hop = strings.TrimSuffix(strings.TrimPrefix(hop, "["), "]")
+	addr, err := netip.ParseAddr(hop)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
@@ -0,0 +1,53 @@
+package request
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientIP(t *testing.T) {
+	proxies, err := ParseTrustedProxies("10.0.0.0/8", "2001:db8::1")
+	require.NoError(t, err)
+
+	request := func(remoteAddr string, h map[string]string) *Request {
+		req := newRequest()
+		req.RemoteAddr = remoteAddr
+		for key, value := range h {
+			req.Headers.Add(key, value)
+		}
+		return &req
+	}
+
+	// TEST: Untrusted peer, forwarding headers are ignored
+	req := request("203.0.113.7:4000", map[string]string{"X-Forwarded-For": "1.2.3.4"})
+	assert.Equal(t, "203.0.113.7", proxies.ClientIP(req))
+
+	// TEST: X-Forwarded-For through two trusted proxies
+	req = request("10.0.0.1:4000", map[string]string{"X-Forwarded-For": "198.51.100.9, 10.1.1.1"})
+	assert.Equal(t, "198.51.100.9", proxies.ClientIP(req))
+
+	// TEST: Spoofed entries left of the first untrusted hop don't count
+	req = request("10.0.0.1:4000", map[string]string{"X-Forwarded-For": "6.6.6.6, 198.51.100.9"})
+	assert.Equal(t, "198.51.100.9", proxies.ClientIP(req))
+
+	// TEST: Forwarded wins over X-Forwarded-For
+	req = request("[2001:db8::1]:443", map[string]string{
+		"Forwarded":       `for="[2001:db8:cafe::17]:4711";proto=https, for=10.2.2.2`,
+		"X-Forwarded-For": "1.2.3.4",
+	})
+	assert.Equal(t, "2001:db8:cafe::17", proxies.ClientIP(req))
+
+	// TEST: Obfuscated identifier stops the walk
+	req = request("10.0.0.1:4000", map[string]string{"Forwarded": "for=_hidden, for=10.3.3.3"})
+	assert.Equal(t, "10.3.3.3", proxies.ClientIP(req))
+
+	// TEST: No trusted proxies
+	req = request("10.0.0.1:4000", map[string]string{"X-Forwarded-For": "1.2.3.4"})
+	assert.Equal(t, "10.0.0.1", TrustedProxies(nil).ClientIP(req))
+
+	// TEST: Bad proxy config
+	_, err = ParseTrustedProxies("10.0.0.0/33")
+	assert.Error(t, err)
+}
@@ -0,0 +1,97 @@
+package request
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"syscall"
+)
+
+// ErrMalformedRequest wraps every error caused by what the client sent, the
+// server answers those with 400 unless one of the errors below is wrapped too
+var ErrMalformedRequest = errors.New("malformed request")
+
+var (
+	ErrRequestLineTooLong          = errors.New("request line too long")
+	ErrHeadersTooLarge             = errors.New("request headers too large")
+	ErrBodyTooLarge                = errors.New("request body too large")
+	ErrUnsupportedTransferEncoding = errors.New("unsupported transfer coding")
+	ErrMethodNotImplemented        = errors.New("method not implemented")
+	ErrVersionNotSupported         = errors.New("http version not supported")
+)
+
+type IOErrorKind int
+
+const (
+	IOErrorOther IOErrorKind = iota
+	// IOErrorClientClosed is the client closing its end, Err is io.EOF when
+	// that happened between requests and io.ErrUnexpectedEOF within one
+	IOErrorClientClosed
+	IOErrorTimeout
+	IOErrorReset
+)
+
+func (k IOErrorKind) String() string {
+	switch k {
+	case IOErrorClientClosed:
+		return "client closed"
+	case IOErrorTimeout:
+		return "timeout"
+	case IOErrorReset:
+		return "connection reset"
+	default:
+		return "io error"
+	}
+}
+
+// IOError is a failed read from the connection
+type IOError struct {
+	Kind IOErrorKind
+	Err  error
+	// Idle is true when nothing of the next request had arrived yet
+	Idle bool
+}
+
+func (e *IOError) Error() string {
+	return e.Kind.String() + ": " + e.Err.Error()
+}
+
+func (e *IOError) Unwrap() error {
+	return e.Err
+}
+
+func (e *IOError) Timeout() bool {
+	return e.Kind == IOErrorTimeout
+}
+
+// Clean is true for a client closing between requests, which is how
+// connections normally end
+func (e *IOError) Clean() bool {
+	return e.Kind == IOErrorClientClosed && e.Err == io.EOF
+}
+
+func classifyReadError(err error, midRequest bool) *IOError {
+	ioErr := classifyError(err, midRequest)
+	ioErr.Idle = !midRequest
+	return ioErr
+}
+
+func classifyError(err error, midRequest bool) *IOError {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, io.EOF):
+		if midRequest {
+			return &IOError{Kind: IOErrorClientClosed, Err: io.ErrUnexpectedEOF}
+		}
+		return &IOError{Kind: IOErrorClientClosed, Err: io.EOF}
+	case errors.Is(err, os.ErrDeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return &IOError{Kind: IOErrorTimeout, Err: err}
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE), errors.Is(err, syscall.ECONNABORTED):
+		return &IOError{Kind: IOErrorReset, Err: err}
+	case errors.Is(err, net.ErrClosed):
+		return &IOError{Kind: IOErrorClientClosed, Err: err}
+	default:
+		return &IOError{Kind: IOErrorOther, Err: err}
+	}
+}
@@ -0,0 +1,121 @@
+package request
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"net/url"
+	"strings"
+)
+
+// Values maps a form field to all its values in the order they came
+type Values map[string][]string
+
+func (v Values) Get(key string) string {
+	if values := v[key]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+func (v Values) Add(key, value string) {
+	v[key] = append(v[key], value)
+}
+
+const DefaultMaxFormSize = 10 << 20
+
+var (
+	errFormTooLarge       = errors.New("form too large")
+	errNotForm            = errors.New("content-type is not application/x-www-form-urlencoded")
+	errMalformedFormValue = errors.New("malformed form value")
+)
+
+// ParseQuery decodes an application/x-www-form-urlencoded string
+func ParseQuery(query string) (Values, error) {
+	values := Values{}
+	for pair := range strings.SplitSeq(query, "&") {
+		if pair == "" {
+			continue
+		}
+		key, value, _ := strings.Cut(pair, "=")
+		key, err := url.QueryUnescape(key)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %q", errMalformedFormValue, pair)
+		}
+		value, err = url.QueryUnescape(value)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %q", errMalformedFormValue, pair)
+		}
+		values.Add(key, value)
+	}
+	return values, nil
+}
+
+// Path is the request target without the query string
+func (r *Request) Path() string {
+	path, _, _ := strings.Cut(r.RequestLine.RequestTarget, "?")
+	return path
+}
+
+func (r *Request) Query() (Values, error) {
+	_, query, _ := strings.Cut(r.RequestLine.RequestTarget, "?")
+	return ParseQuery(query)
+}
+
+func (r *Request) mediaType() (string, map[string]string) {
+	contentType, ok := r.Headers.Get("content-type")
+	if !ok {
+		return "", nil
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", nil
+	}
+	return mediaType, params
+}
+
+// PostForm decodes an urlencoded body, bodies over maxSize are rejected
+// and 0 means DefaultMaxFormSize
+func (r *Request) PostForm(maxSize int) (Values, error) {
+	if mediaType, _ := r.mediaType(); mediaType != "application/x-www-form-urlencoded" {
+		return nil, errNotForm
+	}
+	if maxSize <= 0 {
+		maxSize = DefaultMaxFormSize
+	}
+	if contentLength, ok := r.Headers.GetInt(CONTENT_LENGTH_HEADER); ok && contentLength > maxSize {
+		return nil, errFormTooLarge
+	}
+
+	body, err := r.ReadBody()
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxSize {
+		return nil, errFormTooLarge
+	}
+	return ParseQuery(string(body))
+}
+
+// Form merges the query string and an urlencoded body, body values come first
+func (r *Request) Form() (Values, error) {
+	form := Values{}
+	if mediaType, _ := r.mediaType(); mediaType == "application/x-www-form-urlencoded" {
+		postForm, err := r.PostForm(0)
+		if err != nil {
+			return nil, err
+		}
+		for key, values := range postForm {
+			form[key] = append(form[key], values...)
+		}
+	}
+
+	query, err := r.Query()
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range query {
+		form[key] = append(form[key], values...)
+	}
+	return form, nil
+}
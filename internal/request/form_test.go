@@ -0,0 +1,274 @@
+package request
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestForm(t *testing.T) {
+	// TEST: Urlencoded body and query string
+	reader := &chunkReader{
+		data: "POST /submit?page=2&tag=b HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Type: application/x-www-form-urlencoded\r\n" +
+			"Content-Length: 39\r\n" +
+			"\r\n" +
+			"name=J%C3%BCrgen+M&tag=a&empty=&flag&=x",
+		numBytesPerRead: 3,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	form, err := r.Form()
+	require.NoError(t, err)
+	assert.Equal(t, "Jürgen M", form.Get("name"))
+	assert.Equal(t, []string{"a", "b"}, form["tag"])
+	assert.Equal(t, "2", form.Get("page"))
+	assert.Equal(t, []string{""}, form["empty"])
+	assert.Equal(t, []string{""}, form["flag"])
+	assert.Equal(t, "/submit", r.Path())
+
+	// TEST: Body over the size limit
+	_, err = r.PostForm(10)
+	require.ErrorIs(t, err, errFormTooLarge)
+
+	// TEST: Malformed escape
+	_, err = ParseQuery("a=%zz")
+	require.Error(t, err)
+}
+
+const multipartBody = "preamble is ignored\r\n" +
+	"--XyZ\r\n" +
+	"Content-Disposition: form-data; name=\"title\"\r\n" +
+	"\r\n" +
+	"hello\r\nworld\r\n" +
+	"--XyZ\r\n" +
+	"Content-Disposition: form-data; name=\"upload\"; filename=\"a.txt\"\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"file contents with --XyZ inside\r\n" +
+	"--XyZ\r\n" +
+	"Content-Disposition: form-data; name=\"upload\"; filename=\"b.txt\"\r\n" +
+	"\r\n" +
+	"second file\r\n" +
+	"--XyZ--\r\n"
+
+func newMultipartRequest(body string) *Request {
+	r := newRequest()
+	r.Headers.Add("Content-Type", "multipart/form-data; boundary=XyZ")
+	r.Body = []byte(body)
+	r.ParserState = parserStateDone
+	return &r
+}
+
+func TestMultipart(t *testing.T) {
+	// TEST: Streaming part reader
+	mr, err := newMultipartRequest(multipartBody).MultipartReader()
+	require.NoError(t, err)
+	part, err := mr.NextPart()
+	require.NoError(t, err)
+	assert.Equal(t, "title", part.FormName())
+	data, err := io.ReadAll(part)
+	require.NoError(t, err)
+	assert.Equal(t, "hello\r\nworld", string(data))
+	part, err = mr.NextPart()
+	require.NoError(t, err)
+	assert.Equal(t, "a.txt", part.FileName())
+	assert.Equal(t, "text/plain", part.Headers["content-type"])
+	// unread part is skipped
+	part, err = mr.NextPart()
+	require.NoError(t, err)
+	assert.Equal(t, "b.txt", part.FileName())
+	_, err = mr.NextPart()
+	require.ErrorIs(t, err, io.EOF)
+
+	// TEST: Delimiter split across buffer boundary
+	long := strings.Repeat("x", multipartBufSize-3)
+	mr = NewMultipartReader(strings.NewReader("--XyZ\r\n\r\n"+long+"\r\n--XyZ--"), "XyZ")
+	part, err = mr.NextPart()
+	require.NoError(t, err)
+	data, err = io.ReadAll(part)
+	require.NoError(t, err)
+	assert.Equal(t, long, string(data))
+
+	// TEST: Form with files in memory
+	form, err := newMultipartRequest(multipartBody).ParseMultipartForm(DefaultFormLimits)
+	require.NoError(t, err)
+	assert.Equal(t, "hello\r\nworld", form.Value.Get("title"))
+	require.Len(t, form.File["upload"], 2)
+	file, err := form.File["upload"][0].Open()
+	require.NoError(t, err)
+	data, _ = io.ReadAll(file)
+	assert.Equal(t, "file contents with --XyZ inside", string(data))
+
+	// TEST: Files over the memory threshold are spooled to disk
+	form, err = newMultipartRequest(multipartBody).ParseMultipartForm(FormLimits{MaxMemory: 5})
+	require.NoError(t, err)
+	fh := form.File["upload"][0]
+	require.NotEmpty(t, fh.tempFile)
+	assert.Equal(t, int64(31), fh.Size)
+	file, err = fh.Open()
+	require.NoError(t, err)
+	data, _ = io.ReadAll(file)
+	file.Close()
+	assert.Equal(t, "file contents with --XyZ inside", string(data))
+	require.NoError(t, form.RemoveAll())
+	_, err = os.Stat(fh.tempFile)
+	assert.True(t, os.IsNotExist(err))
+
+	// TEST: File size limit
+	_, err = newMultipartRequest(multipartBody).ParseMultipartForm(FormLimits{MaxMemory: 5, MaxFileSize: 10})
+	require.ErrorIs(t, err, errFileTooLarge)
+
+	// TEST: Part count limit
+	_, err = newMultipartRequest(multipartBody).ParseMultipartForm(FormLimits{MaxParts: 2})
+	require.ErrorIs(t, err, errTooManyParts)
+
+	// TEST: Boundaries over the RFC 2046 limit are refused
+	long = strings.Repeat("b", 5000)
+	r := newMultipartRequest("--" + long + "\r\n\r\nvalue\r\n--" + long + "--")
+	r.Headers["content-type"] = "multipart/form-data; boundary=" + long
+	_, err = r.MultipartReader()
+	require.ErrorIs(t, err, errMalformedMultipart)
+	_, err = r.ParseMultipartForm(DefaultFormLimits)
+	require.ErrorIs(t, err, errMalformedMultipart)
+	long = strings.Repeat("b", multipartBufSize+1)
+	_, err = NewMultipartReader(strings.NewReader("--"+long+"\r\n\r\nvalue\r\n--"+long+"--"), long).NextPart()
+	require.ErrorIs(t, err, errMalformedMultipart)
+	_, err = NewMultipartReader(strings.NewReader(""), strings.Repeat("b", 70)).NextPart()
+	require.ErrorIs(t, err, errMalformedMultipart, "70 bytes is allowed, the empty body is what fails")
+
+	// TEST: Missing closing delimiter
+	_, err = newMultipartRequest("--XyZ\r\nContent-Disposition: form-data; name=\"a\"\r\n\r\nvalue").ParseMultipartForm(DefaultFormLimits)
+	require.Error(t, err)
+}
+
+// patternReader produces n bytes without holding them
+type patternReader struct {
+	n int
+}
+
+func (pr *patternReader) Read(p []byte) (int, error) {
+	if pr.n == 0 {
+		return 0, io.EOF
+	}
+	n := min(len(p), pr.n)
+	for i := range n {
+		p[i] = 'x'
+	}
+	pr.n -= n
+	return n, nil
+}
+
+// chunkedEncoder frames what it reads from r as a chunked body
+type chunkedEncoder struct {
+	r       io.Reader
+	pending []byte
+	done    bool
+}
+
+func (ce *chunkedEncoder) Read(p []byte) (int, error) {
+	if len(ce.pending) == 0 {
+		if ce.done {
+			return 0, io.EOF
+		}
+		buffer := make([]byte, 4096)
+		n, err := ce.r.Read(buffer)
+		if n > 0 {
+			ce.pending = fmt.Appendf(nil, "%x\r\n%s\r\n", n, buffer[:n])
+		}
+		if err == io.EOF {
+			ce.pending = append(ce.pending, "0\r\n\r\n"...)
+			ce.done = true
+		} else if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, ce.pending)
+	ce.pending = ce.pending[n:]
+	return n, nil
+}
+
+func TestMultipartStreaming(t *testing.T) {
+	const fileSize = 8 << 20
+	partHead := "--XyZ\r\n" +
+		"Content-Disposition: form-data; name=\"upload\"; filename=\"big.bin\"\r\n" +
+		"\r\n"
+	tail := "\r\n--XyZ--\r\n"
+	newBody := func() io.Reader {
+		return io.MultiReader(strings.NewReader(partHead), &patternReader{n: fileSize}, strings.NewReader(tail))
+	}
+
+	heads := map[string]io.Reader{
+		"content-length": io.MultiReader(strings.NewReader(fmt.Sprintf(
+			"POST /upload HTTP/1.1\r\nHost: example.com\r\nContent-Type: multipart/form-data; boundary=XyZ\r\nContent-Length: %d\r\n\r\n",
+			len(partHead)+fileSize+len(tail))), newBody()),
+		"chunked": io.MultiReader(strings.NewReader(
+			"POST /upload HTTP/1.1\r\nHost: example.com\r\nContent-Type: multipart/form-data; boundary=XyZ\r\nTransfer-Encoding: chunked\r\n\r\n"),
+			&chunkedEncoder{r: newBody()}),
+	}
+	for name, wire := range heads {
+		// TEST: Deferred multipart body is streamed off the connection
+		parser := NewParser(wire)
+		req, err := parser.ReadRequestHead()
+		require.NoError(t, err, name)
+		parser.DeferBody(req, nil)
+		form, err := req.ParseMultipartForm(FormLimits{MaxMemory: 1 << 10})
+		require.NoError(t, err, name)
+		fh := form.File["upload"][0]
+		assert.Equal(t, int64(fileSize), fh.Size, name)
+		assert.NotEmpty(t, fh.tempFile, name)
+		require.NoError(t, form.RemoveAll())
+
+		// the whole upload never was in memory at once
+		assert.Less(t, cap(req.Body), 64<<10, name)
+		assert.Less(t, len(parser.buffer), 64<<10, name)
+	}
+
+	// TEST: Streamed body still honours the body limit
+	parser := NewParser(nil)
+	parser.MaxBodyBytes = 1 << 20
+	wire := io.MultiReader(strings.NewReader(
+		"POST /upload HTTP/1.1\r\nHost: example.com\r\nContent-Type: multipart/form-data; boundary=XyZ\r\nTransfer-Encoding: chunked\r\n\r\n"),
+		&chunkedEncoder{r: newBody()})
+	parser.Reset(wire)
+	req, err := parser.ReadRequestHead()
+	require.NoError(t, err)
+	parser.DeferBody(req, nil)
+	_, err = req.ParseMultipartForm(FormLimits{MaxMemory: 1 << 10})
+	require.ErrorIs(t, err, ErrBodyTooLarge)
+
+	// TEST: Body is read whole when asked for, after the before hook
+	called := false
+	parser = NewParser(strings.NewReader("POST / HTTP/1.1\r\nHost: example.com\r\nContent-Length: 5\r\n\r\nhello"))
+	req, err = parser.ReadRequestHead()
+	require.NoError(t, err)
+	parser.DeferBody(req, func() error {
+		called = true
+		return nil
+	})
+	body, err := req.ReadBody()
+	require.NoError(t, err)
+	assert.True(t, called)
+	assert.Equal(t, "hello", string(body))
+
+	// TEST: A body read through a copy isn't pending on the original
+	parser = NewParser(io.MultiReader(
+		strings.NewReader("POST / HTTP/1.1\r\nHost: example.com\r\nContent-Length: 5\r\n\r\n"),
+		strings.NewReader("hello")))
+	req, err = parser.ReadRequestHead()
+	require.NoError(t, err)
+	parser.DeferBody(req, nil)
+	copied := req.WithContext(context.Background())
+	assert.True(t, req.BodyPending())
+	_, err = io.ReadAll(copied.BodyReader())
+	require.NoError(t, err)
+	assert.False(t, copied.BodyPending())
+	assert.False(t, req.BodyPending())
+}
@@ -0,0 +1,389 @@
+package request
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"httpfromtcp/internal/headers"
+	"io"
+	"mime"
+	"os"
+	"strings"
+)
+
+var (
+	errNotMultipart       = errors.New("content-type is not multipart/form-data")
+	errNoBoundary         = errors.New("multipart boundary is missing")
+	errMalformedMultipart = errors.New("malformed multipart body")
+	errPartHeaderTooLarge = errors.New("multipart part headers too large")
+	errTooManyParts       = errors.New("too many multipart parts")
+	errFileTooLarge       = errors.New("multipart file too large")
+)
+
+const (
+	maxPartHeaderSize = 16 << 10
+	multipartBufSize  = 4096
+	// maxBoundaryLen is the RFC 2046 limit, it also keeps the delimiter well
+	// inside the buffer Part.Read searches
+	maxBoundaryLen = 70
+)
+
+// MultipartReader reads a multipart body part by part without holding
+// it in memory
+type MultipartReader struct {
+	reader    *bufio.Reader
+	delimiter []byte
+	current   *Part
+	started   bool
+	finished  bool
+	// err is a boundary NewMultipartReader refused, NextPart returns it
+	err error
+}
+
+type Part struct {
+	Headers headers.Headers
+
+	mr   *MultipartReader
+	done bool
+	// disposition params are parsed lazily
+	disposition map[string]string
+}
+
+// NewMultipartReader reads parts delimited by boundary, a boundary that
+// isn't 1 to 70 bytes long makes NextPart fail
+func NewMultipartReader(reader io.Reader, boundary string) *MultipartReader {
+	if err := checkBoundary(boundary); err != nil {
+		return &MultipartReader{err: err}
+	}
+	// the body starts with --boundary, a leading CRLF lets every
+	// delimiter be matched as CRLF--boundary
+	reader = io.MultiReader(strings.NewReader("\r\n"), reader)
+	return &MultipartReader{
+		reader:    bufio.NewReaderSize(reader, multipartBufSize),
+		delimiter: []byte("\r\n--" + boundary),
+	}
+}
+
+// MultipartReader reads the body as multipart/form-data, streamed off the
+// connection when the server left it there
+func (r *Request) MultipartReader() (*MultipartReader, error) {
+	mediaType, params := r.mediaType()
+	if mediaType != "multipart/form-data" {
+		return nil, errNotMultipart
+	}
+	boundary := params["boundary"]
+	if err := checkBoundary(boundary); err != nil {
+		return nil, err
+	}
+
+	return NewMultipartReader(r.BodyReader(), boundary), nil
+}
+
+func checkBoundary(boundary string) error {
+	if boundary == "" {
+		return errNoBoundary
+	}
+	if len(boundary) > maxBoundaryLen {
+		return fmt.Errorf("%w: boundary longer than %d bytes", errMalformedMultipart, maxBoundaryLen)
+	}
+	return nil
+}
+
+// NextPart skips what is left of the current part and returns the next
+// one, io.EOF is returned after the closing delimiter
+func (mr *MultipartReader) NextPart() (*Part, error) {
+	if mr.err != nil {
+		return nil, mr.err
+	}
+	if mr.finished {
+		return nil, io.EOF
+	}
+
+	if mr.current != nil || !mr.started {
+		// the preamble before the first delimiter is read like a part
+		skip := mr.current
+		if skip == nil {
+			skip = &Part{mr: mr}
+		}
+		if _, err := io.Copy(io.Discard, skip); err != nil {
+			return nil, err
+		}
+		mr.started = true
+	}
+
+	if _, err := mr.reader.Discard(len(mr.delimiter)); err != nil {
+		return nil, fmt.Errorf("%w: %w", errMalformedMultipart, err)
+	}
+	next, err := mr.reader.Peek(2)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errMalformedMultipart, err)
+	}
+	if string(next) == "--" {
+		mr.finished = true
+		mr.current = nil
+		return nil, io.EOF
+	}
+
+	// transport padding may sit between the boundary and its CRLF
+	line, err := mr.reader.ReadString('\n')
+	if err != nil || strings.TrimRight(line, " \t\r\n") != "" || !strings.HasSuffix(line, "\r\n") {
+		return nil, fmt.Errorf("%w: bad delimiter line", errMalformedMultipart)
+	}
+
+	part := &Part{Headers: headers.NewHeaders(), mr: mr}
+	headerSize := 0
+	for {
+		line, err := mr.reader.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", errMalformedMultipart, err)
+		}
+		headerSize += len(line)
+		if headerSize > maxPartHeaderSize {
+			return nil, errPartHeaderTooLarge
+		}
+		_, done, err := part.Headers.Parse([]byte(line))
+		if err != nil {
+			return nil, err
+		}
+		if done {
+			break
+		}
+	}
+
+	mr.current = part
+	return part, nil
+}
+
+func (p *Part) Read(b []byte) (int, error) {
+	if p.done {
+		return 0, io.EOF
+	}
+	mr := p.mr
+
+	peek, err := mr.reader.Peek(multipartBufSize)
+	if idx := bytes.Index(peek, mr.delimiter); idx >= 0 {
+		if idx == 0 {
+			p.done = true
+			return 0, io.EOF
+		}
+		n := copy(b, peek[:idx])
+		mr.reader.Discard(n)
+		return n, nil
+	}
+	if err != nil && err != bufio.ErrBufferFull {
+		if err == io.EOF {
+			err = fmt.Errorf("%w: missing closing delimiter", errMalformedMultipart)
+		}
+		return 0, err
+	}
+
+	// keep enough back to spot a delimiter split across reads
+	safe := len(peek) - len(mr.delimiter) + 1
+	n := copy(b, peek[:safe])
+	mr.reader.Discard(n)
+	return n, nil
+}
+
+func (p *Part) dispositionParams() map[string]string {
+	if p.disposition == nil {
+		p.disposition = map[string]string{}
+		if value, ok := p.Headers.Get("content-disposition"); ok {
+			if _, params, err := mime.ParseMediaType(value); err == nil {
+				p.disposition = params
+			}
+		}
+	}
+	return p.disposition
+}
+
+func (p *Part) FormName() string {
+	return p.dispositionParams()["name"]
+}
+
+func (p *Part) FileName() string {
+	return p.dispositionParams()["filename"]
+}
+
+type FormLimits struct {
+	// MaxMemory is how much of the file parts is kept in memory, larger
+	// files are spooled to temporary files
+	MaxMemory int64
+	// MaxFileSize limits a single file part
+	MaxFileSize int64
+	// MaxSize limits all values and files together
+	MaxSize  int64
+	MaxParts int
+}
+
+var DefaultFormLimits = FormLimits{
+	MaxMemory:   32 << 20,
+	MaxFileSize: 1 << 30,
+	MaxSize:     1 << 30,
+	MaxParts:    1000,
+}
+
+type FileHeader struct {
+	Filename string
+	Headers  headers.Headers
+	Size     int64
+
+	content  []byte
+	tempFile string
+}
+
+// Open returns the file contents, either from memory or from the spool file
+func (fh *FileHeader) Open() (io.ReadCloser, error) {
+	if fh.tempFile != "" {
+		return os.Open(fh.tempFile)
+	}
+	return io.NopCloser(bytes.NewReader(fh.content)), nil
+}
+
+type MultipartForm struct {
+	Value Values
+	File  map[string][]*FileHeader
+}
+
+// RemoveAll deletes the temporary files of spooled parts
+func (f *MultipartForm) RemoveAll() error {
+	var errs []error
+	for _, files := range f.File {
+		for _, fh := range files {
+			if fh.tempFile != "" {
+				if err := os.Remove(fh.tempFile); err != nil && !os.IsNotExist(err) {
+					errs = append(errs, err)
+				}
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (r *Request) ParseMultipartForm(limits FormLimits) (*MultipartForm, error) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+	return mr.ReadForm(limits)
+}
+
+// ReadForm reads every part, on error no temporary files are left behind
+func (mr *MultipartReader) ReadForm(limits FormLimits) (_ *MultipartForm, err error) {
+	form := &MultipartForm{Value: Values{}, File: map[string][]*FileHeader{}}
+	defer func() {
+		if err != nil {
+			form.RemoveAll()
+		}
+	}()
+
+	if limits.MaxMemory <= 0 {
+		limits.MaxMemory = DefaultFormLimits.MaxMemory
+	}
+	if limits.MaxSize <= 0 {
+		limits.MaxSize = DefaultFormLimits.MaxSize
+	}
+
+	memoryLeft := limits.MaxMemory
+	sizeLeft := limits.MaxSize
+	parts := 0
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return form, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		parts++
+		if limits.MaxParts > 0 && parts > limits.MaxParts {
+			return nil, errTooManyParts
+		}
+
+		name := part.FormName()
+		if name == "" {
+			continue
+		}
+
+		if part.FileName() == "" {
+			value, err := readLimited(part, sizeLeft)
+			if err != nil {
+				return nil, err
+			}
+			sizeLeft -= int64(len(value))
+			form.Value.Add(name, string(value))
+			continue
+		}
+
+		fh, err := spoolFile(part, limits, &memoryLeft, sizeLeft)
+		if err != nil {
+			return nil, err
+		}
+		sizeLeft -= fh.Size
+		form.File[name] = append(form.File[name], fh)
+	}
+}
+
+func readLimited(reader io.Reader, limit int64) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(reader, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, errFormTooLarge
+	}
+	return data, nil
+}
+
+func spoolFile(part *Part, limits FormLimits, memoryLeft *int64, sizeLeft int64) (*FileHeader, error) {
+	fh := &FileHeader{
+		Filename: part.FileName(),
+		Headers:  part.Headers,
+	}
+
+	limit := sizeLeft
+	fileLimitErr := errFormTooLarge
+	if limits.MaxFileSize > 0 && limits.MaxFileSize < limit {
+		limit = limits.MaxFileSize
+		fileLimitErr = errFileTooLarge
+	}
+
+	// read up to the memory budget, whatever doesn't fit goes to disk
+	inMemory, err := io.ReadAll(io.LimitReader(part, max(*memoryLeft, 0)+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(inMemory)) > limit {
+		return nil, fileLimitErr
+	}
+	if int64(len(inMemory)) <= *memoryLeft {
+		*memoryLeft -= int64(len(inMemory))
+		fh.content = inMemory
+		fh.Size = int64(len(inMemory))
+		return fh, nil
+	}
+
+	file, err := os.CreateTemp("", "multipart-")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	fh.tempFile = file.Name()
+
+	if _, err := file.Write(inMemory); err != nil {
+		os.Remove(fh.tempFile)
+		return nil, err
+	}
+	written, err := io.Copy(file, io.LimitReader(part, limit-int64(len(inMemory))+1))
+	if err != nil {
+		os.Remove(fh.tempFile)
+		return nil, err
+	}
+	fh.Size = int64(len(inMemory)) + written
+	if fh.Size > limit {
+		os.Remove(fh.tempFile)
+		return nil, fileLimitErr
+	}
+	return fh, nil
+}
@@ -0,0 +1,84 @@
+package request
+
+import (
+	"httpfromtcp/internal/headers"
+	"sync"
+	"unsafe"
+)
+
+// Request strings parsed off the wire (the target, header names that
+// aren't common and header values) are views into the request's own raw
+// buffer instead of separate allocations. The buffer is only appended to,
+// so a view stays valid until the request is released to the pool. Code
+// that keeps such a string past the handler has to strings.Clone it: map
+// keys, metric labels, span attributes and session values all do.
+
+var requestPool = sync.Pool{
+	New: func() any {
+		r := newRequest()
+		return &r
+	},
+}
+
+// maxPooledBuffer keeps a request that carried a huge body or head from
+// pinning that memory in the pool
+const maxPooledBuffer = 64 << 10
+
+// AcquireRequest returns an empty request from the pool, to be filled by
+// Parser.ReadRequestHeadInto
+func AcquireRequest() *Request {
+	return requestPool.Get().(*Request)
+}
+
+// ReleaseRequest resets r and puts it back in the pool. Nothing may use r,
+// copies made with WithContext or strings read from it afterwards: they
+// will be overwritten by the next request.
+func ReleaseRequest(r *Request) {
+	r.reset()
+	requestPool.Put(r)
+}
+
+func (r *Request) reset() {
+	hdrs, trailers := r.Headers, r.Trailers
+	clear(hdrs)
+	clear(trailers)
+	body, raw := r.Body[:0], r.raw[:0]
+	if cap(body) > maxPooledBuffer {
+		body = nil
+	}
+	if cap(raw) > maxPooledBuffer {
+		raw = nil
+	}
+	*r = Request{
+		ParserState: parserStateInitialized,
+		Headers:     hdrs,
+		Trailers:    trailers,
+		Body:        body,
+		raw:         raw,
+	}
+}
+
+// view copies b into the raw buffer and returns it as a string
+func (r *Request) view(b []byte) string {
+	if len(b) == 0 {
+		return ""
+	}
+	start := len(r.raw)
+	r.raw = append(r.raw, b...)
+	return unsafe.String(&r.raw[start], len(b))
+}
+
+// viewKey is view for a field name, lowercased, common names are shared
+func (r *Request) viewKey(name []byte) string {
+	if key, ok := headers.CommonKey(name); ok {
+		return key
+	}
+	start := len(r.raw)
+	for _, c := range name {
+		if c >= 'A' && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		r.raw = append(r.raw, c)
+	}
+	return unsafe.String(&r.raw[start], len(name))
+}
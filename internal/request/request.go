@@ -2,12 +2,16 @@ package request
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"httpfromtcp/internal/chunked"
+	"httpfromtcp/internal/cookie"
 	"httpfromtcp/internal/headers"
 	"io"
-	"log"
 	"log/slog"
+	"strconv"
 	"strings"
 )
 
@@ -18,6 +22,7 @@ const (
 	parserStateDone           ParserState = "done"
 	parserStateParsingHeaders ParserState = "headers"
 	parserStateParsingBody    ParserState = "body"
+	parserStateParsingChunked ParserState = "chunked"
 )
 
 type Request struct {
@@ -25,6 +30,36 @@ type Request struct {
 	ParserState ParserState
 	Headers     headers.Headers
 	Body        []byte
+	// BodyStream is sent instead of Body by Write, with the Content-Length
+	// header as its length or chunked when there is none
+	BodyStream io.Reader
+	// Trailers are sent after a chunked body
+	Trailers headers.Headers
+	// RemoteAddr is the address of the peer, set by the server
+	RemoteAddr string
+	LocalAddr  string
+	// TLS is nil on plain connections
+	TLS *tls.ConnectionState
+	// ConnID is unique per server, Sequence counts requests on the
+	// connection starting at 1
+	ConnID   uint64
+	Sequence int
+	// ClientIP is the address of the client as far as trusted proxies
+	// vouch for it, the peer address when there are none
+	ClientIP string
+
+	decoder chunked.Decoder
+	// raw backs the strings parsed for this request, see pool.go
+	raw []byte
+	// maxBody is the parser's body limit, 0 for none
+	maxBody int
+	// maxTrailer bounds the chunked trailers like the head, 0 for none
+	maxTrailer int
+	// deferred is set while the body is left on the connection, see body.go
+	deferred *deferredBody
+	// bodyRead counts body bytes already streamed out of Body
+	bodyRead int
+	ctx      context.Context
 }
 
 type RequestLine struct {
@@ -34,28 +69,160 @@ type RequestLine struct {
 }
 
 var AllowedMethods = map[string]struct{}{
-	"GET":  {},
-	"POST": {},
+	"GET":     {},
+	"POST":    {},
+	"OPTIONS": {},
 }
 
 var (
 	SEPARATOR                       = "\r\n"
 	CONTENT_LENGTH_HEADER           = "content-length"
+	TRANSFER_ENCODING_HEADER        = "transfer-encoding"
 	errNeedMoreData                 = errors.New("need more data to process")
 	errBadContentLength             = errors.New("bad content-length")
 	errNoContentLenButBodyIsPresent = errors.New("no content-length but body is presented")
+	errFoldedHeader                 = errors.New("folded header line")
+	errAmbiguousLength              = errors.New("both content-length and transfer-encoding are set")
+	errChunkedNotLast               = errors.New("chunked is not the final transfer coding")
+	errMissingHost                  = errors.New("missing host header")
+	errDuplicateHost                = errors.New("more than one host header")
 )
 
+// rawSize fits the head of most requests, so raw rarely has to grow
+const rawSize = 512
+
 func newRequest() Request {
 	return Request{
 		ParserState: parserStateInitialized,
 		Headers:     headers.NewHeaders(),
+		Trailers:    headers.NewHeaders(),
+		raw:         make([]byte, 0, rawSize),
+	}
+}
+
+// ExpectsContinue reports a client waiting for 100 Continue before sending the body
+func (r *Request) ExpectsContinue() bool {
+	expect, ok := r.Headers.Get("expect")
+	return ok && strings.EqualFold(strings.TrimSpace(expect), "100-continue")
+}
+
+func (r *Request) Cookies() []*cookie.Cookie {
+	value, ok := r.Headers.Get("cookie")
+	if !ok {
+		return nil
+	}
+	return cookie.ParseCookieHeader(value)
+}
+
+// Cookie returns the first cookie with the name
+func (r *Request) Cookie(name string) (*cookie.Cookie, bool) {
+	for _, c := range r.Cookies() {
+		if c.Name == name {
+			return c, true
+		}
+	}
+	return nil, false
+}
+
+func (r *Request) Context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+	return r.ctx
+}
+
+// WithContext returns a shallow copy carrying ctx, middleware uses it to
+// pass values down to handlers
+func (r *Request) WithContext(ctx context.Context) *Request {
+	copied := *r
+	copied.ctx = ctx
+	return &copied
+}
+
+// ReadBody returns the body, reading it off the connection first when the
+// server deferred it (requests with Expect: 100-continue and multipart
+// uploads). It can't be used after BodyReader.
+func (r *Request) ReadBody() ([]byte, error) {
+	if d := r.deferred; d != nil {
+		r.deferred = nil
+		d.reader = r
+		if err := d.begin(); err != nil {
+			return nil, err
+		}
+		if err := d.parser.ReadBody(r); err != nil {
+			return nil, err
+		}
+	}
+	return r.Body, nil
+}
+
+// BodyPending is true while the body is still on the connection, also when
+// a copy made with WithContext is the one reading it
+func (r *Request) BodyPending() bool {
+	if d := r.deferred; d != nil && d.reader != nil {
+		return !d.reader.bodyDone()
+	}
+	return r.ParserState != parserStateDone
+}
+
+func (r *Request) bodyDone() bool {
+	return r.ParserState == parserStateDone
+}
+
+func (r *Request) headersDone() bool {
+	return r.ParserState != parserStateInitialized && r.ParserState != parserStateParsingHeaders
+}
+
+func (r *Request) isChunked() bool {
+	transferEncoding, ok := r.Headers.Get(TRANSFER_ENCODING_HEADER)
+	if !ok {
+		return false
 	}
+	last := transferEncoding[strings.LastIndexByte(transferEncoding, ',')+1:]
+	return strings.EqualFold(strings.TrimSpace(last), "chunked")
+}
+
+// checkFraming makes sure the body length can only be read one way, two
+// parsers disagreeing on where a request ends is how requests get
+// smuggled past a proxy (RFC 9112 section 6.3)
+func (r *Request) checkFraming() error {
+	contentLength, hasLength := r.Headers.Get(CONTENT_LENGTH_HEADER)
+	transferEncoding, hasEncoding := r.Headers.Get(TRANSFER_ENCODING_HEADER)
+	if hasLength && hasEncoding {
+		return errAmbiguousLength
+	}
+	if hasEncoding {
+		for rest, more := transferEncoding, true; more; {
+			var coding string
+			coding, rest, more = strings.Cut(rest, ",")
+			coding = strings.TrimSpace(coding)
+			isLast := !more
+			switch {
+			case strings.EqualFold(coding, "chunked") && isLast:
+			case strings.EqualFold(coding, "chunked"), isLast:
+				return fmt.Errorf("%w: %q", errChunkedNotLast, transferEncoding)
+			default:
+				return fmt.Errorf("%w: %q", ErrUnsupportedTransferEncoding, coding)
+			}
+		}
+	}
+	if hasLength {
+		length, ok := headers.ParseContentLength(contentLength)
+		if !ok {
+			return fmt.Errorf("%w: %q", errBadContentLength, contentLength)
+		}
+		// repeated identical values are folded into one
+		r.Headers[CONTENT_LENGTH_HEADER] = strconv.Itoa(length)
+		// refused before any of the body is read, or 100 Continue sent
+		if r.maxBody > 0 && length > r.maxBody {
+			return ErrBodyTooLarge
+		}
+	}
+	return nil
 }
 
 func (r *Request) hasBody() bool {
 	contentLen, ok := r.Headers.GetInt(CONTENT_LENGTH_HEADER)
-	slog.Info("HasBody", "ok", ok, "content-length", contentLen)
 	if !ok || contentLen == 0 {
 		return false
 	}
@@ -70,26 +237,42 @@ func (r *Request) parse(data []byte) (int, error) {
 		case parserStateDone:
 			return read, nil
 		case parserStateInitialized:
-			bytesRead, requestLine, err := parseRequestLine(data[read:])
+			bytesRead, err := r.parseRequestLine(data[read:])
 			if err != nil {
 				return read, err
 			}
 			if bytesRead == 0 {
 				return read, nil
 			}
-			r.RequestLine = *requestLine
 			read += bytesRead
 			r.ParserState = parserStateParsingHeaders
 		case parserStateParsingHeaders:
 			for {
-				bytesRead, done, err := r.Headers.Parse(data[read:])
+				// obsolete line folding and whitespace before the first
+				// field are rejected (RFC 9112 sections 2.2 and 5.2)
+				if len(data[read:]) > 0 && (data[read] == ' ' || data[read] == '\t') {
+					return read, errFoldedHeader
+				}
+				bytesRead, done, err := r.parseField(data[read:])
 				if err != nil {
 					return read, err
 				}
 				read += bytesRead
 				if done {
-					slog.Info("RequestHeaders", "Headers", r.Headers)
-					if r.hasBody() {
+					if err := r.checkFraming(); err != nil {
+						return read, err
+					}
+					// RFC 9112 section 3.2, exactly one Host
+					if _, ok := r.Headers.Get("host"); !ok {
+						return read, errMissingHost
+					}
+					if r.isChunked() {
+						r.decoder.Reset(r.Trailers)
+						r.decoder.MaxTrailerBytes = r.maxTrailer
+						r.ParserState = parserStateParsingChunked
+						read = read + len(headers.CRLF)
+						break
+					} else if r.hasBody() {
 						r.ParserState = parserStateParsingBody
 						read = read + len(headers.CRLF)
 						break
@@ -105,7 +288,6 @@ func (r *Request) parse(data []byte) (int, error) {
 		case parserStateParsingBody:
 			contentLength, ok := r.Headers.GetInt(CONTENT_LENGTH_HEADER)
 			if !ok {
-				fmt.Println(len(data[read:]) > 0)
 				if len(data[read:]) > 0 {
 					return read, errNoContentLenButBodyIsPresent
 				}
@@ -113,83 +295,292 @@ func (r *Request) parse(data []byte) (int, error) {
 				return read, nil
 			}
 
-			remaining := min(contentLength-len(r.Body), len(data[read:]))
-			slog.Info("BodyParsing", "remaining", remaining, "read", read)
+			received := r.bodyRead + len(r.Body)
+			remaining := min(contentLength-received, len(data[read:]))
 
 			r.Body = append(r.Body, (data[read:])[:remaining]...)
 			read += remaining
+			received += remaining
 
-			if len(r.Body) > contentLength {
+			if received > contentLength {
 				return read, errBadContentLength
-			} else if contentLength == len(r.Body) {
+			} else if contentLength == received {
 				r.ParserState = parserStateDone
 			}
 
+			return read, nil
+		case parserStateParsingChunked:
+			bytesRead, body, err := r.decoder.Decode(data[read:], r.Body)
+			r.Body = body
+			read += bytesRead
+			if errors.Is(err, chunked.ErrTrailersTooLarge) {
+				return read, ErrHeadersTooLarge
+			}
+			if err != nil {
+				return read, err
+			}
+			if r.maxBody > 0 && r.bodyRead+len(r.Body) > r.maxBody {
+				return read, ErrBodyTooLarge
+			}
+			if r.decoder.Done() {
+				r.ParserState = parserStateDone
+			}
 			return read, nil
 		}
 	}
 }
 
+// Parser reads requests off one connection, it can stop after the headers
+// so the body is only read once the handler asks for it
+type Parser struct {
+	// Logger gets debug output about parsing, nil discards it
+	Logger *slog.Logger
+	// MaxHeaderBytes bounds the request line and headers together, 0 uses
+	// DefaultMaxHeaderBytes
+	MaxHeaderBytes int
+	// MaxBodyBytes bounds the decoded body, 0 means no limit. A larger
+	// Content-Length is refused with the head.
+	MaxBodyBytes int
+
+	reader    io.Reader
+	buffer    []byte
+	bufferLen int
+	// readErr is held back until the bytes read along with it are parsed
+	readErr error
+	// headRead counts the head bytes consumed for the current request
+	headRead int
+}
+
+const (
+	DefaultMaxHeaderBytes = 1 << 20
+	// MaxRequestLineBytes bounds the request line on its own, a longer
+	// target gets 414
+	MaxRequestLineBytes = 8 << 10
+)
+
+func NewParser(reader io.Reader) *Parser {
+	return &Parser{
+		reader: reader,
+		buffer: make([]byte, 1024),
+	}
+}
+
+// Reset points the parser at another connection and drops anything
+// buffered, the buffer itself is kept for reuse
+func (p *Parser) Reset(reader io.Reader) {
+	if len(p.buffer) > maxPooledBuffer {
+		p.buffer = make([]byte, 1024)
+	}
+	p.reader = reader
+	p.bufferLen = 0
+	p.readErr = nil
+	p.headRead = 0
+}
+
+// Buffered returns the bytes read off the connection but not parsed yet,
+// they are only valid until the next call on the parser
+func (p *Parser) Buffered() []byte {
+	return p.buffer[:p.bufferLen]
+}
+
+// Unread puts b back after the buffered bytes, for data someone else read
+// off the connection in between requests
+func (p *Parser) Unread(b []byte) {
+	p.buffer = append(p.buffer[:p.bufferLen], b...)
+	p.bufferLen = len(p.buffer)
+	p.buffer = p.buffer[:cap(p.buffer)]
+}
+
 func RequestFromReader(reader io.Reader) (*Request, error) {
+	return NewParser(reader).ReadRequest()
+}
+
+func (p *Parser) logger() *slog.Logger {
+	if p.Logger == nil {
+		return discardLogger
+	}
+	return p.Logger
+}
+
+var discardLogger = slog.New(slog.DiscardHandler)
+
+func (p *Parser) ReadRequest() (*Request, error) {
+	request, err := p.ReadRequestHead()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.ReadBody(request); err != nil {
+		return nil, err
+	}
+	return request, nil
+}
+
+func (p *Parser) ReadRequestHead() (*Request, error) {
 	request := newRequest()
-	buffer := make([]byte, 1024)
-	bufferLen := 0
+	if err := p.ReadRequestHeadInto(&request); err != nil {
+		return nil, err
+	}
+	return &request, nil
+}
 
-	for request.ParserState != parserStateDone {
-		readBytes, err := reader.Read(buffer[bufferLen:])
-		if err != nil || (err == io.EOF && bufferLen == 0) {
-			log.Fatal(err)
-		}
-		bufferLen += readBytes
+// ReadRequestHeadInto is ReadRequestHead filling an empty request, one
+// from AcquireRequest for parsing without allocating
+func (p *Parser) ReadRequestHeadInto(request *Request) error {
+	request.maxBody = p.MaxBodyBytes
+	request.maxTrailer = p.maxHeaderBytes()
+	p.headRead = 0
+	if err := p.advance(request, request.headersDone); err != nil {
+		return err
+	}
+	if logger := p.logger(); logger.Enabled(context.Background(), slog.LevelDebug) {
+		logger.Debug("request head parsed",
+			"method", request.RequestLine.Method, "target", request.RequestLine.RequestTarget, "state", request.ParserState)
+	}
+	return nil
+}
+
+func (p *Parser) ReadBody(request *Request) error {
+	return p.advance(request, request.bodyDone)
+}
 
-		slog.Info("ParsedState", "state", request.ParserState)
-		consumedBytes, err := request.parse(buffer[:bufferLen])
+// advance parses until until() holds, read errors come back as *IOError and
+// bad input wrapped in ErrMalformedRequest
+func (p *Parser) advance(request *Request, until func() bool) error {
+	for {
+		// the head is parsed no further than the limit, so a head that
+		// arrived whole in one read is held to it too
+		inHead := !request.headersDone()
+		window := p.bufferLen
+		if inHead {
+			window = min(window, max(p.maxHeaderBytes()-p.headRead, 0))
+		}
+		consumedBytes, err := request.parse(p.buffer[:window])
 		if err != nil {
-			return nil, fmt.Errorf("error parsing data %w", err)
+			p.logger().Debug("request parse failed", "state", request.ParserState, "error", err)
+			return fmt.Errorf("%w: %w", ErrMalformedRequest, err)
+		}
+		copy(p.buffer, p.buffer[consumedBytes:p.bufferLen])
+		p.bufferLen -= consumedBytes
+		if inHead {
+			p.headRead += consumedBytes
+			if !request.headersDone() && p.headRead+p.bufferLen > p.maxHeaderBytes() {
+				p.logger().Debug("request head too large", "size", p.headRead+p.bufferLen)
+				tooLarge := ErrHeadersTooLarge
+				if request.ParserState == parserStateInitialized {
+					tooLarge = ErrRequestLineTooLong
+				}
+				return fmt.Errorf("%w: %w", ErrMalformedRequest, tooLarge)
+			}
+		}
+
+		if until() {
+			return nil
+		}
+		if consumedBytes > 0 && p.bufferLen > 0 {
+			continue
 		}
-		copy(buffer, buffer[consumedBytes:bufferLen])
-		bufferLen -= consumedBytes
+
+		if p.readErr != nil {
+			midRequest := request.ParserState != parserStateInitialized || p.bufferLen > 0
+			ioErr := classifyReadError(p.readErr, midRequest)
+			p.logger().Debug("request read failed", "state", request.ParserState, "error", ioErr)
+			return ioErr
+		}
+		if p.bufferLen == len(p.buffer) {
+			p.buffer = append(p.buffer, make([]byte, len(p.buffer))...)
+		}
+		readBytes, err := p.reader.Read(p.buffer[p.bufferLen:])
+		p.bufferLen += readBytes
+		p.readErr = err
 	}
+}
 
-	return &request, nil
+func (p *Parser) maxHeaderBytes() int {
+	if p.MaxHeaderBytes <= 0 {
+		return DefaultMaxHeaderBytes
+	}
+	return p.MaxHeaderBytes
 }
 
-func parseRequestLine(data []byte) (int, *RequestLine, error) {
+var httpVersion11 = []byte("HTTP/1.1")
+
+// parseRequestLine reads the request line in place, the method and version
+// come from fixed sets so only the target is copied
+func (r *Request) parseRequestLine(data []byte) (int, error) {
 	idx := bytes.Index(data, []byte(SEPARATOR))
+	if idx > MaxRequestLineBytes || (idx == -1 && len(data) > MaxRequestLineBytes) {
+		return 0, ErrRequestLineTooLong
+	}
 	if idx == -1 {
-		return 0, nil, nil
+		return 0, nil
 	}
+	line := data[:idx]
 
-	requstLine := string(data[:idx])
-
-	requestLineParts := strings.Split(requstLine, " ")
-
-	if len(requestLineParts) != 3 {
-		return 0, nil, errors.New("invalid parts count")
+	methodEnd := bytes.IndexByte(line, ' ')
+	targetEnd := bytes.LastIndexByte(line, ' ')
+	if methodEnd <= 0 || methodEnd == targetEnd || bytes.IndexByte(line[methodEnd+1:targetEnd], ' ') != -1 {
+		return 0, errors.New("invalid parts count")
 	}
+	method, target, version := line[:methodEnd], line[methodEnd+1:targetEnd], line[targetEnd+1:]
 
-	httpVersion, _ := strings.CutPrefix(requestLineParts[2], "HTTP/")
-	if httpVersion != "1.1" {
-		return 0, nil, fmt.Errorf("invalid http version, presented version is %s", httpVersion)
+	if !bytes.Equal(version, httpVersion11) {
+		httpVersion, _ := bytes.CutPrefix(version, []byte("HTTP/"))
+		if isHTTPVersion(version) {
+			return 0, fmt.Errorf("%w: %s", ErrVersionNotSupported, httpVersion)
+		}
+		return 0, fmt.Errorf("invalid http version, presented version is %s", httpVersion)
 	}
 
-	httpMethod := requestLineParts[0]
-	if strings.ToUpper(httpMethod) != httpMethod {
-		return 0, nil, fmt.Errorf("invalid http method, got %s", httpMethod)
-	} else if _, ok := AllowedMethods[httpMethod]; !ok {
-		return 0, nil, fmt.Errorf("http method is not allowed, got %s", httpMethod)
+	if bytes.ContainsFunc(method, func(c rune) bool { return c >= 'a' && c <= 'z' }) {
+		return 0, fmt.Errorf("invalid http method, got %s", method)
+	}
+	httpMethod := ""
+	for allowed := range AllowedMethods {
+		if string(method) == allowed {
+			httpMethod = allowed
+			break
+		}
+	}
+	if httpMethod == "" {
+		return 0, fmt.Errorf("%w: %s", ErrMethodNotImplemented, method)
 	}
 
-	requestTarget := requestLineParts[1]
-	if !strings.HasPrefix(requestTarget, "/") {
-		return 0, nil, fmt.Errorf("invalid path, got %s", requestTarget)
+	if len(target) == 0 || target[0] != '/' {
+		return 0, fmt.Errorf("invalid path, got %s", target)
 	}
 
-	res := RequestLine{
-		HTTPVersion:   httpVersion,
-		RequestTarget: requestTarget,
+	r.RequestLine = RequestLine{
+		HTTPVersion:   "1.1",
+		RequestTarget: r.view(target),
 		Method:        httpMethod,
 	}
+	return idx + len(SEPARATOR), nil
+}
+
+// isHTTPVersion matches HTTP-version from RFC 9112 section 2.3, only 1.1 is
+// served but other well formed versions get 505 rather than 400
+func isHTTPVersion(version []byte) bool {
+	digits, ok := bytes.CutPrefix(version, []byte("HTTP/"))
+	isDigit := func(c byte) bool { return c >= '0' && c <= '9' }
+	return ok && len(digits) == 3 && isDigit(digits[0]) && digits[1] == '.' && isDigit(digits[2])
+}
 
-	return len(data[:idx+len(SEPARATOR)]), &res, nil
+// parseField is headers.Parse storing views into the raw buffer
+func (r *Request) parseField(data []byte) (n int, done bool, err error) {
+	crlfIdx := bytes.Index(data, headers.CRLF)
+	if crlfIdx == -1 {
+		return 0, false, nil
+	}
+	if crlfIdx == 0 {
+		return 0, true, nil
+	}
+	name, value, err := headers.ParseField(data[:crlfIdx])
+	if err != nil {
+		return 0, false, err
+	}
+	if _, ok := r.Headers.Get("host"); ok && bytes.EqualFold(name, []byte("host")) {
+		return 0, false, errDuplicateHost
+	}
+	r.Headers.Add(r.viewKey(name), r.view(value))
+	return crlfIdx + len(headers.CRLF), false, nil
 }
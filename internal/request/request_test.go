@@ -1,7 +1,13 @@
 package request
 
 import (
+	"bytes"
+	"errors"
+	"httpfromtcp/internal/headers"
 	"io"
+	"os"
+	"strings"
+	"syscall"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -175,3 +181,237 @@ func TestParseBody(t *testing.T) {
 	_, err = RequestFromReader(reader)
 	require.Error(t, err)
 }
+
+func TestWrite(t *testing.T) {
+	// TEST: Round trip with Content-Length body
+	req, err := NewBuilder("POST", "/submit").
+		Host("localhost:42069").
+		Header("content-type", "text/plain").
+		Header("Accept", "*/*").
+		Body([]byte("hello world!\n")).
+		Build()
+	require.NoError(t, err)
+	buf := &bytes.Buffer{}
+	require.NoError(t, req.Write(buf))
+	assert.Equal(t, "POST /submit HTTP/1.1\r\n"+
+		"Host: localhost:42069\r\n"+
+		"Accept: */*\r\n"+
+		"Content-Type: text/plain\r\n"+
+		"Content-Length: 13\r\n"+
+		"\r\n"+
+		"hello world!\n", buf.String())
+	r, err := RequestFromReader(&chunkReader{data: buf.String(), numBytesPerRead: 3})
+	require.NoError(t, err)
+	assert.Equal(t, "POST", r.RequestLine.Method)
+	assert.Equal(t, "/submit", r.RequestLine.RequestTarget)
+	assert.Equal(t, "text/plain", r.Headers["content-type"])
+	assert.Equal(t, "hello world!\n", string(r.Body))
+
+	// TEST: Round trip with chunked body and trailers
+	req, err = NewBuilder("POST", "/upload").
+		Host("localhost:42069").
+		Body([]byte("chunked payload")).
+		Trailer("X-Checksum", "abc123").
+		Build()
+	require.NoError(t, err)
+	buf = &bytes.Buffer{}
+	require.NoError(t, req.Write(buf))
+	assert.Contains(t, buf.String(), "Transfer-Encoding: chunked\r\nTrailer: X-Checksum\r\n\r\n")
+	assert.True(t, strings.HasSuffix(buf.String(), "0\r\nX-Checksum: abc123\r\n\r\n"))
+	r, err = RequestFromReader(&chunkReader{data: buf.String(), numBytesPerRead: 2})
+	require.NoError(t, err)
+	assert.Equal(t, "chunked payload", string(r.Body))
+	assert.Equal(t, "abc123", r.Trailers["x-checksum"])
+
+	// TEST: GET without body has no framing headers
+	req, err = NewBuilder("GET", "/").Host("localhost").Build()
+	require.NoError(t, err)
+	buf = &bytes.Buffer{}
+	require.NoError(t, req.Write(buf))
+	assert.Equal(t, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n", buf.String())
+
+	// TEST: Streamed body of unknown length is sent chunked
+	req, err = NewBuilder("POST", "/upload").
+		Host("localhost").
+		BodyStream(&chunkReader{data: "streamed payload", numBytesPerRead: 3}).
+		Build()
+	require.NoError(t, err)
+	buf = &bytes.Buffer{}
+	require.NoError(t, req.Write(buf))
+	r, err = RequestFromReader(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "chunked", r.Headers["transfer-encoding"])
+	assert.Equal(t, "streamed payload", string(r.Body))
+
+	// TEST: Streamed body keeps its Content-Length and must fill it
+	req, err = NewBuilder("POST", "/upload").
+		Host("localhost").
+		Header("Content-Length", "8").
+		BodyStream(strings.NewReader("streamed")).
+		Build()
+	require.NoError(t, err)
+	buf = &bytes.Buffer{}
+	require.NoError(t, req.Write(buf))
+	assert.True(t, strings.HasSuffix(buf.String(), "Content-Length: 8\r\n\r\nstreamed"), buf.String())
+	req.BodyStream = strings.NewReader("short")
+	require.ErrorIs(t, req.Write(&bytes.Buffer{}), io.ErrUnexpectedEOF)
+
+	// TEST: Invalid header key
+	_, err = NewBuilder("GET", "/").Header("Bad Key", "x").Build()
+	require.Error(t, err)
+
+	// TEST: Header value with CRLF injection
+	_, err = NewBuilder("GET", "/").Header("X-Test", "a\r\nInjected: yes").Build()
+	require.Error(t, err)
+
+	// TEST: Forbidden trailer
+	_, err = NewBuilder("POST", "/").Trailer("Content-Length", "10").Build()
+	require.Error(t, err)
+
+	// TEST: Invalid method
+	_, err = NewBuilder("get", "/").Build()
+	require.Error(t, err)
+}
+
+func TestCookies(t *testing.T) {
+	// TEST: Cookies from several Cookie headers
+	r := newRequest()
+	r.Headers.Add("Cookie", "session=abc; theme=dark")
+	r.Headers.Add("Cookie", "lang=en")
+	cookies := r.Cookies()
+	require.Len(t, cookies, 3)
+	c, ok := r.Cookie("lang")
+	require.True(t, ok)
+	assert.Equal(t, "en", c.Value)
+	_, ok = r.Cookie("missing")
+	assert.False(t, ok)
+}
+
+type errReader struct {
+	data string
+	err  error
+}
+
+func (er *errReader) Read(p []byte) (int, error) {
+	n := copy(p, er.data)
+	er.data = er.data[n:]
+	if len(er.data) == 0 {
+		return n, er.err
+	}
+	return n, nil
+}
+
+func TestReadErrors(t *testing.T) {
+	var ioErr *IOError
+
+	// TEST: Close before a request is clean
+	_, err := RequestFromReader(&errReader{err: io.EOF})
+	require.ErrorAs(t, err, &ioErr)
+	assert.True(t, ioErr.Clean())
+
+	// TEST: Close in the middle of the headers
+	_, err = RequestFromReader(&errReader{data: "GET / HTTP/1.1\r\nHost: loc", err: io.EOF})
+	require.ErrorAs(t, err, &ioErr)
+	assert.Equal(t, IOErrorClientClosed, ioErr.Kind)
+	assert.False(t, ioErr.Clean())
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	// TEST: Data arriving together with EOF is still parsed
+	r, err := RequestFromReader(&errReader{data: "POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 2\r\n\r\nhi", err: io.EOF})
+	require.NoError(t, err)
+	assert.Equal(t, "hi", string(r.Body))
+
+	// TEST: Timeout and reset
+	_, err = RequestFromReader(&errReader{data: "GET", err: os.ErrDeadlineExceeded})
+	require.ErrorAs(t, err, &ioErr)
+	assert.True(t, ioErr.Timeout())
+	_, err = RequestFromReader(&errReader{err: syscall.ECONNRESET})
+	require.ErrorAs(t, err, &ioErr)
+	assert.Equal(t, IOErrorReset, ioErr.Kind)
+
+	// TEST: Bad input is not an io error
+	_, err = RequestFromReader(&errReader{data: "BREW / HTTP/1.1\r\n\r\n", err: io.EOF})
+	assert.ErrorIs(t, err, ErrMalformedRequest)
+	assert.False(t, errors.As(err, &ioErr))
+
+	// TEST: Other versions and Host problems are malformed requests
+	_, err = RequestFromReader(strings.NewReader("GET / HTTP/1.0\r\nHost: a\r\n\r\n"))
+	assert.ErrorIs(t, err, ErrVersionNotSupported)
+	assert.ErrorIs(t, err, ErrMalformedRequest)
+	_, err = RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\n\r\n"))
+	assert.ErrorIs(t, err, errMissingHost)
+	_, err = RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost: a\r\nhost: b\r\n\r\n"))
+	assert.ErrorIs(t, err, errDuplicateHost)
+
+	// TEST: Headers larger than the initial buffer
+	r, err = RequestFromReader(&chunkReader{
+		data:            "GET / HTTP/1.1\r\nHost: localhost\r\nX-Big: " + strings.Repeat("a", 3000) + "\r\n\r\n",
+		numBytesPerRead: 500,
+	})
+	require.NoError(t, err)
+	assert.Len(t, r.Headers["x-big"], 3000)
+}
+
+func FuzzRequestFromReader(f *testing.F) {
+	f.Add([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	f.Add([]byte("POST /submit HTTP/1.1\r\nHost: a\r\nContent-Length: 5\r\n\r\nhello"))
+	f.Add([]byte("POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\nTrailer: X-Sum\r\n\r\n5;ext=1\r\nhello\r\n0\r\nX-Sum: 1\r\n\r\n"))
+	f.Add([]byte("POST / HTTP/1.1\r\nContent-Length: 5\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n"))
+	f.Add([]byte("GET / HTTP/1.1\r\nHost: a\r\n folded\r\n\r\n"))
+	f.Add([]byte("OPTIONS /?a=b HTTP/1.1\r\nCookie: a=b\r\nCookie: c=d\r\n\r\n"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		whole, wholeErr := RequestFromReader(bytes.NewReader(data))
+		split, splitErr := RequestFromReader(&chunkReader{data: string(data), numBytesPerRead: 1})
+
+		// the outcome can't depend on how the bytes arrive
+		require.Equal(t, wholeErr == nil, splitErr == nil, "whole: %v, split: %v", wholeErr, splitErr)
+		if wholeErr != nil {
+			var ioErr *IOError
+			assert.True(t, errors.Is(wholeErr, ErrMalformedRequest) || errors.As(wholeErr, &ioErr), wholeErr)
+			return
+		}
+		assert.Equal(t, whole.RequestLine, split.RequestLine)
+		assert.Equal(t, whole.Headers, split.Headers)
+		assert.Equal(t, whole.Trailers, split.Trailers)
+		assert.Equal(t, string(whole.Body), string(split.Body))
+
+		// the length of the body is never ambiguous
+		_, hasLength := whole.Headers.Get(CONTENT_LENGTH_HEADER)
+		_, hasEncoding := whole.Headers.Get(TRANSFER_ENCODING_HEADER)
+		assert.False(t, hasLength && hasEncoding)
+		if length, ok := whole.Headers.GetInt(CONTENT_LENGTH_HEADER); ok {
+			assert.Len(t, whole.Body, length)
+		}
+	})
+}
+
+func TestRequestPool(t *testing.T) {
+	// TEST: A released request comes back empty
+	parser := NewParser(strings.NewReader("POST /first HTTP/1.1\r\nHost: localhost\r\nX-Only-First: 1\r\nContent-Length: 5\r\n\r\nhello"))
+	r := AcquireRequest()
+	require.NoError(t, parser.ReadRequestHeadInto(r))
+	require.NoError(t, parser.ReadBody(r))
+	assert.Equal(t, "/first", r.RequestLine.RequestTarget)
+	assert.Equal(t, "1", r.Headers["x-only-first"])
+	ReleaseRequest(r)
+
+	// TEST: Reusing it doesn't carry anything over
+	parser.Reset(strings.NewReader("GET /second HTTP/1.1\r\nHost: localhost\r\nX-Custom: Two\r\n\r\n"))
+	r = AcquireRequest()
+	require.NoError(t, parser.ReadRequestHeadInto(r))
+	assert.Equal(t, RequestLine{HTTPVersion: "1.1", RequestTarget: "/second", Method: "GET"}, r.RequestLine)
+	assert.Equal(t, headers.Headers{"host": "localhost", "x-custom": "Two"}, r.Headers)
+	assert.Empty(t, r.Body)
+	assert.False(t, r.BodyPending())
+	ReleaseRequest(r)
+
+	// TEST: Views stay valid while the raw buffer grows
+	long := strings.Repeat("v", 2*rawSize)
+	r, err := RequestFromReader(strings.NewReader("GET /a HTTP/1.1\r\nHost: localhost\r\nX-Short: s\r\nX-Long: " + long + "\r\nX-After: a\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "/a", r.RequestLine.RequestTarget)
+	assert.Equal(t, "s", r.Headers["x-short"])
+	assert.Equal(t, long, r.Headers["x-long"])
+	assert.Equal(t, "a", r.Headers["x-after"])
+}
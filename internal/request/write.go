@@ -0,0 +1,220 @@
+package request
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"httpfromtcp/internal/chunked"
+	"httpfromtcp/internal/headers"
+	"io"
+	"strings"
+)
+
+var (
+	errEmptyMethod       = errors.New("empty method")
+	errInvalidTarget     = errors.New("invalid request target")
+	errInvalidHeaderKey  = errors.New("invalid header key")
+	errInvalidHeaderVal  = errors.New("invalid header value")
+	errForbiddenTrailers = errors.New("trailer field is not allowed")
+)
+
+var bodyMethods = map[string]struct{}{
+	"POST":  {},
+	"PUT":   {},
+	"PATCH": {},
+}
+
+// Write serializes the request: request line, Host first and then the rest of
+// the headers in sorted order. The body is framed with Content-Length unless
+// the request is chunked or carries trailers, or is a BodyStream of unknown
+// length.
+func (r *Request) Write(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+
+	httpVersion := r.RequestLine.HTTPVersion
+	if httpVersion == "" {
+		httpVersion = "1.1"
+	}
+	fmt.Fprintf(bw, "%s %s HTTP/%s\r\n", r.RequestLine.Method, r.RequestLine.RequestTarget, httpVersion)
+
+	if host, ok := r.Headers.Get("host"); ok {
+		fmt.Fprintf(bw, "Host: %s\r\n", host)
+	}
+
+	streamLength, hasStreamLength := -1, false
+	if r.BodyStream != nil {
+		if value, ok := r.Headers.Get(CONTENT_LENGTH_HEADER); ok {
+			streamLength, hasStreamLength = headers.ParseContentLength(value)
+			if !hasStreamLength {
+				return fmt.Errorf("%w: %q", errBadContentLength, value)
+			}
+		}
+	}
+
+	isChunked := r.isChunked() || len(r.Trailers) > 0 || (r.BodyStream != nil && !hasStreamLength)
+	for _, key := range r.Headers.Keys() {
+		switch strings.ToLower(key) {
+		case "host", CONTENT_LENGTH_HEADER, TRANSFER_ENCODING_HEADER, "trailer":
+			continue
+		}
+		fmt.Fprintf(bw, "%s: %s\r\n", headers.CanonicalKey(key), r.Headers[key])
+	}
+
+	if isChunked {
+		bw.WriteString("Transfer-Encoding: chunked\r\n")
+		if len(r.Trailers) > 0 {
+			names := make([]string, 0, len(r.Trailers))
+			for _, key := range r.Trailers.Keys() {
+				names = append(names, headers.CanonicalKey(key))
+			}
+			fmt.Fprintf(bw, "Trailer: %s\r\n", strings.Join(names, ", "))
+		}
+		bw.WriteString("\r\n")
+		if err := r.writeChunks(bw); err != nil {
+			return err
+		}
+		if _, err := chunked.WriteLastChunk(bw, r.Trailers); err != nil {
+			return err
+		}
+		return bw.Flush()
+	}
+
+	if r.BodyStream != nil {
+		fmt.Fprintf(bw, "Content-Length: %d\r\n\r\n", streamLength)
+		n, err := io.CopyN(bw, r.BodyStream, int64(streamLength))
+		if err == io.EOF {
+			return fmt.Errorf("%w: body ended after %d of %d bytes", io.ErrUnexpectedEOF, n, streamLength)
+		}
+		if err != nil {
+			return err
+		}
+		return bw.Flush()
+	}
+
+	if _, ok := bodyMethods[r.RequestLine.Method]; ok || len(r.Body) > 0 {
+		fmt.Fprintf(bw, "Content-Length: %d\r\n", len(r.Body))
+	}
+	bw.WriteString("\r\n")
+	bw.Write(r.Body)
+	return bw.Flush()
+}
+
+// writeChunks sends Body as one chunk, or BodyStream a read at a time
+func (r *Request) writeChunks(w io.Writer) error {
+	if r.BodyStream == nil {
+		_, err := chunked.WriteChunk(w, r.Body)
+		return err
+	}
+	buffer := make([]byte, 32*1024)
+	for {
+		n, err := r.BodyStream.Read(buffer)
+		if _, werr := chunked.WriteChunk(w, buffer[:n]); werr != nil {
+			return werr
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Builder constructs requests programmatically, errors are collected and
+// reported by Build
+type Builder struct {
+	request Request
+	err     error
+}
+
+func NewBuilder(method, target string) *Builder {
+	request := newRequest()
+	request.ParserState = parserStateDone
+	request.RequestLine = RequestLine{
+		HTTPVersion:   "1.1",
+		RequestTarget: target,
+		Method:        method,
+	}
+	return &Builder{request: request}
+}
+
+func (b *Builder) setErr(err error) *Builder {
+	if b.err == nil {
+		b.err = err
+	}
+	return b
+}
+
+func validField(key, value string) error {
+	if !headers.IsToken([]byte(key)) {
+		return fmt.Errorf("%w: %q", errInvalidHeaderKey, key)
+	}
+	if strings.ContainsAny(value, "\r\n\x00") {
+		return fmt.Errorf("%w: %q", errInvalidHeaderVal, value)
+	}
+	return nil
+}
+
+func (b *Builder) Header(key, value string) *Builder {
+	if err := validField(key, value); err != nil {
+		return b.setErr(err)
+	}
+	b.request.Headers.Add(key, value)
+	return b
+}
+
+func (b *Builder) Host(host string) *Builder {
+	b.request.Headers.Remove("host")
+	return b.Header("Host", host)
+}
+
+func (b *Builder) Body(body []byte) *Builder {
+	b.request.Body = body
+	return b
+}
+
+// BodyStream sends the body from body, see Request.BodyStream
+func (b *Builder) BodyStream(body io.Reader) *Builder {
+	b.request.BodyStream = body
+	return b
+}
+
+func (b *Builder) Chunked() *Builder {
+	b.request.Headers.Remove(TRANSFER_ENCODING_HEADER)
+	b.request.Headers.Add(TRANSFER_ENCODING_HEADER, "chunked")
+	return b
+}
+
+// Trailer adds a trailer field, the request gets sent chunked
+func (b *Builder) Trailer(key, value string) *Builder {
+	if err := validField(key, value); err != nil {
+		return b.setErr(err)
+	}
+	if headers.IsForbiddenTrailer(key) {
+		return b.setErr(fmt.Errorf("%w: %s", errForbiddenTrailers, key))
+	}
+	b.request.Trailers.Add(key, value)
+	return b.Chunked()
+}
+
+func (b *Builder) Build() (*Request, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+
+	method := b.request.RequestLine.Method
+	if method == "" {
+		return nil, errEmptyMethod
+	}
+	if !headers.IsToken([]byte(method)) || strings.ToUpper(method) != method {
+		return nil, fmt.Errorf("invalid http method, got %s", method)
+	}
+
+	target := b.request.RequestLine.RequestTarget
+	if target == "" || strings.ContainsAny(target, " \r\n") {
+		return nil, fmt.Errorf("%w: %q", errInvalidTarget, target)
+	}
+
+	request := b.request
+	return &request, nil
+}
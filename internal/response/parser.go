@@ -0,0 +1,390 @@
+package response
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"httpfromtcp/internal/chunked"
+	"httpfromtcp/internal/headers"
+	"io"
+	"strconv"
+	"strings"
+)
+
+type ParserState string
+
+const (
+	parserStateInitialized    ParserState = "init"
+	parserStateDone           ParserState = "done"
+	parserStateParsingHeaders ParserState = "headers"
+	parserStateParsingBody    ParserState = "body"
+	parserStateParsingChunked ParserState = "chunked"
+)
+
+type bodyFraming int
+
+const (
+	bodyNone bodyFraming = iota
+	bodyContentLength
+	bodyChunked
+	bodyUntilClose
+)
+
+type Response struct {
+	StatusLine  StatusLine
+	ParserState ParserState
+	Headers     headers.Headers
+	// Trailers are only filled for chunked bodies
+	Trailers headers.Headers
+	Body     []byte
+	// SetCookies has every Set-Cookie line on its own, the folded value in
+	// Headers can't be split again since Expires holds a comma
+	SetCookies []string
+
+	requestMethod string
+	framing       bodyFraming
+	remaining     int
+	decoder       *chunked.Decoder
+}
+
+type StatusLine struct {
+	HTTPVersion string
+	StatusCode  StatusCode
+	Reason      string
+}
+
+var (
+	SEPARATOR              = "\r\n"
+	errMalformedStatusLine = errors.New("malformed status line")
+	errBadContentLength    = errors.New("bad content-length")
+	// ErrHeadersTooLarge is returned for a status line and headers longer
+	// than Parser.MaxHeaderBytes
+	ErrHeadersTooLarge = errors.New("response headers too large")
+	// errUnexpectedEOF wraps io.ErrUnexpectedEOF so callers can tell a
+	// dropped connection from a bad response
+	errUnexpectedEOF = fmt.Errorf("connection closed before message end: %w", io.ErrUnexpectedEOF)
+)
+
+func newResponse(requestMethod string) Response {
+	return Response{
+		ParserState:   parserStateInitialized,
+		Headers:       headers.NewHeaders(),
+		Trailers:      headers.NewHeaders(),
+		requestMethod: requestMethod,
+	}
+}
+
+// KeepAlive reports whether the connection can carry another message
+// after this response
+func (r *Response) KeepAlive() bool {
+	if r.framing == bodyUntilClose {
+		return false
+	}
+	connection, _ := r.Headers.Get("connection")
+	connection = strings.ToLower(connection)
+	if r.StatusLine.HTTPVersion == "1.0" {
+		return strings.Contains(connection, "keep-alive")
+	}
+	return !strings.Contains(connection, "close")
+}
+
+func (r *Response) IsInformational() bool {
+	return r.StatusLine.StatusCode >= 100 && r.StatusLine.StatusCode < 200
+}
+
+func (r *Response) headersDone() bool {
+	return r.ParserState != parserStateInitialized && r.ParserState != parserStateParsingHeaders
+}
+
+func (r *Response) bodyFraming() (bodyFraming, error) {
+	statusCode := r.StatusLine.StatusCode
+	if r.requestMethod == "HEAD" || r.IsInformational() || statusCode == 204 || statusCode == 304 {
+		return bodyNone, nil
+	}
+
+	if transferEncoding, ok := r.Headers.Get("transfer-encoding"); ok {
+		codings := strings.Split(transferEncoding, ",")
+		if strings.EqualFold(strings.TrimSpace(codings[len(codings)-1]), "chunked") {
+			return bodyChunked, nil
+		}
+		return bodyUntilClose, nil
+	}
+
+	if value, ok := r.Headers.Get("content-length"); ok {
+		contentLength, ok := headers.ParseContentLength(value)
+		if !ok {
+			return bodyNone, fmt.Errorf("%w: %q", errBadContentLength, value)
+		}
+		r.remaining = contentLength
+		if contentLength == 0 {
+			return bodyNone, nil
+		}
+		return bodyContentLength, nil
+	}
+
+	return bodyUntilClose, nil
+}
+
+func (r *Response) parse(data []byte) (int, error) {
+	read := 0
+
+	for {
+		switch r.ParserState {
+		case parserStateDone:
+			return read, nil
+		case parserStateInitialized:
+			bytesRead, statusLine, err := parseStatusLine(data[read:])
+			if err != nil {
+				return read, err
+			}
+			if bytesRead == 0 {
+				return read, nil
+			}
+			r.StatusLine = *statusLine
+			read += bytesRead
+			r.ParserState = parserStateParsingHeaders
+		case parserStateParsingHeaders:
+			bytesRead, done, err := r.parseField(data[read:])
+			if err != nil {
+				return read, err
+			}
+			read += bytesRead
+			if done {
+				read += len(headers.CRLF)
+				framing, err := r.bodyFraming()
+				if err != nil {
+					return read, err
+				}
+				r.framing = framing
+				switch framing {
+				case bodyNone:
+					r.ParserState = parserStateDone
+				case bodyChunked:
+					r.decoder = chunked.NewDecoder(r.Trailers)
+					r.ParserState = parserStateParsingChunked
+				default:
+					r.ParserState = parserStateParsingBody
+				}
+				continue
+			}
+			if bytesRead == 0 {
+				return read, nil
+			}
+		case parserStateParsingBody:
+			available := data[read:]
+			if r.framing == bodyUntilClose {
+				r.Body = append(r.Body, available...)
+				return len(data), nil
+			}
+			taken := min(r.remaining, len(available))
+			r.Body = append(r.Body, available[:taken]...)
+			r.remaining -= taken
+			read += taken
+			if r.remaining == 0 {
+				r.ParserState = parserStateDone
+			}
+			return read, nil
+		case parserStateParsingChunked:
+			bytesRead, body, err := r.decoder.Decode(data[read:], r.Body)
+			r.Body = body
+			read += bytesRead
+			if err != nil {
+				return read, err
+			}
+			if r.decoder.Done() {
+				r.ParserState = parserStateDone
+			}
+			return read, nil
+		}
+	}
+}
+
+// parseField is Headers.Parse noting Set-Cookie lines in SetCookies
+func (r *Response) parseField(data []byte) (int, bool, error) {
+	bytesRead, done, err := r.Headers.Parse(data)
+	if err != nil || bytesRead == 0 {
+		return bytesRead, done, err
+	}
+	name, value, err := headers.ParseField(data[:bytesRead-len(headers.CRLF)])
+	if err == nil && strings.EqualFold(string(name), "set-cookie") {
+		r.SetCookies = append(r.SetCookies, string(value))
+	}
+	return bytesRead, done, nil
+}
+
+// eof is called when the reader is exhausted, only close delimited
+// bodies may end this way
+func (r *Response) eof() error {
+	if r.ParserState == parserStateParsingBody && r.framing == bodyUntilClose {
+		r.ParserState = parserStateDone
+		return nil
+	}
+	return errUnexpectedEOF
+}
+
+func parseStatusLine(data []byte) (int, *StatusLine, error) {
+	idx := bytes.Index(data, []byte(SEPARATOR))
+	if idx == -1 {
+		return 0, nil, nil
+	}
+
+	statusLine := string(data[:idx])
+	statusLineParts := strings.SplitN(statusLine, " ", 3)
+	if len(statusLineParts) < 2 {
+		return 0, nil, fmt.Errorf("%w: %q", errMalformedStatusLine, statusLine)
+	}
+
+	httpVersion, ok := strings.CutPrefix(statusLineParts[0], "HTTP/")
+	if !ok || (httpVersion != "1.1" && httpVersion != "1.0") {
+		return 0, nil, fmt.Errorf("invalid http version, presented version is %s", statusLineParts[0])
+	}
+
+	statusCode, err := strconv.Atoi(statusLineParts[1])
+	if err != nil || len(statusLineParts[1]) != 3 {
+		return 0, nil, fmt.Errorf("%w: status code %q", errMalformedStatusLine, statusLineParts[1])
+	}
+
+	res := StatusLine{
+		HTTPVersion: httpVersion,
+		StatusCode:  StatusCode(statusCode),
+	}
+	if len(statusLineParts) == 3 {
+		res.Reason = statusLineParts[2]
+	}
+
+	return idx + len(SEPARATOR), &res, nil
+}
+
+// Parser reads consecutive responses off one connection, bytes read past
+// the end of a response are kept for the next one
+type Parser struct {
+	// MaxHeaderBytes bounds the status line and headers together, 0 uses
+	// DefaultMaxHeaderBytes
+	MaxHeaderBytes int
+
+	reader    io.Reader
+	buffer    []byte
+	bufferLen int
+	// headRead counts the head bytes consumed for the current response
+	headRead int
+}
+
+const DefaultMaxHeaderBytes = 1 << 20
+
+func NewParser(reader io.Reader) *Parser {
+	return &Parser{
+		reader: reader,
+		buffer: make([]byte, 1024),
+	}
+}
+
+func ResponseFromReader(reader io.Reader) (*Response, error) {
+	return NewParser(reader).ReadResponse("")
+}
+
+// ReadResponse reads a whole response, requestMethod is needed to know that
+// responses to HEAD have no body
+func (p *Parser) ReadResponse(requestMethod string) (*Response, error) {
+	response, err := p.ReadResponseHead(requestMethod)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.advance(response, func() bool { return response.ParserState == parserStateDone }); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// ReadResponseHead stops after the headers, the body is then read with BodyReader
+func (p *Parser) ReadResponseHead(requestMethod string) (*Response, error) {
+	response := newResponse(requestMethod)
+	p.headRead = 0
+	if err := p.advance(&response, response.headersDone); err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
+
+func (p *Parser) BodyReader(response *Response) io.Reader {
+	return &bodyReader{parser: p, response: response}
+}
+
+func (p *Parser) advance(response *Response, until func() bool) error {
+	for {
+		// the head is parsed no further than the limit, so one that
+		// arrived whole in one read is held to it too
+		inHead := !response.headersDone()
+		window := p.bufferLen
+		if inHead {
+			window = min(window, max(p.maxHeaderBytes()-p.headRead, 0))
+		}
+		consumedBytes, err := response.parse(p.buffer[:window])
+		if err != nil {
+			return fmt.Errorf("error parsing data %w", err)
+		}
+		copy(p.buffer, p.buffer[consumedBytes:p.bufferLen])
+		p.bufferLen -= consumedBytes
+		if inHead {
+			p.headRead += consumedBytes
+			if !response.headersDone() && p.headRead+p.bufferLen > p.maxHeaderBytes() {
+				return ErrHeadersTooLarge
+			}
+		}
+
+		if until() {
+			return nil
+		}
+		if consumedBytes > 0 && p.bufferLen > 0 {
+			continue
+		}
+
+		if p.bufferLen == len(p.buffer) {
+			p.buffer = append(p.buffer, make([]byte, len(p.buffer))...)
+		}
+		readBytes, err := p.reader.Read(p.buffer[p.bufferLen:])
+		p.bufferLen += readBytes
+		if err == io.EOF && readBytes == 0 {
+			if err := response.eof(); err != nil {
+				return err
+			}
+			return nil
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+	}
+}
+
+func (p *Parser) maxHeaderBytes() int {
+	if p.MaxHeaderBytes <= 0 {
+		return DefaultMaxHeaderBytes
+	}
+	return p.MaxHeaderBytes
+}
+
+type bodyReader struct {
+	parser   *Parser
+	response *Response
+}
+
+func (br *bodyReader) Read(p []byte) (int, error) {
+	response := br.response
+	if len(response.Body) == 0 {
+		if response.ParserState == parserStateDone {
+			return 0, io.EOF
+		}
+		err := br.parser.advance(response, func() bool {
+			return len(response.Body) > 0 || response.ParserState == parserStateDone
+		})
+		if err != nil {
+			return 0, err
+		}
+		if len(response.Body) == 0 {
+			return 0, io.EOF
+		}
+	}
+
+	n := copy(p, response.Body)
+	response.Body = response.Body[n:]
+	return n, nil
+}
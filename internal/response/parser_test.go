@@ -0,0 +1,213 @@
+package response
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type chunkReader struct {
+	data            string
+	numBytesPerRead int
+	pos             int
+}
+
+// Read reads up to len(p) or numBytesPerRead bytes from the string per call
+// its useful for simulating reading a variable number of bytes per chunk from a network connection
+func (cr *chunkReader) Read(p []byte) (n int, err error) {
+	if cr.pos >= len(cr.data) {
+		return 0, io.EOF
+	}
+	endIndex := min(cr.pos+cr.numBytesPerRead, len(cr.data))
+	n = copy(p, cr.data[cr.pos:endIndex])
+	cr.pos += n
+
+	return n, nil
+}
+
+func TestStatusLine(t *testing.T) {
+	// TEST: Good status line
+	reader := &chunkReader{
+		data:            "HTTP/1.1 404 Not Found\r\nContent-Length: 0\r\n\r\n",
+		numBytesPerRead: 1,
+	}
+	r, err := ResponseFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "1.1", r.StatusLine.HTTPVersion)
+	assert.Equal(t, StatusCode(404), r.StatusLine.StatusCode)
+	assert.Equal(t, "Not Found", r.StatusLine.Reason)
+
+	// TEST: Empty reason phrase
+	reader = &chunkReader{
+		data:            "HTTP/1.1 299\r\nContent-Length: 0\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err = ResponseFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, StatusCode(299), r.StatusLine.StatusCode)
+	assert.Equal(t, "", r.StatusLine.Reason)
+
+	// TEST: Invalid status code
+	reader = &chunkReader{
+		data:            "HTTP/1.1 20 OK\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	_, err = ResponseFromReader(reader)
+	require.Error(t, err)
+
+	// TEST: Invalid version
+	reader = &chunkReader{
+		data:            "HTTP/2 200 OK\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	_, err = ResponseFromReader(reader)
+	require.Error(t, err)
+}
+
+func TestParseBody(t *testing.T) {
+	// TEST: Content-Length body
+	reader := &chunkReader{
+		data:            "HTTP/1.1 200 OK\r\nContent-Length: 13\r\n\r\nhello world!\n",
+		numBytesPerRead: 3,
+	}
+	r, err := ResponseFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "hello world!\n", string(r.Body))
+	assert.True(t, r.KeepAlive())
+
+	// TEST: Chunked body with extensions and trailers
+	reader = &chunkReader{
+		data: "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\nTrailer: X-Sum\r\n\r\n" +
+			"5;name=value\r\nhello\r\n" +
+			"7\r\n, world\r\n" +
+			"0\r\nX-Sum: 42\r\n\r\n",
+		numBytesPerRead: 2,
+	}
+	r, err = ResponseFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "hello, world", string(r.Body))
+	assert.Equal(t, "42", r.Trailers["x-sum"])
+
+	// TEST: Malformed chunk size
+	reader = &chunkReader{
+		data:            "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\nhello\r\n0\r\n\r\n",
+		numBytesPerRead: 4,
+	}
+	_, err = ResponseFromReader(reader)
+	require.Error(t, err)
+
+	// TEST: Close delimited body
+	reader = &chunkReader{
+		data:            "HTTP/1.1 200 OK\r\nConnection: close\r\n\r\nread until eof",
+		numBytesPerRead: 5,
+	}
+	r, err = ResponseFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "read until eof", string(r.Body))
+	assert.False(t, r.KeepAlive())
+
+	// TEST: Body shorter than reported content length
+	reader = &chunkReader{
+		data:            "HTTP/1.1 200 OK\r\nContent-Length: 20\r\n\r\npartial content",
+		numBytesPerRead: 3,
+	}
+	_, err = ResponseFromReader(reader)
+	require.Error(t, err)
+
+	// TEST: Content-Length takes digits only
+	for _, length := range []string{"+5", "-1", " 0x5", "5, 6"} {
+		_, err = ResponseFromReader(strings.NewReader("HTTP/1.1 200 OK\r\nContent-Length: " + length + "\r\n\r\nhello"))
+		require.ErrorIs(t, err, errBadContentLength, length)
+	}
+	r, err = ResponseFromReader(strings.NewReader("HTTP/1.1 200 OK\r\nContent-Length: 5, 5\r\n\r\nhello"))
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(r.Body))
+
+	// TEST: No body status codes ignore framing headers
+	for _, status := range []string{"100 Continue", "204 No Content", "304 Not Modified"} {
+		reader = &chunkReader{
+			data:            "HTTP/1.1 " + status + "\r\nContent-Length: 10\r\n\r\n",
+			numBytesPerRead: 3,
+		}
+		r, err = ResponseFromReader(reader)
+		require.NoError(t, err)
+		assert.Empty(t, r.Body)
+	}
+
+	// TEST: HEAD response has no body
+	parser := NewParser(strings.NewReader("HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\n"))
+	r, err = parser.ReadResponse("HEAD")
+	require.NoError(t, err)
+	assert.Empty(t, r.Body)
+}
+
+func TestParser(t *testing.T) {
+	// TEST: Interim and final response on one connection
+	parser := NewParser(&chunkReader{
+		data: "HTTP/1.1 100 Continue\r\n\r\n" +
+			"HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok" +
+			"HTTP/1.1 201 Created\r\nContent-Length: 0\r\n\r\n",
+		numBytesPerRead: 7,
+	})
+	r, err := parser.ReadResponse("POST")
+	require.NoError(t, err)
+	assert.True(t, r.IsInformational())
+	r, err = parser.ReadResponse("POST")
+	require.NoError(t, err)
+	assert.Equal(t, "ok", string(r.Body))
+	r, err = parser.ReadResponse("GET")
+	require.NoError(t, err)
+	assert.Equal(t, StatusCode(201), r.StatusLine.StatusCode)
+
+	// TEST: Streaming chunked body
+	parser = NewParser(&chunkReader{
+		data:            "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n3\r\ndef\r\n0\r\n\r\n",
+		numBytesPerRead: 1,
+	})
+	r, err = parser.ReadResponseHead("GET")
+	require.NoError(t, err)
+	body, err := io.ReadAll(parser.BodyReader(r))
+	require.NoError(t, err)
+	assert.Equal(t, "abcdef", string(body))
+
+	// TEST: Long headers grow the buffer
+	long := strings.Repeat("a", 3000)
+	r, err = ResponseFromReader(strings.NewReader("HTTP/1.1 200 OK\r\nX-Long: " + long + "\r\nContent-Length: 0\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, long, r.Headers["x-long"])
+
+	// TEST: Endless status line stops at the head limit
+	parser = NewParser(io.MultiReader(strings.NewReader("HTTP/1.1 200 "), endless{}))
+	parser.MaxHeaderBytes = 4096
+	_, err = parser.ReadResponseHead("GET")
+	require.ErrorIs(t, err, ErrHeadersTooLarge)
+	assert.LessOrEqual(t, len(parser.buffer), 2*4096)
+
+	// TEST: Headers over the limit are refused even when they arrive whole
+	parser = NewParser(strings.NewReader("HTTP/1.1 200 OK\r\nX-Long: " + long + "\r\nContent-Length: 0\r\n\r\n"))
+	parser.MaxHeaderBytes = 1024
+	_, err = parser.ReadResponseHead("GET")
+	require.ErrorIs(t, err, ErrHeadersTooLarge)
+
+	// TEST: Limit applies to each response on a connection on its own
+	head := "HTTP/1.1 200 OK\r\nX-Pad: " + strings.Repeat("p", 600) + "\r\nContent-Length: 0\r\n\r\n"
+	parser = NewParser(strings.NewReader(head + head))
+	parser.MaxHeaderBytes = 1024
+	_, err = parser.ReadResponse("GET")
+	require.NoError(t, err)
+	_, err = parser.ReadResponse("GET")
+	require.NoError(t, err)
+}
+
+// endless never runs out of header bytes
+type endless struct{}
+
+func (endless) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 'a'
+	}
+	return len(p), nil
+}
@@ -1,23 +1,66 @@
 package response
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
+	"httpfromtcp/internal/chunked"
+	"httpfromtcp/internal/cookie"
 	"httpfromtcp/internal/headers"
 	"io"
+	"net"
+	"strings"
 )
 
 type StatusCode int
 
 const (
-	StatusCodeOk                  StatusCode = 200
-	StatusCodeBadRequest          StatusCode = 400
-	StatusCodeInternalServerError StatusCode = 500
+	StatusCodeContinue             StatusCode = 100
+	StatusCodeSwitchingProtocols   StatusCode = 101
+	StatusCodeEarlyHints           StatusCode = 103
+	StatusCodeOk                   StatusCode = 200
+	StatusCodeNoContent            StatusCode = 204
+	StatusCodeNotModified          StatusCode = 304
+	StatusCodeBadRequest           StatusCode = 400
+	StatusCodeUnauthorized         StatusCode = 401
+	StatusCodeForbidden            StatusCode = 403
+	StatusCodeNotFound             StatusCode = 404
+	StatusCodeContentTooLarge      StatusCode = 413
+	StatusCodeURITooLong           StatusCode = 414
+	StatusCodeExpectationFailed    StatusCode = 417
+	StatusCodeTooManyRequests      StatusCode = 429
+	StatusCodeHeaderFieldsTooLarge StatusCode = 431
+	StatusCodeInternalServerError  StatusCode = 500
+	StatusCodeNotImplemented       StatusCode = 501
+	StatusCodeBadGateway           StatusCode = 502
+	StatusCodeServiceUnavailable   StatusCode = 503
+	StatusCodeGatewayTimeout       StatusCode = 504
+	StatusCodeVersionNotSupported  StatusCode = 505
 )
 
 var ReasonStatusLineMap = map[StatusCode]string{
-	StatusCodeOk:                  "OK",
-	StatusCodeBadRequest:          "Bad Request",
-	StatusCodeInternalServerError: "Internal Server Error",
+	StatusCodeContinue:             "Continue",
+	StatusCodeSwitchingProtocols:   "Switching Protocols",
+	StatusCodeEarlyHints:           "Early Hints",
+	StatusCodeOk:                   "OK",
+	StatusCodeNoContent:            "No Content",
+	StatusCodeNotModified:          "Not Modified",
+	StatusCodeBadRequest:           "Bad Request",
+	StatusCodeUnauthorized:         "Unauthorized",
+	StatusCodeForbidden:            "Forbidden",
+	StatusCodeNotFound:             "Not Found",
+	StatusCodeContentTooLarge:      "Content Too Large",
+	StatusCodeURITooLong:           "URI Too Long",
+	StatusCodeExpectationFailed:    "Expectation Failed",
+	StatusCodeTooManyRequests:      "Too Many Requests",
+	StatusCodeHeaderFieldsTooLarge: "Request Header Fields Too Large",
+	StatusCodeInternalServerError:  "Internal Server Error",
+	StatusCodeNotImplemented:       "Not Implemented",
+	StatusCodeBadGateway:           "Bad Gateway",
+	StatusCodeServiceUnavailable:   "Service Unavailable",
+	StatusCodeGatewayTimeout:       "Gateway Timeout",
+	StatusCodeVersionNotSupported:  "HTTP Version Not Supported",
 }
 
 func WriteStatusLine(w io.Writer, statusCode StatusCode) error {
@@ -36,7 +79,6 @@ func GetDefaultHeaders(contentLen int) headers.Headers {
 	resHeaders := headers.NewHeaders()
 
 	resHeaders["Content-Length"] = fmt.Sprint(contentLen)
-	resHeaders["Connection"] = "close"
 	resHeaders["Content-Type"] = "text/plain"
 
 	return resHeaders
@@ -54,15 +96,205 @@ func WriteHeaders(w io.Writer, headers headers.Headers) error {
 	return nil
 }
 
+var (
+	ErrHijackNotSupported  = errors.New("writer is not backed by a connection")
+	ErrHijacked            = errors.New("connection has been hijacked")
+	ErrForbiddenTrailer    = errors.New("field is not allowed as a trailer")
+	ErrTrailerNotDeclared  = errors.New("trailer was not declared in the Trailer header")
+	ErrChunkedBodyFinished = errors.New("chunked body already finished")
+	ErrNotInformational    = errors.New("status code is not informational")
+	ErrStatusAlreadySent   = errors.New("final status already sent")
+)
+
+const DefaultBufferSize = 4096
+
+// Flusher is implemented by writers that buffer output, middleware wrapping
+// a writer should keep it so streaming handlers can push data out
+type Flusher interface {
+	Flush() error
+}
+
+var _ Flusher = (*Writer)(nil)
+
+// Writer writes a response to Writer. Writers made with NewWriter buffer the
+// output and need a Flush, a Writer built as a literal writes straight through.
 type Writer struct {
 	Writer io.Writer
+
+	buffer   *bufio.Writer
+	conn     net.Conn
+	hijacked bool
+	// readBuffered returns what was read off conn past the request
+	readBuffered func() []byte
+
+	declaredTrailers []string
+	trailers         headers.Headers
+	bodyDone         bool
+
+	statusCode StatusCode
+	// bodyBytes counts body bytes without chunk framing, for access logs
+	bodyBytes int64
+	// cookies are written as separate Set-Cookie lines by WriteHeaders
+	cookies []string
+	// extraHeaders are added by middleware on top of the handler's headers
+	extraHeaders headers.Headers
+	// beforeHeaders run once, right before the headers go out
+	beforeHeaders []func(w *Writer)
+
+	// what WriteHeaders sent, KeepAlive decides on it
+	headersSent   bool
+	closeAfter    bool
+	chunkedBody   bool
+	contentLength int64
+}
+
+func NewWriter(conn net.Conn) *Writer {
+	return NewWriterSize(conn, DefaultBufferSize)
+}
+
+func NewWriterSize(conn net.Conn, size int) *Writer {
+	if size <= 0 {
+		size = DefaultBufferSize
+	}
+	return &Writer{
+		Writer: conn,
+		buffer: bufio.NewWriterSize(conn, size),
+		conn:   conn,
+	}
+}
+
+func (w *Writer) out() io.Writer {
+	if w.buffer != nil {
+		return w.buffer
+	}
+	return w.Writer
+}
+
+// Flush sends everything buffered so far to the connection
+func (w *Writer) Flush() error {
+	if w.buffer == nil || w.hijacked {
+		return nil
+	}
+	return w.buffer.Flush()
+}
+
+// Buffered is the number of bytes waiting for a Flush
+func (w *Writer) Buffered() int {
+	if w.buffer == nil {
+		return 0
+	}
+	return w.buffer.Buffered()
+}
+
+// SetReadBuffered tells Hijack where to find bytes the server already read
+// off the connection, they may only be valid until the handler returns
+func (w *Writer) SetReadBuffered(fn func() []byte) {
+	w.readBuffered = fn
+}
+
+// Hijack hands the connection over to the caller, the server will neither
+// write to it nor close it after the handler returns. Reads should go through
+// the returned reader, it starts with what the server read past the request.
+func (w *Writer) Hijack() (net.Conn, *bufio.Reader, error) {
+	if w.conn == nil {
+		return nil, nil, ErrHijackNotSupported
+	}
+	if w.hijacked {
+		return nil, nil, ErrHijacked
+	}
+	if err := w.Flush(); err != nil {
+		return nil, nil, err
+	}
+	w.hijacked = true
+
+	var reader io.Reader = w.conn
+	if w.readBuffered != nil {
+		if buffered := w.readBuffered(); len(buffered) > 0 {
+			reader = io.MultiReader(bytes.NewReader(bytes.Clone(buffered)), w.conn)
+		}
+	}
+	return w.conn, bufio.NewReader(reader), nil
+}
+
+func (w *Writer) Hijacked() bool {
+	return w.hijacked
+}
+
+// Reset readies the writer for the next response on the same connection,
+// what is still buffered stays
+func (w *Writer) Reset() {
+	*w = Writer{
+		Writer: w.Writer,
+		buffer: w.buffer,
+		conn:   w.conn,
+	}
+}
+
+// CloseConnection makes this the last response on the connection,
+// WriteHeaders sends Connection: close
+func (w *Writer) CloseConnection() {
+	w.closeAfter = true
+}
+
+// KeepAlive reports whether the response was written completely with its
+// length known to the client, so another one can follow on the connection
+func (w *Writer) KeepAlive() bool {
+	switch {
+	case w.hijacked || !w.headersSent || w.closeAfter:
+		return false
+	case w.statusCode == StatusCodeNoContent || w.statusCode == StatusCodeNotModified:
+		return w.bodyBytes == 0
+	case w.chunkedBody:
+		return w.bodyDone
+	case w.contentLength >= 0:
+		return w.bodyBytes == w.contentLength
+	default:
+		// the body ends when the connection does
+		return false
+	}
+}
+
+// BytesWritten is the number of body bytes written so far
+func (w *Writer) BytesWritten() int64 {
+	return w.bodyBytes
+}
+
+// StatusCode is the final status written so far, 0 if there is none yet
+func (w *Writer) StatusCode() StatusCode {
+	return w.statusCode
+}
+
+// WriteInformational sends an interim 1xx response such as 100 Continue or
+// 103 Early Hints, it has to come before the final status line
+func (w *Writer) WriteInformational(statusCode StatusCode, h headers.Headers) error {
+	if statusCode < 100 || statusCode > 199 || statusCode == StatusCodeSwitchingProtocols {
+		return fmt.Errorf("%w: %d", ErrNotInformational, statusCode)
+	}
+	if w.statusCode != 0 {
+		return ErrStatusAlreadySent
+	}
+
+	reason := ReasonStatusLineMap[statusCode]
+	interim := fmt.Sprintf("HTTP/1.1 %v %s\r\n", statusCode, reason)
+	for _, key := range h.Keys() {
+		interim += fmt.Sprintf("%s: %s\r\n", key, h[key])
+	}
+	interim += "\r\n"
+	if _, err := w.out().Write([]byte(interim)); err != nil {
+		return err
+	}
+	// the client is waiting on it
+	return w.Flush()
 }
 
 func (w *Writer) WriteStatusLine(statusCode StatusCode) error {
+	if statusCode >= 200 {
+		w.statusCode = statusCode
+	}
 	reason := ReasonStatusLineMap[statusCode]
 	statusLine := fmt.Sprintf("HTTP/1.1 %v %s\r\n", statusCode, reason)
 
-	_, err := w.Writer.Write([]byte(statusLine))
+	_, err := w.out().Write([]byte(statusLine))
 	if err != nil {
 		return err
 	}
@@ -70,51 +302,220 @@ func (w *Writer) WriteStatusLine(statusCode StatusCode) error {
 	return nil
 }
 
-func (w *Writer) WriteHeaders(headers headers.Headers) error {
-	for key, value := range headers {
+// DeclareTrailers announces trailer fields, WriteHeaders then sends them in
+// the Trailer header so values can be set with SetTrailer while streaming
+func (w *Writer) DeclareTrailers(keys ...string) error {
+	for _, key := range keys {
+		if err := w.declareTrailer(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *Writer) declareTrailer(key string) error {
+	key = strings.TrimSpace(key)
+	if key == "" {
+		return nil
+	}
+	if headers.IsForbiddenTrailer(key) || !headers.IsToken([]byte(key)) {
+		return fmt.Errorf("%w: %s", ErrForbiddenTrailer, key)
+	}
+	if !w.isDeclared(key) {
+		w.declaredTrailers = append(w.declaredTrailers, headers.CanonicalKey(key))
+	}
+	return nil
+}
+
+func (w *Writer) isDeclared(key string) bool {
+	for _, declared := range w.declaredTrailers {
+		if strings.EqualFold(declared, key) {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *Writer) SetTrailer(key, value string) error {
+	if headers.IsForbiddenTrailer(key) {
+		return fmt.Errorf("%w: %s", ErrForbiddenTrailer, key)
+	}
+	if !w.isDeclared(key) {
+		return fmt.Errorf("%w: %s", ErrTrailerNotDeclared, key)
+	}
+	if w.trailers == nil {
+		w.trailers = headers.NewHeaders()
+	}
+	w.trailers.Remove(key)
+	w.trailers.Add(key, value)
+	return nil
+}
+
+// SetCookie queues a Set-Cookie line, it has to be called before WriteHeaders
+func (w *Writer) SetCookie(c *cookie.Cookie) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	w.cookies = append(w.cookies, c.String())
+	return nil
+}
+
+// AddHeader adds a header that WriteHeaders sends along with the ones it is
+// given, so middleware can decorate a response it doesn't write itself
+func (w *Writer) AddHeader(key, value string) {
+	if w.extraHeaders == nil {
+		w.extraHeaders = headers.NewHeaders()
+	}
+	w.extraHeaders.Add(key, value)
+}
+
+// BeforeHeaders registers fn to run right before the headers are written,
+// middleware uses it to add cookies after the handler decided on a response
+func (w *Writer) BeforeHeaders(fn func(w *Writer)) {
+	w.beforeHeaders = append(w.beforeHeaders, fn)
+}
+
+func (w *Writer) WriteHeaders(h headers.Headers) error {
+	hooks := w.beforeHeaders
+	w.beforeHeaders = nil
+	for _, fn := range hooks {
+		fn(w)
+	}
+
+	// a Trailer header in h declares the trailers too
+	hasTrailerHeader := false
+	for key, value := range h {
+		if !strings.EqualFold(key, "trailer") {
+			continue
+		}
+		hasTrailerHeader = true
+		if err := w.DeclareTrailers(strings.Split(value, ",")...); err != nil {
+			return err
+		}
+	}
+
+	w.noteFraming(h)
+	w.noteFraming(w.extraHeaders)
+	if w.closeAfter && !hasToken(h, "connection", "close") && !hasToken(w.extraHeaders, "connection", "close") {
+		w.AddHeader("Connection", "close")
+	}
+
+	for key, value := range h {
 		writeHeader := fmt.Sprintf("%s: %s\r\n", key, value)
-		_, err := w.Writer.Write([]byte(writeHeader))
+		_, err := w.out().Write([]byte(writeHeader))
 		if err != nil {
 			return err
 		}
 	}
-	w.Writer.Write([]byte("\r\n"))
+	for _, key := range w.extraHeaders.Keys() {
+		writeHeader := fmt.Sprintf("%s: %s\r\n", headers.CanonicalKey(key), w.extraHeaders[key])
+		if _, err := w.out().Write([]byte(writeHeader)); err != nil {
+			return err
+		}
+	}
+	w.extraHeaders = nil
+	for _, c := range w.cookies {
+		if _, err := w.out().Write([]byte("Set-Cookie: " + c + "\r\n")); err != nil {
+			return err
+		}
+	}
+	w.cookies = nil
+	if !hasTrailerHeader && len(w.declaredTrailers) > 0 {
+		trailerHeader := fmt.Sprintf("Trailer: %s\r\n", strings.Join(w.declaredTrailers, ", "))
+		if _, err := w.out().Write([]byte(trailerHeader)); err != nil {
+			return err
+		}
+	}
+	w.out().Write([]byte("\r\n"))
 	return nil
 }
 
+// noteFraming remembers how h delimits the body and whether it closes the
+// connection, the keys can come in any case
+func (w *Writer) noteFraming(h headers.Headers) {
+	if !w.headersSent {
+		w.headersSent = true
+		w.contentLength = -1
+	}
+	for key, value := range h {
+		switch {
+		case strings.EqualFold(key, "content-length"):
+			if n, ok := headers.ParseContentLength(value); ok {
+				w.contentLength = int64(n)
+			}
+		case strings.EqualFold(key, "transfer-encoding"):
+			codings := strings.Split(value, ",")
+			w.chunkedBody = strings.EqualFold(strings.TrimSpace(codings[len(codings)-1]), "chunked")
+		case strings.EqualFold(key, "connection"):
+			if listHas(value, "close") {
+				w.closeAfter = true
+			}
+		}
+	}
+}
+
+// hasToken reports whether the comma separated list in h's key contains token
+func hasToken(h headers.Headers, key, token string) bool {
+	for k, value := range h {
+		if strings.EqualFold(k, key) && listHas(value, token) {
+			return true
+		}
+	}
+	return false
+}
+
+func listHas(list, token string) bool {
+	for part := range strings.SplitSeq(list, ",") {
+		if strings.EqualFold(strings.TrimSpace(part), token) {
+			return true
+		}
+	}
+	return false
+}
+
 func (w *Writer) WriteBody(p []byte) (int, error) {
-	bytesRead, err := w.Writer.Write(p)
+	bytesWrote, err := w.out().Write(p)
+	w.bodyBytes += int64(bytesWrote)
 	if err != nil {
-		return 0, nil
+		return bytesWrote, err
 	}
-	return bytesRead, nil
+	return bytesWrote, nil
 }
 
+// WriteChunkedBody writes p as one chunk, empty p writes nothing since a
+// zero sized chunk would end the body
 func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
-	chunk := fmt.Sprintf("%X\r\n%s\r\n", len(p), string(p))
-	bytesWrote, err := w.Writer.Write([]byte(chunk))
+	if w.bodyDone {
+		return 0, ErrChunkedBodyFinished
+	}
+	bytesWrote, err := chunked.WriteChunk(w.out(), p)
 	if err != nil {
 		return 0, err
 	}
+	w.bodyBytes += int64(len(p))
 	return bytesWrote, nil
 }
 
+// WriteChunkedBodyDone writes the last chunk followed by the trailers set so far
 func (w *Writer) WriteChunkedBodyDone() (int, error) {
-	endChunk := "0\r\n\r\n"
-	bytesWrote, err := w.Writer.Write([]byte(endChunk))
+	if w.bodyDone {
+		return 0, ErrChunkedBodyFinished
+	}
+	w.bodyDone = true
+	bytesWrote, err := chunked.WriteLastChunk(w.out(), w.trailers)
 	if err != nil {
 		return 0, err
 	}
 	return bytesWrote, nil
 }
 
+// WriteTrailers sets the trailers and finishes the chunked body
 func (w *Writer) WriteTrailers(h headers.Headers) error {
 	for key, value := range h {
-		trailer := fmt.Sprintf("%s: %s", key, value)
-		_, err := w.Writer.Write([]byte(trailer))
-		if err != nil {
+		if err := w.SetTrailer(key, value); err != nil {
 			return err
 		}
 	}
-	return nil
+	_, err := w.WriteChunkedBodyDone()
+	return err
 }
@@ -0,0 +1,206 @@
+package response
+
+import (
+	"bytes"
+	"httpfromtcp/internal/cookie"
+	"httpfromtcp/internal/headers"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriter(t *testing.T) {
+	// TEST: Literal writer writes straight through
+	buf := &bytes.Buffer{}
+	w := &Writer{Writer: buf}
+	require.NoError(t, w.WriteStatusLine(StatusCodeOk))
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n", buf.String())
+	require.NoError(t, w.Flush())
+
+	// TEST: Buffered writer holds data until Flush
+	serverSide, clientSide := net.Pipe()
+	defer clientSide.Close()
+	w = NewWriterSize(serverSide, 64)
+	header := headers.NewHeaders()
+	header["Content-Length"] = "2"
+	require.NoError(t, w.WriteStatusLine(StatusCodeOk))
+	require.NoError(t, w.WriteHeaders(header))
+	_, err := w.WriteBody([]byte("ok"))
+	require.NoError(t, err)
+	assert.Equal(t, len("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"), w.Buffered())
+
+	received := make(chan string)
+	go func() {
+		data, _ := io.ReadAll(clientSide)
+		received <- string(data)
+	}()
+	require.NoError(t, w.Flush())
+	assert.Equal(t, 0, w.Buffered())
+
+	// TEST: Hijack flushes pending output first
+	_, err = w.WriteBody([]byte("!"))
+	require.NoError(t, err)
+	conn, _, err := w.Hijack()
+	require.NoError(t, err)
+	conn.Close()
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok!", <-received)
+
+	// TEST: Second hijack fails
+	_, _, err = w.Hijack()
+	require.ErrorIs(t, err, ErrHijacked)
+
+	// TEST: Hijack needs a connection
+	_, _, err = (&Writer{Writer: buf}).Hijack()
+	require.ErrorIs(t, err, ErrHijackNotSupported)
+
+	// TEST: Bytes read past the request come first out of the hijacked reader
+	serverSide, clientSide = net.Pipe()
+	defer clientSide.Close()
+	w = NewWriter(serverSide)
+	leftover := []byte("early")
+	w.SetReadBuffered(func() []byte { return leftover })
+	conn, reader, err := w.Hijack()
+	require.NoError(t, err)
+	defer conn.Close()
+	leftover[0] = 'x'
+	go clientSide.Write([]byte(" late"))
+	data := make([]byte, 10)
+	n, err := io.ReadAtLeast(reader, data, len("early late"))
+	require.NoError(t, err)
+	assert.Equal(t, "early late", string(data[:n]))
+}
+
+func TestKeepAlive(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := &Writer{Writer: buf}
+
+	// TEST: Nothing written yet can't be followed by another response
+	assert.False(t, w.KeepAlive())
+
+	// TEST: Content-Length counts once the whole body is written
+	w.WriteStatusLine(StatusCodeOk)
+	w.WriteHeaders(headers.Headers{"content-length": "4"})
+	w.WriteBody([]byte("ab"))
+	assert.False(t, w.KeepAlive())
+	w.WriteBody([]byte("cd"))
+	assert.True(t, w.KeepAlive())
+
+	// TEST: Chunked bodies count once the last chunk is written
+	w.Reset()
+	w.WriteStatusLine(StatusCodeOk)
+	w.WriteHeaders(headers.Headers{"Transfer-Encoding": "chunked"})
+	w.WriteChunkedBody([]byte("ab"))
+	assert.False(t, w.KeepAlive())
+	w.WriteChunkedBodyDone()
+	assert.True(t, w.KeepAlive())
+
+	// TEST: No length ends the body with the connection
+	w.Reset()
+	w.WriteStatusLine(StatusCodeOk)
+	w.WriteHeaders(headers.Headers{})
+	assert.False(t, w.KeepAlive())
+
+	// TEST: 204 has no body to delimit
+	w.Reset()
+	w.WriteStatusLine(StatusCodeNoContent)
+	w.WriteHeaders(headers.Headers{})
+	assert.True(t, w.KeepAlive())
+
+	// TEST: CloseConnection sends Connection: close once
+	w.Reset()
+	buf.Reset()
+	w.CloseConnection()
+	w.WriteStatusLine(StatusCodeOk)
+	w.WriteHeaders(GetDefaultHeaders(0))
+	assert.Equal(t, 1, strings.Count(buf.String(), "Connection: close\r\n"))
+	assert.False(t, w.KeepAlive())
+
+	w.Reset()
+	buf.Reset()
+	w.CloseConnection()
+	w.WriteStatusLine(StatusCodeOk)
+	w.WriteHeaders(headers.Headers{"Connection": "close", "Content-Length": "0"})
+	assert.Equal(t, 1, strings.Count(buf.String(), "Connection: close\r\n"))
+
+	// TEST: A handler's Connection: close ends the connection too
+	w.Reset()
+	w.WriteStatusLine(StatusCodeOk)
+	w.WriteHeaders(headers.Headers{"Connection": "close", "Content-Length": "0"})
+	assert.False(t, w.KeepAlive())
+}
+
+func TestTrailers(t *testing.T) {
+	// TEST: Declared trailers go after the last chunk
+	buf := &bytes.Buffer{}
+	w := &Writer{Writer: buf}
+	header := headers.NewHeaders()
+	header.Add("Transfer-Encoding", "chunked")
+	header.Add("Trailer", "X-Checksum")
+	require.NoError(t, w.WriteStatusLine(StatusCodeOk))
+	require.NoError(t, w.WriteHeaders(header))
+	_, err := w.WriteChunkedBody([]byte("hello"))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBody([]byte{})
+	require.NoError(t, err)
+	require.NoError(t, w.SetTrailer("x-checksum", "abc"))
+	_, err = w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+
+	r, err := ResponseFromReader(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(r.Body))
+	assert.Equal(t, "abc", r.Trailers["x-checksum"])
+	assert.Equal(t, "X-Checksum", r.Headers["trailer"])
+
+	// TEST: DeclareTrailers adds the Trailer header
+	buf = &bytes.Buffer{}
+	w = &Writer{Writer: buf}
+	require.NoError(t, w.DeclareTrailers("X-One", "X-Two"))
+	header = headers.NewHeaders()
+	header["Transfer-Encoding"] = "chunked"
+	require.NoError(t, w.WriteStatusLine(StatusCodeOk))
+	require.NoError(t, w.WriteHeaders(header))
+	trailers := headers.NewHeaders()
+	trailers.Add("X-One", "1")
+	trailers.Add("X-Two", "2")
+	require.NoError(t, w.WriteTrailers(trailers))
+	r, err = ResponseFromReader(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "X-One, X-Two", r.Headers["trailer"])
+	assert.Equal(t, "1", r.Trailers["x-one"])
+	assert.Equal(t, "2", r.Trailers["x-two"])
+
+	// TEST: Body can't be finished twice
+	_, err = w.WriteChunkedBodyDone()
+	require.ErrorIs(t, err, ErrChunkedBodyFinished)
+
+	// TEST: Forbidden trailers are rejected
+	w = &Writer{Writer: &bytes.Buffer{}}
+	require.ErrorIs(t, w.DeclareTrailers("Content-Length"), ErrForbiddenTrailer)
+	header = headers.NewHeaders()
+	header["Trailer"] = "X-Fine, Transfer-Encoding"
+	require.ErrorIs(t, w.WriteHeaders(header), ErrForbiddenTrailer)
+	require.ErrorIs(t, w.SetTrailer("Host", "example.com"), ErrForbiddenTrailer)
+
+	// TEST: Undeclared trailer is rejected
+	w = &Writer{Writer: &bytes.Buffer{}}
+	require.ErrorIs(t, w.SetTrailer("X-Surprise", "1"), ErrTrailerNotDeclared)
+}
+
+func TestSetCookie(t *testing.T) {
+	// TEST: Each cookie gets its own header line
+	buf := &bytes.Buffer{}
+	w := &Writer{Writer: buf}
+	require.NoError(t, w.SetCookie(&cookie.Cookie{Name: "a", Value: "1", Path: "/"}))
+	require.NoError(t, w.SetCookie(&cookie.Cookie{Name: "b", Value: "2", HttpOnly: true}))
+	require.NoError(t, w.WriteStatusLine(StatusCodeOk))
+	require.NoError(t, w.WriteHeaders(headers.Headers{"Content-Length": "0"}))
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\nSet-Cookie: a=1; Path=/\r\nSet-Cookie: b=2; HttpOnly\r\n\r\n", buf.String())
+
+	// TEST: Invalid cookie is rejected
+	require.Error(t, w.SetCookie(&cookie.Cookie{Name: "bad name"}))
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"httpfromtcp/internal/response"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// conformanceCases is an RFC 9112 corpus, every request is either served by
+// echoHandler (200 with the body) or refused with the given status before
+// the handler runs
+var conformanceCases = []struct {
+	name   string
+	raw    string
+	status response.StatusCode
+	body   string
+}{
+	// plain messages
+	{"get", "GET / HTTP/1.1\r\nHost: a\r\n\r\n", 200, ""},
+	{"content-length", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 5\r\n\r\nhello", 200, "hello"},
+	{"content-length leading zeros", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 005\r\n\r\nhello", 200, "hello"},
+	{"repeated identical content-length", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 5\r\nContent-Length: 5\r\n\r\nhello", 200, "hello"},
+	{"content-length list", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 5, 5\r\n\r\nhello", 200, "hello"},
+	{"chunked", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nhel\r\n2\r\nlo\r\n0\r\n\r\n", 200, "hello"},
+	{"chunked any case", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: CHUNKED\r\n\r\n5\r\nhello\r\n0\r\n\r\n", 200, "hello"},
+	{"chunked trailers", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\nX-Sum: 1\r\n\r\n", 200, "hello"},
+	{"chunk size hex digits", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n00000a\r\n0123456789\r\n0\r\n\r\n", 200, "0123456789"},
+
+	// whitespace
+	{"optional whitespace around value", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length:  \t5 \t\r\n\r\nhello", 200, "hello"},
+	{"no whitespace after colon", "POST / HTTP/1.1\r\nHost:a\r\nContent-Length:5\r\n\r\nhello", 200, "hello"},
+	{"tab inside value", "GET / HTTP/1.1\r\nHost: a\r\nX-Note: a\tb\r\n\r\n", 200, ""},
+	{"space before colon", "GET / HTTP/1.1\r\nHost : a\r\n\r\n", 400, ""},
+	{"tab before colon", "GET / HTTP/1.1\r\nHost\t: a\r\n\r\n", 400, ""},
+	{"empty field name", "GET / HTTP/1.1\r\n: a\r\n\r\n", 400, ""},
+	{"obsolete line folding", "GET / HTTP/1.1\r\nHost: a\r\nX-Long: one\r\n two\r\n\r\n", 400, ""},
+	{"whitespace before first field", "GET / HTTP/1.1\r\n Host: a\r\n\r\n", 400, ""},
+	{"double space in request line", "GET  / HTTP/1.1\r\nHost: a\r\n\r\n", 400, ""},
+	{"trailing space in request line", "GET / HTTP/1.1 \r\nHost: a\r\n\r\n", 400, ""},
+
+	// field syntax
+	{"comma in field name", "GET / HTTP/1.1\r\nHost: a\r\nX,Y: b\r\n\r\n", 400, ""},
+	{"non ascii field name", "GET / HTTP/1.1\r\nHøst: a\r\n\r\n", 400, ""},
+	{"bare cr in value", "GET / HTTP/1.1\r\nHost: a\r\nX-A: b\rX-B: c\r\n\r\n", 400, ""},
+	{"bare lf in value", "GET / HTTP/1.1\r\nHost: a\r\nX-A: b\nX-B: c\r\n\r\n", 400, ""},
+	{"nul in value", "GET / HTTP/1.1\r\nHost: a\r\nX-A: b\x00c\r\n\r\n", 400, ""},
+	{"no colon", "GET / HTTP/1.1\r\nHost a\r\n\r\n", 400, ""},
+
+	// request line
+	{"lowercase version", "GET / http/1.1\r\nHost: a\r\n\r\n", 400, ""},
+	{"http/1.0", "GET / HTTP/1.0\r\nHost: a\r\n\r\n", 505, ""},
+	{"http/2.0", "GET / HTTP/2.0\r\nHost: a\r\n\r\n", 505, ""},
+	{"malformed version", "GET / HTTP/1.10\r\nHost: a\r\n\r\n", 400, ""},
+	{"lowercase method", "get / HTTP/1.1\r\nHost: a\r\n\r\n", 400, ""},
+	{"unknown method", "BREW / HTTP/1.1\r\nHost: a\r\n\r\n", 501, ""},
+	{"target not origin form", "GET a HTTP/1.1\r\nHost: a\r\n\r\n", 400, ""},
+
+	// host
+	{"missing host", "GET / HTTP/1.1\r\n\r\n", 400, ""},
+	{"empty host", "GET / HTTP/1.1\r\nHost:\r\n\r\n", 200, ""},
+	{"duplicate host", "GET / HTTP/1.1\r\nHost: a\r\nHost: a\r\n\r\n", 400, ""},
+	{"conflicting host", "GET / HTTP/1.1\r\nHost: a\r\nHost: b\r\n\r\n", 400, ""},
+	{"host in any case", "GET / HTTP/1.1\r\nHost: a\r\nHOST: b\r\n\r\n", 400, ""},
+
+	// smuggling
+	{"content-length and chunked", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 5\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n", 400, ""},
+	{"chunked and content-length", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\nContent-Length: 5\r\n\r\n0\r\n\r\n", 400, ""},
+	{"conflicting content-length", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 5\r\nContent-Length: 6\r\n\r\nhello!", 400, ""},
+	{"signed content-length", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: +5\r\n\r\nhello", 400, ""},
+	{"negative content-length", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: -1\r\n\r\n", 400, ""},
+	{"hex content-length", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 0x5\r\n\r\nhello", 400, ""},
+	{"content-length with space", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 1 5\r\n\r\nhello", 400, ""},
+	{"empty content-length", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length:\r\n\r\n", 400, ""},
+	{"overflowing content-length", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 99999999999999999999\r\n\r\n", 400, ""},
+	{"chunked not last", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked, identity\r\n\r\n0\r\n\r\n", 400, ""},
+	{"chunked twice", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n", 400, ""},
+	{"only identity", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: identity\r\n\r\n", 400, ""},
+	{"chunked with space in name", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chun ked\r\n\r\n0\r\n\r\n", 400, ""},
+	{"unsupported coding", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: gzip, chunked\r\n\r\n0\r\n\r\n", 501, ""},
+
+	// chunks
+	{"chunk extension", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n5;name=value\r\nhello\r\n0\r\n\r\n", 200, "hello"},
+	{"chunk extension no value", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n5;flag;x=1\r\nhello\r\n0;last\r\n\r\n", 200, "hello"},
+	{"chunk extension quoted", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n5;q=\"a \\\" ; b\"\r\nhello\r\n0\r\n\r\n", 200, "hello"},
+	{"chunk extension whitespace", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n5 ; a = b\r\nhello\r\n0\r\n\r\n", 200, "hello"},
+	{"chunk extension without name", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n5;=x\r\nhello\r\n0\r\n\r\n", 400, ""},
+	{"chunk extension empty", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n5;\r\nhello\r\n0\r\n\r\n", 400, ""},
+	{"chunk extension unclosed quote", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n5;q=\"abc\r\nhello\r\n0\r\n\r\n", 400, ""},
+	{"chunk extension two names", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n5;a b\r\nhello\r\n0\r\n\r\n", 400, ""},
+	{"chunk extension too long", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n5;a=" + strings.Repeat("x", 5000) + "\r\nhello\r\n0\r\n\r\n", 400, ""},
+	{"chunk size not hex", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\nhello\r\n0\r\n\r\n", 400, ""},
+	{"chunk size with 0x", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n0x5\r\nhello\r\n0\r\n\r\n", 400, ""},
+	{"chunk size signed", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n+5\r\nhello\r\n0\r\n\r\n", 400, ""},
+	{"chunk size too many digits", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n000000005\r\nhello\r\n0\r\n\r\n", 400, ""},
+	{"chunk size missing", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n\r\nhello\r\n0\r\n\r\n", 400, ""},
+	{"chunk longer than size", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nhello\r\n0\r\n\r\n", 400, ""},
+
+	// limits, the server below allows 4 KiB of headers and 16 bytes of body
+	{"request line too long", "GET /" + strings.Repeat("a", 9000) + " HTTP/1.1\r\nHost: a\r\n\r\n", 414, ""},
+	{"headers too large", "GET / HTTP/1.1\r\nHost: a\r\nX-Big: " + strings.Repeat("a", 5000) + "\r\n\r\n", 431, ""},
+	{"many headers", "GET / HTTP/1.1\r\nHost: a\r\n" + strings.Repeat("X-A: b\r\n", 1000) + "\r\n", 431, ""},
+	{"body at limit", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 16\r\n\r\n0123456789abcdef", 200, "0123456789abcdef"},
+	{"declared body too large", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 17\r\n\r\n0123456789abcdefg", 413, ""},
+	{"chunked body too large", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n10\r\n0123456789abcdef\r\n1\r\ng\r\n0\r\n\r\n", 413, ""},
+	{"trailers too large", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n0\r\nX-Big: " + strings.Repeat("a", 5000) + "\r\n\r\n", 431, ""},
+	{"many trailers", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n" + strings.Repeat("X-A: b\r\n", 1000) + "\r\n", 431, ""},
+	{"too large before continue", "POST / HTTP/1.1\r\nHost: a\r\nExpect: 100-continue\r\nContent-Length: 17\r\n\r\n", 413, ""},
+}
+
+func TestConformance(t *testing.T) {
+	for mode, pooling := range map[string][]Option{"fresh": nil, "pooled": {WithRequestPooling()}} {
+		opts := append([]Option{WithLogger(slog.New(slog.DiscardHandler)), WithMaxHeaderBytes(4096), WithMaxBodyBytes(16)}, pooling...)
+		_, port, err := net.SplitHostPort(startServer(t, echoHandler, opts...))
+		require.NoError(t, err)
+		addr := net.JoinHostPort("127.0.0.1", port)
+
+		for _, tc := range conformanceCases {
+			t.Run(mode+"/"+tc.name, func(t *testing.T) {
+				conn, err := net.Dial("tcp", addr)
+				require.NoError(t, err)
+				defer conn.Close()
+				conn.SetDeadline(time.Now().Add(5 * time.Second))
+				_, err = io.WriteString(conn, tc.raw)
+				require.NoError(t, err)
+
+				resp, err := response.NewParser(conn).ReadResponse("POST")
+				require.NoError(t, err)
+				assert.Equal(t, tc.status, resp.StatusLine.StatusCode)
+				if tc.status == response.StatusCodeOk {
+					assert.Equal(t, tc.body, string(resp.Body))
+				}
+			})
+		}
+	}
+}
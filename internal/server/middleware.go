@@ -0,0 +1,12 @@
+package server
+
+// Middleware wraps a handler to run code around it
+type Middleware func(Handler) Handler
+
+// Chain applies middleware so the first one is the outermost
+func Chain(h Handler, middleware ...Middleware) Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		h = middleware[i](h)
+	}
+	return h
+}
@@ -1,26 +1,177 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"httpfromtcp/internal/headers"
 	"httpfromtcp/internal/request"
 	"httpfromtcp/internal/response"
 	"io"
+	"log/slog"
 	"net"
+	"slices"
+	"strings"
+	"sync"
 	"sync/atomic"
+	"time"
 )
 
 type Server struct {
 	Listener net.Listener
 	State    atomic.Bool
 	Handler  Handler
+	// WriteBufferSize is the size of each response buffer
+	WriteBufferSize int
+	// TLSConfig makes Serve accept TLS connections
+	TLSConfig *tls.Config
+	// TrustedProxies may set the client address with forwarding headers
+	TrustedProxies request.TrustedProxies
+	// Logger gets connection and parse errors, nil uses slog.Default
+	Logger *slog.Logger
+	// ConnState is told about every change in a connection's state
+	ConnState func(conn net.Conn, state ConnState)
+	// ReadError is told about every request that couldn't be read
+	ReadError func(err error)
+	// MaxHeaderBytes bounds the request line and headers, 0 uses
+	// request.DefaultMaxHeaderBytes
+	MaxHeaderBytes int
+	// MaxBodyBytes bounds request bodies, 0 means no limit
+	MaxBodyBytes int
+	// PoolRequests reuses Request values between connections, handlers must
+	// not keep the request or any of its strings after they return
+	PoolRequests bool
+	// DrainDelay keeps accepting connections for a while after Shutdown
+	// flips readiness
+	DrainDelay time.Duration
+	// IdleTimeout closes a kept-alive connection that waits this long for
+	// its next request, 0 waits as long as the client does
+	IdleTimeout time.Duration
+
+	lastConnID   atomic.Uint64
+	conns        connTracker
+	shuttingDown atomic.Bool
+	shutdownMu   sync.Mutex
+	onShutdown   []func()
+}
+
+type ConnState int
+
+const (
+	// StateNew is a connection just accepted
+	StateNew ConnState = iota
+	// StateActive is a connection with a request being handled
+	StateActive
+	// StateHijacked is a connection handed over to the handler
+	StateHijacked
+	// StateClosed is a connection the server closed
+	StateClosed
+	// StateIdle is a kept-alive connection waiting for its next request
+	StateIdle
+)
+
+func (cs ConnState) String() string {
+	switch cs {
+	case StateNew:
+		return "new"
+	case StateActive:
+		return "active"
+	case StateHijacked:
+		return "hijacked"
+	case StateClosed:
+		return "closed"
+	case StateIdle:
+		return "idle"
+	default:
+		return fmt.Sprintf("ConnState(%d)", int(cs))
+	}
+}
+
+type Option func(*Server)
+
+func WithWriteBufferSize(size int) Option {
+	return func(s *Server) {
+		s.WriteBufferSize = size
+	}
+}
+
+func WithTLSConfig(config *tls.Config) Option {
+	return func(s *Server) {
+		s.TLSConfig = config
+	}
+}
+
+func WithTrustedProxies(proxies request.TrustedProxies) Option {
+	return func(s *Server) {
+		s.TrustedProxies = proxies
+	}
+}
+
+func WithLogger(logger *slog.Logger) Option {
+	return func(s *Server) {
+		s.Logger = logger
+	}
+}
+
+func WithConnState(fn func(conn net.Conn, state ConnState)) Option {
+	return func(s *Server) {
+		s.ConnState = fn
+	}
+}
+
+func WithReadError(fn func(err error)) Option {
+	return func(s *Server) {
+		s.ReadError = fn
+	}
+}
+
+func WithMaxHeaderBytes(n int) Option {
+	return func(s *Server) {
+		s.MaxHeaderBytes = n
+	}
 }
 
-func newServer(h Handler) Server {
-	return Server{
-		Handler: h,
+func WithMaxBodyBytes(n int) Option {
+	return func(s *Server) {
+		s.MaxBodyBytes = n
 	}
 }
 
+// WithRequestPooling turns on PoolRequests
+func WithRequestPooling() Option {
+	return func(s *Server) {
+		s.PoolRequests = true
+	}
+}
+
+func WithDrainDelay(delay time.Duration) Option {
+	return func(s *Server) {
+		s.DrainDelay = delay
+	}
+}
+
+// WithIdleTimeout sets IdleTimeout
+func WithIdleTimeout(timeout time.Duration) Option {
+	return func(s *Server) {
+		s.IdleTimeout = timeout
+	}
+}
+
+const DefaultIdleTimeout = 2 * time.Minute
+
+func newServer(h Handler, opts ...Option) *Server {
+	s := &Server{
+		Handler:         h,
+		WriteBufferSize: response.DefaultBufferSize,
+		IdleTimeout:     DefaultIdleTimeout,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
 func (s *Server) Close() error {
 	err := s.Listener.Close()
 	if err != nil {
@@ -29,44 +180,343 @@ func (s *Server) Close() error {
 	return nil
 }
 
+func (s *Server) logger() *slog.Logger {
+	if s.Logger == nil {
+		return slog.Default()
+	}
+	return s.Logger
+}
+
 func (s *Server) listen() {
 	s.State.Store(true)
 	for {
 		connection, err := s.Listener.Accept()
-		if !s.State.Load() {
+		if !s.State.Load() || errors.Is(err, net.ErrClosed) {
+			if connection != nil {
+				connection.Close()
+			}
 			break
 		}
 		if err != nil {
-			panic("you are a bad progremmer")
+			// running out of file descriptors and the like, back off and retry
+			s.logger().Error("accept failed", "error", err)
+			time.Sleep(acceptBackoff)
+			continue
 		}
-		s.handle(connection)
+		// tracked before the goroutine starts, so Shutdown can't look in
+		// between and miss it
+		connID := s.lastConnID.Add(1)
+		s.setState(connection, connID, StateNew)
+		go s.handle(connection, connID)
+	}
+}
+
+const acceptBackoff = 50 * time.Millisecond
+
+func (s *Server) setState(conn net.Conn, connID uint64, state ConnState) {
+	s.conns.update(conn, connID, state)
+	if s.ConnState != nil {
+		s.ConnState(conn, state)
+	}
+}
+
+func (s *Server) readError(err error) {
+	if s.ReadError != nil {
+		s.ReadError(err)
 	}
 }
 
-func (s *Server) handle(conn net.Conn) {
-	defer conn.Close()
+func (s *Server) handle(conn net.Conn, connID uint64) {
+	writer := response.NewWriterSize(conn, s.WriteBufferSize)
+	defer func() {
+		if writer.Hijacked() {
+			s.setState(conn, connID, StateHijacked)
+			return
+		}
+		conn.Close()
+		s.setState(conn, connID, StateClosed)
+	}()
+
+	parser := parserPool.Get().(*request.Parser)
+	parser.Reset(conn)
+	defer func() {
+		parser.Reset(nil)
+		parserPool.Put(parser)
+	}()
+	parser.Logger = s.logger()
+	parser.MaxHeaderBytes = s.MaxHeaderBytes
+	parser.MaxBodyBytes = s.MaxBodyBytes
+
+	for sequence := 1; s.serveRequest(writer, parser, conn, connID, sequence); sequence++ {
+		writer.Reset()
+		s.setState(conn, connID, StateIdle)
+		if s.IdleTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(s.IdleTimeout))
+		}
+	}
+}
 
-	request, err := request.RequestFromReader(conn)
+// serveRequest reads and answers one request, it reports whether the
+// connection can take another
+func (s *Server) serveRequest(writer *response.Writer, parser *request.Parser, conn net.Conn, connID uint64, sequence int) bool {
+	writer.SetReadBuffered(parser.Buffered)
+	req, err := s.readRequestHead(parser)
 	if err != nil {
-		fmt.Println(err)
+		var ioErr *request.IOError
+		if sequence > 1 && errors.As(err, &ioErr) && ioErr.Idle {
+			// the client closed, the idle timeout or Shutdown did
+			s.logger().Debug("idle connection closed", "remote", conn.RemoteAddr().String(), "error", ioErr.Err)
+			return false
+		}
+		if s.readFailed(writer, conn, err) {
+			lingerClose(conn)
+		}
+		return false
+	}
+	conn.SetReadDeadline(time.Time{})
+	s.describeConn(req, conn, connID, sequence)
+	s.setState(conn, connID, StateActive)
+	// a pooled request isn't the handler's after this, unless it hijacked
+	release := func() {
+		if s.PoolRequests && !writer.Hijacked() {
+			request.ReleaseRequest(req)
+		}
+	}
+	if !s.prepareBody(writer, parser, req) {
+		writer.Flush()
+		lingerClose(conn)
+		release()
+		return false
+	}
+	if s.shuttingDown.Load() || wantsClose(req) {
+		writer.CloseConnection()
+	}
+
+	// a client that goes away cancels the context, unless the body is still
+	// to be read: the connection is the handler's to read then
+	handlerReq := req
+	clientGone := func() bool { return false }
+	var watcher *closeWatcher
+	if !req.BodyPending() {
+		ctx, cancel := context.WithCancel(req.Context())
+		defer cancel()
+		watcher = watchClose(conn, cancel)
+		defer watcher.stop()
+		writer.SetReadBuffered(func() []byte {
+			return append(slices.Clone(parser.Buffered()), watcher.stop()...)
+		})
+		handlerReq = req.WithContext(ctx)
+		clientGone = func() bool { return ctx.Err() != nil }
+	}
+
+	s.Handler(writer, handlerReq)
+	if err := writer.Flush(); err != nil {
+		s.logger().Debug("response flush failed", "remote", conn.RemoteAddr().String(), "error", err)
+	}
+	if writer.Hijacked() {
+		return false
+	}
+	// the client may still be sending a body the handler left unread
+	if req.BodyPending() {
+		lingerClose(conn)
+		release()
+		return false
+	}
+	if watcher != nil {
+		// a pipelined request the watch read is parsed next
+		parser.Unread(watcher.stop())
+	}
+	keepAlive := writer.KeepAlive() && !clientGone() && !s.shuttingDown.Load()
+	release()
+	return keepAlive
+}
+
+// wantsClose is true for a request asking to end the connection after it
+func wantsClose(req *request.Request) bool {
+	connection, _ := req.Headers.Get("connection")
+	for token := range strings.SplitSeq(connection, ",") {
+		if strings.EqualFold(strings.TrimSpace(token), "close") {
+			return true
+		}
+	}
+	return false
+}
+
+var parserPool = sync.Pool{
+	New: func() any { return request.NewParser(nil) },
+}
+
+func (s *Server) readRequestHead(parser *request.Parser) (*request.Request, error) {
+	if !s.PoolRequests {
+		return parser.ReadRequestHead()
+	}
+	req := request.AcquireRequest()
+	if err := parser.ReadRequestHeadInto(req); err != nil {
+		request.ReleaseRequest(req)
+		return nil, err
+	}
+	return req, nil
+}
+
+// readFailed logs a request that couldn't be read, answering with an error
+// status when the client sent something unparseable. It reports whether it
+// did, the client may still be sending then.
+func (s *Server) readFailed(w *response.Writer, conn net.Conn, err error) bool {
+	s.readError(err)
+	remote := conn.RemoteAddr().String()
+	var ioErr *request.IOError
+	switch {
+	case errors.As(err, &ioErr) && ioErr.Clean():
+		s.logger().Debug("connection closed", "remote", remote)
+	case errors.As(err, &ioErr):
+		s.logger().Info("request read failed", "remote", remote, "kind", ioErr.Kind.String(), "error", ioErr.Err)
+	case errors.Is(err, request.ErrMalformedRequest):
+		s.logger().Info("malformed request", "remote", remote, "error", err)
+		writeReadError(w, err)
+		w.Flush()
+		return true
+	default:
+		s.logger().Error("request read failed", "remote", remote, "error", err)
 	}
-	writer := response.Writer{
-		Writer: conn,
+	return false
+}
+
+const (
+	lingerTimeout  = 500 * time.Millisecond
+	lingerMaxBytes = 256 << 10
+)
+
+// lingerClose stops writing and reads off what the client is still sending
+// for a moment: closing with unread data resets the connection, and the
+// client may lose the error response with it
+func lingerClose(conn net.Conn) {
+	type closeWriter interface {
+		CloseWrite() error
 	}
+	if cw, ok := conn.(closeWriter); ok {
+		cw.CloseWrite()
+	}
+	conn.SetReadDeadline(time.Now().Add(lingerTimeout))
+	io.CopyN(io.Discard, conn, lingerMaxBytes)
+}
 
-	s.Handler(&writer, request)
+// readErrorStatus picks the status for a request the parser refused
+func readErrorStatus(err error) response.StatusCode {
+	switch {
+	case errors.Is(err, request.ErrRequestLineTooLong):
+		return response.StatusCodeURITooLong
+	case errors.Is(err, request.ErrHeadersTooLarge):
+		return response.StatusCodeHeaderFieldsTooLarge
+	case errors.Is(err, request.ErrBodyTooLarge):
+		return response.StatusCodeContentTooLarge
+	case errors.Is(err, request.ErrUnsupportedTransferEncoding), errors.Is(err, request.ErrMethodNotImplemented):
+		return response.StatusCodeNotImplemented
+	case errors.Is(err, request.ErrVersionNotSupported):
+		return response.StatusCodeVersionNotSupported
+	default:
+		return response.StatusCodeBadRequest
+	}
 }
 
-func Serve(port int, h Handler) (*Server, error) {
-	newServer := newServer(h)
+func writeReadError(w *response.Writer, err error) {
+	status := readErrorStatus(err)
+	body := []byte(response.ReasonStatusLineMap[status] + "\n")
+	w.WriteStatusLine(status)
+	w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+	w.WriteBody(body)
+}
 
-	newListener, _ := net.Listen("tcp", ":"+fmt.Sprint(port))
-	newServer.Listener = newListener
+// describeConn fills in what the request can't say about itself
+func (s *Server) describeConn(req *request.Request, conn net.Conn, connID uint64, sequence int) {
+	req.RemoteAddr = conn.RemoteAddr().String()
+	req.LocalAddr = conn.LocalAddr().String()
+	req.ConnID = connID
+	req.Sequence = sequence
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		req.TLS = &state
+	}
+	req.ClientIP = s.TrustedProxies.ClientIP(req)
+}
+
+var errFinalStatusSent = errors.New("final status sent, the client won't send the body")
+
+// prepareBody reads the body up front, unless the client waits for 100 Continue
+// or the body is a multipart upload: then it is read when the handler calls
+// ReadBody or BodyReader, and a handler that answers with a final status
+// first never gets a waiting client's body sent
+func (s *Server) prepareBody(w *response.Writer, parser *request.Parser, req *request.Request) bool {
+	if _, ok := req.Headers.Get("expect"); ok && !req.ExpectsContinue() {
+		body := "unsupported expectation"
+		h := headers.NewHeaders()
+		h["Connection"] = "close"
+		h["Content-Type"] = "text/plain"
+		h["Content-Length"] = fmt.Sprint(len(body))
+		w.WriteStatusLine(response.StatusCodeExpectationFailed)
+		w.WriteHeaders(h)
+		w.WriteBody([]byte(body))
+		return false
+	}
+
+	deferBody := req.ExpectsContinue() || streamsBody(req)
+	if !deferBody || !req.BodyPending() {
+		if err := parser.ReadBody(req); err != nil {
+			s.readError(err)
+			if errors.Is(err, request.ErrMalformedRequest) {
+				s.logger().Info("malformed request body", "remote", req.RemoteAddr, "error", err)
+				writeReadError(w, err)
+			} else {
+				s.logger().Info("request body read failed", "remote", req.RemoteAddr, "error", err)
+			}
+			return false
+		}
+		return true
+	}
+
+	var before func() error
+	if req.ExpectsContinue() {
+		before = func() error {
+			if w.StatusCode() != 0 {
+				return errFinalStatusSent
+			}
+			return w.WriteInformational(response.StatusCodeContinue, nil)
+		}
+	}
+	parser.DeferBody(req, before)
+	return true
+}
+
+// streamsBody is true for bodies left for the handler to read as they
+// arrive: multipart uploads go through MultipartReader, which keeps large
+// files out of memory
+func streamsBody(req *request.Request) bool {
+	contentType, _ := req.Headers.Get("content-type")
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	return strings.EqualFold(strings.TrimSpace(mediaType), "multipart/form-data")
+}
+
+// Serve listens on port on all interfaces and serves h
+func Serve(port int, h Handler, opts ...Option) (*Server, error) {
+	newListener, err := net.Listen("tcp", ":"+fmt.Sprint(port))
+	if err != nil {
+		return nil, err
+	}
+	return ServeListener(newListener, h, opts...), nil
+}
+
+// ServeListener serves h on connections accepted from l, Shutdown closes it
+func ServeListener(l net.Listener, h Handler, opts ...Option) *Server {
+	newServer := newServer(h, opts...)
+
+	if newServer.TLSConfig != nil {
+		l = tls.NewListener(l, newServer.TLSConfig)
+	}
+	newServer.Listener = l
 	go func() {
 		newServer.listen()
 	}()
 
-	return &newServer, nil
+	return newServer
 }
 
 type HandlerError struct {
@@ -0,0 +1,503 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func startServer(t *testing.T, h Handler, opts ...Option) string {
+	s, err := Serve(0, h, opts...)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		s.State.Store(false)
+		s.Close()
+	})
+	return s.Listener.Addr().String()
+}
+
+func echoHandler(w *response.Writer, req *request.Request) {
+	body, err := req.ReadBody()
+	if err != nil {
+		w.WriteStatusLine(response.StatusCodeBadRequest)
+		w.WriteHeaders(headers.Headers{"Content-Length": "0"})
+		return
+	}
+	w.WriteStatusLine(response.StatusCodeOk)
+	w.WriteHeaders(headers.Headers{"Content-Length": fmt.Sprint(len(body))})
+	w.WriteBody(body)
+}
+
+func TestServeListenError(t *testing.T) {
+	s, err := Serve(0, echoHandler)
+	require.NoError(t, err)
+	defer s.Close()
+	_, port, err := net.SplitHostPort(s.Listener.Addr().String())
+	require.NoError(t, err)
+
+	// TEST: A port already in use is an error, not a server without a listener
+	number, err := strconv.Atoi(port)
+	require.NoError(t, err)
+	_, err = Serve(number, echoHandler)
+	require.Error(t, err)
+}
+
+func TestExpectContinue(t *testing.T) {
+	addr := startServer(t, echoHandler)
+
+	// TEST: 100 Continue is sent before the body is read
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	io.WriteString(conn, "POST /upload HTTP/1.1\r\nHost: localhost\r\nExpect: 100-continue\r\nContent-Length: 5\r\n\r\n")
+	parser := response.NewParser(conn)
+	resp, err := parser.ReadResponse("POST")
+	require.NoError(t, err)
+	assert.Equal(t, response.StatusCodeContinue, resp.StatusLine.StatusCode)
+	io.WriteString(conn, "hello")
+	resp, err = parser.ReadResponse("POST")
+	require.NoError(t, err)
+	assert.Equal(t, response.StatusCodeOk, resp.StatusLine.StatusCode)
+	assert.Equal(t, "hello", string(resp.Body))
+
+	// TEST: Handler rejecting before reading never sends 100 Continue
+	addr = startServer(t, func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.StatusCodeExpectationFailed)
+		w.WriteHeaders(headers.Headers{"Content-Length": "0"})
+	})
+	conn, err = net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	io.WriteString(conn, "POST /upload HTTP/1.1\r\nHost: localhost\r\nExpect: 100-continue\r\nContent-Length: 5\r\n\r\n")
+	resp, err = response.ResponseFromReader(bufio.NewReader(conn))
+	require.NoError(t, err)
+	assert.Equal(t, response.StatusCodeExpectationFailed, resp.StatusLine.StatusCode)
+
+	// TEST: Unknown expectation gets 417
+	addr = startServer(t, echoHandler)
+	conn, err = net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	io.WriteString(conn, "POST /upload HTTP/1.1\r\nHost: localhost\r\nExpect: something-else\r\nContent-Length: 0\r\n\r\n")
+	resp, err = response.ResponseFromReader(conn)
+	require.NoError(t, err)
+	assert.Equal(t, response.StatusCodeExpectationFailed, resp.StatusLine.StatusCode)
+
+	// TEST: Requests without Expect keep the eager body
+	conn, err = net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	io.WriteString(conn, "POST /upload HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\n\r\nhello")
+	resp, err = response.ResponseFromReader(conn)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(resp.Body))
+}
+
+func TestMultipartUpload(t *testing.T) {
+	const fileSize = 4 << 20
+	addr := startServer(t, func(w *response.Writer, req *request.Request) {
+		// the handler sees the body before any of it was read
+		pending := req.BodyPending()
+		form, err := req.ParseMultipartForm(request.FormLimits{MaxMemory: 1 << 10})
+		if err != nil {
+			w.WriteStatusLine(response.StatusCodeBadRequest)
+			w.WriteHeaders(headers.Headers{"Content-Length": "0"})
+			return
+		}
+		defer form.RemoveAll()
+		body := fmt.Sprintf("%v %d %v", pending, form.File["upload"][0].Size, cap(req.Body) < 64<<10)
+		w.WriteStatusLine(response.StatusCodeOk)
+		w.WriteHeaders(headers.Headers{"Content-Length": fmt.Sprint(len(body))})
+		w.WriteBody([]byte(body))
+	})
+
+	// TEST: Multipart body is left for the handler to stream
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	partHead := "--XyZ\r\nContent-Disposition: form-data; name=\"upload\"; filename=\"big.bin\"\r\n\r\n"
+	tail := "\r\n--XyZ--\r\n"
+	go func() {
+		fmt.Fprintf(conn, "POST /upload HTTP/1.1\r\nHost: localhost\r\nContent-Type: multipart/form-data; boundary=XyZ\r\nContent-Length: %d\r\n\r\n",
+			len(partHead)+fileSize+len(tail))
+		io.WriteString(conn, partHead)
+		io.Copy(conn, io.LimitReader(zeros{}, fileSize))
+		io.WriteString(conn, tail)
+	}()
+	resp, err := response.ResponseFromReader(conn)
+	require.NoError(t, err)
+	assert.Equal(t, response.StatusCodeOk, resp.StatusLine.StatusCode)
+	assert.Equal(t, fmt.Sprintf("true %d true", fileSize), string(resp.Body))
+}
+
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+func TestEarlyHints(t *testing.T) {
+	addr := startServer(t, func(w *response.Writer, req *request.Request) {
+		w.WriteInformational(response.StatusCodeEarlyHints, headers.Headers{"Link": "</style.css>; rel=preload"})
+		w.WriteStatusLine(response.StatusCodeOk)
+		w.WriteHeaders(headers.Headers{"Content-Length": "2"})
+		w.WriteBody([]byte("ok"))
+		// too late for an interim response
+		assert.ErrorIs(t, w.WriteInformational(response.StatusCodeEarlyHints, nil), response.ErrStatusAlreadySent)
+	})
+
+	// TEST: 103 precedes the final response
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	parser := response.NewParser(conn)
+	resp, err := parser.ReadResponse("GET")
+	require.NoError(t, err)
+	assert.Equal(t, response.StatusCodeEarlyHints, resp.StatusLine.StatusCode)
+	assert.Equal(t, "</style.css>; rel=preload", resp.Headers["link"])
+	resp, err = parser.ReadResponse("GET")
+	require.NoError(t, err)
+	assert.Equal(t, "ok", string(resp.Body))
+}
+
+func selfSignedConfig(t *testing.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+func TestConnMetadata(t *testing.T) {
+	proxies, err := request.ParseTrustedProxies("127.0.0.1")
+	require.NoError(t, err)
+	seen := make(chan *request.Request, 2)
+	h := func(w *response.Writer, req *request.Request) {
+		seen <- req
+		w.WriteStatusLine(response.StatusCodeOk)
+		w.WriteHeaders(headers.Headers{"Content-Length": "0"})
+	}
+	_, port, err := net.SplitHostPort(startServer(t, h, WithTrustedProxies(proxies)))
+	require.NoError(t, err)
+	addr := net.JoinHostPort("127.0.0.1", port)
+
+	// TEST: Addresses, ids and the client behind a trusted proxy
+	for range 2 {
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer conn.Close()
+		io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\nX-Forwarded-For: 198.51.100.9\r\n\r\n")
+		_, err = response.ResponseFromReader(conn)
+		require.NoError(t, err)
+	}
+	first, second := <-seen, <-seen
+	assert.Equal(t, addr, first.LocalAddr)
+	assert.NotEmpty(t, first.RemoteAddr)
+	assert.Equal(t, "198.51.100.9", first.ClientIP)
+	assert.Equal(t, 1, first.Sequence)
+	assert.Nil(t, first.TLS)
+	assert.NotEqual(t, first.ConnID, second.ConnID)
+
+	// TEST: TLS state
+	addr = startServer(t, h, WithTLSConfig(selfSignedConfig(t)))
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	require.NoError(t, err)
+	defer conn.Close()
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	resp, err := response.ResponseFromReader(conn)
+	require.NoError(t, err)
+	assert.Equal(t, response.StatusCodeOk, resp.StatusLine.StatusCode)
+	req := <-seen
+	require.NotNil(t, req.TLS)
+	assert.True(t, req.TLS.HandshakeComplete)
+}
+
+func TestKeepAlive(t *testing.T) {
+	h := func(w *response.Writer, req *request.Request) {
+		body := fmt.Sprintf("%d/%d", req.ConnID, req.Sequence)
+		w.WriteStatusLine(response.StatusCodeOk)
+		if req.RequestLine.RequestTarget == "/unframed" {
+			w.WriteHeaders(headers.Headers{})
+		} else {
+			w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+		}
+		w.WriteBody([]byte(body))
+	}
+	var readErrors atomic.Int32
+	s, err := Serve(0, h, WithIdleTimeout(time.Second), WithReadError(func(error) { readErrors.Add(1) }))
+	require.NoError(t, err)
+	addr := s.Listener.Addr().String()
+	get := func(conn net.Conn, parser *response.Parser, method, target string, extra string) *response.Response {
+		t.Helper()
+		_, err := io.WriteString(conn, method+" "+target+" HTTP/1.1\r\nHost: localhost\r\n"+extra+"\r\n")
+		require.NoError(t, err)
+		resp, err := parser.ReadResponse(method)
+		require.NoError(t, err)
+		return resp
+	}
+
+	// TEST: Requests on one connection share the id and count up
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	parser := response.NewParser(conn)
+	first := get(conn, parser, "GET", "/", "")
+	second := get(conn, parser, "GET", "/", "")
+	connID, _, _ := strings.Cut(string(first.Body), "/")
+	assert.Equal(t, connID+"/1", string(first.Body))
+	assert.Equal(t, connID+"/2", string(second.Body))
+	assert.True(t, second.KeepAlive())
+
+	// TEST: The idle connection is tracked with the requests it served
+	require.Eventually(t, func() bool {
+		conns := s.Connections()
+		return len(conns) == 1 && conns[0].State == StateIdle
+	}, time.Second, 5*time.Millisecond)
+	assert.Equal(t, 2, s.Connections()[0].RequestsSeen)
+
+	// TEST: Pipelined requests are answered in order
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"+
+		"POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\n\r\nhello"+
+		"GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	for _, want := range []string{"/3", "/4", "/5"} {
+		resp, err := parser.ReadResponse("GET")
+		require.NoError(t, err)
+		assert.Equal(t, connID+want, string(resp.Body))
+	}
+
+	// TEST: Connection: close from the client is the last request
+	resp := get(conn, parser, "GET", "/", "Connection: close\r\n")
+	assert.Equal(t, connID+"/6", string(resp.Body))
+	assert.False(t, resp.KeepAlive())
+	_, err = conn.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+
+	// TEST: A response without a length ends the connection
+	conn, err = net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	parser = response.NewParser(conn)
+	resp = get(conn, parser, "GET", "/unframed", "")
+	assert.Contains(t, string(resp.Body), "/1")
+
+	// TEST: The idle timeout closes a connection without a read error
+	conn, err = net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	parser = response.NewParser(conn)
+	get(conn, parser, "GET", "/", "")
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+
+	// TEST: Shutdown closes idle connections and doesn't wait for them
+	conn, err = net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	parser = response.NewParser(conn)
+	get(conn, parser, "GET", "/", "")
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	require.NoError(t, s.Shutdown(ctx))
+	_, err = conn.Read(make([]byte, 1))
+	assert.Error(t, err)
+	assert.Zero(t, readErrors.Load())
+}
+
+func TestMalformedRequest(t *testing.T) {
+	logs := &syncBuffer{}
+	logger := slog.New(slog.NewTextHandler(logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	called := false
+	addr := startServer(t, func(w *response.Writer, req *request.Request) {
+		called = true
+	}, WithLogger(logger))
+
+	// TEST: Garbage gets 400 without reaching the handler
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	io.WriteString(conn, "NOT A REQUEST\r\n\r\n")
+	resp, err := response.ResponseFromReader(conn)
+	require.NoError(t, err)
+	assert.Equal(t, response.StatusCodeBadRequest, resp.StatusLine.StatusCode)
+
+	// TEST: Client hanging up mid request is only logged
+	conn, err = net.Dial("tcp", addr)
+	require.NoError(t, err)
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: loc")
+	conn.Close()
+
+	require.Eventually(t, func() bool {
+		return strings.Contains(logs.String(), "client closed")
+	}, time.Second, 10*time.Millisecond)
+	assert.Contains(t, logs.String(), "malformed request")
+	assert.False(t, called)
+}
+
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (sb *syncBuffer) Write(p []byte) (int, error) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	return sb.buf.Write(p)
+}
+
+func (sb *syncBuffer) String() string {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	return sb.buf.String()
+}
+
+func TestShutdown(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	s, err := Serve(0, func(w *response.Writer, req *request.Request) {
+		close(started)
+		<-release
+		w.WriteStatusLine(response.StatusCodeOk)
+		w.WriteHeaders(response.GetDefaultHeaders(0))
+	}, WithLogger(slog.New(slog.DiscardHandler)))
+	require.NoError(t, err)
+	_, port, err := net.SplitHostPort(s.Listener.Addr().String())
+	require.NoError(t, err)
+	addr := net.JoinHostPort("127.0.0.1", port)
+
+	busy, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer busy.Close()
+	io.WriteString(busy, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	<-started
+	idle, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer idle.Close()
+
+	// TEST: Connections lists both with their state
+	require.Eventually(t, func() bool { return len(s.Connections()) == 2 }, time.Second, 5*time.Millisecond)
+	conns := s.Connections()
+	assert.Equal(t, StateActive, conns[0].State)
+	assert.Equal(t, 1, conns[0].RequestsSeen)
+	assert.Equal(t, StateNew, conns[1].State)
+	assert.Equal(t, idle.LocalAddr().String(), conns[1].RemoteAddr)
+
+	// TEST: The deadline passes while a request is in flight
+	hookCalled := false
+	s.OnShutdown(func() { hookCalled = true })
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, s.Shutdown(ctx), context.DeadlineExceeded)
+	assert.True(t, s.ShuttingDown())
+	assert.True(t, hookCalled)
+	assert.Error(t, s.Shutdown(context.Background()))
+
+	// TEST: The idle connection was closed, new ones are refused
+	idle.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = idle.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+	_, err = net.Dial("tcp", addr)
+	assert.Error(t, err)
+
+	// TEST: The request in flight still gets its response
+	close(release)
+	resp, err := response.ResponseFromReader(busy)
+	require.NoError(t, err)
+	assert.Equal(t, response.StatusCodeOk, resp.StatusLine.StatusCode)
+	assert.Eventually(t, func() bool { return len(s.Connections()) == 0 }, time.Second, 5*time.Millisecond)
+}
+
+// pipeListener hands out one end of a pipe, then reports what the server
+// tracked by the time it asked for the next connection
+type pipeListener struct {
+	conn    net.Conn
+	tracked chan int
+	server  *Server
+	closed  chan struct{}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	if l.conn != nil {
+		conn := l.conn
+		l.conn = nil
+		return conn, nil
+	}
+	l.tracked <- len(l.server.Connections())
+	<-l.closed
+	return nil, net.ErrClosed
+}
+
+func (l *pipeListener) Close() error {
+	close(l.closed)
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr { return &net.TCPAddr{} }
+
+func TestConnTrackedOnAccept(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	s := newServer(echoHandler)
+	listener := &pipeListener{conn: serverConn, tracked: make(chan int, 1), server: s, closed: make(chan struct{})}
+	s.Listener = listener
+	go s.listen()
+
+	// TEST: The connection is tracked before accept is called again
+	assert.Equal(t, 1, <-listener.tracked)
+	s.Close()
+}
+
+func TestShutdownDrain(t *testing.T) {
+	s, err := Serve(0, echoHandler, WithDrainDelay(100*time.Millisecond))
+	require.NoError(t, err)
+	_, port, err := net.SplitHostPort(s.Listener.Addr().String())
+	require.NoError(t, err)
+	addr := net.JoinHostPort("127.0.0.1", port)
+
+	done := make(chan error, 1)
+	go func() { done <- s.Shutdown(context.Background()) }()
+
+	// TEST: Requests are still served while draining
+	require.Eventually(t, s.ShuttingDown, time.Second, time.Millisecond)
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	io.WriteString(conn, "POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 2\r\n\r\nhi")
+	resp, err := response.ResponseFromReader(conn)
+	require.NoError(t, err)
+	assert.Equal(t, "hi", string(resp.Body))
+
+	// TEST: Shutdown returns once drained and idle
+	assert.NoError(t, <-done)
+}
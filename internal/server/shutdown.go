@@ -0,0 +1,142 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ConnInfo describes an open connection, for debug endpoints
+type ConnInfo struct {
+	ID           uint64
+	RemoteAddr   string
+	State        ConnState
+	OpenedAt     time.Time
+	StateSince   time.Time
+	RequestsSeen int
+}
+
+type tracked struct {
+	conn net.Conn
+	info ConnInfo
+}
+
+type connTracker struct {
+	mu    sync.Mutex
+	conns map[net.Conn]*tracked
+}
+
+func (ct *connTracker) update(conn net.Conn, id uint64, state ConnState) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	if state == StateClosed || state == StateHijacked {
+		delete(ct.conns, conn)
+		return
+	}
+	now := time.Now()
+	if ct.conns == nil {
+		ct.conns = map[net.Conn]*tracked{}
+	}
+	t, ok := ct.conns[conn]
+	if !ok {
+		t = &tracked{conn: conn, info: ConnInfo{ID: id, RemoteAddr: conn.RemoteAddr().String(), OpenedAt: now}}
+		ct.conns[conn] = t
+	}
+	if state == StateActive {
+		t.info.RequestsSeen++
+	}
+	t.info.State = state
+	t.info.StateSince = now
+}
+
+func (ct *connTracker) len() int {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	return len(ct.conns)
+}
+
+// closeWaiting closes connections that haven't started a request or sit
+// idle between two, waiting for them could take until the client gives up
+func (ct *connTracker) closeWaiting() {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	for _, t := range ct.conns {
+		if t.info.State == StateNew || t.info.State == StateIdle {
+			t.conn.Close()
+		}
+	}
+}
+
+// Connections lists the open connections oldest first, hijacked ones are
+// the handler's business and not included
+func (s *Server) Connections() []ConnInfo {
+	s.conns.mu.Lock()
+	infos := make([]ConnInfo, 0, len(s.conns.conns))
+	for _, t := range s.conns.conns {
+		infos = append(infos, t.info)
+	}
+	s.conns.mu.Unlock()
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
+
+// OnShutdown registers fn to run when Shutdown starts
+func (s *Server) OnShutdown(fn func()) {
+	s.shutdownMu.Lock()
+	defer s.shutdownMu.Unlock()
+	s.onShutdown = append(s.onShutdown, fn)
+}
+
+// ShuttingDown is true once Shutdown was called, readiness checks use it
+func (s *Server) ShuttingDown() bool {
+	return s.shuttingDown.Load()
+}
+
+const shutdownPollInterval = 10 * time.Millisecond
+
+// Shutdown stops the server gracefully: readiness starts failing, new
+// connections are still accepted for DrainDelay so load balancers can
+// notice, then the listener closes and Shutdown waits for the requests in
+// flight. It returns ctx.Err() if ctx ends first, connections left open
+// are not closed then.
+func (s *Server) Shutdown(ctx context.Context) error {
+	if !s.shuttingDown.CompareAndSwap(false, true) {
+		return errors.New("server: shutdown already in progress")
+	}
+	s.shutdownMu.Lock()
+	hooks := s.onShutdown
+	s.shutdownMu.Unlock()
+	for _, fn := range hooks {
+		fn()
+	}
+
+	if s.DrainDelay > 0 {
+		select {
+		case <-time.After(s.DrainDelay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	s.State.Store(false)
+	if err := s.Listener.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+		return err
+	}
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		s.conns.closeWaiting()
+		if s.conns.len() == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
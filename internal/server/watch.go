@@ -0,0 +1,60 @@
+package server
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// closeWatcher reads the connection while the handler runs, so a client
+// that goes away cancels the request context. Whatever arrives meanwhile is
+// a pipelined request, or data for a handler that hijacks the connection.
+type closeWatcher struct {
+	conn     net.Conn
+	cancel   context.CancelFunc
+	stopping atomic.Bool
+	stopOnce sync.Once
+	done     chan struct{}
+	read     []byte
+}
+
+// watchReadLimit stops the watch for a client that keeps sending
+const watchReadLimit = 64 << 10
+
+func watchClose(conn net.Conn, cancel context.CancelFunc) *closeWatcher {
+	cw := &closeWatcher{
+		conn:   conn,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	go cw.run()
+	return cw
+}
+
+func (cw *closeWatcher) run() {
+	defer close(cw.done)
+	buffer := make([]byte, 512)
+	for len(cw.read) < watchReadLimit {
+		n, err := cw.conn.Read(buffer)
+		cw.read = append(cw.read, buffer[:n]...)
+		if err != nil {
+			if !cw.stopping.Load() {
+				cw.cancel()
+			}
+			return
+		}
+	}
+}
+
+// stop ends the watch and returns what was read meanwhile
+func (cw *closeWatcher) stop() []byte {
+	cw.stopOnce.Do(func() {
+		cw.stopping.Store(true)
+		cw.conn.SetReadDeadline(time.Unix(1, 0))
+		<-cw.done
+		cw.conn.SetReadDeadline(time.Time{})
+	})
+	return cw.read
+}
@@ -0,0 +1,113 @@
+// Package servertest runs handlers without a real server on a fixed port:
+// ResponseRecorder and NewRequest call a handler directly, Server runs one
+// on an ephemeral port with a client pointed at it.
+package servertest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+)
+
+var ErrNoResponse = errors.New("handler wrote no response")
+
+// ResponseRecorder is a response.Writer that keeps what the handler wrote.
+// It has no connection behind it, so Hijack fails with
+// response.ErrHijackNotSupported.
+type ResponseRecorder struct {
+	*response.Writer
+
+	raw *bytes.Buffer
+}
+
+func NewRecorder() *ResponseRecorder {
+	raw := &bytes.Buffer{}
+	return &ResponseRecorder{Writer: &response.Writer{Writer: raw}, raw: raw}
+}
+
+// Raw is the response exactly as it would have gone on the wire
+func (rec *ResponseRecorder) Raw() []byte {
+	return rec.raw.Bytes()
+}
+
+// Recorded is the parsed final response, with the status codes of any
+// interim responses sent before it
+type Recorded struct {
+	StatusCode    response.StatusCode
+	Headers       headers.Headers
+	Body          []byte
+	Trailers      headers.Headers
+	Informational []response.StatusCode
+}
+
+// Header returns the value of a response header, "" if it wasn't sent
+func (r *Recorded) Header(key string) string {
+	value, _ := r.Headers.Get(key)
+	return value
+}
+
+// Result parses what the handler wrote, chunked bodies are decoded
+func (rec *ResponseRecorder) Result() (*Recorded, error) {
+	if rec.raw.Len() == 0 {
+		return nil, ErrNoResponse
+	}
+	parser := response.NewParser(bytes.NewReader(rec.raw.Bytes()))
+	recorded := &Recorded{}
+	for {
+		resp, err := parser.ReadResponseHead("")
+		if err != nil {
+			return nil, fmt.Errorf("servertest: %w", err)
+		}
+		if resp.IsInformational() && resp.StatusLine.StatusCode != response.StatusCodeSwitchingProtocols {
+			recorded.Informational = append(recorded.Informational, resp.StatusLine.StatusCode)
+			continue
+		}
+		recorded.StatusCode = resp.StatusLine.StatusCode
+		recorded.Headers = resp.Headers
+
+		body := &bytes.Buffer{}
+		if _, err := body.ReadFrom(parser.BodyReader(resp)); err != nil {
+			return nil, fmt.Errorf("servertest: %w", err)
+		}
+		recorded.Body = body.Bytes()
+		recorded.Trailers = resp.Trailers
+		return recorded, nil
+	}
+}
+
+// Record runs h with req and parses its response
+func Record(h server.Handler, req *request.Request) (*Recorded, error) {
+	rec := NewRecorder()
+	h(rec.Writer, req)
+	return rec.Result()
+}
+
+// NewRequest builds a request the way the server would have parsed it off
+// the wire, from a client at 192.0.2.1. target is in origin form and the
+// Host is example.com, change Headers afterwards for anything else. It
+// panics on input the parser rejects, it is meant for tests.
+func NewRequest(method, target string, body []byte) *request.Request {
+	wire := &request.Request{
+		RequestLine: request.RequestLine{HTTPVersion: "1.1", Method: method, RequestTarget: target},
+		Headers:     headers.Headers{"host": "example.com"},
+		Body:        body,
+	}
+	raw := &bytes.Buffer{}
+	if err := wire.Write(raw); err != nil {
+		panic("servertest: " + err.Error())
+	}
+	req, err := request.RequestFromReader(raw)
+	if err != nil {
+		panic("servertest: " + err.Error())
+	}
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.LocalAddr = "192.0.2.2:80"
+	req.ClientIP = "192.0.2.1"
+	req.ConnID = 1
+	req.Sequence = 1
+	return req
+}
@@ -0,0 +1,65 @@
+package servertest
+
+import (
+	"context"
+	"httpfromtcp/internal/client"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/server"
+	"net"
+	"time"
+)
+
+// Server is a real server on an ephemeral loopback port, for tests that
+// need the whole path through parsing and the connection
+type Server struct {
+	// URL is http://127.0.0.1:port, without a trailing slash
+	URL    string
+	Addr   string
+	Server *server.Server
+	// Client talks to this server, its idle connections go on Close
+	Client *client.Client
+}
+
+const closeTimeout = 5 * time.Second
+
+// NewServer starts h, it panics if the server can't start
+func NewServer(h server.Handler, opts ...server.Option) *Server {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic("servertest: " + err.Error())
+	}
+	s := server.ServeListener(listener, h, opts...)
+	addr := listener.Addr().String()
+	return &Server{
+		URL:    "http://" + addr,
+		Addr:   addr,
+		Server: s,
+		Client: &client.Client{DialTimeout: closeTimeout},
+	}
+}
+
+// NewRequest builds a request for path on this server to send with Do
+func (s *Server) NewRequest(method, path string, body []byte) (*request.Request, error) {
+	return client.NewRequest(method, s.URL+path, body)
+}
+
+func (s *Server) Do(req *request.Request) (*client.Response, error) {
+	return s.Client.Do(req)
+}
+
+func (s *Server) Get(path string) (*client.Response, error) {
+	return s.Client.Get(s.URL + path)
+}
+
+// Dial opens a raw connection, for tests that write bytes by hand
+func (s *Server) Dial() (net.Conn, error) {
+	return net.Dial("tcp", s.Addr)
+}
+
+// Close shuts the server down, waiting a while for handlers still running
+func (s *Server) Close() error {
+	s.Client.CloseIdleConnections()
+	ctx, cancel := context.WithTimeout(context.Background(), closeTimeout)
+	defer cancel()
+	return s.Server.Shutdown(ctx)
+}
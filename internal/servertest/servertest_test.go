@@ -0,0 +1,120 @@
+package servertest
+
+import (
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func echo(w *response.Writer, req *request.Request) {
+	body, err := req.ReadBody()
+	if err != nil {
+		w.WriteStatusLine(response.StatusCodeBadRequest)
+		w.WriteHeaders(response.GetDefaultHeaders(0))
+		return
+	}
+	h := response.GetDefaultHeaders(len(body))
+	h["X-Method"] = req.RequestLine.Method
+	h["X-Client"] = req.ClientIP
+	w.WriteStatusLine(response.StatusCodeOk)
+	w.WriteHeaders(h)
+	w.WriteBody(body)
+}
+
+func TestRecorder(t *testing.T) {
+	// TEST: Status, headers and body of a plain response
+	rec, err := Record(echo, NewRequest("POST", "/echo?x=1", []byte("hello")))
+	require.NoError(t, err)
+	assert.Equal(t, response.StatusCodeOk, rec.StatusCode)
+	assert.Equal(t, "POST", rec.Header("x-method"))
+	assert.Equal(t, "192.0.2.1", rec.Header("X-Client"))
+	assert.Equal(t, "hello", string(rec.Body))
+
+	// TEST: Interim responses, chunked bodies and trailers
+	recorder := NewRecorder()
+	func(w *response.Writer, req *request.Request) {
+		w.WriteInformational(response.StatusCodeEarlyHints, headers.Headers{"Link": "</app.js>; rel=preload"})
+		w.DeclareTrailers("X-Checksum")
+		w.WriteStatusLine(response.StatusCodeOk)
+		w.WriteHeaders(headers.Headers{"Transfer-Encoding": "chunked"})
+		w.WriteChunkedBody([]byte("hel"))
+		w.WriteChunkedBody([]byte("lo"))
+		w.WriteTrailers(headers.Headers{"X-Checksum": "abc"})
+	}(recorder.Writer, NewRequest("GET", "/", nil))
+	rec, err = recorder.Result()
+	require.NoError(t, err)
+	assert.Equal(t, []response.StatusCode{response.StatusCodeEarlyHints}, rec.Informational)
+	assert.Equal(t, "hello", string(rec.Body))
+	assert.Equal(t, "abc", rec.Trailers["x-checksum"])
+	assert.Contains(t, string(recorder.Raw()), "HTTP/1.1 103")
+
+	// TEST: Nothing written, and no connection to hijack
+	recorder = NewRecorder()
+	_, _, err = recorder.Hijack()
+	assert.ErrorIs(t, err, response.ErrHijackNotSupported)
+	_, err = recorder.Result()
+	assert.ErrorIs(t, err, ErrNoResponse)
+}
+
+func TestNewRequest(t *testing.T) {
+	// TEST: The request looks like one read off a connection
+	req := NewRequest("POST", "/form?a=1", []byte("name=x"))
+	assert.Equal(t, "/form", req.Path())
+	host, _ := req.Headers.Get("host")
+	assert.Equal(t, "example.com", host)
+	body, err := req.ReadBody()
+	require.NoError(t, err)
+	assert.Equal(t, "name=x", string(body))
+	assert.Equal(t, "192.0.2.1:1234", req.RemoteAddr)
+
+	// TEST: Input the parser rejects panics
+	assert.Panics(t, func() { NewRequest("GET", "bad target", nil) })
+}
+
+func TestServer(t *testing.T) {
+	s := NewServer(echo)
+	defer s.Close()
+
+	// TEST: Only loopback is listened on
+	host, _, err := net.SplitHostPort(s.Server.Listener.Addr().String())
+	require.NoError(t, err)
+	assert.Equal(t, "127.0.0.1", host)
+
+	// TEST: Requests go through the real parser and connection
+	req, err := s.NewRequest("POST", "/echo", []byte("over the wire"))
+	require.NoError(t, err)
+	resp, err := s.Do(req)
+	require.NoError(t, err)
+	body, err := resp.ReadAll()
+	require.NoError(t, err)
+	assert.Equal(t, response.StatusCodeOk, resp.StatusCode)
+	assert.Equal(t, "over the wire", string(body))
+	client, _ := resp.Headers.Get("x-client")
+	assert.Equal(t, "127.0.0.1", client)
+
+	resp, err = s.Get("/")
+	require.NoError(t, err)
+	resp.Body.Close()
+	method, _ := resp.Headers.Get("x-method")
+	assert.Equal(t, "GET", method)
+
+	// TEST: Raw connections get a 400 for garbage
+	conn, err := s.Dial()
+	require.NoError(t, err)
+	defer conn.Close()
+	io.WriteString(conn, "NOT HTTP\r\n\r\n")
+	raw, err := response.ResponseFromReader(conn)
+	require.NoError(t, err)
+	assert.Equal(t, response.StatusCodeBadRequest, raw.StatusLine.StatusCode)
+
+	// TEST: Close waits for the server to stop
+	require.NoError(t, s.Close())
+	_, err = s.Get("/")
+	assert.Error(t, err)
+}
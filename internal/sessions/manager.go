@@ -0,0 +1,216 @@
+package sessions
+
+import (
+	"context"
+	"httpfromtcp/internal/cookie"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+	"log/slog"
+	"time"
+)
+
+const DefaultCookieName = "session_id"
+
+type contextKey struct{}
+
+// Manager loads the session named by the request cookie before the handler
+// runs and saves it, together with the cookie, once the handler responds
+type Manager struct {
+	Store      Store
+	CookieName string
+	Path       string
+	Domain     string
+	Secure     bool
+	HttpOnly   bool
+	SameSite   cookie.SameSite
+	// IdleTimeout ends a session that has not been used for that long
+	IdleTimeout time.Duration
+	// AbsoluteTimeout ends a session that long after it was created, however
+	// active it is
+	AbsoluteTimeout time.Duration
+	// Codec signs or encrypts the id in the cookie, nil sends it as is
+	Codec cookie.Codec
+
+	now func() time.Time
+}
+
+func NewManager(store Store) *Manager {
+	return &Manager{
+		Store:           store,
+		CookieName:      DefaultCookieName,
+		Path:            "/",
+		HttpOnly:        true,
+		SameSite:        cookie.SameSiteLax,
+		IdleTimeout:     30 * time.Minute,
+		AbsoluteTimeout: 24 * time.Hour,
+		now:             time.Now,
+	}
+}
+
+// FromRequest returns the session the middleware attached, nil without one
+func FromRequest(req *request.Request) *Session {
+	s, _ := req.Context().Value(contextKey{}).(*Session)
+	return s
+}
+
+func (m *Manager) Middleware(next server.Handler) server.Handler {
+	return func(w *response.Writer, req *request.Request) {
+		s := m.load(req)
+		req = req.WithContext(context.WithValue(req.Context(), contextKey{}, s))
+
+		w.BeforeHeaders(func(w *response.Writer) {
+			if c := m.commit(s); c != nil {
+				if err := w.SetCookie(c); err != nil {
+					slog.Error("SessionCookie", "error", err)
+				}
+			}
+		})
+		next(w, req)
+		// changes made after the headers went out still reach the store
+		m.commit(s)
+	}
+}
+
+func (m *Manager) clock() time.Time {
+	if m.now == nil {
+		return time.Now()
+	}
+	return m.now()
+}
+
+func (m *Manager) load(req *request.Request) *Session {
+	now := m.clock()
+	c, ok := req.Cookie(m.CookieName)
+	if !ok {
+		return newSession(now)
+	}
+
+	id := c.Value
+	if m.Codec != nil {
+		decoded, err := m.Codec.Decode(m.CookieName, c.Value)
+		if err != nil {
+			return newSession(now)
+		}
+		id = decoded
+	}
+	if !validID(id) {
+		return newSession(now)
+	}
+
+	record, err := m.Store.Load(id)
+	if err != nil {
+		if err != ErrNotFound {
+			slog.Error("SessionLoad", "error", err)
+		}
+		return newSession(now)
+	}
+	if m.expired(record, now) {
+		if err := m.Store.Delete(id); err != nil {
+			slog.Error("SessionDelete", "error", err)
+		}
+		return newSession(now)
+	}
+
+	if record.Values == nil {
+		record.Values = map[string]string{}
+	}
+	// an unchanged session is saved again only to keep the idle timer
+	// sliding, and that can wait until part of it has passed
+	touch := m.IdleTimeout > 0 && now.Sub(record.LastSeen) >= m.IdleTimeout/touchDivisor
+	return &Session{record: *record, modified: touch}
+}
+
+// touchDivisor spaces the saves of an unchanged session a fraction of
+// IdleTimeout apart, such a session can end that much earlier than the
+// timeout after its last request
+const touchDivisor = 4
+
+func (m *Manager) expired(record *Record, now time.Time) bool {
+	if m.IdleTimeout > 0 && now.Sub(record.LastSeen) > m.IdleTimeout {
+		return true
+	}
+	if m.AbsoluteTimeout > 0 && now.Sub(record.CreatedAt) > m.AbsoluteTimeout {
+		return true
+	}
+	return false
+}
+
+// ttl is how long the store keeps the record, whichever timeout comes first
+func (m *Manager) ttl(record *Record, now time.Time) time.Duration {
+	ttl := m.IdleTimeout
+	if m.AbsoluteTimeout > 0 {
+		remaining := record.CreatedAt.Add(m.AbsoluteTimeout).Sub(now)
+		if ttl == 0 || remaining < ttl {
+			ttl = remaining
+		}
+	}
+	return ttl
+}
+
+// commit writes pending changes to the store and returns the cookie that
+// goes with them, nil when nothing changed
+func (m *Manager) commit(s *Session) *cookie.Cookie {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.modified {
+		return nil
+	}
+	s.modified = false
+
+	if s.previousID != "" {
+		if err := m.Store.Delete(s.previousID); err != nil {
+			slog.Error("SessionDelete", "error", err)
+		}
+		s.previousID = ""
+	}
+
+	if s.destroyed {
+		if !s.isNew {
+			if err := m.Store.Delete(s.record.ID); err != nil {
+				slog.Error("SessionDelete", "error", err)
+			}
+		}
+		c := m.cookie("")
+		c.MaxAge = -1
+		return c
+	}
+
+	now := m.clock()
+	// every save restarts the idle timer, the ttl below does the same
+	s.record.LastSeen = now
+	record := s.snapshot()
+	ttl := m.ttl(&record, now)
+	if err := m.Store.Save(&record, ttl); err != nil {
+		slog.Error("SessionSave", "error", err)
+		return nil
+	}
+	s.isNew = false
+
+	value := record.ID
+	if m.Codec != nil {
+		encoded, err := m.Codec.Encode(m.CookieName, value)
+		if err != nil {
+			slog.Error("SessionCookie", "error", err)
+			return nil
+		}
+		value = encoded
+	}
+	c := m.cookie(value)
+	if ttl > 0 {
+		c.MaxAge = int(ttl / time.Second)
+	}
+	return c
+}
+
+func (m *Manager) cookie(value string) *cookie.Cookie {
+	return &cookie.Cookie{
+		Name:     m.CookieName,
+		Value:    value,
+		Path:     m.Path,
+		Domain:   m.Domain,
+		Secure:   m.Secure,
+		HttpOnly: m.HttpOnly,
+		SameSite: m.SameSite,
+	}
+}
@@ -0,0 +1,140 @@
+package sessions
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Record is what a store keeps for one session
+type Record struct {
+	ID        string            `json:"id"`
+	Values    map[string]string `json:"values"`
+	Flashes   []string          `json:"flashes,omitempty"`
+	CreatedAt time.Time         `json:"created_at"`
+	LastSeen  time.Time         `json:"last_seen"`
+}
+
+type Session struct {
+	mu        sync.Mutex
+	record    Record
+	isNew     bool
+	modified  bool
+	destroyed bool
+	// previousID is dropped from the store once a rotated session is saved
+	previousID string
+}
+
+func newID() string {
+	id := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(id)
+}
+
+func validID(id string) bool {
+	if len(id) != 64 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+func newSession(now time.Time) *Session {
+	return &Session{
+		record: Record{
+			ID:        newID(),
+			Values:    map[string]string{},
+			CreatedAt: now,
+			LastSeen:  now,
+		},
+		isNew: true,
+	}
+}
+
+func (s *Session) ID() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.record.ID
+}
+
+func (s *Session) IsNew() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.isNew
+}
+
+func (s *Session) Get(key string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	value, ok := s.record.Values[key]
+	return value, ok
+}
+
+func (s *Session) Set(key, value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.record.Values[strings.Clone(key)] = strings.Clone(value)
+	s.modified = true
+}
+
+func (s *Session) Delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.record.Values, key)
+	s.modified = true
+}
+
+// AddFlash stores a message for the next request that reads flashes
+func (s *Session) AddFlash(message string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.record.Flashes = append(s.record.Flashes, strings.Clone(message))
+	s.modified = true
+}
+
+// Flashes returns the pending flash messages and clears them
+func (s *Session) Flashes() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	flashes := s.record.Flashes
+	if len(flashes) > 0 {
+		s.record.Flashes = nil
+		s.modified = true
+	}
+	return flashes
+}
+
+// Rotate moves the data to a fresh id, call it on login so an id known
+// before authentication is worthless afterwards
+func (s *Session) Rotate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.isNew && s.previousID == "" {
+		s.previousID = s.record.ID
+	}
+	s.record.ID = newID()
+	s.modified = true
+}
+
+// Destroy removes the session from the store and the client
+func (s *Session) Destroy() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.destroyed = true
+	s.modified = true
+}
+
+func (s *Session) snapshot() Record {
+	values := make(map[string]string, len(s.record.Values))
+	for key, value := range s.record.Values {
+		values[key] = value
+	}
+	record := s.record
+	record.Values = values
+	record.Flashes = append([]string(nil), s.record.Flashes...)
+	return record
+}
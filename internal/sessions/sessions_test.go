@@ -0,0 +1,197 @@
+package sessions
+
+import (
+	"bytes"
+	"httpfromtcp/internal/cookie"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// serve runs one request through the middleware and returns the Set-Cookie value
+func serve(t *testing.T, m *Manager, cookieHeader string, h func(s *Session)) string {
+	t.Helper()
+	raw := "GET / HTTP/1.1\r\nHost: localhost\r\n"
+	if cookieHeader != "" {
+		raw += "Cookie: " + cookieHeader + "\r\n"
+	}
+	req, err := request.RequestFromReader(strings.NewReader(raw + "\r\n"))
+	require.NoError(t, err)
+
+	out := &bytes.Buffer{}
+	w := &response.Writer{Writer: out}
+	m.Middleware(func(w *response.Writer, req *request.Request) {
+		s := FromRequest(req)
+		require.NotNil(t, s)
+		h(s)
+		w.WriteStatusLine(response.StatusCodeOk)
+		w.WriteHeaders(response.GetDefaultHeaders(0))
+	})(w, req)
+
+	for _, line := range strings.Split(out.String(), "\r\n") {
+		if value, ok := strings.CutPrefix(line, "Set-Cookie: "); ok {
+			return value
+		}
+	}
+	return ""
+}
+
+func cookiePair(t *testing.T, setCookie string) string {
+	t.Helper()
+	c, err := cookie.ParseSetCookie(setCookie)
+	require.NoError(t, err)
+	return c.Name + "=" + c.Value
+}
+
+func TestManager(t *testing.T) {
+	store := NewMemoryStore()
+	m := NewManager(store)
+
+	// TEST: Untouched new session sets no cookie
+	setCookie := serve(t, m, "", func(s *Session) {})
+	assert.Empty(t, setCookie)
+
+	// TEST: Values survive between requests
+	setCookie = serve(t, m, "", func(s *Session) { s.Set("user", "alice") })
+	require.NotEmpty(t, setCookie)
+	assert.Contains(t, setCookie, "HttpOnly")
+	pair := cookiePair(t, setCookie)
+	serve(t, m, pair, func(s *Session) {
+		assert.False(t, s.IsNew())
+		value, ok := s.Get("user")
+		assert.True(t, ok)
+		assert.Equal(t, "alice", value)
+	})
+
+	// TEST: Flashes are read once
+	serve(t, m, pair, func(s *Session) { s.AddFlash("saved") })
+	serve(t, m, pair, func(s *Session) { assert.Equal(t, []string{"saved"}, s.Flashes()) })
+	serve(t, m, pair, func(s *Session) { assert.Empty(t, s.Flashes()) })
+
+	// TEST: Rotate drops the old id
+	var oldID, newID string
+	rotated := serve(t, m, pair, func(s *Session) {
+		oldID = s.ID()
+		s.Rotate()
+		newID = s.ID()
+	})
+	assert.NotEqual(t, oldID, newID)
+	_, err := store.Load(oldID)
+	assert.ErrorIs(t, err, ErrNotFound)
+	serve(t, m, cookiePair(t, rotated), func(s *Session) {
+		value, _ := s.Get("user")
+		assert.Equal(t, "alice", value)
+	})
+
+	// TEST: Destroy clears the cookie
+	destroyed := serve(t, m, cookiePair(t, rotated), func(s *Session) { s.Destroy() })
+	assert.Contains(t, destroyed, "Max-Age=0")
+	_, err = store.Load(newID)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	// TEST: Unknown id starts over
+	serve(t, m, m.CookieName+"="+strings.Repeat("ab", 32), func(s *Session) { assert.True(t, s.IsNew()) })
+}
+
+func TestTimeouts(t *testing.T) {
+	now := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	store := NewMemoryStore()
+	store.now = clock
+	m := NewManager(store)
+	m.now = clock
+	m.IdleTimeout = 10 * time.Minute
+	m.AbsoluteTimeout = time.Hour
+
+	pair := cookiePair(t, serve(t, m, "", func(s *Session) { s.Set("k", "v") }))
+
+	// TEST: Activity keeps the session alive past the idle timeout
+	for range 5 {
+		now = now.Add(9 * time.Minute)
+		serve(t, m, pair, func(s *Session) { assert.False(t, s.IsNew()) })
+	}
+
+	// TEST: Unchanged session is only saved again after part of the idle timeout
+	assert.Empty(t, serve(t, m, pair, func(s *Session) {}))
+	now = now.Add(time.Minute)
+	assert.Empty(t, serve(t, m, pair, func(s *Session) {}))
+	assert.NotEmpty(t, serve(t, m, pair, func(s *Session) { s.Set("k", "changed") }))
+	now = now.Add(3 * time.Minute)
+	assert.NotEmpty(t, serve(t, m, pair, func(s *Session) {}))
+
+	// TEST: Idle timeout
+	now = now.Add(11 * time.Minute)
+	serve(t, m, pair, func(s *Session) { assert.True(t, s.IsNew()) })
+
+	// TEST: Absolute timeout
+	pair = cookiePair(t, serve(t, m, "", func(s *Session) { s.Set("k", "v") }))
+	for range 7 {
+		now = now.Add(9 * time.Minute)
+		serve(t, m, pair, func(s *Session) {})
+	}
+	serve(t, m, pair, func(s *Session) { assert.True(t, s.IsNew()) })
+}
+
+func TestSignedCookie(t *testing.T) {
+	m := NewManager(NewMemoryStore())
+	signer, err := newTestSigner()
+	require.NoError(t, err)
+	m.Codec = signer
+
+	pair := cookiePair(t, serve(t, m, "", func(s *Session) { s.Set("k", "v") }))
+	serve(t, m, pair, func(s *Session) { assert.False(t, s.IsNew()) })
+
+	// TEST: Raw id without signature is rejected
+	var id string
+	serve(t, m, pair, func(s *Session) { id = s.ID() })
+	serve(t, m, m.CookieName+"="+id, func(s *Session) { assert.True(t, s.IsNew()) })
+}
+
+func newTestSigner() (*cookie.Signer, error) {
+	return cookie.NewSigner([]byte(strings.Repeat("k", 32)))
+}
+
+func TestFileStore(t *testing.T) {
+	fs, err := NewFileStore(t.TempDir())
+	require.NoError(t, err)
+	now := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	fs.now = func() time.Time { return now }
+
+	record := &Record{ID: newID(), Values: map[string]string{"a": "b"}, CreatedAt: now, LastSeen: now}
+	require.NoError(t, fs.Save(record, time.Minute))
+
+	// TEST: Load
+	loaded, err := fs.Load(record.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "b", loaded.Values["a"])
+
+	// TEST: Expiry
+	now = now.Add(2 * time.Minute)
+	_, err = fs.Load(record.ID)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	// TEST: Path traversal ids
+	_, err = fs.Load("../../etc/passwd")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	// TEST: Cleanup deletes expired session files without loading them
+	expired := &Record{ID: newID(), CreatedAt: now, LastSeen: now}
+	require.NoError(t, fs.Save(expired, time.Minute))
+	kept := &Record{ID: newID(), CreatedAt: now, LastSeen: now}
+	require.NoError(t, fs.Save(kept, time.Hour))
+	forever := &Record{ID: newID(), CreatedAt: now, LastSeen: now}
+	require.NoError(t, fs.Save(forever, 0))
+	now = now.Add(2 * time.Minute)
+	assert.Equal(t, 1, fs.Cleanup())
+	files, err := os.ReadDir(fs.Dir)
+	require.NoError(t, err)
+	assert.Len(t, files, 2)
+	_, err = fs.Load(kept.ID)
+	assert.NoError(t, err)
+}
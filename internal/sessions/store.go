@@ -0,0 +1,255 @@
+package sessions
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var ErrNotFound = errors.New("session not found")
+
+type Store interface {
+	Load(id string) (*Record, error)
+	// Save keeps the record for ttl, a zero ttl means no expiry
+	Save(record *Record, ttl time.Duration) error
+	Delete(id string) error
+}
+
+type memoryEntry struct {
+	record    Record
+	expiresAt time.Time
+}
+
+type MemoryStore struct {
+	mu      sync.Mutex
+	entries map[string]memoryEntry
+	now     func() time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		entries: map[string]memoryEntry{},
+		now:     time.Now,
+	}
+}
+
+func (ms *MemoryStore) Load(id string) (*Record, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	entry, ok := ms.entries[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if !entry.expiresAt.IsZero() && ms.now().After(entry.expiresAt) {
+		delete(ms.entries, id)
+		return nil, ErrNotFound
+	}
+	record := entry.record
+	return &record, nil
+}
+
+func (ms *MemoryStore) Save(record *Record, ttl time.Duration) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	entry := memoryEntry{record: *record}
+	if ttl > 0 {
+		entry.expiresAt = ms.now().Add(ttl)
+	}
+	ms.entries[record.ID] = entry
+	return nil
+}
+
+func (ms *MemoryStore) Delete(id string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	delete(ms.entries, id)
+	return nil
+}
+
+// Cleanup drops expired sessions, Load only notices them on access
+func (ms *MemoryStore) Cleanup() int {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	removed := 0
+	now := ms.now()
+	for id, entry := range ms.entries {
+		if !entry.expiresAt.IsZero() && now.After(entry.expiresAt) {
+			delete(ms.entries, id)
+			removed++
+		}
+	}
+	return removed
+}
+
+// StartCleanup runs Cleanup every interval until stop is closed
+func (ms *MemoryStore) StartCleanup(interval time.Duration, stop <-chan struct{}) {
+	startCleanup(interval, stop, func() { ms.Cleanup() })
+}
+
+func startCleanup(interval time.Duration, stop <-chan struct{}, cleanup func()) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				cleanup()
+			}
+		}
+	}()
+}
+
+// FileStore keeps every session as a json file in Dir
+type FileStore struct {
+	Dir string
+
+	mu  sync.Mutex
+	now func() time.Time
+}
+
+type fileEntry struct {
+	Record    Record    `json:"record"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &FileStore{Dir: dir, now: time.Now}, nil
+}
+
+func (fs *FileStore) path(id string) (string, error) {
+	// ids come from cookies, never let them pick a path
+	if !validID(id) {
+		return "", ErrNotFound
+	}
+	return filepath.Join(fs.Dir, id+".json"), nil
+}
+
+func (fs *FileStore) Load(id string) (*Record, error) {
+	path, err := fs.path(id)
+	if err != nil {
+		return nil, err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var entry fileEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, err
+	}
+	if !entry.ExpiresAt.IsZero() && fs.now().After(entry.ExpiresAt) {
+		os.Remove(path)
+		return nil, ErrNotFound
+	}
+	return &entry.Record, nil
+}
+
+func (fs *FileStore) Save(record *Record, ttl time.Duration) error {
+	path, err := fs.path(record.ID)
+	if err != nil {
+		return err
+	}
+	entry := fileEntry{Record: *record}
+	if ttl > 0 {
+		entry.ExpiresAt = fs.now().Add(ttl)
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	// write and rename so a crash never leaves half a session behind
+	tmp, err := os.CreateTemp(fs.Dir, "session-*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (fs *FileStore) Delete(id string) error {
+	path, err := fs.path(id)
+	if err != nil {
+		return nil
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// tmpMaxAge is how old a leftover temp file of an interrupted Save has to
+// be before Cleanup removes it
+const tmpMaxAge = time.Hour
+
+// Cleanup deletes the files of expired sessions, Load only notices them on
+// access. Files it can't read are left alone.
+func (fs *FileStore) Cleanup() int {
+	entries, err := os.ReadDir(fs.Dir)
+	if err != nil {
+		return 0
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	removed := 0
+	now := fs.now()
+	for _, dirEntry := range entries {
+		path := filepath.Join(fs.Dir, dirEntry.Name())
+		if filepath.Ext(path) == ".tmp" {
+			if info, err := dirEntry.Info(); err == nil && now.Sub(info.ModTime()) > tmpMaxAge {
+				os.Remove(path)
+			}
+			continue
+		}
+		if filepath.Ext(path) != ".json" {
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		var entry fileEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			continue
+		}
+		if !entry.ExpiresAt.IsZero() && now.After(entry.ExpiresAt) {
+			if err := os.Remove(path); err == nil {
+				removed++
+			}
+		}
+	}
+	return removed
+}
+
+// StartCleanup runs Cleanup every interval until stop is closed
+func (fs *FileStore) StartCleanup(interval time.Duration, stop <-chan struct{}) {
+	startCleanup(interval, stop, func() { fs.Cleanup() })
+}
@@ -0,0 +1,188 @@
+package sse
+
+import (
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ReplayBuffer keeps the latest events so reconnecting clients can resume
+// from their Last-Event-ID
+type ReplayBuffer struct {
+	mu     sync.Mutex
+	events []Event
+	size   int
+	nextID uint64
+}
+
+func NewReplayBuffer(size int) *ReplayBuffer {
+	return &ReplayBuffer{size: size}
+}
+
+// Add stores the event, events without an id get a sequential one
+func (b *ReplayBuffer) Add(e Event) Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.nextID++
+	if e.ID == "" {
+		e.ID = strconv.FormatUint(b.nextID, 10)
+	}
+	if b.size <= 0 {
+		return e
+	}
+	b.events = append(b.events, e)
+	if len(b.events) > b.size {
+		b.events = b.events[len(b.events)-b.size:]
+	}
+	return e
+}
+
+// Since returns the events after lastID, ok is false when lastID is no
+// longer in the buffer and the client missed events
+func (b *ReplayBuffer) Since(lastID string) ([]Event, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if lastID == "" {
+		return nil, true
+	}
+	for i, e := range b.events {
+		if e.ID == lastID {
+			return append([]Event(nil), b.events[i+1:]...), true
+		}
+	}
+	return append([]Event(nil), b.events...), false
+}
+
+type Broker struct {
+	// HeartbeatInterval spaces the comment lines that keep proxies from
+	// timing out a quiet stream, 0 or less sends none
+	HeartbeatInterval time.Duration
+	// Retry is sent once per connection as the reconnection delay
+	Retry time.Duration
+
+	replay      *ReplayBuffer
+	mu          sync.Mutex
+	subscribers map[chan Event]struct{}
+	done        chan struct{}
+	closeOnce   sync.Once
+}
+
+const (
+	defaultHeartbeatInterval = 15 * time.Second
+	subscriberBuffer         = 16
+)
+
+func NewBroker(replaySize int) *Broker {
+	return &Broker{
+		HeartbeatInterval: defaultHeartbeatInterval,
+		replay:            NewReplayBuffer(replaySize),
+		subscribers:       map[chan Event]struct{}{},
+		done:              make(chan struct{}),
+	}
+}
+
+// Publish sends the event to every connected client, clients that can't
+// keep up lose the event and can recover it from the replay buffer
+func (b *Broker) Publish(e Event) Event {
+	e = b.replay.Add(e)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for subscriber := range b.subscribers {
+		select {
+		case subscriber <- e:
+		default:
+			slog.Warn("SSESlowSubscriber", "event", e.ID)
+		}
+	}
+	return e
+}
+
+func (b *Broker) subscribe() chan Event {
+	subscriber := make(chan Event, subscriberBuffer)
+	b.mu.Lock()
+	b.subscribers[subscriber] = struct{}{}
+	b.mu.Unlock()
+	return subscriber
+}
+
+func (b *Broker) unsubscribe(subscriber chan Event) {
+	b.mu.Lock()
+	delete(b.subscribers, subscriber)
+	b.mu.Unlock()
+}
+
+func (b *Broker) Subscribers() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.subscribers)
+}
+
+// Close ends every open stream
+func (b *Broker) Close() {
+	b.closeOnce.Do(func() { close(b.done) })
+}
+
+// Handler streams events until the client disconnects or the broker closes,
+// the server cancels the request context when the client goes away
+func (b *Broker) Handler(w *response.Writer, req *request.Request) {
+	stream, err := Start(w, req)
+	if err != nil {
+		return
+	}
+	defer stream.Close()
+
+	// subscribe before replaying so nothing published in between is lost
+	subscriber := b.subscribe()
+	defer b.unsubscribe(subscriber)
+
+	if b.Retry > 0 {
+		if err := stream.Send(Event{Retry: b.Retry}); err != nil {
+			return
+		}
+	}
+
+	sent := map[string]struct{}{}
+	missed, _ := b.replay.Since(stream.LastEventID())
+	for _, e := range missed {
+		if err := stream.Send(e); err != nil {
+			return
+		}
+		sent[e.ID] = struct{}{}
+	}
+
+	var heartbeat <-chan time.Time
+	if b.HeartbeatInterval > 0 {
+		ticker := time.NewTicker(b.HeartbeatInterval)
+		defer ticker.Stop()
+		heartbeat = ticker.C
+	}
+	var gone <-chan struct{}
+	if req != nil {
+		gone = req.Context().Done()
+	}
+	for {
+		select {
+		case <-b.done:
+			return
+		case <-gone:
+			return
+		case e := <-subscriber:
+			if _, ok := sent[e.ID]; ok {
+				continue
+			}
+			if err := stream.Send(e); err != nil {
+				return
+			}
+		case <-heartbeat:
+			if err := stream.Heartbeat(); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package sse
+
+import (
+	"errors"
+	"fmt"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrStreamClosed = errors.New("event stream closed")
+
+type Event struct {
+	ID    string
+	Event string
+	Data  string
+	// Retry tells the client how long to wait before reconnecting
+	Retry time.Duration
+}
+
+var lineBreaks = strings.NewReplacer("\r\n", "\n", "\r", "\n")
+
+// stripLineBreaks keeps single line fields from breaking the event framing
+func stripLineBreaks(s string) string {
+	return strings.NewReplacer("\r", "", "\n", "").Replace(s)
+}
+
+func (e Event) Format() string {
+	var sb strings.Builder
+	if e.Event != "" {
+		fmt.Fprintf(&sb, "event: %s\n", stripLineBreaks(e.Event))
+	}
+	if e.ID != "" {
+		fmt.Fprintf(&sb, "id: %s\n", stripLineBreaks(e.ID))
+	}
+	if e.Retry > 0 {
+		fmt.Fprintf(&sb, "retry: %d\n", e.Retry.Milliseconds())
+	}
+	if e.Data != "" || e.Event != "" || e.ID != "" {
+		for _, line := range strings.Split(lineBreaks.Replace(e.Data), "\n") {
+			fmt.Fprintf(&sb, "data: %s\n", line)
+		}
+	}
+	sb.WriteString("\n")
+	return sb.String()
+}
+
+type Stream struct {
+	w           *response.Writer
+	lastEventID string
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// Start answers the request with an open text/event-stream response
+func Start(w *response.Writer, req *request.Request) (*Stream, error) {
+	header := headers.NewHeaders()
+	header["Content-Type"] = "text/event-stream"
+	header["Cache-Control"] = "no-cache"
+	header["Connection"] = "close"
+	header["Transfer-Encoding"] = "chunked"
+	if err := w.WriteStatusLine(response.StatusCodeOk); err != nil {
+		return nil, err
+	}
+	if err := w.WriteHeaders(header); err != nil {
+		return nil, err
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+
+	stream := &Stream{w: w}
+	if req != nil {
+		stream.lastEventID, _ = req.Headers.Get("last-event-id")
+	}
+	return stream, nil
+}
+
+// LastEventID is the id the client saw last before reconnecting
+func (s *Stream) LastEventID() string {
+	return s.lastEventID
+}
+
+func (s *Stream) write(p string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrStreamClosed
+	}
+	if _, err := s.w.WriteChunkedBody([]byte(p)); err != nil {
+		s.closed = true
+		return err
+	}
+	// events are useless sitting in a buffer
+	if err := s.w.Flush(); err != nil {
+		s.closed = true
+		return err
+	}
+	return nil
+}
+
+func (s *Stream) Send(e Event) error {
+	return s.write(e.Format())
+}
+
+// Heartbeat writes a comment line, it keeps proxies from timing out the
+// connection and surfaces a gone client as a write error
+func (s *Stream) Heartbeat() error {
+	return s.write(": heartbeat\n\n")
+}
+
+func (s *Stream) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	if _, err := s.w.WriteChunkedBodyDone(); err != nil {
+		return err
+	}
+	return s.w.Flush()
+}
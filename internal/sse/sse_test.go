@@ -0,0 +1,164 @@
+package sse
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/servertest"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFormat(t *testing.T) {
+	// TEST: All fields with multi-line data
+	e := Event{ID: "7", Event: "update", Data: "line one\nline two\r\nline three", Retry: 3 * time.Second}
+	assert.Equal(t, "event: update\nid: 7\nretry: 3000\ndata: line one\ndata: line two\ndata: line three\n\n", e.Format())
+
+	// TEST: Newlines are stripped from single line fields
+	e = Event{Event: "bad\nevent", Data: "x"}
+	assert.Equal(t, "event: badevent\ndata: x\n\n", e.Format())
+
+	// TEST: Retry only
+	e = Event{Retry: time.Second}
+	assert.Equal(t, "retry: 1000\n\n", e.Format())
+}
+
+func TestReplayBuffer(t *testing.T) {
+	buffer := NewReplayBuffer(3)
+	for range 5 {
+		buffer.Add(Event{Data: "x"})
+	}
+
+	// TEST: Resume from an id inside the buffer
+	events, ok := buffer.Since("4")
+	assert.True(t, ok)
+	require.Len(t, events, 1)
+	assert.Equal(t, "5", events[0].ID)
+
+	// TEST: Id that fell out of the buffer
+	events, ok = buffer.Since("1")
+	assert.False(t, ok)
+	assert.Len(t, events, 3)
+
+	// TEST: No id means no replay
+	events, ok = buffer.Since("")
+	assert.True(t, ok)
+	assert.Empty(t, events)
+}
+
+// failingWriter accepts the response head and fails once the client is gone
+type failingWriter struct {
+	writes int
+}
+
+func (fw *failingWriter) Write(p []byte) (int, error) {
+	fw.writes++
+	if fw.writes > 6 {
+		return 0, errors.New("client went away")
+	}
+	return len(p), nil
+}
+
+func TestBroker(t *testing.T) {
+	broker := NewBroker(10)
+	broker.Retry = 2 * time.Second
+	broker.Publish(Event{Data: "first"})
+	broker.Publish(Event{Data: "second"})
+
+	req := &request.Request{Headers: headers.NewHeaders()}
+	req.Headers.Add("Last-Event-ID", "1")
+
+	// TEST: Reconnecting client gets the missed events and new ones
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		broker.Handler(&response.Writer{Writer: pw}, req)
+		pw.Close()
+		close(done)
+	}()
+
+	parser := response.NewParser(pr)
+	resp, err := parser.ReadResponseHead("GET")
+	require.NoError(t, err)
+	assert.Equal(t, "text/event-stream", resp.Headers["content-type"])
+	body := bufio.NewReader(parser.BodyReader(resp))
+
+	readEvent := func() string {
+		var lines []string
+		for {
+			line, err := body.ReadString('\n')
+			require.NoError(t, err)
+			if line == "\n" {
+				return strings.Join(lines, "")
+			}
+			lines = append(lines, line)
+		}
+	}
+	assert.Equal(t, "retry: 2000\n", readEvent())
+	assert.Equal(t, "id: 2\ndata: second\n", readEvent())
+
+	require.Eventually(t, func() bool { return broker.Subscribers() == 1 }, time.Second, time.Millisecond)
+	broker.Publish(Event{Event: "live", Data: "third"})
+	assert.Equal(t, "event: live\nid: 3\ndata: third\n", readEvent())
+
+	// TEST: Closing the broker ends the stream
+	broker.Close()
+	io.Copy(io.Discard, body)
+	<-done
+	assert.Equal(t, 0, broker.Subscribers())
+
+	// TEST: Disconnected client is noticed on heartbeat
+	broker = NewBroker(0)
+	broker.HeartbeatInterval = time.Millisecond
+	finished := make(chan struct{})
+	go func() {
+		broker.Handler(&response.Writer{Writer: &failingWriter{}}, &request.Request{Headers: headers.NewHeaders()})
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(time.Second):
+		t.Fatal("handler did not stop")
+	}
+
+	// TEST: Cancelled request context ends the stream without heartbeats
+	broker = NewBroker(0)
+	broker.HeartbeatInterval = 0
+	ctx, cancel := context.WithCancel(context.Background())
+	finished = make(chan struct{})
+	go func() {
+		req := (&request.Request{Headers: headers.NewHeaders()}).WithContext(ctx)
+		broker.Handler(&response.Writer{Writer: io.Discard}, req)
+		close(finished)
+	}()
+	require.Eventually(t, func() bool { return broker.Subscribers() == 1 }, time.Second, time.Millisecond)
+	cancel()
+	select {
+	case <-finished:
+	case <-time.After(time.Second):
+		t.Fatal("handler did not stop")
+	}
+}
+
+func TestClientGone(t *testing.T) {
+	broker := NewBroker(0)
+	ts := servertest.NewServer(broker.Handler)
+	defer ts.Close()
+
+	// TEST: Client closing the connection is noticed before any heartbeat
+	conn, err := ts.Dial()
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("GET /events HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return broker.Subscribers() == 1 }, time.Second, time.Millisecond)
+	conn.Close()
+	require.Eventually(t, func() bool { return broker.Subscribers() == 0 }, time.Second, time.Millisecond)
+}
@@ -0,0 +1,240 @@
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+type TraceID [16]byte
+
+type SpanID [8]byte
+
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+
+func (s SpanID) String() string { return hex.EncodeToString(s[:]) }
+
+func (t TraceID) IsValid() bool { return t != TraceID{} }
+
+func (s SpanID) IsValid() bool { return s != SpanID{} }
+
+const FlagSampled byte = 0x01
+
+// SpanContext is the part of a span that crosses process boundaries
+type SpanContext struct {
+	TraceID    TraceID
+	SpanID     SpanID
+	Flags      byte
+	TraceState string
+	// Remote is set for contexts extracted from an incoming request
+	Remote bool
+}
+
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID.IsValid() && sc.SpanID.IsValid()
+}
+
+func (sc SpanContext) Sampled() bool {
+	return sc.Flags&FlagSampled != 0
+}
+
+var (
+	ErrInvalidTraceparent = errors.New("invalid traceparent")
+	ErrInvalidTracestate  = errors.New("invalid tracestate")
+)
+
+// Traceparent renders the context as a version 00 traceparent value
+func (sc SpanContext) Traceparent() string {
+	return fmt.Sprintf("00-%s-%s-%02x", sc.TraceID, sc.SpanID, sc.Flags)
+}
+
+// ParseTraceparent reads a traceparent header. Versions above 00 are read
+// as 00 as the spec asks, as long as the known fields are intact.
+func ParseTraceparent(value string) (SpanContext, error) {
+	value = strings.TrimSpace(value)
+	if len(value) < 55 {
+		return SpanContext{}, ErrInvalidTraceparent
+	}
+	version, err := decodeHex(value[0:2], 1)
+	if err != nil || version[0] == 0xff || value[2] != '-' {
+		return SpanContext{}, ErrInvalidTraceparent
+	}
+	if version[0] == 0 && len(value) != 55 {
+		return SpanContext{}, ErrInvalidTraceparent
+	}
+	if len(value) > 55 && value[55] != '-' {
+		return SpanContext{}, ErrInvalidTraceparent
+	}
+	if value[35] != '-' || value[52] != '-' {
+		return SpanContext{}, ErrInvalidTraceparent
+	}
+
+	var sc SpanContext
+	traceID, err := decodeHex(value[3:35], 16)
+	if err != nil {
+		return SpanContext{}, ErrInvalidTraceparent
+	}
+	spanID, err := decodeHex(value[36:52], 8)
+	if err != nil {
+		return SpanContext{}, ErrInvalidTraceparent
+	}
+	flags, err := decodeHex(value[53:55], 1)
+	if err != nil {
+		return SpanContext{}, ErrInvalidTraceparent
+	}
+	copy(sc.TraceID[:], traceID)
+	copy(sc.SpanID[:], spanID)
+	sc.Flags = flags[0]
+	if !sc.IsValid() {
+		return SpanContext{}, ErrInvalidTraceparent
+	}
+	return sc, nil
+}
+
+// decodeHex only takes lowercase hex, the spec forbids uppercase
+func decodeHex(s string, size int) ([]byte, error) {
+	if len(s) != size*2 || strings.ToLower(s) != s {
+		return nil, ErrInvalidTraceparent
+	}
+	return hex.DecodeString(s)
+}
+
+const maxTracestateMembers = 32
+
+// ParseTracestate validates a tracestate value and returns it normalized,
+// invalid values have to be dropped rather than passed on
+func ParseTracestate(value string) (string, error) {
+	var members []string
+	seen := map[string]bool{}
+	for _, member := range strings.Split(value, ",") {
+		member = strings.TrimSpace(member)
+		if member == "" {
+			continue
+		}
+		key, val, ok := strings.Cut(member, "=")
+		if !ok || !validTracestateKey(key) || !validTracestateValue(val) || seen[key] {
+			return "", fmt.Errorf("%w: %q", ErrInvalidTracestate, member)
+		}
+		seen[key] = true
+		members = append(members, member)
+	}
+	if len(members) > maxTracestateMembers {
+		return "", fmt.Errorf("%w: too many members", ErrInvalidTracestate)
+	}
+	return strings.Join(members, ","), nil
+}
+
+func validTracestateKey(key string) bool {
+	tenant, system, multi := strings.Cut(key, "@")
+	if multi {
+		return len(tenant) <= 241 && len(system) <= 14 && validKeyChars(tenant, true) && validKeyChars(system, false)
+	}
+	return len(key) <= 256 && validKeyChars(key, false)
+}
+
+func validKeyChars(s string, digitFirst bool) bool {
+	if s == "" {
+		return false
+	}
+	for i, c := range s {
+		lower := c >= 'a' && c <= 'z'
+		digit := c >= '0' && c <= '9'
+		switch {
+		case i == 0 && !(lower || (digitFirst && digit)):
+			return false
+		case !(lower || digit || c == '_' || c == '-' || c == '*' || c == '/'):
+			return false
+		}
+	}
+	return true
+}
+
+func validTracestateValue(value string) bool {
+	if value == "" || len(value) > 256 || strings.HasSuffix(value, " ") {
+		return false
+	}
+	for _, c := range value {
+		if c < 0x20 || c > 0x7e || c == ',' || c == '=' {
+			return false
+		}
+	}
+	return true
+}
+
+// Extract reads the trace context from request headers, get looks a header up
+func Extract(get func(key string) (string, bool)) (SpanContext, bool) {
+	traceparent, ok := get("traceparent")
+	if !ok {
+		return SpanContext{}, false
+	}
+	sc, err := ParseTraceparent(traceparent)
+	if err != nil {
+		return SpanContext{}, false
+	}
+	if tracestate, ok := get("tracestate"); ok {
+		// a broken tracestate doesn't void the traceparent
+		sc.TraceState, _ = ParseTracestate(tracestate)
+	}
+	sc.Remote = true
+	return sc, true
+}
+
+// Inject writes the context of the span in ctx for an outgoing request,
+// set replaces a header
+func Inject(ctx context.Context, set func(key, value string)) {
+	sc := SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return
+	}
+	set("traceparent", sc.Traceparent())
+	if sc.TraceState != "" {
+		set("tracestate", sc.TraceState)
+	}
+}
+
+type spanKey struct{}
+
+type remoteKey struct{}
+
+func ContextWithSpan(ctx context.Context, span *Span) context.Context {
+	return context.WithValue(ctx, spanKey{}, span)
+}
+
+// ContextWithRemoteSpanContext makes sc the parent of spans started from ctx
+func ContextWithRemoteSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, remoteKey{}, sc)
+}
+
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// SpanContextFromContext returns the current span's context, or the remote
+// parent when no local span was started
+func SpanContextFromContext(ctx context.Context) SpanContext {
+	if span := SpanFromContext(ctx); span != nil {
+		return span.SpanContext()
+	}
+	sc, _ := ctx.Value(remoteKey{}).(SpanContext)
+	return sc
+}
+
+func newTraceID() TraceID {
+	var id TraceID
+	for !id.IsValid() {
+		rand.Read(id[:])
+	}
+	return id
+}
+
+func newSpanID() SpanID {
+	var id SpanID
+	for !id.IsValid() {
+		rand.Read(id[:])
+	}
+	return id
+}
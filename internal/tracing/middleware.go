@@ -0,0 +1,43 @@
+package tracing
+
+import (
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+	"strings"
+)
+
+// Middleware continues the trace of the incoming request, or starts one,
+// with a server span around the handler
+func (t *Tracer) Middleware(next server.Handler) server.Handler {
+	return func(w *response.Writer, req *request.Request) {
+		ctx := req.Context()
+		if sc, ok := Extract(req.Headers.Get); ok {
+			sc.TraceState = strings.Clone(sc.TraceState)
+			ctx = ContextWithRemoteSpanContext(ctx, sc)
+		}
+		ctx, span := t.Start(ctx, req.RequestLine.Method+" "+req.Path(), SpanKindServer)
+		defer span.End()
+
+		span.SetAttribute("http.request.method", req.RequestLine.Method)
+		span.SetAttribute("url.path", strings.Clone(req.Path()))
+		if _, query, ok := strings.Cut(req.RequestLine.RequestTarget, "?"); ok && query != "" {
+			span.SetAttribute("url.query", strings.Clone(query))
+		}
+		if req.ClientIP != "" {
+			span.SetAttribute("client.address", req.ClientIP)
+		}
+		if userAgent, ok := req.Headers.Get("user-agent"); ok {
+			span.SetAttribute("user_agent.original", strings.Clone(userAgent))
+		}
+
+		next(w, req.WithContext(ctx))
+
+		status := int(w.StatusCode())
+		span.SetAttribute("http.response.status_code", status)
+		// only 5xx is a server span error, 4xx is the client's
+		if status >= 500 {
+			span.SetStatus(StatusError, "")
+		}
+	}
+}
@@ -0,0 +1,289 @@
+package tracing
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type SpanKind int
+
+const (
+	SpanKindInternal SpanKind = iota + 1
+	SpanKindServer
+	SpanKindClient
+)
+
+type StatusCode int
+
+const (
+	StatusUnset StatusCode = iota
+	StatusOK
+	StatusError
+)
+
+// SpanData is a finished span as handed to exporters
+type SpanData struct {
+	Name          string
+	Kind          SpanKind
+	SpanContext   SpanContext
+	Parent        SpanID
+	Start         time.Time
+	End           time.Time
+	Attributes    map[string]any
+	StatusCode    StatusCode
+	StatusMessage string
+}
+
+// Span methods are safe on a nil span, so callers with an optional tracer
+// don't have to check
+type Span struct {
+	tracer *Tracer
+
+	mu    sync.Mutex
+	data  SpanData
+	ended bool
+}
+
+func (s *Span) SpanContext() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	// the context never changes after start, no lock needed
+	return s.data.SpanContext
+}
+
+func (s *Span) SetAttribute(key string, value any) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Attributes[key] = value
+}
+
+func (s *Span) SetStatus(code StatusCode, message string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.StatusCode = code
+	s.data.StatusMessage = message
+}
+
+// RecordError marks the span failed
+func (s *Span) RecordError(err error) {
+	if err != nil {
+		s.SetStatus(StatusError, err.Error())
+	}
+}
+
+// End finishes the span, later calls do nothing
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.End = s.tracer.clock()
+	data := s.data
+	s.mu.Unlock()
+
+	if data.SpanContext.Sampled() {
+		s.tracer.enqueue(&data)
+	}
+}
+
+type Exporter interface {
+	Export(spans []*SpanData) error
+}
+
+// Tracer starts spans and hands finished sampled ones to the exporter in
+// batches of BatchSize. Exports run on a background goroutine fed by a
+// queue of QueueSize spans, spans are dropped while it is full. Call Flush
+// or Shutdown to export a partial batch.
+type Tracer struct {
+	Exporter  Exporter
+	BatchSize int
+	// QueueSize is read when the first span ends
+	QueueSize int
+	// OnError gets export failures, nil drops them
+	OnError func(err error)
+
+	startOnce    sync.Once
+	queue        chan *SpanData
+	flushes      chan chan struct{}
+	done         chan struct{}
+	stopped      chan struct{}
+	shutdownOnce sync.Once
+	dropped      atomic.Uint64
+	now          func() time.Time
+}
+
+const defaultQueueSize = 2048
+
+func NewTracer(exporter Exporter) *Tracer {
+	return &Tracer{Exporter: exporter, BatchSize: 64, QueueSize: defaultQueueSize, now: time.Now}
+}
+
+func (t *Tracer) clock() time.Time {
+	if t.now == nil {
+		return time.Now()
+	}
+	return t.now()
+}
+
+// Start begins a span as a child of the span or remote context in ctx, a
+// new trace is started when there is neither. Unsampled parents give
+// unsampled children, which propagate but are never exported.
+func (t *Tracer) Start(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	parent := SpanContextFromContext(ctx)
+	sc := SpanContext{SpanID: newSpanID()}
+	if parent.IsValid() {
+		sc.TraceID = parent.TraceID
+		sc.Flags = parent.Flags
+		sc.TraceState = parent.TraceState
+	} else {
+		sc.TraceID = newTraceID()
+		sc.Flags = FlagSampled
+	}
+
+	span := &Span{
+		tracer: t,
+		data: SpanData{
+			Name:        name,
+			Kind:        kind,
+			SpanContext: sc,
+			Start:       t.clock(),
+			Attributes:  map[string]any{},
+		},
+	}
+	if parent.IsValid() {
+		span.data.Parent = parent.SpanID
+	}
+	return ContextWithSpan(ctx, span), span
+}
+
+// start runs the exporter goroutine, the first span that ends starts it
+func (t *Tracer) start() {
+	t.startOnce.Do(func() {
+		size := t.QueueSize
+		if size <= 0 {
+			size = defaultQueueSize
+		}
+		t.queue = make(chan *SpanData, size)
+		t.flushes = make(chan chan struct{})
+		t.done = make(chan struct{})
+		t.stopped = make(chan struct{})
+		go t.run()
+	})
+}
+
+func (t *Tracer) run() {
+	defer close(t.stopped)
+	var pending []*SpanData
+	// drain takes what is queued right now, so a flush covers every span
+	// that ended before it
+	drain := func() {
+		for {
+			select {
+			case data := <-t.queue:
+				pending = append(pending, data)
+			default:
+				t.export(pending)
+				pending = nil
+				return
+			}
+		}
+	}
+	for {
+		select {
+		case data := <-t.queue:
+			pending = append(pending, data)
+			if len(pending) >= max(t.BatchSize, 1) {
+				t.export(pending)
+				pending = nil
+			}
+		case flushed := <-t.flushes:
+			drain()
+			close(flushed)
+		case <-t.done:
+			drain()
+			return
+		}
+	}
+}
+
+// enqueue never blocks the request, the span is dropped when the exporter
+// can't keep up
+func (t *Tracer) enqueue(data *SpanData) {
+	t.start()
+	select {
+	case <-t.done:
+		t.dropped.Add(1)
+		return
+	default:
+	}
+	select {
+	case t.queue <- data:
+	default:
+		t.dropped.Add(1)
+	}
+}
+
+func (t *Tracer) export(batch []*SpanData) {
+	if len(batch) == 0 || t.Exporter == nil {
+		return
+	}
+	if err := t.Exporter.Export(batch); err != nil && t.OnError != nil {
+		t.OnError(err)
+	}
+}
+
+// Dropped counts the spans lost to a full queue or ended after Shutdown
+func (t *Tracer) Dropped() uint64 {
+	return t.dropped.Load()
+}
+
+// Flush exports the spans that ended so far and waits for it
+func (t *Tracer) Flush() {
+	t.start()
+	flushed := make(chan struct{})
+	select {
+	case t.flushes <- flushed:
+		<-flushed
+	case <-t.stopped:
+	}
+}
+
+// Shutdown exports what is queued and stops the exporter goroutine, spans
+// that end later are dropped
+func (t *Tracer) Shutdown() {
+	t.start()
+	t.shutdownOnce.Do(func() { close(t.done) })
+	<-t.stopped
+}
+
+// StartFlushing calls Flush every interval until stop is closed, so quiet
+// servers don't hold on to spans forever
+func (t *Tracer) StartFlushing(interval time.Duration, stop <-chan struct{}) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				t.Flush()
+				return
+			case <-ticker.C:
+				t.Flush()
+			}
+		}
+	}()
+}
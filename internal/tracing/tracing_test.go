@@ -0,0 +1,311 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type memoryExporter struct {
+	mu    sync.Mutex
+	spans []*SpanData
+}
+
+func (e *memoryExporter) Export(spans []*SpanData) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = append(e.spans, spans...)
+	return nil
+}
+
+func (e *memoryExporter) Spans() []*SpanData {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]*SpanData(nil), e.spans...)
+}
+
+const validParent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+func TestTraceparent(t *testing.T) {
+	// TEST: Round trip
+	sc, err := ParseTraceparent(validParent)
+	require.NoError(t, err)
+	assert.True(t, sc.Sampled())
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", sc.TraceID.String())
+	assert.Equal(t, validParent, sc.Traceparent())
+
+	// TEST: Future versions may append fields
+	_, err = ParseTraceparent("cc-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-what-the-future-holds")
+	assert.NoError(t, err)
+
+	// TEST: Invalid values
+	for _, value := range []string{
+		"",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"00_4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+	} {
+		_, err := ParseTraceparent(value)
+		assert.ErrorIs(t, err, ErrInvalidTraceparent, value)
+	}
+}
+
+func TestTracestate(t *testing.T) {
+	// TEST: Valid list is normalized
+	state, err := ParseTracestate(" congo=t61rcWkgMzE , rojo=00f067aa0ba902b7,tenant@vendor=x ")
+	require.NoError(t, err)
+	assert.Equal(t, "congo=t61rcWkgMzE,rojo=00f067aa0ba902b7,tenant@vendor=x", state)
+
+	// TEST: Duplicate keys, bad keys and too many members
+	for _, value := range []string{"a=1,a=2", "UPPER=1", "novalue", "a=b=c"} {
+		_, err := ParseTracestate(value)
+		assert.ErrorIs(t, err, ErrInvalidTracestate, value)
+	}
+	members := make([]string, 33)
+	for i := range members {
+		members[i] = "k" + strings.Repeat("x", i) + "=v"
+	}
+	_, err = ParseTracestate(strings.Join(members, ","))
+	assert.ErrorIs(t, err, ErrInvalidTracestate)
+}
+
+func serve(t *testing.T, h server.Handler, lines ...string) {
+	t.Helper()
+	raw := "GET /orders?id=7 HTTP/1.1\r\nHost: localhost\r\n" + strings.Join(lines, "")
+	req, err := request.RequestFromReader(strings.NewReader(raw + "\r\n"))
+	require.NoError(t, err)
+	h(&response.Writer{Writer: &bytes.Buffer{}}, req)
+}
+
+func TestMiddleware(t *testing.T) {
+	exporter := &memoryExporter{}
+	tracer := NewTracer(exporter)
+	tracer.BatchSize = 1
+
+	var injected map[string]string
+	h := tracer.Middleware(func(w *response.Writer, req *request.Request) {
+		// a child span like a database call would make
+		_, child := tracer.Start(req.Context(), "load order", SpanKindInternal)
+		child.End()
+
+		injected = map[string]string{}
+		Inject(req.Context(), func(key, value string) { injected[key] = value })
+		w.WriteStatusLine(response.StatusCodeInternalServerError)
+		w.WriteHeaders(response.GetDefaultHeaders(0))
+	})
+
+	// TEST: Incoming trace is continued
+	serve(t, h, "Traceparent: "+validParent+"\r\n", "Tracestate: rojo=00f067aa0ba902b7\r\n")
+	tracer.Flush()
+	spans := exporter.Spans()
+	require.Len(t, spans, 2)
+	child, root := spans[0], spans[1]
+	assert.Equal(t, "GET /orders", root.Name)
+	assert.Equal(t, SpanKindServer, root.Kind)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", root.SpanContext.TraceID.String())
+	assert.Equal(t, "00f067aa0ba902b7", root.Parent.String())
+	assert.Equal(t, root.SpanContext.SpanID, child.Parent)
+	assert.Equal(t, 500, root.Attributes["http.response.status_code"])
+	assert.Equal(t, "id=7", root.Attributes["url.query"])
+	assert.Equal(t, StatusError, root.StatusCode)
+
+	// TEST: Outgoing headers carry the server span and tracestate
+	assert.Equal(t, root.SpanContext.Traceparent(), injected["traceparent"])
+	assert.Equal(t, "rojo=00f067aa0ba902b7", injected["tracestate"])
+
+	// TEST: No incoming context starts a new sampled trace
+	serve(t, h)
+	tracer.Flush()
+	spans = exporter.Spans()
+	require.Len(t, spans, 4)
+	assert.NotEqual(t, root.SpanContext.TraceID, spans[3].SpanContext.TraceID)
+	assert.False(t, spans[3].Parent.IsValid())
+
+	// TEST: Unsampled parent propagates but isn't exported
+	serve(t, h, "Traceparent: 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00\r\n")
+	tracer.Flush()
+	assert.Len(t, exporter.Spans(), 4)
+	assert.True(t, strings.HasSuffix(injected["traceparent"], "-00"))
+}
+
+func TestPooledRequests(t *testing.T) {
+	exporter := &memoryExporter{}
+	tracer := NewTracer(exporter)
+	h := tracer.Middleware(func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.StatusCodeOk)
+		w.WriteHeaders(response.GetDefaultHeaders(0))
+	})
+
+	// the requests are the same length, so a reused buffer lines up exactly
+	for _, name := range []string{"aaaa", "bbbb"} {
+		req := request.AcquireRequest()
+		raw := "GET /" + name + "?q=" + name + " HTTP/1.1\r\nHost: localhost\r\nUser-Agent: " + name + "\r\n\r\n"
+		require.NoError(t, request.NewParser(strings.NewReader(raw)).ReadRequestHeadInto(req))
+		h(&response.Writer{Writer: &bytes.Buffer{}}, req)
+		request.ReleaseRequest(req)
+	}
+	tracer.Flush()
+
+	// TEST: Span attributes survive the request going back to the pool
+	spans := exporter.Spans()
+	require.Len(t, spans, 2)
+	assert.Equal(t, "/aaaa", spans[0].Attributes["url.path"])
+	assert.Equal(t, "q=aaaa", spans[0].Attributes["url.query"])
+	assert.Equal(t, "aaaa", spans[0].Attributes["user_agent.original"])
+}
+
+func TestBatching(t *testing.T) {
+	exporter := &memoryExporter{}
+	tracer := NewTracer(exporter)
+	tracer.BatchSize = 3
+
+	// TEST: Spans wait for a full batch or a flush
+	for range 2 {
+		_, span := tracer.Start(context.Background(), "work", SpanKindInternal)
+		span.End()
+		span.End()
+	}
+	assert.Empty(t, exporter.Spans())
+	tracer.Flush()
+	assert.Len(t, exporter.Spans(), 2)
+
+	// TEST: A full batch is exported without a flush
+	for range 3 {
+		_, span := tracer.Start(context.Background(), "work", SpanKindInternal)
+		span.End()
+	}
+	assert.Eventually(t, func() bool { return len(exporter.Spans()) == 5 }, time.Second, time.Millisecond)
+
+	// TEST: Nil spans are no-ops
+	var span *Span
+	span.SetAttribute("k", "v")
+	span.End()
+	assert.False(t, span.SpanContext().IsValid())
+}
+
+// blockingExporter holds every export until release is closed
+type blockingExporter struct {
+	memoryExporter
+	started chan struct{}
+	release chan struct{}
+}
+
+func (e *blockingExporter) Export(spans []*SpanData) error {
+	select {
+	case e.started <- struct{}{}:
+	default:
+	}
+	<-e.release
+	return e.memoryExporter.Export(spans)
+}
+
+func TestExportQueue(t *testing.T) {
+	exporter := &blockingExporter{started: make(chan struct{}, 1), release: make(chan struct{})}
+	tracer := NewTracer(exporter)
+	tracer.BatchSize = 1
+	tracer.QueueSize = 2
+	end := func() {
+		_, span := tracer.Start(context.Background(), "work", SpanKindInternal)
+		span.End()
+	}
+
+	// TEST: A stuck exporter doesn't block ending spans, the overflow is dropped
+	end()
+	<-exporter.started
+	for range 5 {
+		end()
+	}
+	assert.Equal(t, uint64(3), tracer.Dropped())
+
+	// TEST: Shutdown drains the queue
+	close(exporter.release)
+	tracer.Shutdown()
+	assert.Len(t, exporter.Spans(), 3)
+
+	// TEST: Spans after shutdown are dropped
+	end()
+	tracer.Flush()
+	assert.Len(t, exporter.Spans(), 3)
+	assert.Equal(t, uint64(4), tracer.Dropped())
+}
+
+func TestStdoutExporter(t *testing.T) {
+	var out bytes.Buffer
+	tracer := NewTracer(&StdoutExporter{W: &out})
+	tracer.BatchSize = 1
+
+	// TEST: One JSON object per span
+	_, span := tracer.Start(context.Background(), "work", SpanKindInternal)
+	span.SetAttribute("items", 3)
+	span.End()
+	tracer.Flush()
+	var line map[string]any
+	require.NoError(t, json.Unmarshal(out.Bytes(), &line))
+	assert.Equal(t, "work", line["name"])
+	assert.Equal(t, "internal", line["kind"])
+	assert.Equal(t, span.SpanContext().TraceID.String(), line["trace_id"])
+}
+
+func TestOTLPExporter(t *testing.T) {
+	received := make(chan map[string]any, 1)
+	collector, err := server.Serve(0, func(w *response.Writer, req *request.Request) {
+		var payload map[string]any
+		if err := json.Unmarshal(req.Body, &payload); err == nil && req.Path() == "/v1/traces" {
+			received <- payload
+		}
+		w.WriteStatusLine(response.StatusCodeOk)
+		w.WriteHeaders(response.GetDefaultHeaders(2))
+		w.WriteBody([]byte("{}"))
+	})
+	require.NoError(t, err)
+	defer func() {
+		collector.State.Store(false)
+		collector.Close()
+	}()
+
+	exporter := &OTLPExporter{
+		Endpoint:    "http://" + collector.Listener.Addr().String() + "/v1/traces",
+		ServiceName: "checkout",
+	}
+	tracer := NewTracer(exporter)
+	var exportErr error
+	tracer.OnError = func(err error) { exportErr = err }
+
+	ctx, parent := tracer.Start(context.Background(), "parent", SpanKindServer)
+	_, child := tracer.Start(ctx, "child", SpanKindClient)
+	child.SetAttribute("http.response.status_code", 200)
+	child.End()
+	parent.End()
+
+	// TEST: Spans reach the collector in OTLP JSON
+	tracer.Flush()
+	require.NoError(t, exportErr)
+	payload := <-received
+	resourceSpans := payload["resourceSpans"].([]any)[0].(map[string]any)
+	resource := resourceSpans["resource"].(map[string]any)["attributes"].([]any)[0].(map[string]any)
+	assert.Equal(t, "service.name", resource["key"])
+	assert.Equal(t, "checkout", resource["value"].(map[string]any)["stringValue"])
+
+	spans := resourceSpans["scopeSpans"].([]any)[0].(map[string]any)["spans"].([]any)
+	require.Len(t, spans, 2)
+	first := spans[0].(map[string]any)
+	assert.Equal(t, "child", first["name"])
+	assert.Equal(t, float64(SpanKindClient), first["kind"])
+	assert.Equal(t, parent.SpanContext().SpanID.String(), first["parentSpanId"])
+	assert.Equal(t, parent.SpanContext().TraceID.String(), first["traceId"])
+	attribute := first["attributes"].([]any)[0].(map[string]any)
+	assert.Equal(t, "200", attribute["value"].(map[string]any)["intValue"])
+}
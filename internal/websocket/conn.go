@@ -0,0 +1,431 @@
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+type Opcode byte
+
+const (
+	OpContinuation Opcode = 0x0
+	OpText         Opcode = 0x1
+	OpBinary       Opcode = 0x2
+	OpClose        Opcode = 0x8
+	OpPing         Opcode = 0x9
+	OpPong         Opcode = 0xA
+)
+
+func (op Opcode) isControl() bool {
+	return op&0x8 != 0
+}
+
+const (
+	CloseNormal          = 1000
+	CloseGoingAway       = 1001
+	CloseProtocolError   = 1002
+	CloseUnsupportedData = 1003
+	CloseNoStatus        = 1005
+	CloseInvalidPayload  = 1007
+	ClosePolicyViolation = 1008
+	CloseMessageTooBig   = 1009
+	CloseInternalError   = 1011
+)
+
+const (
+	maxControlPayload     = 125
+	defaultMaxMessageSize = 1 << 20
+	closeTimeout          = 5 * time.Second
+)
+
+var (
+	ErrClosed           = errors.New("websocket connection closed")
+	errProtocol         = errors.New("websocket protocol error")
+	errInvalidUTF8      = errors.New("invalid utf-8 in text message")
+	errMessageTooBig    = errors.New("websocket message too big")
+	errInvalidCloseCode = errors.New("invalid close code")
+)
+
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("websocket closed: %d %s", e.Code, e.Reason)
+}
+
+type Conn struct {
+	// MaxMessageSize limits a reassembled message, 0 means 1MB
+	MaxMessageSize int
+	// FragmentSize splits written messages into frames of this size, 0 disables it
+	FragmentSize int
+	// PongHandler is called with the payload of every received pong
+	PongHandler func(data []byte)
+
+	conn     net.Conn
+	reader   *bufio.Reader
+	isServer bool
+
+	// messageMu keeps the fragments of one message together, writeMu is
+	// taken per frame so control frames can still go between them
+	messageMu sync.Mutex
+	writeMu   sync.Mutex
+	closeSent bool
+	// readMu serializes frame reads between ReadMessage and Close
+	readMu     sync.Mutex
+	closedRead bool
+}
+
+// newConn reads through reader, nil reads straight from conn
+func newConn(conn net.Conn, reader *bufio.Reader, isServer bool) *Conn {
+	if reader == nil {
+		reader = bufio.NewReader(conn)
+	}
+	return &Conn{
+		conn:     conn,
+		reader:   reader,
+		isServer: isServer,
+	}
+}
+
+// NewClientConn wraps a connection that already finished the handshake
+// from the client side, client frames are masked
+func NewClientConn(conn net.Conn) *Conn {
+	return newConn(conn, nil, false)
+}
+
+func (c *Conn) NetConn() net.Conn {
+	return c.conn
+}
+
+type frame struct {
+	fin     bool
+	opcode  Opcode
+	payload []byte
+}
+
+func (c *Conn) readFrame() (*frame, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(c.reader, head[:]); err != nil {
+		return nil, err
+	}
+
+	f := &frame{
+		fin:    head[0]&0x80 != 0,
+		opcode: Opcode(head[0] & 0x0F),
+	}
+	if head[0]&0x70 != 0 {
+		return nil, fmt.Errorf("%w: reserved bits set", errProtocol)
+	}
+	switch f.opcode {
+	case OpContinuation, OpText, OpBinary, OpClose, OpPing, OpPong:
+	default:
+		return nil, fmt.Errorf("%w: unknown opcode %d", errProtocol, f.opcode)
+	}
+
+	masked := head[1]&0x80 != 0
+	if masked != c.isServer {
+		return nil, fmt.Errorf("%w: wrong masking", errProtocol)
+	}
+
+	length := uint64(head[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+			return nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+			return nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+		if length>>63 != 0 {
+			return nil, fmt.Errorf("%w: bad payload length", errProtocol)
+		}
+	}
+
+	if f.opcode.isControl() {
+		if !f.fin {
+			return nil, fmt.Errorf("%w: fragmented control frame", errProtocol)
+		}
+		if length > maxControlPayload {
+			return nil, fmt.Errorf("%w: control frame too long", errProtocol)
+		}
+	}
+	if length > uint64(c.maxMessageSize()) {
+		return nil, errMessageTooBig
+	}
+
+	var maskKey [4]byte
+	if masked {
+		if _, err := io.ReadFull(c.reader, maskKey[:]); err != nil {
+			return nil, err
+		}
+	}
+
+	f.payload = make([]byte, length)
+	if _, err := io.ReadFull(c.reader, f.payload); err != nil {
+		return nil, err
+	}
+	if masked {
+		maskBytes(maskKey, f.payload)
+	}
+	return f, nil
+}
+
+func maskBytes(key [4]byte, data []byte) {
+	for i := range data {
+		data[i] ^= key[i%4]
+	}
+}
+
+func (c *Conn) writeFrame(fin bool, opcode Opcode, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.closeSent {
+		return ErrClosed
+	}
+	if opcode == OpClose {
+		c.closeSent = true
+	}
+
+	frame := make([]byte, 0, len(payload)+14)
+	head := byte(opcode)
+	if fin {
+		head |= 0x80
+	}
+	frame = append(frame, head)
+
+	var maskBit byte
+	if !c.isServer {
+		maskBit = 0x80
+	}
+	length := len(payload)
+	switch {
+	case length <= 125:
+		frame = append(frame, maskBit|byte(length))
+	case length <= 0xFFFF:
+		frame = append(frame, maskBit|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(length))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(length))
+	}
+
+	if c.isServer {
+		frame = append(frame, payload...)
+	} else {
+		var maskKey [4]byte
+		if _, err := rand.Read(maskKey[:]); err != nil {
+			return err
+		}
+		frame = append(frame, maskKey[:]...)
+		start := len(frame)
+		frame = append(frame, payload...)
+		maskBytes(maskKey, frame[start:])
+	}
+
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+func (c *Conn) maxMessageSize() int {
+	if c.MaxMessageSize <= 0 {
+		return defaultMaxMessageSize
+	}
+	return c.MaxMessageSize
+}
+
+// ReadMessage returns the next complete text or binary message, pings are
+// answered and close frames end the connection with a *CloseError
+func (c *Conn) ReadMessage() (Opcode, []byte, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	if c.closedRead {
+		return 0, nil, ErrClosed
+	}
+
+	var messageType Opcode
+	var message []byte
+	for {
+		f, err := c.readFrame()
+		if err != nil {
+			return 0, nil, c.fail(err)
+		}
+
+		switch f.opcode {
+		case OpPing:
+			if err := c.writeFrame(true, OpPong, f.payload); err != nil && !errors.Is(err, ErrClosed) {
+				return 0, nil, err
+			}
+			continue
+		case OpPong:
+			if c.PongHandler != nil {
+				c.PongHandler(f.payload)
+			}
+			continue
+		case OpClose:
+			return 0, nil, c.handleClose(f.payload)
+		case OpContinuation:
+			if messageType == 0 {
+				return 0, nil, c.fail(fmt.Errorf("%w: unexpected continuation", errProtocol))
+			}
+		default:
+			if messageType != 0 {
+				return 0, nil, c.fail(fmt.Errorf("%w: expected continuation", errProtocol))
+			}
+			messageType = f.opcode
+		}
+
+		if len(message)+len(f.payload) > c.maxMessageSize() {
+			return 0, nil, c.fail(errMessageTooBig)
+		}
+		message = append(message, f.payload...)
+
+		if f.fin {
+			if messageType == OpText && !utf8.Valid(message) {
+				return 0, nil, c.fail(errInvalidUTF8)
+			}
+			return messageType, message, nil
+		}
+	}
+}
+
+func (c *Conn) handleClose(payload []byte) error {
+	c.closedRead = true
+
+	closeErr := &CloseError{Code: CloseNoStatus}
+	switch {
+	case len(payload) == 1:
+		return c.fail(fmt.Errorf("%w: close payload too short", errProtocol))
+	case len(payload) >= 2:
+		closeErr.Code = int(binary.BigEndian.Uint16(payload))
+		closeErr.Reason = string(payload[2:])
+		if !validCloseCode(closeErr.Code) {
+			return c.fail(errInvalidCloseCode)
+		}
+		if !utf8.ValidString(closeErr.Reason) {
+			return c.fail(errInvalidUTF8)
+		}
+	}
+
+	// echo the close frame and drop the connection
+	replyCode := closeErr.Code
+	if replyCode == CloseNoStatus {
+		replyCode = CloseNormal
+	}
+	c.writeFrame(true, OpClose, closePayload(replyCode, ""))
+	c.conn.Close()
+	return closeErr
+}
+
+func validCloseCode(code int) bool {
+	switch {
+	case code >= 3000 && code <= 4999:
+		return true
+	case code >= 1000 && code <= 1011:
+		return code != 1004 && code != 1005 && code != 1006
+	}
+	return false
+}
+
+// fail closes the connection with the status code matching the error
+func (c *Conn) fail(err error) error {
+	code := CloseProtocolError
+	switch {
+	case errors.Is(err, errInvalidUTF8):
+		code = CloseInvalidPayload
+	case errors.Is(err, errMessageTooBig):
+		code = CloseMessageTooBig
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, net.ErrClosed):
+		c.closedRead = true
+		c.conn.Close()
+		return err
+	}
+	c.closedRead = true
+	c.writeFrame(true, OpClose, closePayload(code, ""))
+	c.conn.Close()
+	return err
+}
+
+func closePayload(code int, reason string) []byte {
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	return append(payload, reason...)
+}
+
+func (c *Conn) WriteMessage(messageType Opcode, data []byte) error {
+	if messageType != OpText && messageType != OpBinary {
+		return fmt.Errorf("%w: %d is not a data opcode", errProtocol, messageType)
+	}
+	if messageType == OpText && !utf8.Valid(data) {
+		return errInvalidUTF8
+	}
+
+	c.messageMu.Lock()
+	defer c.messageMu.Unlock()
+	if c.FragmentSize <= 0 || len(data) <= c.FragmentSize {
+		return c.writeFrame(true, messageType, data)
+	}
+
+	opcode := messageType
+	for len(data) > c.FragmentSize {
+		if err := c.writeFrame(false, opcode, data[:c.FragmentSize]); err != nil {
+			return err
+		}
+		data = data[c.FragmentSize:]
+		opcode = OpContinuation
+	}
+	return c.writeFrame(true, opcode, data)
+}
+
+func (c *Conn) WriteText(text string) error {
+	return c.WriteMessage(OpText, []byte(text))
+}
+
+func (c *Conn) Ping(data []byte) error {
+	if len(data) > maxControlPayload {
+		return fmt.Errorf("%w: ping payload too long", errProtocol)
+	}
+	return c.writeFrame(true, OpPing, data)
+}
+
+// Close starts the closing handshake and waits a bit for the peer to
+// answer before dropping the connection
+func (c *Conn) Close(code int, reason string) error {
+	if len(reason) > maxControlPayload-2 {
+		reason = reason[:maxControlPayload-2]
+	}
+	err := c.writeFrame(true, OpClose, closePayload(code, reason))
+	if errors.Is(err, ErrClosed) {
+		return c.conn.Close()
+	}
+
+	// the deadline also ends a ReadMessage blocked on another goroutine,
+	// which holds the read side until then
+	c.conn.SetReadDeadline(time.Now().Add(closeTimeout))
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	if !c.closedRead {
+		for {
+			f, err := c.readFrame()
+			if err != nil || f.opcode == OpClose {
+				break
+			}
+		}
+		c.closedRead = true
+	}
+	return c.conn.Close()
+}
@@ -0,0 +1,102 @@
+package websocket
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"strings"
+)
+
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+var (
+	errNotGet              = errors.New("websocket handshake must be a GET request")
+	errNoUpgrade           = errors.New("missing upgrade: websocket header")
+	errNoConnectionUpgrade = errors.New("missing connection: upgrade header")
+	errBadVersion          = errors.New("unsupported sec-websocket-version")
+	errBadKey              = errors.New("invalid sec-websocket-key")
+)
+
+func AcceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func headerHasToken(h headers.Headers, key, token string) bool {
+	value, ok := h.Get(key)
+	if !ok {
+		return false
+	}
+	for _, part := range strings.Split(value, ",") {
+		if strings.EqualFold(strings.TrimSpace(part), token) {
+			return true
+		}
+	}
+	return false
+}
+
+func checkHandshake(req *request.Request) (string, error) {
+	if req.RequestLine.Method != "GET" {
+		return "", errNotGet
+	}
+	if !headerHasToken(req.Headers, "upgrade", "websocket") {
+		return "", errNoUpgrade
+	}
+	if !headerHasToken(req.Headers, "connection", "upgrade") {
+		return "", errNoConnectionUpgrade
+	}
+	if version, _ := req.Headers.Get("sec-websocket-version"); version != "13" {
+		return "", errBadVersion
+	}
+	key, _ := req.Headers.Get("sec-websocket-key")
+	decoded, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(decoded) != 16 {
+		return "", errBadKey
+	}
+	return key, nil
+}
+
+// Upgrade performs the RFC 6455 opening handshake and takes over the
+// connection, on a bad handshake it answers 400 and returns the error
+func Upgrade(w *response.Writer, req *request.Request) (*Conn, error) {
+	key, err := checkHandshake(req)
+	if err != nil {
+		body := err.Error()
+		header := headers.NewHeaders()
+		header["Connection"] = "close"
+		header["Content-Type"] = "text/plain"
+		header["Sec-WebSocket-Version"] = "13"
+		header["Content-Length"] = fmt.Sprint(len(body))
+		w.WriteStatusLine(response.StatusCodeBadRequest)
+		w.WriteHeaders(header)
+		w.WriteBody([]byte(body))
+		return nil, err
+	}
+
+	netConn, reader, err := w.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	header := headers.NewHeaders()
+	header["Upgrade"] = "websocket"
+	header["Connection"] = "Upgrade"
+	header["Sec-WebSocket-Accept"] = AcceptKey(key)
+	handshake := response.Writer{Writer: netConn}
+	if err := handshake.WriteStatusLine(response.StatusCodeSwitchingProtocols); err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	if err := handshake.WriteHeaders(header); err != nil {
+		netConn.Close()
+		return nil, err
+	}
+
+	// the client may send frames right behind the handshake, the reader
+	// has whatever of them the server already read
+	return newConn(netConn, reader, true), nil
+}
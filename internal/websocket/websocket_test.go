@@ -0,0 +1,275 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+	"httpfromtcp/internal/servertest"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newHandshakeRequest() *request.Request {
+	req := &request.Request{
+		RequestLine: request.RequestLine{HTTPVersion: "1.1", RequestTarget: "/ws", Method: "GET"},
+		Headers:     headers.NewHeaders(),
+	}
+	req.Headers.Add("Host", "localhost:42069")
+	req.Headers.Add("Upgrade", "websocket")
+	req.Headers.Add("Connection", "keep-alive, Upgrade")
+	req.Headers.Add("Sec-WebSocket-Version", "13")
+	req.Headers.Add("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	return req
+}
+
+// upgradeConn runs the handshake over a loopback connection and returns both ends
+func upgradeConn(t *testing.T) (*Conn, *Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	clientSide, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	serverSide, err := listener.Accept()
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		serverSide.Close()
+		clientSide.Close()
+	})
+
+	type result struct {
+		conn *Conn
+		err  error
+	}
+	done := make(chan result)
+	go func() {
+		conn, err := Upgrade(response.NewWriter(serverSide), newHandshakeRequest())
+		done <- result{conn, err}
+	}()
+
+	parser := response.NewParser(clientSide)
+	resp, err := parser.ReadResponse("GET")
+	require.NoError(t, err)
+	assert.Equal(t, response.StatusCodeSwitchingProtocols, resp.StatusLine.StatusCode)
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", resp.Headers["sec-websocket-accept"])
+
+	res := <-done
+	require.NoError(t, res.err)
+	return res.conn, NewClientConn(clientSide)
+}
+
+func TestHandshake(t *testing.T) {
+	// TEST: Accept key from RFC 6455 example
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", AcceptKey("dGhlIHNhbXBsZSBub25jZQ=="))
+
+	// TEST: Successful upgrade hijacks the connection
+	upgradeConn(t)
+
+	// TEST: Missing key is rejected with 400
+	req := newHandshakeRequest()
+	req.Headers.Remove("Sec-WebSocket-Key")
+	buf := &bytes.Buffer{}
+	w := &response.Writer{Writer: buf}
+	_, err := Upgrade(w, req)
+	require.Error(t, err)
+	assert.True(t, strings.HasPrefix(buf.String(), "HTTP/1.1 400 Bad Request\r\n"))
+	assert.False(t, w.Hijacked())
+
+	// TEST: Wrong version is rejected
+	req = newHandshakeRequest()
+	req.Headers["sec-websocket-version"] = "8"
+	_, err = Upgrade(&response.Writer{Writer: &bytes.Buffer{}}, req)
+	require.Error(t, err)
+}
+
+func TestFrameWithHandshake(t *testing.T) {
+	echo := func(w *response.Writer, req *request.Request) {
+		conn, err := Upgrade(w, req)
+		if err != nil {
+			return
+		}
+		defer conn.NetConn().Close()
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		conn.WriteText("echo " + string(message))
+	}
+
+	for _, opts := range [][]server.Option{nil, {server.WithRequestPooling()}} {
+		ts := servertest.NewServer(echo, opts...)
+		defer ts.Close()
+
+		// TEST: Frame sent in the same write as the handshake reaches the server
+		netConn, err := ts.Dial()
+		require.NoError(t, err)
+		defer netConn.Close()
+		netConn.SetDeadline(time.Now().Add(5 * time.Second))
+		frame := []byte{0x81, 0x80 | 5, 1, 2, 3, 4}
+		payload := []byte("early")
+		maskBytes([4]byte{1, 2, 3, 4}, payload)
+		handshake := "GET /ws HTTP/1.1\r\nHost: example.com\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+			"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n"
+		_, err = netConn.Write(append(append([]byte(handshake), frame...), payload...))
+		require.NoError(t, err)
+
+		reader := bufio.NewReader(netConn)
+		status, err := reader.ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, "HTTP/1.1 101 Switching Protocols\r\n", status)
+		for {
+			line, err := reader.ReadString('\n')
+			require.NoError(t, err)
+			if line == "\r\n" {
+				break
+			}
+		}
+		client := newConn(netConn, reader, false)
+		_, message, err := client.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, "echo early", string(message))
+	}
+}
+
+func TestConcurrentClose(t *testing.T) {
+	server, client := upgradeConn(t)
+
+	// TEST: Close and a ReadMessage on another goroutine take turns reading
+	readDone := make(chan error, 1)
+	go func() {
+		_, _, err := server.ReadMessage()
+		readDone <- err
+	}()
+	go func() {
+		client.ReadMessage()
+	}()
+	require.NoError(t, server.Close(CloseNormal, "bye"))
+	// whichever got the reply first, the reader ends with the connection
+	err := <-readDone
+	var closeErr *CloseError
+	assert.True(t, errors.Is(err, ErrClosed) || errors.As(err, &closeErr), err)
+}
+
+func TestMessages(t *testing.T) {
+	server, client := upgradeConn(t)
+
+	// TEST: Fragmented text message with ping in between
+	pongs := make(chan string, 1)
+	client.PongHandler = func(data []byte) { pongs <- string(data) }
+	go func() {
+		client.writeFrame(false, OpText, []byte("hello, "))
+		client.writeFrame(true, OpPing, []byte("are you there"))
+		client.writeFrame(true, OpContinuation, []byte("world"))
+	}()
+	messageType, message, err := server.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, OpText, messageType)
+	assert.Equal(t, "hello, world", string(message))
+
+	// TEST: Server message is fragmented and reassembled by the client
+	server.FragmentSize = 4
+	go server.WriteMessage(OpBinary, []byte("binary payload"))
+	messageType, message, err = client.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, OpBinary, messageType)
+	assert.Equal(t, "binary payload", string(message))
+	assert.Equal(t, "are you there", <-pongs)
+
+	// TEST: Close handshake
+	go server.Close(CloseNormal, "bye")
+	_, _, err = client.ReadMessage()
+	var closeErr *CloseError
+	require.True(t, errors.As(err, &closeErr))
+	assert.Equal(t, CloseNormal, closeErr.Code)
+	assert.Equal(t, "bye", closeErr.Reason)
+}
+
+// slowConn holds every write long enough for the frame lock to go to a
+// waiting writer next, so concurrent writers interleave even on one CPU
+type slowConn struct {
+	net.Conn
+}
+
+func (c slowConn) Write(p []byte) (int, error) {
+	time.Sleep(2 * time.Millisecond)
+	return c.Conn.Write(p)
+}
+
+func TestConcurrentWrites(t *testing.T) {
+	serverSide, clientSide := net.Pipe()
+	defer serverSide.Close()
+	defer clientSide.Close()
+	server, client := newConn(slowConn{serverSide}, nil, true), newConn(clientSide, nil, false)
+	server.FragmentSize = 4
+	// takes the close frame a failing client sends
+	go server.ReadMessage()
+
+	// TEST: Concurrent fragmented messages don't interleave
+	var messages []string
+	for i := range 4 {
+		messages = append(messages, strings.Repeat(string(rune('a'+i)), 16))
+	}
+	for _, m := range messages {
+		go server.WriteMessage(OpText, []byte(m))
+	}
+	var received []string
+	for range messages {
+		_, message, err := client.ReadMessage()
+		require.NoError(t, err)
+		received = append(received, string(message))
+	}
+	assert.ElementsMatch(t, messages, received)
+}
+
+func TestProtocolErrors(t *testing.T) {
+	// TEST: Invalid utf-8 closes with 1007
+	server, client := upgradeConn(t)
+	go client.writeFrame(true, OpText, []byte{0xff, 0xfe})
+	closeFrame := make(chan *frame)
+	go func() {
+		f, _ := client.readFrame()
+		closeFrame <- f
+	}()
+	_, _, err := server.ReadMessage()
+	require.Error(t, err)
+	f := <-closeFrame
+	require.NotNil(t, f)
+	assert.Equal(t, OpClose, f.opcode)
+	assert.Equal(t, uint16(CloseInvalidPayload), binary.BigEndian.Uint16(f.payload))
+
+	// TEST: Unmasked client frame is a protocol error
+	server, client = upgradeConn(t)
+	go client.NetConn().Write([]byte{0x81, 0x02, 'h', 'i'})
+	go func() {
+		f, _ := client.readFrame()
+		closeFrame <- f
+	}()
+	_, _, err = server.ReadMessage()
+	require.Error(t, err)
+	f = <-closeFrame
+	require.NotNil(t, f)
+	assert.Equal(t, uint16(CloseProtocolError), binary.BigEndian.Uint16(f.payload))
+
+	// TEST: Message over size limit closes with 1009
+	server, client = upgradeConn(t)
+	server.MaxMessageSize = 8
+	go client.WriteText("this is way too long")
+	go func() {
+		f, _ := client.readFrame()
+		closeFrame <- f
+	}()
+	_, _, err = server.ReadMessage()
+	require.Error(t, err)
+	f = <-closeFrame
+	require.NotNil(t, f)
+	assert.Equal(t, uint16(CloseMessageTooBig), binary.BigEndian.Uint16(f.payload))
+}